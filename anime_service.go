@@ -2,41 +2,68 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alvarorichard/Goanime/pkg/goanime"
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
 	"github.com/alvarorichard/Goanime/pkg/goanime/types"
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
+// Every outbound request goes through the library's shared transport, so
+// per-host rate limits and retries hold across the app and the scrapers
 var (
-	metadataCache     = make(map[string]Metadata)
-	cacheMutex        sync.RWMutex
-	jikanMutex        sync.Mutex
-	lastJikanRequest  time.Time
-	httpClient        = &http.Client{Timeout: 120 * time.Second}
-	downloadClient    = &http.Client{Timeout: 0}
-	metadataCachePath string
+	httpClient     = &http.Client{Timeout: 120 * time.Second, Transport: transport.Default}
+	downloadClient = &http.Client{Timeout: 0, Transport: transport.Default}
 )
 
 type AnimeService struct {
-	ctx          context.Context
-	client       *goanime.Client
-	proxyCache   map[string]*StreamInfo
-	proxyPort    string
-	proxyMutex   sync.RWMutex
-	cacheDir     string
-	downloadsDir string
-	progressMap  sync.Map
-	cancelFuncs  map[string]context.CancelFunc
-	cancelMutex  sync.RWMutex
+	ctx        context.Context
+	client     *goanime.Client
+	proxyCache map[string]*StreamInfo
+	proxyMutex sync.RWMutex
+	// proxyHost and proxyPort are where the proxy tries to listen first;
+	// proxyBase is the base URL it ended up serving on
+	proxyHost   string
+	proxyPort   string
+	proxyBase   string
+	proxyServer *http.Server
+	// proxyKey signs proxy URLs for this session; proxyHosts are the
+	// upstream hosts each stream may fetch from, by stream id
+	proxyKey        []byte
+	proxyHosts      map[string]map[string]bool
+	upstreamClient  *http.Client
+	cacheDir        string
+	segments        *segmentCache
+	prefetch        *prefetcher
+	downloadsDir    string
+	progressMap     sync.Map
+	cancelFuncs     map[string]context.CancelCauseFunc
+	pausedDownloads map[string]*DownloadJob
+	cancelMutex     sync.RWMutex
+	downloads       sync.WaitGroup
+	closing         atomic.Bool
+	queue           *downloadQueue
+	activeBatches   map[string]*batchTracker
+	batchMutex      sync.Mutex
+	settings        AppSettings
+	settingsPath    string
+	settingsMutex   sync.RWMutex
+	metadata        *metadataStore
+	metadataDir     string
+	providers       metadataProviders
+	searcher        sourceSearcher
+	resolver        streamResolver
+	requests        map[string]activeRequest
+	requestSeq      uint64
+	requestsMutex   sync.Mutex
 }
 
 func NewAnimeService() *AnimeService {
@@ -48,19 +75,40 @@ func NewAnimeService() *AnimeService {
 	os.MkdirAll(cacheDir, 0755)
 	os.MkdirAll(downloadsDir, 0755)
 
-	metadataCachePath = filepath.Join(appDataDir, "metadata_cache.json")
-
+	client := goanime.NewClient()
 	return &AnimeService{
-		client:       goanime.NewClient(),
-		proxyCache:   make(map[string]*StreamInfo),
-		proxyPort:    "34116",
-		cacheDir:     cacheDir,
-		downloadsDir: downloadsDir,
-		cancelFuncs:  make(map[string]context.CancelFunc),
+		client:          client,
+		proxyCache:      make(map[string]*StreamInfo),
+		proxyHost:       "127.0.0.1",
+		proxyPort:       "34116",
+		proxyKey:        newProxyKey(),
+		proxyHosts:      make(map[string]map[string]bool),
+		upstreamClient:  newUpstreamClient(),
+		cacheDir:        cacheDir,
+		segments:        newSegmentCache(cacheDir, defaultCacheBudgetMB<<20),
+		prefetch:        newPrefetcher(),
+		downloadsDir:    downloadsDir,
+		cancelFuncs:     make(map[string]context.CancelCauseFunc),
+		pausedDownloads: make(map[string]*DownloadJob),
+		activeBatches:   make(map[string]*batchTracker),
+		queue:           newDownloadQueue(filepath.Join(appDataDir, "download_queue.json")),
+		settings:        defaultSettings(),
+		settingsPath:    filepath.Join(appDataDir, "settings.json"),
+		metadata:        newMemoryMetadataStore(),
+		metadataDir:     filepath.Join(appDataDir, "metadata"),
+		providers:       defaultMetadataProviders(),
+		searcher:        client,
+		resolver:        client,
 	}
 }
 
 func (a *AnimeService) GetDubbedAnime(currentName string) (*Anime, error) {
+	ctx, done := a.beginRequest(requestEpisodes, episodesTimeout)
+	defer done()
+	return a.getDubbedAnime(ctx, currentName)
+}
+
+func (a *AnimeService) getDubbedAnime(ctx context.Context, currentName string) (*Anime, error) {
 	fmt.Printf("[DubCheck] Searching for alternate version of: %s\n", currentName)
 
 	var searchQuery string
@@ -74,10 +122,11 @@ func (a *AnimeService) GetDubbedAnime(currentName string) (*Anime, error) {
 		searchQuery = currentName + " (Dub)"
 	}
 
-	results, err := a.Search(searchQuery)
+	resp, err := a.searchWithStatus(ctx, searchQuery, nil)
 	if err != nil {
 		return nil, err
 	}
+	results := resp.Results
 
 	var bestMatch *Anime
 	bestScore := -1
@@ -121,12 +170,130 @@ func (a *AnimeService) GetDubbedAnime(currentName string) (*Anime, error) {
 
 func (a *AnimeService) startup(ctx context.Context) {
 	a.ctx = ctx
-	a.loadCache()
-	a.startProxyServer()
+	a.loadSettings()
+	a.openMetadataStore()
+	a.segments.setBudget(a.GetSettings().cacheBudget())
+	a.segments.load()
+	a.segments.startSweeps(cacheSweepInterval)
+	a.loadQueue()
+	if err := a.startProxyServer(); err != nil {
+		fmt.Printf("Proxy server error: %v\n", err)
+	}
+	a.processQueue()
 	fmt.Println("AnimeService initialized")
 }
 
+// shutdownTimeout bounds how long shutdown waits for downloads to stop and
+// the proxy to finish its responses
+const shutdownTimeout = 5 * time.Second
+
+// shutdown stops the service when the app closes. Running downloads are
+// stopped and stay in the queue to pick up on the next start; the queue and
+// metadata store are written out and the proxy is shut down.
+func (a *AnimeService) shutdown(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	a.closing.Store(true)
+
+	a.cancelMutex.RLock()
+	for key, cancelDownload := range a.cancelFuncs {
+		fmt.Printf("[%s] Stopping download for shutdown\n", key)
+		cancelDownload(errShuttingDown)
+	}
+	a.cancelMutex.RUnlock()
+
+	a.requestsMutex.Lock()
+	for kind, req := range a.requests {
+		req.cancel()
+		delete(a.requests, kind)
+	}
+	a.requestsMutex.Unlock()
+	a.prefetch.stop()
+
+	stopped := make(chan struct{})
+	go func() {
+		a.downloads.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		fmt.Println("Shutdown: downloads did not stop in time")
+	}
+
+	if a.queue != nil {
+		a.saveQueue()
+	}
+	if a.metadata != nil {
+		a.metadata.Close()
+	}
+	if a.segments != nil {
+		a.segments.close()
+	}
+	if a.proxyServer != nil {
+		if err := a.proxyServer.Shutdown(ctx); err != nil {
+			fmt.Printf("Proxy shutdown: %v\n", err)
+			a.proxyServer.Close()
+		}
+	}
+	fmt.Println("AnimeService stopped")
+}
+
+// GetEpisodes lists the episodes of an anime. Opening another anime cancels
+// a listing still in progress.
 func (a *AnimeService) GetEpisodes(name, animeURL string, animeID int, sourceStr string, isDub bool) ([]Episode, error) {
+	ctx, done := a.beginRequest(requestEpisodes, episodesTimeout)
+	defer done()
+	return a.getEpisodes(ctx, name, animeURL, animeID, sourceStr, isDub)
+}
+
+// GetEpisodesWithMetadata is GetEpisodes with titles, air dates and
+// filler/recap flags merged in from the metadata providers in one pass.
+// animeID is the MAL ID; without one, or when no provider answers, the
+// list comes back as the source has it. Metadata past the first 100
+// episodes is merged only when stored, see GetEpisodeMetadataPage.
+func (a *AnimeService) GetEpisodesWithMetadata(name, animeURL string, animeID int, sourceStr string, isDub bool) ([]Episode, error) {
+	ctx, done := a.beginRequest(requestEpisodes, episodesTimeout)
+	defer done()
+
+	episodes, err := a.getEpisodes(ctx, name, animeURL, animeID, sourceStr, isDub)
+	if err != nil || animeID <= 0 {
+		return episodes, err
+	}
+	meta, err := a.loadedEpisodeMetadata(ctx, animeID)
+	if err != nil {
+		fmt.Printf("[GetEpisodes] No episode metadata for MAL ID %d: %v\n", animeID, err)
+		return episodes, nil
+	}
+	mergeEpisodeMetadata(episodes, meta)
+	return episodes, nil
+}
+
+// getEpisodes lists the episodes of an anime on its source. Lists are kept
+// in the metadata store for a while, and a stale list is used when the
+// source fails.
+func (a *AnimeService) getEpisodes(ctx context.Context, name, animeURL string, animeID int, sourceStr string, isDub bool) ([]Episode, error) {
+	key := seriesKey(sourceStr, animeURL, isDub)
+	cached, fresh, ok := a.metadata.episodeLists.Get(key)
+	if ok && fresh {
+		return append([]Episode{}, cached...), nil
+	}
+
+	episodes, err := a.listEpisodes(ctx, name, animeURL, sourceStr, isDub)
+	if err != nil {
+		if ok && ctx.Err() == nil {
+			fmt.Printf("Using stale episode list for %s: %v\n", name, err)
+			return append([]Episode{}, cached...), nil
+		}
+		return nil, err
+	}
+	if len(episodes) > 0 {
+		a.metadata.episodeLists.Put(key, episodes)
+	}
+	return append([]Episode{}, episodes...), nil
+}
+
+func (a *AnimeService) listEpisodes(ctx context.Context, name, animeURL string, sourceStr string, isDub bool) ([]Episode, error) {
 	fmt.Printf("[GetEpisodes] name: %s, url: %s, source: %s, isDub: %v\n", name, animeURL, sourceStr, isDub)
 
 	source, err := types.ParseSource(sourceStr)
@@ -139,26 +306,25 @@ func (a *AnimeService) GetEpisodes(name, animeURL string, animeID int, sourceStr
 	if isDub && source == types.SourceAllAnime && !strings.HasSuffix(animeURL, ":dub") {
 		testURL := animeURL + ":dub"
 		fmt.Printf("[DubCheck] Trying suffix-first for AllAnime: %s\n", testURL)
-		eps, err := a.client.GetAnimeEpisodes(testURL, source)
+		eps, err := a.resolver.GetAnimeEpisodesContext(ctx, testURL, source)
 		if err == nil && len(eps) > 0 {
 			fmt.Printf("[DubCheck] Success! Suffix-first returned %d episodes\n", len(eps))
-			var episodes []Episode
-			for _, ep := range eps {
-				episodes = append(episodes, Episode{
-					Number: ep.Number,
-					URL:    ep.URL,
-				})
-			}
-			return episodes, nil
+			return mapEpisodeList(eps), nil
 		}
 	}
 
-	if isDub && !strings.HasSuffix(animeURL, ":dub") {
+	if isDub && !strings.HasSuffix(animeURL, ":dub") && !isDubEntry(name, animeURL) {
 		fmt.Printf("[DubCheck] Resolving dubbed version via search for: %s\n", name)
-		dubAnime, err := a.GetDubbedAnime(name)
+		dubAnime, err := a.getDubbedAnime(ctx, name)
 		if err == nil && dubAnime != nil {
-			fmt.Printf("[DubCheck] Resolved dubbed URL: %s\n", dubAnime.URL)
-			targetURL = dubAnime.URL
+			// Only a dub on the same source can be opened with it
+			if entry := dubAnime.sourceEntry(source.String()); entry != nil && entry.HasDub {
+				targetURL = entry.entryURL()
+				if entry.DubURL != "" {
+					targetURL = entry.DubURL
+				}
+				fmt.Printf("[DubCheck] Resolved dubbed URL: %s\n", targetURL)
+			}
 		}
 	}
 
@@ -166,72 +332,51 @@ func (a *AnimeService) GetEpisodes(name, animeURL string, animeID int, sourceStr
 		targetURL += ":dub"
 	}
 
-	rawEpisodes, err := a.client.GetAnimeEpisodes(targetURL, source)
+	rawEpisodes, err := a.resolver.GetAnimeEpisodesContext(ctx, targetURL, source)
 	if err != nil {
 		fmt.Printf("Error fetching episodes: %v\n", err)
 		return nil, err
 	}
 
-	var episodes []Episode
-	for _, ep := range rawEpisodes {
-		episodes = append(episodes, Episode{
-			Number: ep.Number,
-			URL:    ep.URL,
-		})
-	}
-
-	return episodes, nil
+	return mapEpisodeList(rawEpisodes), nil
 }
 
+// ClearCache empties the segment cache, keeping the segments of the episode
+// being played.
 func (a *AnimeService) ClearCache() {
 	fmt.Println("Clearing video cache...")
-	if err := os.RemoveAll(a.cacheDir); err != nil {
-		fmt.Printf("Failed to clear cache: %v\n", err)
-	}
-	os.MkdirAll(a.cacheDir, 0755)
+	a.segments.clear()
 }
 
-func (a *AnimeService) loadCache() {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-
-	data, err := os.ReadFile(metadataCachePath)
+// openMetadataStore opens the persistent metadata store, importing the
+// legacy metadata_cache.json on first run. On failure the in-memory store
+// set up by NewAnimeService stays in use.
+func (a *AnimeService) openMetadataStore() {
+	store, err := openMetadataStore(a.metadataDir)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			fmt.Printf("Error reading cache file: %v\n", err)
-		}
+		fmt.Printf("Error opening metadata store (using memory only): %v\n", err)
 		return
 	}
-
-	if len(data) == 0 {
-		return
+	legacyPath := filepath.Join(filepath.Dir(a.metadataDir), "metadata_cache.json")
+	if err := store.migrateLegacyCache(legacyPath); err != nil {
+		fmt.Printf("Error migrating metadata cache: %v\n", err)
 	}
+	store.SetTTL(a.GetSettings().MetadataTTL)
 
-	if err := json.Unmarshal(data, &metadataCache); err != nil {
-		fmt.Printf("Error unmarshaling cache (resetting): %v\n", err)
-		metadataCache = make(map[string]Metadata)
-		return
-	}
-	fmt.Printf("Loaded %d items from cache\n", len(metadataCache))
+	a.metadata = store
+	fmt.Printf("Loaded metadata store: %d titles, %d anime, %d episode lists\n",
+		store.titles.Len(), store.anime.Len(), store.episodes.Len())
 }
 
-func (a *AnimeService) saveCache() {
-	cacheMutex.RLock()
-	defer cacheMutex.RUnlock()
-
-	data, err := json.MarshalIndent(metadataCache, "", "  ")
-	if err != nil {
-		fmt.Printf("Error marshaling cache: %v\n", err)
-		return
-	}
-
-	if err := os.WriteFile(metadataCachePath, data, 0644); err != nil {
-		fmt.Printf("Error saving cache: %v\n", err)
-	}
+func (a *AnimeService) LogProxyEvent(message string) {
+	a.emit("proxy:log", message)
 }
 
-func (a *AnimeService) LogProxyEvent(message string) {
-	if a.ctx != nil {
-		runtime.EventsEmit(a.ctx, "proxy:log", message)
+// emit sends an event to the frontend. It does nothing before startup or when
+// running outside the Wails runtime, e.g. in tests.
+func (a *AnimeService) emit(eventName string, data ...interface{}) {
+	if a.ctx == nil || a.ctx.Value("events") == nil {
+		return
 	}
+	runtime.EventsEmit(a.ctx, eventName, data...)
 }
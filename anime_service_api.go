@@ -1,171 +1,219 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/alvarorichard/Goanime/pkg/goanime"
 	"github.com/alvarorichard/Goanime/pkg/goanime/types"
 )
 
-func (a *AnimeService) Search(query string) ([]Anime, error) {
-	fmt.Printf("Searching for: %s\n", query)
-	gaAnimes, err := a.client.SearchAnime(query, nil)
-	if err != nil {
-		if strings.Contains(err.Error(), "no anime found") {
-			return []Anime{}, nil
-		}
-		return nil, err
-	}
-
-	results := mapAnimeList(gaAnimes)
-
-	limit := len(results)
-	if limit > 10 {
-		limit = 10
-	}
+const (
+	// episodesPerPage is how many episodes Jikan lists per page
+	episodesPerPage = 100
+	// maxEpisodePages bounds fetchFullMetadata, at 5000 episodes
+	maxEpisodePages = 50
+)
 
-	var wg sync.WaitGroup
-	for i := 0; i < limit; i++ {
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
-			metadataTitle := cleanTitle(results[idx].Name)
-			img, desc, malID := fetchAnimeMetadata(metadataTitle)
-			if img != "" {
-				results[idx].ImageURL = img
-			}
-			if desc != "" {
-				results[idx].Synopsis = desc
-			}
-			if malID > 0 {
-				results[idx].MalID = malID
-			}
-		}(i)
+// episodePageKey is the episodes table key of a page. Page 1 keeps the key
+// whole lists were stored under before pagination.
+func episodePageKey(malID, page int) string {
+	if page <= 1 {
+		return malKey(malID)
 	}
-	wg.Wait()
-
-	sort.Slice(results, func(i, j int) bool {
-		scoreI := calculateSimilarity(query, results[i].Name)
-		scoreJ := calculateSimilarity(query, results[j].Name)
-		return scoreI > scoreJ
-	})
+	return malKey(malID) + "/" + strconv.Itoa(page)
+}
 
-	return results, nil
+// episodePageOf is the page listing an episode
+func episodePageOf(epNum int) int {
+	return (epNum-1)/episodesPerPage + 1
 }
 
 func (a *AnimeService) GetEpisodeMetadata(malID int, epNum int) (*EpisodeMetadata, error) {
 	fmt.Printf("Fetching metadata for MAL ID: %d, Episode: %d\n", malID, epNum)
 
-	cacheMutex.RLock()
-	for _, v := range metadataCache {
-		if v.MalID == malID {
-			for _, ep := range v.Episodes {
-				if ep.Episode == epNum {
-					cacheMutex.RUnlock()
-					return &ep, nil
-				}
+	key := episodePageKey(malID, episodePageOf(epNum))
+	var cached *EpisodeMetadata
+	eps, fresh, pageCached := a.metadata.episodes.Get(key)
+	for _, ep := range eps {
+		if ep.Episode == epNum {
+			if fresh {
+				return &ep, nil
 			}
+			cached = &ep
+			break
 		}
 	}
-	cacheMutex.RUnlock()
 
-	epURL := fmt.Sprintf("https://api.jikan.moe/v4/anime/%d/episodes/%d", malID, epNum)
-	resp, err := throttledGet(epURL)
-	if err != nil || resp == nil {
-		return nil, fmt.Errorf("failed to fetch episode metadata")
+	result, err := a.providers.Episode(a.baseContext(), malID, epNum)
+	if err != nil {
+		if cached != nil {
+			fmt.Printf("Using stale metadata for MAL ID %d episode %d: %v\n", malID, epNum, err)
+			return cached, nil
+		}
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("jikan api error: %s", resp.Status)
+	if !pageCached {
+		// Stored stale, so the page is still fetched in full when asked for
+		a.metadata.episodes.putAt(key, []EpisodeMetadata{*result}, time.Time{})
+		return result, nil
 	}
+	a.metadata.episodes.Update(key, func(eps []EpisodeMetadata) []EpisodeMetadata {
+		updated := append([]EpisodeMetadata{}, eps...)
+		for i, ep := range updated {
+			if ep.Episode == epNum {
+				updated[i] = *result
+				return updated
+			}
+		}
+		return append(updated, *result)
+	})
+
+	return result, nil
+}
 
-	var result struct {
-		Data EpisodeMetadata `json:"data"`
+// GetEpisodeMetadataPage returns a page of episode metadata, 100 episodes
+// to a page: page 2 holds episodes 101 to 200. The UI loads pages past the
+// first as the user scrolls to them.
+func (a *AnimeService) GetEpisodeMetadataPage(malID, page int) (*EpisodeMetadataPage, error) {
+	if page < 1 {
+		return nil, fmt.Errorf("invalid page: %d", page)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	return a.episodeMetadataPage(a.baseContext(), malID, page)
+}
+
+// episodeMetadataPage returns a page of episode metadata from the store
+// when fresh, and from the providers otherwise. Each page is stored as it
+// arrives, and a stale page is used when the providers fail.
+func (a *AnimeService) episodeMetadataPage(ctx context.Context, malID, page int) (*EpisodeMetadataPage, error) {
+	key := episodePageKey(malID, page)
+	eps, fresh, cached := a.metadata.episodes.Get(key)
+	if cached && fresh {
+		return storedEpisodePage(page, eps), nil
 	}
 
-	cacheMutex.Lock()
-	for k, v := range metadataCache {
-		if v.MalID == malID {
-			found := false
-			for i, ep := range v.Episodes {
-				if ep.Episode == epNum {
-					v.Episodes[i] = result.Data
-					found = true
-					break
-				}
-			}
-			if !found {
-				v.Episodes = append(v.Episodes, result.Data)
-			}
-			metadataCache[k] = v
-		}
+	result, err := a.providers.Episodes(ctx, malID, page)
+	if err == nil {
+		keepSynopses(result.Episodes, eps)
+		a.metadata.episodes.Put(key, result.Episodes)
+		return result, nil
 	}
-	cacheMutex.Unlock()
-	a.saveCache()
 
-	return &result.Data, nil
+	if cached {
+		fmt.Printf("Using stale episode list for MAL ID %d page %d: %v\n", malID, page, err)
+		return storedEpisodePage(page, eps), nil
+	}
+	return nil, err
 }
 
-func (a *AnimeService) fetchFullMetadata(malID int) (*Metadata, error) {
-	k := strconv.Itoa(malID)
-	cacheMutex.RLock()
-	if v, ok := metadataCache[k]; ok {
-		cacheMutex.RUnlock()
-		return &v, nil
+// storedEpisodePage rebuilds a page from the store, which keeps only the
+// episodes: a full page may have another after it
+func storedEpisodePage(page int, eps []EpisodeMetadata) *EpisodeMetadataPage {
+	return &EpisodeMetadataPage{Page: page, HasNext: len(eps) >= episodesPerPage, Episodes: eps}
+}
+
+// keepSynopses carries synopses fetched one episode at a time over to a
+// refreshed page, as episode lists do not include them
+func keepSynopses(eps, old []EpisodeMetadata) {
+	synopses := make(map[int]string)
+	for _, ep := range old {
+		if ep.Synopsis != "" {
+			synopses[ep.Episode] = ep.Synopsis
+		}
+	}
+	for i := range eps {
+		if eps[i].Synopsis == "" {
+			eps[i].Synopsis = synopses[eps[i].Episode]
+		}
 	}
-	cacheMutex.RUnlock()
+}
 
-	jikanURL := fmt.Sprintf("https://api.jikan.moe/v4/anime/%d/episodes", malID)
-	jikanMutex.Lock()
-	if time.Since(lastJikanRequest) < 500*time.Millisecond {
-		time.Sleep(500*time.Millisecond - time.Since(lastJikanRequest))
+// fetchFullMetadata follows every page of an anime's episode metadata. A
+// page past the first that fails ends the list early.
+func (a *AnimeService) fetchFullMetadata(malID int) (*Metadata, error) {
+	var all []EpisodeMetadata
+	for page := 1; page <= maxEpisodePages; page++ {
+		p, err := a.episodeMetadataPage(a.baseContext(), malID, page)
+		if err != nil {
+			if page == 1 {
+				return nil, err
+			}
+			fmt.Printf("Episode metadata for MAL ID %d stops at page %d: %v\n", malID, page-1, err)
+			break
+		}
+		all = append(all, p.Episodes...)
+		if !p.HasNext {
+			break
+		}
 	}
-	resp, err := http.Get(jikanURL)
-	lastJikanRequest = time.Now()
-	jikanMutex.Unlock()
+	return a.storedMetadata(malID, all), nil
+}
 
+// loadedEpisodeMetadata returns the first page of episode metadata and the
+// later pages already in the store, leaving the others to
+// GetEpisodeMetadataPage.
+func (a *AnimeService) loadedEpisodeMetadata(ctx context.Context, malID int) ([]EpisodeMetadata, error) {
+	first, err := a.episodeMetadataPage(ctx, malID, 1)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	var result struct {
-		Data []EpisodeMetadata `json:"data"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	all := first.Episodes
+	for page := 2; page <= maxEpisodePages; page++ {
+		eps, _, ok := a.metadata.episodes.Get(episodePageKey(malID, page))
+		if !ok {
+			break
+		}
+		all = append(all, eps...)
 	}
+	return all, nil
+}
 
-	v := Metadata{Episodes: result.Data, MalID: malID}
-	cacheMutex.Lock()
-	metadataCache[k] = v
-	cacheMutex.Unlock()
-	a.saveCache()
-
-	return &v, nil
+// storedMetadata combines the cached details of an anime with its episodes.
+func (a *AnimeService) storedMetadata(malID int, eps []EpisodeMetadata) *Metadata {
+	details, _, _ := a.metadata.anime.Get(malKey(malID))
+	return &Metadata{Img: details.Img, Desc: details.Desc, MalID: malID, Episodes: eps}
 }
 
 func (a *AnimeService) GetStreamUrl(animeName, animeURL, animeSource, epNumStr, epURL string, epNum float64, isDub bool) (*StreamInfo, error) {
-	resURL, headers, err := a.ResolveStreamURL(animeName, animeURL, animeSource, epNumStr, epURL, epNum, isDub)
+	return a.GetStreamUrlWithQuality(animeName, animeURL, animeSource, epNumStr, epURL, epNum, isDub, "")
+}
+
+// GetStreamUrlWithQuality is GetStreamUrl with a per-call quality override.
+// An empty quality uses the global preference.
+// Starting another stream request cancels one still resolving.
+func (a *AnimeService) GetStreamUrlWithQuality(animeName, animeURL, animeSource, epNumStr, epURL string, epNum float64, isDub bool, quality string) (*StreamInfo, error) {
+	if err := validateQuality(quality); err != nil {
+		return nil, err
+	}
+	quality = a.effectiveQuality(quality)
+
+	ctx, done := a.beginRequest(requestStream, streamTimeout)
+	defer done()
+
+	target := streamTarget{
+		AnimeName: animeName,
+		AnimeURL:  animeURL,
+		Source:    animeSource,
+		EpNumStr:  epNumStr,
+		EpURL:     epURL,
+		EpNum:     epNum,
+		IsDub:     isDub,
+		Quality:   quality,
+	}
+	stream, err := a.resolveLocalOrStream(ctx, target)
 	if err != nil {
 		return nil, err
 	}
+	resURL, headers := stream.URL, stream.Headers
 
 	isHLS := strings.Contains(strings.ToLower(resURL), ".m3u8")
 	epDir := a.getEpisodeDir(animeName, epNumStr)
@@ -174,24 +222,34 @@ func (a *AnimeService) GetStreamUrl(animeName, animeURL, animeSource, epNumStr,
 	} else if _, err := os.Stat(filepath.Join(epDir, "index.m3u8")); err == nil {
 		isHLS = true
 		go func() {
-			manifestPath := filepath.Join(epDir, "manifest.json")
-			mBytes, err := os.ReadFile(manifestPath)
+			manifest, err := readManifest(epDir)
 			if err != nil {
 				return
 			}
-			var fileList []string
-			if err := json.Unmarshal(mBytes, &fileList); err != nil {
+			fileList := manifestFiles(manifest)
+
+			rawContent, err := os.ReadFile(filepath.Join(epDir, "index.m3u8"))
+			if err != nil {
 				return
 			}
-
-			localM3U8 := a.generateLocalM3U8(fileList)
+			segments, err := parsePlaylist(string(rawContent)).Segments(resURL)
+			if err != nil {
+				return
+			}
+			// Keeps the key tags so the FFmpeg fallback decrypts as well
+			localM3U8 := localPlaylist(string(rawContent), resURL)
 			localM3U8Path := filepath.Join(epDir, "local_index.m3u8")
-			os.WriteFile(localM3U8Path, []byte(localM3U8), 0644)
+			if err := os.WriteFile(localM3U8Path, []byte(localM3U8), 0644); err != nil {
+				fmt.Printf("[Maintenance] Could not write local playlist for %s: %v\n", epDir, err)
+				return
+			}
 
 			mp4Path := filepath.Join(epDir, "episode.mp4")
 			fmt.Printf("[Maintenance] Triggering background remux for %s\n", mp4Path)
-			if err := exec.Command("ffmpeg", "-i", localM3U8Path, "-c", "copy", "-y", mp4Path).Run(); err == nil {
+			if err := remuxEpisode(context.Background(), epDir, segments, mp4Path, "-allowed_extensions", "ALL", "-i", localM3U8Path); err == nil {
 				a.CleanupHLSFiles(epDir, fileList)
+			} else {
+				fmt.Printf("[Maintenance] Background remux failed for %s: %v\n", mp4Path, err)
 			}
 		}()
 	} else if a.CheckDownloadStatus(animeName, epNumStr) {
@@ -201,7 +259,8 @@ func (a *AnimeService) GetStreamUrl(animeName, animeURL, animeSource, epNumStr,
 	}
 
 	id := strconv.FormatInt(time.Now().UnixNano(), 10)
-	proxyURL := fmt.Sprintf("http://localhost:%s/proxy?id=%s", a.proxyPort, id)
+	proxyURL := a.proxyURL(id, "")
+	a.allowUpstream(id, resURL)
 
 	a.proxyMutex.Lock()
 	a.proxyCache[id] = &StreamInfo{
@@ -210,6 +269,10 @@ func (a *AnimeService) GetStreamUrl(animeName, animeURL, animeSource, epNumStr,
 		AnimeName:  animeName,
 		EpisodeNum: epNumStr,
 		IsHLS:      isHLS,
+		Source:     stream.Source,
+		Provider:   stream.Provider,
+		FailedOver: stream.FailedOver,
+		failover:   &streamFailover{target: target, alternatives: stream.Alternatives},
 	}
 	a.proxyMutex.Unlock()
 
@@ -225,8 +288,14 @@ func (a *AnimeService) GetStreamUrl(animeName, animeURL, animeSource, epNumStr,
 		}, nil
 	}
 
-	if isHLS {
-		req, _ := http.NewRequest("GET", resURL, nil)
+	var variant *hlsVariant
+	adaptive := a.GetSettings().AdaptiveStreaming
+	if isHLS && adaptive {
+		// The master playlist is passed through and rewritten by the proxy,
+		// so hls.js can switch between variants on its own
+		quality = "auto"
+	} else if isHLS {
+		req, _ := http.NewRequestWithContext(ctx, "GET", resURL, nil)
 		for k, v := range headers {
 			req.Header.Set(k, v)
 		}
@@ -237,16 +306,17 @@ func (a *AnimeService) GetStreamUrl(animeName, animeURL, animeSource, epNumStr,
 				body, _ := io.ReadAll(resp.Body)
 				content := string(body)
 				if strings.Contains(content, "#EXT-X-STREAM-INF") {
-					bestVariant := selectHighestQualityVariant(content)
-					if bestVariant != "" {
+					variant = selectVariant(parseMasterPlaylist(content), quality)
+					if variant != nil {
 						baseURL, _ := url.Parse(resURL)
-						variantURL, _ := baseURL.Parse(bestVariant)
+						variantURL, _ := baseURL.Parse(variant.URI)
 						resURL = variantURL.String()
-						fmt.Printf("Selected highest quality variant for streaming: %s\n", resURL)
+						fmt.Printf("Selected %s variant for streaming (%s, %d bps): %s\n", quality, variant.Resolution(), variant.Bandwidth, resURL)
 
 						a.proxyMutex.Lock()
 						a.proxyCache[id].URL = resURL
 						a.proxyMutex.Unlock()
+						a.allowUpstream(id, resURL)
 					}
 				}
 			}
@@ -255,68 +325,75 @@ func (a *AnimeService) GetStreamUrl(animeName, animeURL, animeSource, epNumStr,
 
 	fmt.Printf("Proxying stream: %s -> %s (IsHLS: %v)\n", resURL, proxyURL, isHLS)
 
-	return &StreamInfo{
-		URL:     proxyURL,
-		Headers: headers,
-		IsHLS:   isHLS,
-	}, nil
+	info := &StreamInfo{
+		URL:        proxyURL,
+		Headers:    headers,
+		IsHLS:      isHLS,
+		Quality:    quality,
+		Source:     stream.Source,
+		Provider:   stream.Provider,
+		FailedOver: stream.FailedOver,
+	}
+	if variant != nil {
+		info.Resolution = variant.Resolution()
+		info.Bandwidth = variant.Bandwidth
+	}
+	return info, nil
 }
 
 func (a *AnimeService) ResolveStreamURL(animeName, animeURL, animeSource, epNumStr, epURL string, epNum float64, isDub bool) (string, map[string]string, error) {
-	epDir := a.getEpisodeDir(animeName, epNumStr)
-	metadataPath := filepath.Join(epDir, "stream_metadata.json")
-
-	var resURL string
-	var headers map[string]string
+	ctx, done := a.beginRequest(requestStream, streamTimeout)
+	defer done()
+	return a.resolveStreamURL(ctx, animeName, animeURL, animeSource, epNumStr, epURL, epNum, isDub, a.GetQualityPreference())
+}
 
-	if _, err := os.Stat(metadataPath); err == nil {
-		fmt.Printf("[%s] Loading stream metadata from local storage\n", animeName)
-		data, err := os.ReadFile(metadataPath)
-		if err == nil {
-			var meta struct {
-				URL     string            `json:"url"`
-				Headers map[string]string `json:"headers"`
-			}
-			if err := json.Unmarshal(data, &meta); err == nil {
-				resURL = meta.URL
-				headers = meta.Headers
-			}
-		}
+func (a *AnimeService) resolveStreamURL(ctx context.Context, animeName, animeURL, animeSource, epNumStr, epURL string, epNum float64, isDub bool, quality string) (string, map[string]string, error) {
+	stream, err := a.resolveLocalOrStream(ctx, streamTarget{
+		AnimeName: animeName,
+		AnimeURL:  animeURL,
+		Source:    animeSource,
+		EpNumStr:  epNumStr,
+		EpURL:     epURL,
+		EpNum:     epNum,
+		IsDub:     isDub,
+		Quality:   quality,
+	})
+	if err != nil {
+		return "", nil, err
 	}
+	return stream.URL, stream.Headers, nil
+}
 
-	if resURL == "" {
-		gaAnime := &types.Anime{Name: animeName, URL: animeURL, Source: animeSource}
-		gaEpisode := &types.Episode{Number: epNumStr, Num: int(epNum), URL: epURL}
+// resolveLocalOrStream uses the stream metadata saved with a download, and
+// resolves the stream with failover otherwise
+func (a *AnimeService) resolveLocalOrStream(ctx context.Context, t streamTarget) (*resolvedStream, error) {
+	epDir := a.getEpisodeDir(t.AnimeName, t.EpNumStr)
+	metadataPath := filepath.Join(epDir, "stream_metadata.json")
 
-		opts := goanime.DefaultStreamOptions()
-		if isDub {
-			opts.Mode = "dub"
-		}
-		var err error
-		resURL, headers, err = a.client.GetEpisodeStreamURL(gaAnime, gaEpisode, &opts)
-		if err != nil {
-			return "", nil, err
+	if _, err := os.Stat(metadataPath); err == nil {
+		fmt.Printf("[%s] Loading stream metadata from local storage\n", t.AnimeName)
+		if meta, err := loadStreamMetadata(epDir); err == nil && meta.URL != "" {
+			return &resolvedStream{URL: meta.URL, Headers: meta.Headers, Source: t.Source}, nil
 		}
 	}
 
-	if resURL == "" {
-		return "", nil, fmt.Errorf("failed to resolve stream URL")
-	}
-
-	return resURL, headers, nil
+	return a.resolveStream(ctx, t)
 }
 
-func mapAnimeList(src []*types.Anime) []Anime {
+// mapAnimeList maps the search results of one source
+func mapAnimeList(src []*types.Anime, source string) []Anime {
 	out := make([]Anime, len(src))
 	for i, a := range src {
+		entry := animeSourceEntry(a, source)
 		out[i] = Anime{
 			Name:      cleanTitle(a.Name),
 			URL:       a.URL,
 			ImageURL:  a.ImageURL,
 			AnilistID: a.AnilistID,
 			MalID:     a.MalID,
-			Source:    a.Source,
-			HasDub:    a.HasDub,
+			Source:    source,
+			HasDub:    entry.HasDub,
+			Sources:   []AnimeSource{entry},
 		}
 	}
 	return out
@@ -327,173 +404,117 @@ func mapEpisodeList(src []*types.Episode) []Episode {
 	for i, e := range src {
 		out[i] = Episode{
 			Number:   e.Number,
-			Num:      float64(e.Num),
+			Num:      episodeNum(e.Number, e.Num),
 			URL:      e.URL,
-			Title:    e.Title.Romaji,
 			Aired:    e.Aired,
 			Duration: float64(e.Duration),
 			IsFiller: e.IsFiller,
 			IsRecap:  e.IsRecap,
 			Synopsis: e.Synopsis,
 		}
+		// Placeholder titles like "Episode 3" are left for the metadata
+		if e.Title != nil && e.Title.Romaji != "Episode "+e.Number {
+			out[i].Title = e.Title.Romaji
+		}
 	}
 	return out
 }
 
-func throttledGet(url string) (*http.Response, error) {
-	jikanMutex.Lock()
-
-	// Jikan API allows 3 requests per second for public API
-	elapsed := time.Since(lastJikanRequest)
-	if elapsed < time.Second {
-		time.Sleep(time.Second - elapsed)
+// episodeNum parses an episode number as the source lists it, so specials
+// like "12.5" stay apart from episode 12. Numbers that do not parse, like
+// "OVA", keep the source's integer.
+func episodeNum(number string, fallback int) float64 {
+	if n, err := strconv.ParseFloat(strings.TrimSpace(number), 64); err == nil {
+		return n
 	}
+	return float64(fallback)
+}
 
-	var resp *http.Response
-	var err error
-
-	backoff := time.Second
-	for i := 0; i < 3; i++ {
-		resp, err = httpClient.Get(url)
-		if err == nil && resp.StatusCode == http.StatusOK {
-			lastJikanRequest = time.Now()
-			jikanMutex.Unlock()
-			return resp, nil
-		}
-
-		if resp != nil {
-			if resp.StatusCode == 429 {
-				fmt.Printf("Jikan Rate Limit (429) hit, retrying in %v... (attempt %d/3)\n", backoff, i+1)
-				resp.Body.Close()
-				time.Sleep(backoff)
-				backoff *= 2
-				continue
-			}
-			resp.Body.Close()
+// mergeEpisodeMetadata fills titles, air dates, synopses and filler/recap
+// flags into episodes from the provider episode list, matching by number.
+// Specials have no provider entry and are left alone.
+func mergeEpisodeMetadata(episodes []Episode, meta []EpisodeMetadata) {
+	byNum := make(map[int]EpisodeMetadata, len(meta))
+	for _, m := range meta {
+		byNum[m.Episode] = m
+	}
+	for i := range episodes {
+		ep := &episodes[i]
+		if ep.Num <= 0 || ep.Num != math.Trunc(ep.Num) {
+			continue
 		}
-
-		if err != nil {
-			fmt.Printf("Jikan request error: %v, retrying...\n", err)
-			time.Sleep(backoff)
-			backoff *= 2
+		m, ok := byNum[int(ep.Num)]
+		if !ok {
 			continue
 		}
-
-		break
+		if ep.Title == "" {
+			ep.Title = m.Title
+		}
+		if ep.Aired == "" {
+			ep.Aired = m.Aired
+		}
+		if ep.Synopsis == "" {
+			ep.Synopsis = m.Synopsis
+		}
+		ep.IsFiller = ep.IsFiller || m.Filler
+		ep.IsRecap = ep.IsRecap || m.Recap
 	}
-
-	lastJikanRequest = time.Now()
-	jikanMutex.Unlock()
-	return resp, err
 }
 
-func fetchAnimeMetadata(title string) (string, string, int) {
-	cleaned := cleanTitle(title)
-
-	cacheMutex.RLock()
-	if meta, ok := metadataCache[cleaned]; ok {
-		cacheMutex.RUnlock()
-		return meta.Img, meta.Desc, meta.MalID
+// storedDetails returns the stored metadata for a title, if any, and
+// whether it is still fresh.
+func (a *AnimeService) storedDetails(title string) (*AnimeDetails, bool) {
+	t, titleFresh, ok := a.metadata.titles.Get(cleanTitle(title))
+	if !ok {
+		return nil, false
 	}
-	cacheMutex.RUnlock()
-
-	searchURL := fmt.Sprintf("https://api.jikan.moe/v4/anime?q=%s&limit=5", url.QueryEscape(cleaned))
-
-	resp, err := throttledGet(searchURL)
-	if err != nil || resp == nil {
-		fmt.Printf("Jikan search error for %s: %v\n", cleaned, err)
-		return "", "", 0
+	details, detailsFresh, found := a.metadata.anime.Get(detailsKey(t.MalID, t.AnilistID))
+	if !found {
+		return nil, false
 	}
-	defer resp.Body.Close()
+	return &details, titleFresh && detailsFresh
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Jikan search status %d for %s\n", resp.StatusCode, cleaned)
-		return "", "", 0
-	}
+// animeDetails returns the merged provider metadata for a title, from the
+// store when fresh. Stale entries are used when every provider fails.
+func (a *AnimeService) animeDetails(ctx context.Context, title string) *AnimeDetails {
+	cleaned := cleanTitle(title)
 
-	var jikan JikanResponse
-	if err := json.NewDecoder(resp.Body).Decode(&jikan); err != nil {
-		fmt.Printf("Jikan decode error for %s: %v\n", cleaned, err)
-		return "", "", 0
+	stored, fresh := a.storedDetails(cleaned)
+	if fresh {
+		return stored
 	}
 
-	if len(jikan.Data) > 0 {
-		bestIdx := 0
-		maxSimilarity := -1
-		for i, data := range jikan.Data {
-			sim := calculateSimilarity(cleaned, data.Title)
-			if data.TitleEnglish != "" {
-				if engSim := calculateSimilarity(cleaned, data.TitleEnglish); engSim > sim {
-					sim = engSim
-				}
-			}
-			if sim > maxSimilarity {
-				maxSimilarity = sim
-				bestIdx = i
-			}
-		}
-
-		best := jikan.Data[bestIdx]
-		img := best.Images.Webp.LargeImageURL
-		desc := best.Synopsis
-		malID := best.MALID
-
-		fmt.Printf("Found Jikan Metadata for %s: MAL ID %d (Similarity: %d)\n", cleaned, malID, maxSimilarity)
-
-		cacheMutex.Lock()
-		if existing, ok := metadataCache[cleaned]; ok {
-			existing.Img = img
-			existing.Desc = desc
-			existing.MalID = malID
-			metadataCache[cleaned] = existing
-		} else {
-			metadataCache[cleaned] = Metadata{
-				Img:   img,
-				Desc:  desc,
-				MalID: malID,
-			}
+	details, err := a.providers.FindAnime(ctx, cleaned, 0)
+	if err != nil {
+		if stored != nil {
+			return stored
 		}
-		cacheMutex.Unlock()
-		return img, desc, malID
+		fmt.Printf("No metadata found for %s: %v\n", cleaned, err)
+		return nil
 	}
 
-	fmt.Printf("No Jikan results found for %s\n", cleaned)
-	return "", "", 0
+	a.metadata.titles.Put(cleaned, titleEntry{MalID: details.MalID, AnilistID: details.AnilistID})
+	a.metadata.anime.Put(detailsKey(details.MalID, details.AnilistID), *details)
+	return details
 }
 
-func fetchEpisodeMetadata(malID int) []EpisodeMetadata {
-	epURL := fmt.Sprintf("https://api.jikan.moe/v4/anime/%d/episodes", malID)
-
-	resp, err := throttledGet(epURL)
-	if err != nil || resp == nil {
-		return nil
+// applyDetails copies provider metadata onto a search result.
+func (anime *Anime) applyDetails(d *AnimeDetails) {
+	if d.Img != "" {
+		anime.ImageURL = d.Img
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil
+	if d.Desc != "" {
+		anime.Synopsis = d.Desc
 	}
-
-	var jikan JikanEpisodeResponse
-	if err := json.NewDecoder(resp.Body).Decode(&jikan); err != nil {
-		return nil
+	if d.MalID > 0 {
+		anime.MalID = d.MalID
 	}
-
-	var out []EpisodeMetadata
-	for _, d := range jikan.Data {
-		// Format date if possible
-		aired := d.Aired
-		if len(aired) > 10 {
-			aired = aired[:10] // Keep YYYY-MM-DD
-		}
-
-		out = append(out, EpisodeMetadata{
-			Episode: d.EpisodeID,
-			Title:   d.Title,
-			Aired:   aired,
-			Filler:  d.Filler,
-		})
+	if d.AnilistID > 0 {
+		anime.AnilistID = d.AnilistID
 	}
-
-	return out
+	anime.Genres = d.Genres
+	anime.Score = d.Score
+	anime.Status = d.Status
+	anime.BannerImage = d.Banner
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DownloadBatch groups the episodes scheduled by a single DownloadRange call
+// so their progress can be reported as one.
+type DownloadBatch struct {
+	ID        string   `json:"id"`
+	AnimeName string   `json:"animeName"`
+	Keys      []string `json:"keys"`
+	Skipped   []string `json:"skipped"`
+}
+
+type batchTracker struct {
+	batch    DownloadBatch
+	progress map[string]int
+	states   map[string]string
+}
+
+// DownloadRange queues every episode of anime numbered between startEp and
+// endEp (inclusive). Episodes that are already downloaded are skipped; ones
+// already in the queue keep their job and count towards the batch.
+// Per-episode progress is still reported through "download-progress" and the
+// aggregate through "download-batch-progress".
+func (a *AnimeService) DownloadRange(anime Anime, startEp, endEp float64, isDub bool) (*DownloadBatch, error) {
+	if endEp < startEp {
+		return nil, fmt.Errorf("invalid episode range: %v-%v", startEp, endEp)
+	}
+
+	// Not an episodes request of its own, so it leaves the UI's alone
+	ctx, cancel := context.WithTimeout(a.baseContext(), episodesTimeout)
+	defer cancel()
+	episodes, err := a.getEpisodes(ctx, anime.Name, anime.URL, anime.MalID, anime.Source, isDub)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &DownloadBatch{
+		ID:        strconv.FormatInt(time.Now().UnixNano(), 10),
+		AnimeName: anime.Name,
+	}
+
+	var jobs []DownloadJob
+	for _, ep := range episodes {
+		num := ep.Num
+		if num == 0 {
+			num = parseEpisodeNumber(ep.Number)
+		}
+		if num < startEp || num > endEp {
+			continue
+		}
+
+		key := anime.Name + ":" + ep.Number
+		if a.CheckDownloadStatus(anime.Name, ep.Number) {
+			batch.Skipped = append(batch.Skipped, key)
+			continue
+		}
+
+		batch.Keys = append(batch.Keys, key)
+		jobs = append(jobs, DownloadJob{
+			AnimeName:   anime.Name,
+			AnimeURL:    anime.URL,
+			AnimeSource: anime.Source,
+			EpNumStr:    ep.Number,
+			EpURL:       ep.URL,
+			EpNum:       num,
+			IsDub:       isDub,
+		})
+	}
+
+	fmt.Printf("[Batch %s] %s episodes %v-%v: %d queued, %d already downloaded\n", batch.ID, anime.Name, startEp, endEp, len(batch.Keys), len(batch.Skipped))
+
+	if len(batch.Keys) == 0 {
+		return batch, nil
+	}
+
+	tracker := &batchTracker{
+		batch:    *batch,
+		progress: make(map[string]int),
+		states:   make(map[string]string),
+	}
+	for _, key := range batch.Keys {
+		tracker.states[key] = queueStatusQueued
+	}
+	a.batchMutex.Lock()
+	a.activeBatches[batch.ID] = tracker
+	a.batchMutex.Unlock()
+
+	if _, err := a.EnqueueDownloads(jobs); err != nil {
+		a.batchMutex.Lock()
+		delete(a.activeBatches, batch.ID)
+		a.batchMutex.Unlock()
+		return nil, err
+	}
+
+	// Episodes already running or paused report to this batch from their
+	// own job; pick up where they are. One that left the queue before the
+	// batch was tracked has finished or was cancelled.
+	current := make(map[string]DownloadJob)
+	for _, job := range a.GetQueue() {
+		current[job.Key] = job
+	}
+	downloaded := make(map[string]bool)
+	for _, job := range jobs {
+		key := job.AnimeName + ":" + job.EpNumStr
+		if _, ok := current[key]; !ok && a.CheckDownloadStatus(job.AnimeName, job.EpNumStr) {
+			downloaded[key] = true
+		}
+	}
+
+	a.batchMutex.Lock()
+	for _, key := range batch.Keys {
+		// Only episodes that have not reported since
+		if tracker.states[key] != queueStatusQueued {
+			continue
+		}
+		switch job, ok := current[key]; {
+		case ok:
+			tracker.states[key] = job.Status
+			tracker.progress[key] = job.Progress
+		case downloaded[key]:
+			tracker.states[key] = downloadStateCompleted
+			tracker.progress[key] = 100
+		default:
+			tracker.states[key] = downloadStateCancelled
+		}
+	}
+	update, done := tracker.summary()
+	if done {
+		delete(a.activeBatches, batch.ID)
+	}
+	a.batchMutex.Unlock()
+	if done {
+		a.emit("download-batch-progress", update)
+	}
+
+	return batch, nil
+}
+
+// updateBatchProgress folds a per-episode progress update into every batch
+// that contains the episode and emits the aggregate.
+func (a *AnimeService) updateBatchProgress(key string, progress int, state string) {
+	a.batchMutex.Lock()
+	var updates []map[string]interface{}
+	for id, t := range a.activeBatches {
+		if _, ok := t.states[key]; !ok {
+			continue
+		}
+		t.progress[key] = progress
+		t.states[key] = state
+
+		update, done := t.summary()
+		updates = append(updates, update)
+		if done {
+			delete(a.activeBatches, id)
+		}
+	}
+	a.batchMutex.Unlock()
+
+	for _, u := range updates {
+		a.emit("download-batch-progress", u)
+	}
+}
+
+// summary is the aggregate progress of the batch and whether every episode
+// in it has finished
+func (t *batchTracker) summary() (map[string]interface{}, bool) {
+	total, completed, failed, paused := 0, 0, 0, 0
+	for _, k := range t.batch.Keys {
+		total += t.progress[k]
+		switch t.states[k] {
+		case downloadStateCompleted:
+			completed++
+		case downloadStateFailed, downloadStateCancelled:
+			failed++
+		case downloadStatePaused:
+			paused++
+		}
+	}
+
+	progress := 100
+	if len(t.batch.Keys) > 0 {
+		progress = total / len(t.batch.Keys)
+	}
+	done := completed+failed == len(t.batch.Keys)
+	return map[string]interface{}{
+		"batchId":   t.batch.ID,
+		"animeName": t.batch.AnimeName,
+		"total":     len(t.batch.Keys),
+		"completed": completed,
+		"failed":    failed,
+		"paused":    paused,
+		"skipped":   len(t.batch.Skipped),
+		"progress":  progress,
+		"done":      done,
+	}, done
+}
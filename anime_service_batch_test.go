@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatchRequeuesFailedAndTracksQueuedEpisodes(t *testing.T) {
+	a := newTestService(t, "")
+	a.resolver = &fakeResolver{}
+	// Nothing runs, so the batch only moves through the queue
+	a.queue.settings.MaxConcurrent = 0
+	a.queue.jobs = append(a.queue.jobs, &DownloadJob{
+		Key:       "Sousou no Frieren:01",
+		AnimeName: "Sousou no Frieren",
+		EpNumStr:  "01",
+		Status:    queueStatusFailed,
+		Error:     "all mirrors failed",
+	})
+	epDir := a.getEpisodeDir("Sousou no Frieren", "02")
+	if err := os.MkdirAll(epDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(epDir, "episode.mp4"), []byte("mp4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	anime := Anime{Name: "Sousou no Frieren", URL: "af-frieren", Source: "AnimeFire"}
+
+	// The failed episode is queued again and counts towards the batch; only
+	// the downloaded one is skipped
+	batch, err := a.DownloadRange(anime, 1, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Keys) != 1 || batch.Keys[0] != "Sousou no Frieren:01" {
+		t.Errorf("batch keys %v, want episode 01", batch.Keys)
+	}
+	if len(batch.Skipped) != 1 || batch.Skipped[0] != "Sousou no Frieren:02" {
+		t.Errorf("batch skipped %v, want episode 02", batch.Skipped)
+	}
+	if queue := a.GetQueue(); len(queue) != 1 || queue[0].Status != queueStatusQueued || queue[0].Error != "" {
+		t.Errorf("queue %+v, want the failed job queued again", queue)
+	}
+	if tracker := a.activeBatches[batch.ID]; tracker == nil || tracker.states["Sousou no Frieren:01"] != queueStatusQueued {
+		t.Fatalf("tracker %+v, want episode 01 tracked", tracker)
+	}
+
+	// Cancelling the one episode before it starts finishes the batch
+	if err := a.CancelQueued("Sousou no Frieren:01"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.activeBatches) != 0 {
+		t.Errorf("batch still tracked after its last episode was cancelled")
+	}
+
+	// A paused episode keeps its job and is tracked as paused
+	a.queue.jobs = append(a.queue.jobs, &DownloadJob{
+		Key:       "Sousou no Frieren:01",
+		AnimeName: "Sousou no Frieren",
+		EpNumStr:  "01",
+		Status:    queueStatusPaused,
+		Progress:  40,
+	})
+	batch, err = a.DownloadRange(anime, 1, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := a.activeBatches[batch.ID]
+	if tracker == nil {
+		t.Fatal("batch of a paused episode not tracked")
+	}
+	if update, done := tracker.summary(); done || update["paused"] != 1 || update["progress"] != 40 {
+		t.Errorf("summary %v, want the paused episode at 40%%", update)
+	}
+	if queue := a.GetQueue(); len(queue) != 1 || queue[0].Status != queueStatusPaused {
+		t.Errorf("queue %+v, want the paused job untouched", queue)
+	}
+	if err := a.CancelQueued("Sousou no Frieren:01"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.activeBatches) != 0 {
+		t.Errorf("batch still tracked after its paused episode was cancelled")
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The proxy caches segments in cacheDir under segmentFilename. Only complete
+// responses are stored, through a temp file renamed into place, so a reader
+// never sees part of a segment. A sidecar records the content type, length
+// and episode; a segment without one, or of another length, is not used.
+//
+// The cache is kept within a byte budget by evicting the least recently
+// used segments, except those of the stream being played.
+
+const (
+	defaultCacheBudgetMB = 2048
+	cacheSweepInterval   = 10 * time.Minute
+)
+
+// segmentMeta is the sidecar of a cached segment
+type segmentMeta struct {
+	ContentType string `json:"contentType,omitempty"`
+	Length      int64  `json:"length"`
+	AnimeName   string `json:"animeName,omitempty"`
+	EpisodeNum  string `json:"episodeNum,omitempty"`
+}
+
+func segmentMetaPath(path string) string {
+	return path + ".meta"
+}
+
+// cacheStreamKey identifies the episode a segment belongs to, for pinning.
+// Segments of streams opened without an anime name are never pinned.
+func cacheStreamKey(animeName, episodeNum string) string {
+	if animeName == "" {
+		return ""
+	}
+	return animeName + " - " + episodeNum
+}
+
+// cacheEntry is a segment in the index
+type cacheEntry struct {
+	size     int64
+	accessed time.Time
+	anime    string
+	stream   string
+}
+
+type cacheCounters struct {
+	hits, misses int64
+}
+
+// segmentCache indexes the segments in a directory, evicts them to stay
+// within budget and counts hits and misses per anime
+type segmentCache struct {
+	dir     string
+	mu      sync.Mutex
+	budget  int64
+	size    int64
+	entries map[string]*cacheEntry
+	pinned  string
+	counts  map[string]*cacheCounters
+	// flights are the segments being fetched into the cache
+	flights map[string]chan struct{}
+	stop    chan struct{}
+}
+
+// newSegmentCache returns an empty cache over dir; load indexes what is
+// already there. A budget of 0 or less is no limit.
+func newSegmentCache(dir string, budget int64) *segmentCache {
+	return &segmentCache{
+		dir:     dir,
+		budget:  budget,
+		entries: make(map[string]*cacheEntry),
+		counts:  make(map[string]*cacheCounters),
+		flights: make(map[string]chan struct{}),
+	}
+}
+
+// load indexes the segments in the directory, using their modification time
+// as last access. Files of an interrupted write and segments without a
+// sidecar, left by older versions, are removed.
+func (c *segmentCache) load() {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		fmt.Printf("Failed to read cache: %v\n", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		path := filepath.Join(c.dir, name)
+		meta, ok := readSegmentMeta(path)
+		info, err := f.Info()
+		if !ok || err != nil || info.Size() != meta.Length {
+			os.Remove(path)
+			os.Remove(segmentMetaPath(path))
+			continue
+		}
+		c.add(name, meta, info.ModTime())
+	}
+	for _, f := range files {
+		name := f.Name()
+		if base, ok := strings.CutSuffix(name, ".meta"); ok && c.entries[base] == nil {
+			os.Remove(filepath.Join(c.dir, name))
+		}
+	}
+	c.evict()
+}
+
+func readSegmentMeta(path string) (segmentMeta, bool) {
+	var meta segmentMeta
+	data, err := os.ReadFile(segmentMetaPath(path))
+	if err != nil || json.Unmarshal(data, &meta) != nil {
+		return meta, false
+	}
+	return meta, true
+}
+
+// add indexes a segment; c.mu must be held
+func (c *segmentCache) add(name string, meta segmentMeta, accessed time.Time) {
+	if old := c.entries[name]; old != nil {
+		c.size -= old.size
+	}
+	c.entries[name] = &cacheEntry{
+		size:     meta.Length,
+		accessed: accessed,
+		anime:    meta.AnimeName,
+		stream:   cacheStreamKey(meta.AnimeName, meta.EpisodeNum),
+	}
+	c.size += meta.Length
+}
+
+// remove deletes a segment and its sidecar; c.mu must be held. A segment
+// that cannot be removed, such as one being served on Windows, stays.
+func (c *segmentCache) remove(name string) bool {
+	path := filepath.Join(c.dir, name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	os.Remove(segmentMetaPath(path))
+	if e := c.entries[name]; e != nil {
+		c.size -= e.size
+		delete(c.entries, name)
+	}
+	return true
+}
+
+// evict removes the least recently used segments until the cache is within
+// budget, sparing the pinned stream; c.mu must be held
+func (c *segmentCache) evict() {
+	if c.budget <= 0 || c.size <= c.budget {
+		return
+	}
+	names := make([]string, 0, len(c.entries))
+	for name, e := range c.entries {
+		if !c.isPinned(e) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return c.entries[names[i]].accessed.Before(c.entries[names[j]].accessed)
+	})
+	for _, name := range names {
+		if c.size <= c.budget {
+			break
+		}
+		c.remove(name)
+	}
+}
+
+// lookup returns the path and sidecar of a complete cached segment and
+// marks it used
+func (c *segmentCache) lookup(name string) (string, segmentMeta, bool) {
+	path := filepath.Join(c.dir, name)
+	meta, ok := readSegmentMeta(path)
+	if !ok {
+		return "", meta, false
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != meta.Length {
+		return "", meta, false
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	c.mu.Lock()
+	if e := c.entries[name]; e != nil {
+		e.accessed = now
+	} else {
+		c.add(name, meta, now)
+	}
+	c.mu.Unlock()
+	return path, meta, true
+}
+
+// has tells whether a segment is in the index, without marking it used
+func (c *segmentCache) has(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[name] != nil
+}
+
+// count records a cache hit or miss for an anime
+func (c *segmentCache) count(anime string, hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.counts[anime]
+	if n == nil {
+		n = &cacheCounters{}
+		c.counts[anime] = n
+	}
+	if hit {
+		n.hits++
+	} else {
+		n.misses++
+	}
+}
+
+// pin spares the segments of a stream from eviction, in place of the
+// stream pinned before
+func (c *segmentCache) pin(stream string) {
+	c.mu.Lock()
+	c.pinned = stream
+	c.mu.Unlock()
+}
+
+func (c *segmentCache) isPinned(e *cacheEntry) bool {
+	return e.stream != "" && e.stream == c.pinned
+}
+
+func (c *segmentCache) setBudget(budget int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.budget = budget
+	c.evict()
+}
+
+// clear removes every segment but those of the pinned stream
+func (c *segmentCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, e := range c.entries {
+		if !c.isPinned(e) {
+			c.remove(name)
+		}
+	}
+}
+
+// flight registers a fetch of segment name. The first caller leads and must
+// call endFlight when done; the others get a channel closed at that point,
+// after which the segment is cached if the fetch succeeded.
+func (c *segmentCache) flight(name string) (<-chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.flights[name]; ok {
+		return done, false
+	}
+	c.flights[name] = make(chan struct{})
+	return nil, true
+}
+
+func (c *segmentCache) endFlight(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.flights[name]; ok {
+		close(done)
+		delete(c.flights, name)
+	}
+}
+
+// store copies a complete upstream response to w and into the cache. The
+// segment is stored only when the whole body arrived.
+func (c *segmentCache) store(w io.Writer, resp *http.Response, name string, length int64, info *StreamInfo) error {
+	path := filepath.Join(c.dir, name)
+	tmp, err := os.CreateTemp(c.dir, name+".*.tmp")
+	if err != nil {
+		fmt.Printf("Failed to create cache file: %v\n", err)
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(io.MultiWriter(w, tmp), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if length >= 0 && n != length {
+		return fmt.Errorf("segment %s: got %d of %d bytes", name, n, length)
+	}
+
+	meta := segmentMeta{
+		ContentType: resp.Header.Get("Content-Type"),
+		Length:      n,
+		AnimeName:   info.AnimeName,
+		EpisodeNum:  info.EpisodeNum,
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(segmentMetaPath(path), data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(name, meta, time.Now())
+	c.evict()
+	return nil
+}
+
+// startSweeps evicts in the background every interval until close, for
+// segments the proxy did not add, like those of a changed budget
+func (c *segmentCache) startSweeps(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	c.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.sweep()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// sweep drops segments removed behind the cache's back and evicts to budget
+func (c *segmentCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, e := range c.entries {
+		if _, err := os.Stat(filepath.Join(c.dir, name)); os.IsNotExist(err) {
+			c.size -= e.size
+			delete(c.entries, name)
+		}
+	}
+	c.evict()
+}
+
+func (c *segmentCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// stats reports the cache by anime, largest first
+func (c *segmentCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byAnime := make(map[string]*AnimeCacheStats)
+	get := func(anime string) *AnimeCacheStats {
+		s := byAnime[anime]
+		if s == nil {
+			s = &AnimeCacheStats{AnimeName: anime}
+			byAnime[anime] = s
+		}
+		return s
+	}
+	stats := CacheStats{Size: c.size, Items: len(c.entries), Budget: max(c.budget, 0)}
+	for _, e := range c.entries {
+		s := get(e.anime)
+		s.Size += e.size
+		s.Items++
+	}
+	for anime, n := range c.counts {
+		s := get(anime)
+		s.Hits, s.Misses = n.hits, n.misses
+		s.HitRatio = hitRatio(n.hits, n.misses)
+		stats.Hits += n.hits
+		stats.Misses += n.misses
+	}
+	stats.HitRatio = hitRatio(stats.Hits, stats.Misses)
+
+	stats.Anime = make([]AnimeCacheStats, 0, len(byAnime))
+	for _, s := range byAnime {
+		stats.Anime = append(stats.Anime, *s)
+	}
+	sort.Slice(stats.Anime, func(i, j int) bool {
+		if stats.Anime[i].Size != stats.Anime[j].Size {
+			return stats.Anime[i].Size > stats.Anime[j].Size
+		}
+		return stats.Anime[i].AnimeName < stats.Anime[j].AnimeName
+	})
+	return stats
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// serveCachedSegment serves a cached segment, ranges included. It returns
+// false when the segment is not cached.
+func (a *AnimeService) serveCachedSegment(w http.ResponseWriter, r *http.Request, name string) bool {
+	path, meta, ok := a.segments.lookup(name)
+	if !ok {
+		return false
+	}
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	http.ServeFile(w, r, path)
+	return true
+}
+
+// GetCacheStats reports the size of the segment cache and its hit ratio,
+// overall and per anime. Hits and misses are counted since the app started.
+func (a *AnimeService) GetCacheStats() CacheStats {
+	return a.segments.stats()
+}
+
+// cacheableSegment tells whether the proxy caches the resource at rawURL
+func cacheableSegment(rawURL string) bool {
+	switch getUrlExtension(rawURL) {
+	case ".ts", ".m4s", ".mp4", ".aspx", ".avi":
+		return true
+	}
+	return false
+}
+
+// completeLength tells whether resp carries a whole resource and its length,
+// -1 when unknown: a 200, or a 206 whose range covers everything
+func completeLength(resp *http.Response) (int64, bool) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true
+	case http.StatusPartialContent:
+		first, last, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if ok && first == 0 && total > 0 && last == total-1 {
+			return total, true
+		}
+	}
+	return 0, false
+}
+
+// parseContentRange reads "bytes first-last/total"
+func parseContentRange(v string) (first, last, total int64, ok bool) {
+	spec, found := strings.CutPrefix(v, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	from, to, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	first, err1 = strconv.ParseInt(from, 10, 64)
+	last, err2 = strconv.ParseInt(to, 10, 64)
+	total, err3 = strconv.ParseInt(size, 10, 64)
+	return first, last, total, err1 == nil && err2 == nil && err3 == nil
+}
+
+// writeFileAtomic writes data through a temp file renamed over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSegmentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	// A segment left without a sidecar and an interrupted write
+	os.WriteFile(filepath.Join(dir, "old.ts"), []byte("legacy"), 0644)
+	os.WriteFile(filepath.Join(dir, "new.ts.123.tmp"), []byte("part"), 0644)
+
+	c := newSegmentCache(dir, 35)
+	c.load()
+	if names := cacheFiles(t, dir); len(names) != 0 {
+		t.Fatalf("load left %v", names)
+	}
+
+	store := func(name, anime, ep string) {
+		t.Helper()
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"video/mp2t"}},
+			Body:          io.NopCloser(strings.NewReader("0123456789")),
+			ContentLength: 10,
+		}
+		if err := c.store(io.Discard, resp, name, 10, &StreamInfo{AnimeName: anime, EpisodeNum: ep}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store("a.ts", "Frieren", "1")
+	store("d.ts", "Dandadan", "1")
+	c.pin(cacheStreamKey("Frieren", "2"))
+	store("b.ts", "Frieren", "2")
+	if _, _, ok := c.lookup("a.ts"); !ok {
+		t.Fatal("a.ts not cached")
+	}
+
+	// Over budget, the least recently used segment goes first
+	store("e.ts", "Dandadan", "2")
+	if got := cacheSegments(t, dir); strings.Join(got, " ") != "a.ts b.ts e.ts" {
+		t.Errorf("after eviction cached %v, want a.ts b.ts e.ts", got)
+	}
+
+	// The pinned episode stays even over budget
+	c.setBudget(5)
+	if got := cacheSegments(t, dir); strings.Join(got, " ") != "b.ts" {
+		t.Errorf("at a 5 byte budget cached %v, want the pinned b.ts", got)
+	}
+
+	c.count("Frieren", true)
+	c.count("Frieren", true)
+	c.count("Frieren", true)
+	c.count("Frieren", false)
+	c.count("Dandadan", false)
+	stats := c.stats()
+	if stats.Size != 10 || stats.Items != 1 || stats.Hits != 3 || stats.Misses != 2 || stats.HitRatio != 0.6 {
+		t.Errorf("stats %+v", stats)
+	}
+	want := []AnimeCacheStats{
+		{AnimeName: "Frieren", Size: 10, Items: 1, Hits: 3, Misses: 1, HitRatio: 0.75},
+		{AnimeName: "Dandadan", Misses: 1},
+	}
+	if len(stats.Anime) != 2 || stats.Anime[0] != want[0] || stats.Anime[1] != want[1] {
+		t.Errorf("per anime %+v, want %+v", stats.Anime, want)
+	}
+
+	// A restart indexes the segments from their sidecars
+	reloaded := newSegmentCache(dir, 0)
+	reloaded.load()
+	if s := reloaded.stats(); s.Size != 10 || s.Items != 1 || s.Anime[0].AnimeName != "Frieren" {
+		t.Errorf("reloaded stats %+v", s)
+	}
+
+	c.clear()
+	if got := cacheSegments(t, dir); len(got) != 1 {
+		t.Errorf("clear removed the pinned episode: %v", got)
+	}
+	c.pin("")
+	c.clear()
+	if names := cacheFiles(t, dir); len(names) != 0 {
+		t.Errorf("clear left %v", names)
+	}
+}
+
+// cacheFiles lists the files in a cache directory
+func cacheFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// cacheSegments lists the segments in a cache directory, without sidecars
+func cacheSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	for _, name := range cacheFiles(t, dir) {
+		if !strings.HasSuffix(name, ".meta") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
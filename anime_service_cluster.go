@@ -0,0 +1,278 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+// titleNoise are words sources add to a title to mark the audio, ignored
+// when matching titles across sources
+var titleNoise = map[string]bool{"dublado": true, "legendado": true, "dub": true, "sub": true}
+
+// clusterTitle is the title search results are matched by
+func clusterTitle(name string) string {
+	var words []string
+	for _, w := range strings.Fields(normalizeTitle(cleanTitle(name))) {
+		if !titleNoise[w] {
+			words = append(words, w)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// isDubEntry tells a dubbed entry listed as its own anime, as AnimeFire does
+// with "(Dublado)"
+func isDubEntry(name, url string) bool {
+	return strings.Contains(strings.ToLower(name), "dublado") || strings.Contains(strings.ToLower(url), "dublado")
+}
+
+// animeSourceEntry describes a search result as one source of an anime
+func animeSourceEntry(a *types.Anime, source string) AnimeSource {
+	entry := AnimeSource{Source: source, SubEpisodes: a.SubEpisodes, DubEpisodes: a.DubEpisodes}
+	if isDubEntry(a.Name, a.URL) {
+		entry.DubURL = a.URL
+		entry.HasDub = true
+		return entry
+	}
+	entry.URL = a.URL
+	entry.HasDub = a.HasDub
+	// Sources that list no counts are assumed to have the sub
+	entry.HasSub = a.SubEpisodes > 0 || a.DubEpisodes == 0
+	return entry
+}
+
+// episodeCount is the most episodes the source lists in either language
+func (s AnimeSource) episodeCount() int {
+	if s.DubEpisodes > s.SubEpisodes {
+		return s.DubEpisodes
+	}
+	return s.SubEpisodes
+}
+
+// entryURL is the URL to open the source with, the sub if it has one
+func (s AnimeSource) entryURL() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	return s.DubURL
+}
+
+// sourceEntry returns the anime's entry for a source, or nil
+func (a *Anime) sourceEntry(source string) *AnimeSource {
+	for i := range a.Sources {
+		if a.Sources[i].Source == source {
+			return &a.Sources[i]
+		}
+	}
+	return nil
+}
+
+// hasMember tells whether the source entry url belongs to the anime
+func (a *Anime) hasMember(source, url string) bool {
+	s := a.sourceEntry(source)
+	return s != nil && (s.URL == url || s.DubURL == url)
+}
+
+// conflicts tells whether merging other into a would put two different
+// entries of the same source into one anime
+func (a *Anime) conflicts(other *Anime) bool {
+	for _, o := range other.Sources {
+		s := a.sourceEntry(o.Source)
+		if s == nil {
+			continue
+		}
+		if (s.URL != "" && o.URL != "" && s.URL != o.URL) || (s.DubURL != "" && o.DubURL != "" && s.DubURL != o.DubURL) {
+			return true
+		}
+	}
+	return false
+}
+
+// merge adds other's sources to a and fills in metadata a lacks
+func (a *Anime) merge(other *Anime) {
+	for _, o := range other.Sources {
+		s := a.sourceEntry(o.Source)
+		if s == nil {
+			a.Sources = append(a.Sources, o)
+			continue
+		}
+		if s.URL == "" {
+			s.URL = o.URL
+		}
+		if s.DubURL == "" {
+			s.DubURL = o.DubURL
+		}
+		s.HasSub = s.HasSub || o.HasSub
+		s.HasDub = s.HasDub || o.HasDub
+		s.SubEpisodes = max(s.SubEpisodes, o.SubEpisodes)
+		s.DubEpisodes = max(s.DubEpisodes, o.DubEpisodes)
+	}
+
+	if a.ImageURL == "" {
+		a.ImageURL = other.ImageURL
+	}
+	if a.MalID == 0 {
+		a.MalID = other.MalID
+	}
+	if a.AnilistID == 0 {
+		a.AnilistID = other.AnilistID
+	}
+	if a.Synopsis == "" {
+		a.Synopsis = other.Synopsis
+	}
+	if len(a.Genres) == 0 {
+		a.Genres = other.Genres
+	}
+	if a.Score == 0 {
+		a.Score = other.Score
+	}
+	if a.Status == "" {
+		a.Status = other.Status
+	}
+	if a.BannerImage == "" {
+		a.BannerImage = other.BannerImage
+	}
+}
+
+// pickSource sets URL and Source to the preferred source if the anime is on
+// it, otherwise to the source listing the most episodes, the first found on
+// a tie.
+func (a *Anime) pickSource(preferred string) {
+	if len(a.Sources) == 0 {
+		return
+	}
+	best := 0
+	for i, s := range a.Sources {
+		if s.Source == preferred {
+			best = i
+			break
+		}
+		if s.episodeCount() > a.Sources[best].episodeCount() {
+			best = i
+		}
+	}
+	a.Source = a.Sources[best].Source
+	a.URL = a.Sources[best].entryURL()
+
+	a.HasDub = false
+	for _, s := range a.Sources {
+		a.HasDub = a.HasDub || s.HasDub
+	}
+}
+
+// resultClusters merges search results from every source into one result
+// per anime. Results match by MAL ID, or by title when their MAL IDs do not
+// differ. A source's entries never merge with another entry of the same
+// source, except its separate dub entry.
+type resultClusters struct {
+	mu        sync.Mutex
+	preferred string
+	items     []*resultCluster
+}
+
+type resultCluster struct {
+	anime  Anime
+	titles map[string]bool
+}
+
+func newResultClusters(preferred string) *resultClusters {
+	return &resultClusters{preferred: preferred}
+}
+
+// add merges search results of one source in
+func (c *resultClusters) add(results []Anime) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range results {
+		r := results[i]
+		title := clusterTitle(r.Name)
+		if cl := c.match(&r, title); cl != nil {
+			cl.anime.merge(&r)
+			cl.titles[title] = true
+			cl.anime.pickSource(c.preferred)
+			continue
+		}
+		r.Key = r.Source + "|" + r.URL
+		r.pickSource(c.preferred)
+		c.items = append(c.items, &resultCluster{anime: r, titles: map[string]bool{title: true}})
+	}
+}
+
+func (c *resultClusters) match(r *Anime, title string) *resultCluster {
+	for _, cl := range c.items {
+		if cl.anime.conflicts(r) {
+			continue
+		}
+		if r.MalID != 0 && cl.anime.MalID != 0 {
+			if r.MalID == cl.anime.MalID {
+				return cl
+			}
+			continue
+		}
+		if title != "" && cl.titles[title] {
+			return cl
+		}
+	}
+	return nil
+}
+
+// update applies metadata found for a search result to the anime it was
+// merged into. When that gives it a MAL ID another anime has, the two are
+// merged. It returns the updated anime and the keys of those merged away,
+// or false if the result is unknown.
+func (c *resultClusters) update(r Anime) (Anime, []string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var target *resultCluster
+	for _, cl := range c.items {
+		if cl.anime.hasMember(r.Source, r.URL) {
+			target = cl
+			break
+		}
+	}
+	if target == nil {
+		return Anime{}, nil, false
+	}
+
+	// The details are for that source's title: they only fill in gaps
+	details := r
+	details.Sources = nil
+	target.anime.merge(&details)
+
+	var removed []string
+	if target.anime.MalID != 0 {
+		kept := c.items[:0]
+		for _, cl := range c.items {
+			if cl != target && cl.anime.MalID == target.anime.MalID && !target.anime.conflicts(&cl.anime) {
+				target.anime.merge(&cl.anime)
+				for t := range cl.titles {
+					target.titles[t] = true
+				}
+				removed = append(removed, cl.anime.Key)
+				continue
+			}
+			kept = append(kept, cl)
+		}
+		c.items = kept
+	}
+	target.anime.pickSource(c.preferred)
+	out := target.anime
+	out.Sources = append([]AnimeSource{}, target.anime.Sources...)
+	return out, removed, true
+}
+
+// list returns the merged results sorted by similarity to query
+func (c *resultClusters) list(query string) []Anime {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]Anime, len(c.items))
+	for i, cl := range c.items {
+		out[i] = cl.anime
+		out[i].Sources = append([]AnimeSource{}, cl.anime.Sources...)
+	}
+	sortBySimilarity(query, out)
+	return out
+}
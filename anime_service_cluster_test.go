@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+func TestClusterResults(t *testing.T) {
+	allAnime := mapAnimeList([]*types.Anime{
+		{Name: "[AllAnime] Sousou no Frieren (28 episodes)", URL: "aa-frieren", HasDub: true, SubEpisodes: 28, DubEpisodes: 12},
+		{Name: "[AllAnime] Sousou no Frieren: Mini Anime (10 episodes)", URL: "aa-mini", SubEpisodes: 10},
+	}, "AllAnime")
+	animeFire := mapAnimeList([]*types.Anime{
+		{Name: "[AnimeFire] Sousou no Frieren", URL: "https://animefire.plus/animes/sousou-no-frieren-todos-os-episodios"},
+		{Name: "[AnimeFire] Sousou no Frieren (Dublado)", URL: "https://animefire.plus/animes/sousou-no-frieren-dublado-todos-os-episodios"},
+	}, "AnimeFire")
+
+	c := newResultClusters("")
+	c.add(allAnime)
+	c.add(animeFire)
+	results := c.list("Sousou no Frieren")
+
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(results), results)
+	}
+	frieren := results[0]
+	if frieren.Name != "Sousou no Frieren" || len(frieren.Sources) != 2 {
+		t.Fatalf("merged result = %+v", frieren)
+	}
+	fire := frieren.sourceEntry("AnimeFire")
+	if fire == nil || fire.URL != animeFire[0].URL || fire.DubURL != animeFire[1].URL || !fire.HasSub || !fire.HasDub {
+		t.Errorf("AnimeFire entry = %+v, want its sub and dub entries merged", fire)
+	}
+	if aa := frieren.sourceEntry("AllAnime"); aa == nil || aa.SubEpisodes != 28 || aa.DubEpisodes != 12 {
+		t.Errorf("AllAnime entry = %+v", aa)
+	}
+	// AllAnime lists the most episodes
+	if frieren.Source != "AllAnime" || frieren.URL != "aa-frieren" || !frieren.HasDub {
+		t.Errorf("picked %s %s", frieren.Source, frieren.URL)
+	}
+	if results[1].URL != "aa-mini" || len(results[1].Sources) != 1 {
+		t.Errorf("unrelated title merged: %+v", results[1])
+	}
+
+	// A preferred source wins when the anime is on it
+	c = newResultClusters("AnimeFire")
+	c.add(allAnime)
+	c.add(animeFire)
+	if r := c.list("Sousou no Frieren")[0]; r.Source != "AnimeFire" || r.URL != animeFire[0].URL {
+		t.Errorf("preferred source not picked: %s %s", r.Source, r.URL)
+	}
+}
+
+func TestClusterResultsByMalID(t *testing.T) {
+	c := newResultClusters("")
+	c.add([]Anime{
+		{Name: "Attack on Titan", URL: "aa-aot", Source: "AllAnime", Sources: []AnimeSource{{Source: "AllAnime", URL: "aa-aot", HasSub: true, SubEpisodes: 25}}},
+		{Name: "Attack on Titan Season 2", URL: "aa-aot2", Source: "AllAnime", MalID: 25777, Sources: []AnimeSource{{Source: "AllAnime", URL: "aa-aot2", HasSub: true}}},
+	})
+	c.add([]Anime{
+		{Name: "Shingeki no Kyojin", URL: "af-snk", Source: "AnimeFire", Sources: []AnimeSource{{Source: "AnimeFire", URL: "af-snk", HasSub: true}}},
+	})
+	if n := len(c.list("")); n != 3 {
+		t.Fatalf("got %d results before metadata, want 3", n)
+	}
+
+	c.update(Anime{Name: "Attack on Titan", URL: "aa-aot", Source: "AllAnime", MalID: 16498, ImageURL: "aot.jpg"})
+	merged, removed, ok := c.update(Anime{Name: "Shingeki no Kyojin", URL: "af-snk", Source: "AnimeFire", MalID: 16498, Synopsis: "Walls."})
+	if !ok {
+		t.Fatal("update of a known result failed")
+	}
+	if len(removed) != 1 || len(merged.Sources) != 2 {
+		t.Fatalf("merged = %+v, removed %v", merged, removed)
+	}
+	if merged.ImageURL != "aot.jpg" || merged.Synopsis != "Walls." {
+		t.Errorf("metadata of both results not kept: %+v", merged)
+	}
+	if n := len(c.list("")); n != 2 {
+		t.Errorf("got %d results after metadata, want 2", n)
+	}
+
+	// Different MAL IDs never merge, even with the same title
+	if _, _, ok := c.update(Anime{URL: "unknown", Source: "AllAnime"}); ok {
+		t.Error("update of an unknown result succeeded")
+	}
+	c.add([]Anime{{Name: "Attack on Titan", URL: "af-other", Source: "AnimeFire", MalID: 1, Sources: []AnimeSource{{Source: "AnimeFire", URL: "af-other"}}}})
+	if n := len(c.list("")); n != 3 {
+		t.Errorf("got %d results, want a separate result for another MAL ID", n)
+	}
+}
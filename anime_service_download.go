@@ -3,22 +3,34 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+)
+
+const (
+	downloadStateDownloading = "downloading"
+	downloadStatePaused      = "paused"
+	downloadStateResumed     = "resumed"
+	downloadStateCompleted   = "completed"
+	downloadStateFailed      = "failed"
+	downloadStateCancelled   = "cancelled"
+)
 
-	"github.com/wailsapp/wails/v2/pkg/runtime"
+var (
+	errDownloadPaused    = errors.New("download paused")
+	errDownloadCancelled = errors.New("download cancelled")
+	// errShuttingDown stops downloads when the app closes; they stay queued
+	errShuttingDown = errors.New("shutting down")
 )
 
 func (a *AnimeService) GetDownloads() (map[string][]string, error) {
@@ -72,47 +84,215 @@ func (a *AnimeService) GetActiveDownloads() map[string]int {
 	return active
 }
 
-func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumStr, epURL string, epNum float64, isDub bool) error {
+func (a *AnimeService) GetPausedDownloads() map[string]int {
+	a.cancelMutex.RLock()
+	defer a.cancelMutex.RUnlock()
+
+	paused := make(map[string]int)
+	for key, p := range a.pausedDownloads {
+		paused[key] = p.Progress
+	}
+	return paused
+}
+
+// PauseDownload stops the workers of an active download. Segments that were
+// already fetched stay in the episode directory so ResumeDownload can continue.
+func (a *AnimeService) PauseDownload(animeName, epNumStr string) error {
+	key := animeName + ":" + epNumStr
+
+	a.cancelMutex.RLock()
+	cancel, exists := a.cancelFuncs[key]
+	a.cancelMutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("no active download for %s", key)
+	}
+
+	fmt.Printf("[%s] Pausing download\n", key)
+	cancel(errDownloadPaused)
+	return nil
+}
+
+// ResumeDownload puts a paused (or failed) download back into the queue. The
+// segments fetched before the pause are reused when it starts again.
+func (a *AnimeService) ResumeDownload(animeName, epNumStr string) error {
 	key := animeName + ":" + epNumStr
-	fmt.Printf("Starting download: %s\n", key)
 
-	runtime.EventsEmit(a.ctx, "download-progress", map[string]interface{}{
+	a.cancelMutex.RLock()
+	p, exists := a.pausedDownloads[key]
+	a.cancelMutex.RUnlock()
+
+	if a.queue.requeue(key) {
+		fmt.Printf("[%s] Resuming download via queue\n", key)
+		a.saveQueue()
+		a.processQueue()
+		return nil
+	}
+
+	if !exists {
+		return fmt.Errorf("no paused download for %s", key)
+	}
+
+	// Paused outside the queue, e.g. during a repair: it waits its turn
+	// like any other download
+	job := *p
+	job.Key = key
+	job.Status = queueStatusQueued
+	if job.AddedAt.IsZero() {
+		job.AddedAt = time.Now()
+	}
+	a.queue.mu.Lock()
+	if _, existing := a.queue.find(key); existing != nil {
+		a.queue.mu.Unlock()
+		return fmt.Errorf("download already in progress for %s", key)
+	}
+	a.queue.jobs = append(a.queue.jobs, &job)
+	a.queue.mu.Unlock()
+
+	fmt.Printf("[%s] Resuming download from %d%% via queue\n", key, p.Progress)
+	a.saveQueue()
+	a.processQueue()
+	return nil
+}
+
+func (a *AnimeService) emitDownloadProgress(key, animeName, epNumStr string, progress int, state string) {
+	a.emit("download-progress", map[string]interface{}{
+		"key":       key,
+		"animeName": animeName,
+		"episode":   epNumStr,
+		"progress":  progress,
+		"state":     state,
+	})
+	a.updateBatchProgress(key, progress, state)
+}
+
+func (a *AnimeService) emitDownloadFailed(key, animeName, epNumStr string, progress int, err error) {
+	a.emit("download-progress", map[string]interface{}{
 		"key":       key,
 		"animeName": animeName,
 		"episode":   epNumStr,
-		"progress":  0,
+		"progress":  progress,
+		"state":     downloadStateFailed,
+		"error":     err.Error(),
 	})
+	a.updateBatchProgress(key, progress, downloadStateFailed)
+}
+
+func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumStr, epURL string, epNum float64, isDub bool) error {
+	return a.DownloadEpisodeWithQuality(animeName, animeURL, animeSource, epNumStr, epURL, epNum, isDub, "")
+}
+
+// DownloadEpisodeWithQuality downloads an episode using the given quality
+// instead of the global preference. An empty quality uses the preference.
+func (a *AnimeService) DownloadEpisodeWithQuality(animeName, animeURL, animeSource, epNumStr, epURL string, epNum float64, isDub bool, quality string) error {
+	if err := validateQuality(quality); err != nil {
+		return err
+	}
+	return a.downloadEpisode(DownloadJob{
+		AnimeName:   animeName,
+		AnimeURL:    animeURL,
+		AnimeSource: animeSource,
+		EpNumStr:    epNumStr,
+		EpURL:       epURL,
+		EpNum:       epNum,
+		IsDub:       isDub,
+		Quality:     quality,
+	})
+}
+
+func (a *AnimeService) downloadEpisode(job DownloadJob) error {
+	animeName, epNumStr := job.AnimeName, job.EpNumStr
+	key := animeName + ":" + epNumStr
+	quality := a.effectiveQuality(job.Quality)
+	fmt.Printf("Starting download: %s (quality: %s)\n", key, quality)
 
 	a.cancelMutex.Lock()
 	if _, exists := a.cancelFuncs[key]; exists {
 		a.cancelMutex.Unlock()
 		return fmt.Errorf("download already in progress for %s", key)
 	}
-	ctx, cancel := context.WithCancel(a.ctx)
+	if a.closing.Load() {
+		a.cancelMutex.Unlock()
+		return errShuttingDown
+	}
+	ctx, cancel := context.WithCancelCause(a.ctx)
 	a.cancelFuncs[key] = cancel
+	a.downloads.Add(1)
+	defer a.downloads.Done()
+	paused, wasPaused := a.pausedDownloads[key]
+	delete(a.pausedDownloads, key)
 	a.cancelMutex.Unlock()
 
+	if wasPaused {
+		a.progressMap.Store(key, paused.Progress)
+		a.emitDownloadProgress(key, animeName, epNumStr, paused.Progress, downloadStateResumed)
+	} else {
+		a.emitDownloadProgress(key, animeName, epNumStr, 0, downloadStateDownloading)
+	}
+
 	defer func() {
 		a.cancelMutex.Lock()
 		delete(a.cancelFuncs, key)
 		a.cancelMutex.Unlock()
 		a.progressMap.Delete(key)
+		cancel(nil)
 	}()
 
-	rawURL, headers, err := a.ResolveStreamURL(animeName, animeURL, animeSource, epNumStr, epURL, epNum, isDub)
+	currentProgress := func() int {
+		if v, ok := a.progressMap.Load(key); ok {
+			return v.(int)
+		}
+		return 0
+	}
+
+	// fail reports the error to the UI, or records the download as paused
+	// when the context was cancelled through PauseDownload.
+	fail := func(err error) error {
+		if errors.Is(context.Cause(ctx), errDownloadPaused) {
+			progress := currentProgress()
+			pausedJob := job
+			pausedJob.Key = key
+			pausedJob.Status = queueStatusPaused
+			pausedJob.Progress = progress
+			// Keep the resolved quality so resuming picks the same variant
+			pausedJob.Quality = quality
+			a.cancelMutex.Lock()
+			a.pausedDownloads[key] = &pausedJob
+			a.cancelMutex.Unlock()
+			fmt.Printf("[%s] Download paused at %d%%\n", key, progress)
+			a.emitDownloadProgress(key, animeName, epNumStr, progress, downloadStatePaused)
+			return nil
+		}
+		if errors.Is(context.Cause(ctx), errShuttingDown) {
+			fmt.Printf("[%s] Download stopped at %d%% for shutdown\n", key, currentProgress())
+			return errShuttingDown
+		}
+		if errors.Is(context.Cause(ctx), errDownloadCancelled) {
+			fmt.Printf("[%s] Download cancelled\n", key)
+			a.emitDownloadProgress(key, animeName, epNumStr, currentProgress(), downloadStateCancelled)
+			return errDownloadCancelled
+		}
+		fmt.Printf("[%s] Download failed with error: %v\n", key, err)
+		a.emitDownloadFailed(key, animeName, epNumStr, currentProgress(), err)
+		return err
+	}
+
+	rawURL, headers, err := a.resolveStreamURL(ctx, animeName, job.AnimeURL, job.AnimeSource, epNumStr, job.EpURL, job.EpNum, job.IsDub, quality)
 	if err != nil {
 		fmt.Printf("[%s] Error resolving raw stream URL: %v\n", key, err)
-		return err
+		return fail(err)
 	}
 	streamURL := rawURL
 
 	epDir := a.getEpisodeDir(animeName, epNumStr)
 	if err := os.MkdirAll(epDir, 0755); err != nil {
-		return err
+		return fail(err)
 	}
 
 	var rawContent string
 	var segmentURLs []string
+	var segments []hlsSegment
+	kinds := make(map[string]string)
 	maxFollow := 3
 	for i := 0; i < maxFollow; i++ {
 		fmt.Printf("[%s] Fetching playlist or stream (level %d): %s\n", key, i, streamURL)
@@ -127,12 +307,12 @@ func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumSt
 		resp, err := downloadClient.Do(req)
 		if err != nil {
 			fmt.Printf("[%s] Error opening stream: %v\n", key, err)
-			return err
+			return fail(err)
 		}
 		if resp.StatusCode != http.StatusOK {
 			fmt.Printf("[%s] Bad status code: %d\n", key, resp.StatusCode)
 			resp.Body.Close()
-			return fmt.Errorf("bad status code: %d", resp.StatusCode)
+			return fail(fmt.Errorf("bad status code: %d", resp.StatusCode))
 		}
 
 		// Peek content to see if it's a playlist
@@ -144,6 +324,7 @@ func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumSt
 			if i == 0 {
 				fmt.Printf("[%s] Detected direct download (not HLS).\n", key)
 				segmentURLs = []string{streamURL}
+				kinds[streamURL] = hlsRefSegment
 				resp.Body.Close()
 				break
 			}
@@ -155,38 +336,48 @@ func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumSt
 		content := string(body)
 
 		if strings.Contains(content, "#EXT-X-STREAM-INF") {
-			fmt.Printf("[%s] Detected master playlist, selecting highest quality variant...\n", key)
-			variantURL := selectHighestQualityVariant(content)
+			fmt.Printf("[%s] Detected master playlist, selecting %s variant...\n", key, quality)
+			variant := selectVariant(parseMasterPlaylist(content), quality)
 
-			if variantURL != "" {
+			if variant != nil {
 				baseURL, _ := url.Parse(streamURL)
-				refURL, _ := url.Parse(variantURL)
+				refURL, _ := url.Parse(variant.URI)
 				streamURL = baseURL.ResolveReference(refURL).String()
-				fmt.Printf("[%s] Resolved highest quality variant URL: %s\n", key, streamURL)
+				fmt.Printf("[%s] Resolved variant URL (%s, %d bps): %s\n", key, variant.Resolution(), variant.Bandwidth, streamURL)
 				continue
 			}
 		}
 
 		rawContent = content
-		scanner := bufio.NewScanner(strings.NewReader(content))
-		baseURL, _ := url.Parse(streamURL)
-
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
+		playlist := parsePlaylist(content)
+		segments, err = playlist.Segments(streamURL)
+		if err != nil {
+			return fail(err)
+		}
+		for _, seg := range segments {
+			if seg.Key != nil && (seg.Key.Method != "AES-128" || seg.Key.URL == "") {
+				return fail(fmt.Errorf("unsupported HLS encryption: METHOD=%s", seg.Key.Method))
 			}
-			u, err := url.Parse(line)
-			if err != nil {
-				continue
+		}
+
+		// Init segments (EXT-X-MAP) and keys are needed offline as well.
+		// Keys are kept as local copies next to the segments.
+		seen := make(map[string]bool)
+		for _, ref := range playlist.References(streamURL) {
+			switch ref.Kind {
+			case hlsRefSegment, hlsRefMap, hlsRefKey:
+				if !seen[ref.URL] {
+					seen[ref.URL] = true
+					segmentURLs = append(segmentURLs, ref.URL)
+					kinds[ref.URL] = ref.Kind
+				}
 			}
-			segmentURLs = append(segmentURLs, baseURL.ResolveReference(u).String())
 		}
 		break
 	}
 
 	if len(segmentURLs) == 0 {
-		return fmt.Errorf("no segments found")
+		return fail(fmt.Errorf("no segments found"))
 	}
 
 	totalSegments := len(segmentURLs)
@@ -200,45 +391,48 @@ func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumSt
 		newCount := atomic.AddInt32(&downloadedCount, 1)
 		progress := int(float64(newCount) / float64(totalSegments) * 100)
 		a.progressMap.Store(key, progress)
-		runtime.EventsEmit(a.ctx, "download-progress", map[string]interface{}{
-			"key":       key,
-			"animeName": animeName,
-			"episode":   epNumStr,
-			"progress":  progress,
-		})
+		a.emitDownloadProgress(key, animeName, epNumStr, progress, downloadStateDownloading)
 	}
 
 	for i, sURL := range segmentURLs {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+		if ctx.Err() != nil {
+			break
 		}
 
 		wg.Add(1)
 		go func(target string, idx int) {
 			defer wg.Done()
 			sem <- struct{}{}
-			ext := getUrlExtension(target)
-			hash := sha256.Sum256([]byte(target))
-			filename := hex.EncodeToString(hash[:]) + ext
+			defer func() { <-sem }()
 
-			searchPaths := []string{
-				filepath.Join(epDir, filename),
-				filepath.Join(a.downloadsDir, filename), // Legacy flat structure support
-				filepath.Join(a.cacheDir, filename),
+			if ctx.Err() != nil {
+				return
 			}
 
-			defer func() { <-sem }()
+			filename := segmentFilename(target)
+			dest := filepath.Join(epDir, filename)
+			if info, err := os.Stat(dest); err == nil && info.Size() > 0 {
+				updateProgress()
+				return
+			}
 
-			for _, p := range searchPaths {
+			// The remux reads from epDir, so reused files are copied in.
+			// Cached segments count only when complete.
+			reusePaths := []string{
+				filepath.Join(a.downloadsDir, filename), // Legacy flat structure support
+			}
+			if p, _, ok := a.segments.lookup(filename); ok {
+				reusePaths = append(reusePaths, p)
+			}
+			for _, p := range reusePaths {
 				if info, err := os.Stat(p); err == nil && info.Size() > 0 {
-					updateProgress()
-					return
+					if err := copyFile(p, dest); err == nil {
+						updateProgress()
+						return
+					}
 				}
 			}
 
-			dest := filepath.Join(epDir, filename)
 			onSegProgress := func(downloaded, total int64) {
 				if totalSegments == 1 && total > 0 {
 					p := int(float64(downloaded) / float64(total) * 100)
@@ -246,12 +440,7 @@ func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumSt
 					current, _ := a.progressMap.Load(key)
 					if current != p {
 						a.progressMap.Store(key, p)
-						runtime.EventsEmit(a.ctx, "download-progress", map[string]interface{}{
-							"key":       key,
-							"animeName": animeName,
-							"episode":   epNumStr,
-							"progress":  p,
-						})
+						a.emitDownloadProgress(key, animeName, epNumStr, p, downloadStateDownloading)
 					}
 				}
 			}
@@ -270,12 +459,39 @@ func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumSt
 
 	wg.Wait()
 
-	var fileList []string
+	if ctx.Err() != nil {
+		return fail(ctx.Err())
+	}
+
+	select {
+	case err := <-errChan:
+		return fail(err)
+	default:
+	}
+
+	if err := checkSegmentKeys(epDir, segments); err != nil {
+		return fail(err)
+	}
+
+	// Sizes are recorded before the remux cleans the segments up
+	encrypted := make(map[string]bool)
+	for _, seg := range segments {
+		encrypted[seg.URL] = encrypted[seg.URL] || seg.Key != nil
+	}
+	manifest := make([]manifestEntry, 0, len(segmentURLs))
 	for _, sURL := range segmentURLs {
-		ext := getUrlExtension(sURL)
-		hash := sha256.Sum256([]byte(sURL))
-		fileList = append(fileList, hex.EncodeToString(hash[:])+ext)
+		entry := manifestEntry{
+			File:      segmentFilename(sURL),
+			URL:       sURL,
+			Kind:      kinds[sURL],
+			Encrypted: encrypted[sURL],
+		}
+		if info, err := os.Stat(filepath.Join(epDir, entry.File)); err == nil {
+			entry.Size = info.Size()
+		}
+		manifest = append(manifest, entry)
 	}
+	fileList := manifestFiles(manifest)
 
 	if rawContent != "" {
 		localPlaylistPath := filepath.Join(epDir, "index.m3u8")
@@ -288,57 +504,50 @@ func (a *AnimeService) DownloadEpisode(animeName, animeURL, animeSource, epNumSt
 	mp4Path := filepath.Join(epDir, "episode.mp4")
 
 	if rawContent != "" {
-		// Local index avoids network requests in FFmpeg during remux
-		content := a.generateLocalM3U8(fileList)
+		// Local index for the FFmpeg fallback, avoids network requests
+		content := localPlaylist(rawContent, streamURL)
 		localM3U8Path := filepath.Join(epDir, "local_index.m3u8")
-		os.WriteFile(localM3U8Path, []byte(content), 0644)
-
-		cmd := exec.CommandContext(ctx, "ffmpeg", "-i", localM3U8Path, "-c", "copy", "-y", mp4Path)
-		if err := cmd.Run(); err == nil {
+		if err := os.WriteFile(localM3U8Path, []byte(content), 0644); err != nil {
+			fmt.Printf("[%s] Could not write local playlist, keeping HLS segments for playback: %v\n", key, err)
+		} else if err := remuxEpisode(ctx, epDir, segments, mp4Path, "-allowed_extensions", "ALL", "-i", localM3U8Path); err == nil {
 			fmt.Printf("[%s] Successfully remuxed HLS to MP4: %s\n", key, mp4Path)
 			a.CleanupHLSFiles(epDir, fileList)
+		} else {
+			fmt.Printf("[%s] Remux failed, keeping HLS segments for playback: %v\n", key, err)
 		}
 	} else if totalSegments == 1 {
 		ext := getUrlExtension(segmentURLs[0])
 		if strings.ToLower(ext) == ".ts" {
-			hash := sha256.Sum256([]byte(segmentURLs[0]))
-			filename := hex.EncodeToString(hash[:]) + ext
-			tsPath := filepath.Join(epDir, filename)
+			tsPath := filepath.Join(epDir, segmentFilename(segmentURLs[0]))
 
-			cmd := exec.CommandContext(ctx, "ffmpeg", "-i", tsPath, "-c", "copy", "-y", mp4Path)
-			if err := cmd.Run(); err == nil {
+			if err := remuxEpisode(ctx, epDir, []hlsSegment{{URL: segmentURLs[0]}}, mp4Path, "-i", tsPath); err == nil {
 				fmt.Printf("[%s] Successfully remuxed TS to MP4: %s\n", key, mp4Path)
 				os.Remove(tsPath)
+			} else {
+				fmt.Printf("[%s] Remux failed, keeping TS file: %v\n", key, err)
 			}
 		}
 	}
 
-	select {
-	case err := <-errChan:
-		fmt.Printf("[%s] Download failed with error: %v\n", key, err)
-		return err
-	default:
+	if ctx.Err() != nil {
+		return fail(ctx.Err())
 	}
 
-	// Store manifest for deletion later
+	// Store manifest for deletion and verification later
 	fmt.Printf("[%s] Saving manifest...\n", key)
-	manifestPath := filepath.Join(epDir, "manifest.json")
-	mBytes, _ := json.Marshal(fileList)
-	os.WriteFile(manifestPath, mBytes, 0644)
+	mBytes, _ := json.Marshal(manifest)
+	os.WriteFile(filepath.Join(epDir, "manifest.json"), mBytes, 0644)
 
 	// Store stream metadata for offline playback
 	fmt.Printf("[%s] Saving stream metadata...\n", key)
-	metadataPath := filepath.Join(epDir, "stream_metadata.json")
-	meta := struct {
-		URL     string            `json:"url"`
-		Headers map[string]string `json:"headers"`
-	}{
+	meta := streamMetadata{
 		URL:     streamURL, // This is the media-level URL (after following variants)
 		Headers: headers,
 	}
 	metaBytes, _ := json.Marshal(meta)
-	os.WriteFile(metadataPath, metaBytes, 0644)
+	os.WriteFile(filepath.Join(epDir, "stream_metadata.json"), metaBytes, 0644)
 
+	a.emitDownloadProgress(key, animeName, epNumStr, 100, downloadStateCompleted)
 	return nil
 }
 
@@ -358,21 +567,39 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// downloadSegmentWithContext fetches target into dest. Data is written to
+// dest+".part" first; if a partial file is left over from a paused download it
+// is continued with a Range request and only renamed to dest once complete.
+// Failed requests and error statuses are retried by the shared transport;
+// only a body cut off midway is continued here, from the partial file.
 func (a *AnimeService) downloadSegmentWithContext(ctx context.Context, target string, headers map[string]string, dest string, onProgress func(int64, int64)) error {
 	if info, err := os.Stat(dest); err == nil && info.Size() > 0 {
 		return nil
 	}
 
+	partPath := dest + ".part"
 	maxRetries := 3
 	var lastErr error
 
 	for i := 0; i < maxRetries; i++ {
 		if i > 0 {
 			fmt.Printf("[%d/%d] Retrying segment download: %s\n", i+1, maxRetries, target)
-			time.Sleep(time.Duration(i) * time.Second)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(i) * time.Second):
+			}
 		}
 
+		// resume is set when the body broke off, so the next attempt
+		// continues the partial file
+		resume := false
 		err := func() error {
+			var offset int64
+			if info, err := os.Stat(partPath); err == nil {
+				offset = info.Size()
+			}
+
 			req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
 			if err != nil {
 				return err
@@ -383,6 +610,9 @@ func (a *AnimeService) downloadSegmentWithContext(ctx context.Context, target st
 			if req.Header.Get("User-Agent") == "" {
 				req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
 			}
+			if offset > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			}
 
 			resp, err := downloadClient.Do(req)
 			if err != nil {
@@ -390,29 +620,58 @@ func (a *AnimeService) downloadSegmentWithContext(ctx context.Context, target st
 			}
 			defer resp.Body.Close()
 
-			if resp.StatusCode != http.StatusOK {
+			flags := os.O_CREATE | os.O_WRONLY
+			total := resp.ContentLength
+			switch {
+			case resp.StatusCode == http.StatusPartialContent && offset > 0:
+				flags |= os.O_APPEND
+				if total >= 0 {
+					total += offset
+				}
+			case resp.StatusCode == http.StatusOK:
+				// Server ignored the Range header, start over
+				flags |= os.O_TRUNC
+				offset = 0
+			case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+				os.Remove(partPath)
+				resume = true
+				return fmt.Errorf("partial segment no longer matches upstream, restarting")
+			default:
 				return fmt.Errorf("bad status: %s", resp.Status)
 			}
 
-			out, err := os.Create(dest)
+			out, err := os.OpenFile(partPath, flags, 0644)
 			if err != nil {
 				return err
 			}
-			defer out.Close()
 
 			reader := &progressReader{
 				Reader:     resp.Body,
-				Total:      resp.ContentLength,
+				Total:      total,
+				Downloaded: offset,
 				OnProgress: onProgress,
 			}
 
 			_, err = io.Copy(out, reader)
-			return err
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				resume = true
+				return err
+			}
+			return os.Rename(partPath, dest)
 		}()
 
 		if err == nil {
 			return nil
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !resume {
+			return err
+		}
 		lastErr = err
 		fmt.Printf("Error downloading segment %s (attempt %d): %v\n", target, i+1, err)
 	}
@@ -440,13 +699,115 @@ func (a *AnimeService) downloadSegment(target string, headers map[string]string,
 	io.Copy(out, resp.Body)
 }
 
-func (a *AnimeService) generateLocalM3U8(filenames []string) string {
-	content := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n"
-	for _, f := range filenames {
-		content += fmt.Sprintf("#EXTINF:10.0,\n%s\n", f)
+// vodPlaylist parses a downloaded media playlist and finalizes it for
+// offline playback. Durations, discontinuities, byte ranges, maps and keys
+// are kept as they are.
+func vodPlaylist(content, baseURL string) *hlsPlaylist {
+	p := parsePlaylist(content)
+	if !p.IsMaster() {
+		segments, _ := p.Segments(baseURL)
+		p.finalize(segments)
+	}
+	return p
+}
+
+// localPlaylist maps every URI of a downloaded media playlist, including
+// EXT-X-MAP init segments and EXT-X-KEY keys, to its local file name.
+func localPlaylist(content, baseURL string) string {
+	return vodPlaylist(content, baseURL).Rewrite(baseURL, func(absURL, kind string) string {
+		return segmentFilename(absURL)
+	}) + "\n"
+}
+
+// checkSegmentKeys makes sure every downloaded key decrypts the first segment
+// that uses it. Sources tend to answer expired key requests with an error
+// page, which would otherwise only show up as an unplayable MP4. A key that
+// fails the check is removed so the next attempt fetches it again.
+func checkSegmentKeys(epDir string, segments []hlsSegment) error {
+	checked := make(map[string]bool)
+	for _, seg := range segments {
+		if seg.Key == nil || checked[seg.Key.URL] {
+			continue
+		}
+		checked[seg.Key.URL] = true
+
+		keyPath := filepath.Join(epDir, segmentFilename(seg.Key.URL))
+		key, err := os.ReadFile(keyPath)
+		if err != nil {
+			return fmt.Errorf("reading key: %w", err)
+		}
+		data, err := os.ReadFile(filepath.Join(epDir, segmentFilename(seg.URL)))
+		if err != nil {
+			return fmt.Errorf("reading segment: %w", err)
+		}
+		// Each sub-range of a byte-range playlist is encrypted on its own
+		if data, err = seg.ByteRange.Slice(data); err != nil {
+			return err
+		}
+		if _, err := decryptAES128(data, key, seg.IV()); err != nil {
+			os.Remove(keyPath)
+			return fmt.Errorf("key %s does not decrypt segment %d: %w", seg.Key.URL, seg.Sequence, err)
+		}
+	}
+	return nil
+}
+
+// manifestEntry is one downloaded file of an episode, as recorded in
+// manifest.json.
+type manifestEntry struct {
+	File      string `json:"file"`
+	URL       string `json:"url"`
+	Kind      string `json:"kind"`
+	Size      int64  `json:"size"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// streamMetadata is stream_metadata.json, written once a download completes.
+type streamMetadata struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+func loadStreamMetadata(epDir string) (*streamMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(epDir, "stream_metadata.json"))
+	if err != nil {
+		return nil, err
+	}
+	var meta streamMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// readManifest loads manifest.json. Older downloads stored a plain list of
+// file names, those come back as entries with only File set.
+func readManifest(epDir string) ([]manifestEntry, error) {
+	data, err := os.ReadFile(filepath.Join(epDir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err == nil {
+		return entries, nil
+	}
+	var files []string
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		entries = append(entries, manifestEntry{File: f})
+	}
+	return entries, nil
+}
+
+func manifestFiles(entries []manifestEntry) []string {
+	files := make([]string, len(entries))
+	for i, e := range entries {
+		files[i] = e.File
 	}
-	content += "#EXT-X-ENDLIST\n"
-	return content
+	return files
 }
 
 func (a *AnimeService) CleanupHLSFiles(epDir string, fileList []string) {
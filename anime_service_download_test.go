@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const fixtureReferer = "https://fixture.example/"
+
+// encryptedFixture is a small AES-128 encrypted media playlist: two segments
+// with a sequence-derived IV, one with an explicit IV and a second key, and a
+// trailing clear segment after METHOD=NONE.
+type encryptedFixture struct {
+	plain  map[string][]byte
+	served map[string][]byte
+	keyHit int32
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+// Hits returns how often path was served.
+func (f *encryptedFixture) Hits(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits[path]
+}
+
+func newEncryptedFixture(t *testing.T, badKey bool) (*encryptedFixture, *httptest.Server) {
+	t.Helper()
+
+	key1 := bytes.Repeat([]byte{0x11}, 16)
+	key2 := bytes.Repeat([]byte{0x22}, 16)
+	explicitIV, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+
+	f := &encryptedFixture{plain: make(map[string][]byte), served: make(map[string][]byte), hits: make(map[string]int)}
+	for i, name := range []string{"seg0.ts", "seg1.ts", "seg2.ts", "seg3.ts"} {
+		// Fake TS packets, the sync byte is all the check needs
+		data := bytes.Repeat([]byte{0x47, byte(i), 0xAA, 0x55}, 47*3)
+		f.plain[name] = data
+	}
+
+	f.served["/media/seg0.ts"] = encryptAES128(t, f.plain["seg0.ts"], key1, sequenceIV(7))
+	f.served["/media/seg1.ts"] = encryptAES128(t, f.plain["seg1.ts"], key1, sequenceIV(8))
+	f.served["/media/seg2.ts"] = encryptAES128(t, f.plain["seg2.ts"], key2, explicitIV)
+	f.served["/media/seg3.ts"] = f.plain["seg3.ts"]
+	f.served["/media/keys/k1.key"] = key1
+	f.served["/keys/k2.key"] = key2
+	if badKey {
+		f.served["/keys/k2.key"] = bytes.Repeat([]byte{0x33}, 16)
+	}
+	f.served["/media/index.m3u8"] = []byte(strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:7",
+		`#EXT-X-KEY:METHOD=AES-128,URI="keys/k1.key"`,
+		"#EXTINF:4.0,",
+		"seg0.ts",
+		"#EXTINF:4.0,",
+		"seg1.ts",
+		`#EXT-X-KEY:METHOD=AES-128,URI="/keys/k2.key",IV=0x000102030405060708090a0b0c0d0e0f`,
+		"#EXTINF:4.0,",
+		"seg2.ts",
+		"#EXT-X-KEY:METHOD=NONE",
+		"#EXTINF:2.0,",
+		"seg3.ts",
+		"#EXT-X-ENDLIST",
+	}, "\n"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keys and segments are only served with the stored headers
+		if r.Header.Get("Referer") != fixtureReferer {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		data, ok := f.served[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.mu.Lock()
+		f.hits[r.URL.Path]++
+		f.mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, ".key") {
+			atomic.AddInt32(&f.keyHit, 1)
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func sequenceIV(seq int64) []byte {
+	s := hlsSegment{Sequence: seq}
+	return s.IV()
+}
+
+func encryptAES128(t *testing.T, data, key, iv []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, padded)
+	return out
+}
+
+// newTestService returns a service rooted in a temp dir whose episode
+// "Fixture:1" resolves to streamURL through stored stream metadata.
+func newTestService(t *testing.T, streamURL string) *AnimeService {
+	t.Helper()
+	// Keep the FFmpeg fallback out of the test. Fixture segments are not
+	// real MPEG-TS, so the built-in remux fails and they stay on disk.
+	t.Setenv("PATH", "")
+
+	dir := t.TempDir()
+	a := &AnimeService{
+		ctx:             context.Background(),
+		proxyCache:      make(map[string]*StreamInfo),
+		cacheDir:        filepath.Join(dir, "cache"),
+		segments:        newSegmentCache(filepath.Join(dir, "cache"), 0),
+		downloadsDir:    filepath.Join(dir, "downloads"),
+		cancelFuncs:     make(map[string]context.CancelCauseFunc),
+		pausedDownloads: make(map[string]*DownloadJob),
+		queue:           newDownloadQueue(filepath.Join(dir, "download_queue.json")),
+		activeBatches:   make(map[string]*batchTracker),
+		settings:        defaultSettings(),
+		settingsPath:    filepath.Join(dir, "settings.json"),
+		metadata:        newMemoryMetadataStore(),
+	}
+
+	epDir := a.getEpisodeDir("Fixture", "1")
+	if err := os.MkdirAll(epDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := json.Marshal(map[string]interface{}{
+		"url":     streamURL,
+		"headers": map[string]string{"Referer": fixtureReferer},
+	})
+	if err := os.WriteFile(filepath.Join(epDir, "stream_metadata.json"), meta, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestDownloadEncryptedHLS(t *testing.T) {
+	f, srv := newEncryptedFixture(t, false)
+	a := newTestService(t, srv.URL+"/media/index.m3u8")
+
+	if err := a.downloadEpisode(DownloadJob{AnimeName: "Fixture", EpNumStr: "1", EpNum: 1}); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if hits := atomic.LoadInt32(&f.keyHit); hits != 2 {
+		t.Errorf("expected each key to be fetched once, got %d fetches", hits)
+	}
+
+	epDir := a.getEpisodeDir("Fixture", "1")
+	local, err := os.ReadFile(filepath.Join(epDir, "local_index.m3u8"))
+	if err != nil {
+		t.Fatalf("local playlist missing: %v", err)
+	}
+	if strings.Contains(string(local), srv.URL) {
+		t.Errorf("local playlist still references the server:\n%s", local)
+	}
+
+	// Resolve the local playlist's URIs against a dummy base and decrypt
+	// every segment with its local key copy
+	segments, err := parsePlaylist(string(local)).Segments("http://local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 4 {
+		t.Fatalf("expected 4 segments, got %d", len(segments))
+	}
+
+	localFile := func(rawURL string) []byte {
+		u, _ := url.Parse(rawURL)
+		data, err := os.ReadFile(filepath.Join(epDir, path.Base(u.Path)))
+		if err != nil {
+			t.Fatalf("reading %s: %v", rawURL, err)
+		}
+		return data
+	}
+
+	for i, seg := range segments {
+		want := f.plain[[]string{"seg0.ts", "seg1.ts", "seg2.ts", "seg3.ts"}[i]]
+		data := localFile(seg.URL)
+		if seg.Key != nil {
+			data, err = decryptAES128(data, localFile(seg.Key.URL), seg.IV())
+			if err != nil {
+				t.Fatalf("segment %d: %v", i, err)
+			}
+		} else if i != 3 {
+			t.Fatalf("segment %d lost its key", i)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("segment %d does not match the plaintext", i)
+		}
+	}
+}
+
+func TestDownloadEncryptedHLSWrongKey(t *testing.T) {
+	_, srv := newEncryptedFixture(t, true)
+	a := newTestService(t, srv.URL+"/media/index.m3u8")
+
+	err := a.downloadEpisode(DownloadJob{AnimeName: "Fixture", EpNumStr: "1", EpNum: 1})
+	if err == nil {
+		t.Fatal("expected the download to fail with a key that does not decrypt")
+	}
+	if !strings.Contains(err.Error(), "does not decrypt") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	keyPath := filepath.Join(a.getEpisodeDir("Fixture", "1"), segmentFilename(srv.URL+"/keys/k2.key"))
+	if _, statErr := os.Stat(keyPath); !os.IsNotExist(statErr) {
+		t.Errorf("bad key should be removed so a retry refetches it")
+	}
+}
+
+func TestPauseAndResumeContinuesPartialSegment(t *testing.T) {
+	body := bytes.Repeat([]byte{0x47, 0x40, 0x11, 0x10}, 16<<10)
+	half := len(body) / 2
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		first := hits[r.URL.Path] == 1
+		if r.URL.Path == "/slow.ts" {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/index.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nfast0.ts\n#EXTINF:4,\nfast1.ts\n#EXTINF:4,\nslow.ts\n#EXT-X-ENDLIST\n"))
+		case "/slow.ts":
+			if !first {
+				http.ServeContent(w, r, "slow.ts", time.Time{}, bytes.NewReader(body))
+				return
+			}
+			// Half the segment, then nothing until the download is paused
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write(body[:half])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.Write(body[:1024])
+		}
+	}))
+	defer srv.Close()
+	fetched := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+
+	a := newTestService(t, srv.URL+"/index.m3u8")
+	epDir := a.getEpisodeDir("Fixture", "1")
+	slowPath := filepath.Join(epDir, segmentFilename(srv.URL+"/slow.ts"))
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	status := func() string {
+		if queue := a.GetQueue(); len(queue) == 1 {
+			return queue[0].Status
+		}
+		return ""
+	}
+
+	if _, err := a.EnqueueDownloads([]DownloadJob{{AnimeName: "Fixture", EpNumStr: "1", EpNum: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("half of the slow segment", func() bool {
+		info, err := os.Stat(slowPath + ".part")
+		return err == nil && info.Size() == int64(half)
+	})
+	if err := a.PauseDownload("Fixture", "1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the job to pause", func() bool { return status() == queueStatusPaused })
+	if _, err := os.Stat(slowPath + ".part"); err != nil {
+		t.Fatalf("partial segment gone after the pause: %v", err)
+	}
+
+	if err := a.ResumeDownload("Fixture", "1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the download to finish", func() bool { return len(a.GetQueue()) == 0 })
+
+	data, err := os.ReadFile(slowPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Errorf("resumed segment is %d bytes and differs from the %d served", len(data), len(body))
+	}
+	mu.Lock()
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", half) {
+		t.Errorf("slow segment requested with ranges %q, want the second from byte %d", ranges, half)
+	}
+	mu.Unlock()
+	for _, p := range []string{"/fast0.ts", "/fast1.ts"} {
+		if n := fetched(p); n != 1 {
+			t.Errorf("%s fetched %d times, want once", p, n)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+// streamResolver finds and resolves episodes on a given source, see
+// goanime.Client.
+type streamResolver interface {
+	SearchAnimeContext(ctx context.Context, query string, source *types.Source) ([]*types.Anime, error)
+	GetAnimeEpisodesContext(ctx context.Context, animeURL string, source types.Source) ([]*types.Episode, error)
+	ResolveStream(ctx context.Context, req *types.StreamRequest) (*types.StreamResult, error)
+}
+
+// failoverSources are the sources an episode is looked up on, in order, when
+// the one the anime was opened on cannot play it
+var failoverSources = []types.Source{types.SourceAllAnime, types.SourceAnimeFire}
+
+// streamTarget is an episode to resolve, as the UI opened it
+type streamTarget struct {
+	AnimeName string
+	AnimeURL  string
+	Source    string
+	EpNumStr  string
+	EpURL     string
+	EpNum     float64
+	IsDub     bool
+	Quality   string
+}
+
+// resolvedStream is a resolved stream and where it came from
+type resolvedStream struct {
+	URL          string
+	Headers      map[string]string
+	Source       string
+	Provider     string
+	Alternatives []types.StreamCandidate
+	// FailedOver is set when the stream is not from the target's source
+	FailedOver bool
+}
+
+// sourceMapping is the entry of a series on another source, remembered once
+// an episode played from there so later episodes go there directly
+type sourceMapping struct {
+	Source string `json:"source"`
+	URL    string `json:"url"`
+	Name   string `json:"name,omitempty"`
+}
+
+// seriesKey identifies an anime on a source, in one language
+func seriesKey(source, animeURL string, isDub bool) string {
+	key := source + "|" + strings.TrimSuffix(animeURL, ":dub")
+	if isDub {
+		key += "|dub"
+	}
+	return key
+}
+
+// streamFailoverEvent is emitted as "stream:failover" when the proxy
+// switches a playing stream. Reason is "mirror" or "source".
+type streamFailoverEvent struct {
+	ID       string `json:"id"`
+	Source   string `json:"source"`
+	Provider string `json:"provider,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// streamFailover is what the proxy needs to switch a stream the CDN refuses:
+// the other mirrors' links, then the episode to look up on other sources.
+type streamFailover struct {
+	mu           sync.Mutex
+	target       streamTarget
+	alternatives []types.StreamCandidate
+	triedSources bool
+}
+
+// resolveStream resolves target on the source its series was mapped to, if
+// any, then on its own source. When both fail the episode is looked up on
+// the other sources, and the first that plays it is remembered for the
+// series.
+func (a *AnimeService) resolveStream(ctx context.Context, t streamTarget) (*resolvedStream, error) {
+	key := seriesKey(t.Source, t.AnimeURL, t.IsDub)
+	if m, _, ok := a.metadata.sources.Get(key); ok {
+		res, err := a.resolveOnMapping(ctx, t, m)
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		fmt.Printf("[Failover] Remembered %s entry for %s failed: %v\n", m.Source, t.AnimeName, err)
+	}
+
+	res, err := a.resolveOn(ctx, t)
+	if err == nil {
+		return res, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	fmt.Printf("[Failover] %s could not resolve %s episode %s: %v\n", t.Source, t.AnimeName, t.EpNumStr, err)
+
+	res, altErr := a.resolveOnAlternate(ctx, t)
+	if altErr != nil {
+		return nil, fmt.Errorf("%w (failover: %v)", err, altErr)
+	}
+	return res, nil
+}
+
+// resolveOn resolves target on its own source
+func (a *AnimeService) resolveOn(ctx context.Context, t streamTarget) (*resolvedStream, error) {
+	req := &types.StreamRequest{
+		Anime:   &types.Anime{Name: t.AnimeName, URL: t.AnimeURL, Source: t.Source},
+		Episode: &types.Episode{Number: t.EpNumStr, Num: int(t.EpNum), URL: t.EpURL},
+		Quality: libraryQuality(t.Quality),
+		Mode:    "sub",
+	}
+	if t.IsDub {
+		req.Mode = "dub"
+	}
+	stream, err := a.resolver.ResolveStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if stream.URL == "" {
+		return nil, fmt.Errorf("failed to resolve stream URL")
+	}
+	fmt.Printf("[%s] Resolved %s stream from %s (%s)\n", t.AnimeName, stream.Type, stream.Provider, stream.Resolution)
+	return &resolvedStream{
+		URL:          stream.URL,
+		Headers:      stream.Headers,
+		Source:       stream.Source.String(),
+		Provider:     stream.Provider,
+		Alternatives: stream.Alternatives,
+	}, nil
+}
+
+// resolveOnAlternate looks the episode up on every source but the target's
+// and resolves it on the first that has it. That source is remembered for
+// the series.
+func (a *AnimeService) resolveOnAlternate(ctx context.Context, t streamTarget) (*resolvedStream, error) {
+	var errs []error
+	for _, src := range failoverSources {
+		if src.String() == t.Source {
+			continue
+		}
+		m, err := a.findOnSource(ctx, t, src)
+		if err == nil {
+			var res *resolvedStream
+			if res, err = a.resolveOnMapping(ctx, t, *m); err == nil {
+				fmt.Printf("[Failover] Playing %s episode %s from %s (%s)\n", t.AnimeName, t.EpNumStr, m.Source, m.URL)
+				a.metadata.sources.Put(seriesKey(t.Source, t.AnimeURL, t.IsDub), *m)
+				return res, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", src, err))
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no other source to try")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// resolveOnMapping resolves the target's episode on the series' entry on
+// another source
+func (a *AnimeService) resolveOnMapping(ctx context.Context, t streamTarget, m sourceMapping) (*resolvedStream, error) {
+	src, err := types.ParseSource(m.Source)
+	if err != nil {
+		return nil, err
+	}
+	listURL := m.URL
+	if t.IsDub && src == types.SourceAllAnime && !strings.HasSuffix(listURL, ":dub") {
+		listURL += ":dub"
+	}
+	eps, err := a.resolver.GetAnimeEpisodesContext(ctx, listURL, src)
+	if err != nil {
+		return nil, err
+	}
+	ep := matchEpisode(eps, t.EpNumStr, t.EpNum)
+	if ep == nil {
+		return nil, fmt.Errorf("episode %s not found on %s", t.EpNumStr, m.Source)
+	}
+
+	alt := t
+	alt.AnimeName = m.Name
+	alt.AnimeURL = m.URL
+	alt.Source = src.String()
+	alt.EpNumStr = ep.Number
+	alt.EpURL = ep.URL
+	res, err := a.resolveOn(ctx, alt)
+	if err != nil {
+		return nil, err
+	}
+	res.FailedOver = true
+	return res, nil
+}
+
+// findOnSource searches a source for the target's series. Only a result
+// with the same title, or the same MAL ID per the metadata store, is taken:
+// playing the wrong show is worse than failing.
+func (a *AnimeService) findOnSource(ctx context.Context, t streamTarget, src types.Source) (*sourceMapping, error) {
+	queries := []string{t.AnimeName}
+	wantMal := 0
+	if d, _ := a.storedDetails(t.AnimeName); d != nil {
+		wantMal = d.MalID
+		if d.Title != "" && !strings.EqualFold(d.Title, t.AnimeName) {
+			queries = append(queries, d.Title)
+		}
+	}
+	want := clusterTitle(t.AnimeName)
+
+	var lastErr error
+	for _, q := range queries {
+		found, err := a.resolver.SearchAnimeContext(ctx, q, &src)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, r := range mapAnimeList(found, src.String()) {
+			entry := r.Sources[0]
+			if (t.IsDub && !entry.HasDub) || (!t.IsDub && !entry.HasSub) {
+				continue
+			}
+			if clusterTitle(r.Name) != want && !a.sameMalID(wantMal, r.Name) {
+				continue
+			}
+			url := entry.URL
+			if t.IsDub && entry.DubURL != "" {
+				url = entry.DubURL
+			}
+			return &sourceMapping{Source: src.String(), URL: url, Name: r.Name}, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("%s not found", t.AnimeName)
+}
+
+// sameMalID tells whether the metadata store has title under malID
+func (a *AnimeService) sameMalID(malID int, title string) bool {
+	if malID == 0 {
+		return false
+	}
+	d, _ := a.storedDetails(title)
+	return d != nil && d.MalID == malID
+}
+
+// matchEpisode finds an episode by its number as listed, then by value so
+// "01" matches "1"
+func matchEpisode(eps []*types.Episode, epNumStr string, epNum float64) *types.Episode {
+	for _, ep := range eps {
+		if ep.Number == epNumStr {
+			return ep
+		}
+	}
+	for _, ep := range eps {
+		if n, err := strconv.ParseFloat(ep.Number, 64); err == nil && n == epNum {
+			return ep
+		}
+	}
+	return nil
+}
+
+// failoverStream switches the proxied stream id away from failedURL, which
+// the CDN refused: to the next mirror's link, then to another source. It
+// returns the stream to use, or false when nothing is left to try.
+func (a *AnimeService) failoverStream(ctx context.Context, id, failedURL string) (*StreamInfo, bool) {
+	a.proxyMutex.RLock()
+	info := a.proxyCache[id]
+	a.proxyMutex.RUnlock()
+	if info == nil || info.failover == nil {
+		return nil, false
+	}
+
+	f := info.failover
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Another request may have switched the stream while this one waited
+	a.proxyMutex.RLock()
+	cur := a.proxyCache[id]
+	a.proxyMutex.RUnlock()
+	if cur.URL != failedURL {
+		return cur, true
+	}
+
+	next := *cur
+	next.FailedOver = true
+	reason := "mirror"
+	if len(f.alternatives) > 0 {
+		alt := f.alternatives[0]
+		f.alternatives = f.alternatives[1:]
+		next.URL = alt.URL
+		next.Provider = alt.Provider
+		if len(alt.Headers) > 0 {
+			next.Headers = alt.Headers
+		}
+		fmt.Printf("[Failover] %s refused, trying mirror %s\n", failedURL, alt.Provider)
+	} else if !f.triedSources {
+		f.triedSources = true
+		ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+		defer cancel()
+		res, err := a.resolveOnAlternate(ctx, f.target)
+		if err != nil {
+			fmt.Printf("[Failover] No other source for %s: %v\n", f.target.AnimeName, err)
+			return nil, false
+		}
+		next.URL = res.URL
+		next.Headers = res.Headers
+		next.Source = res.Source
+		next.Provider = res.Provider
+		f.alternatives = res.Alternatives
+		reason = "source"
+	} else {
+		return nil, false
+	}
+	next.IsHLS = strings.Contains(strings.ToLower(next.URL), ".m3u8")
+
+	a.proxyMutex.Lock()
+	a.proxyCache[id] = &next
+	a.proxyMutex.Unlock()
+	a.allowUpstream(id, next.URL)
+
+	a.LogProxyEvent(fmt.Sprintf("Stream %s switched to %s %s", id, next.Source, next.Provider))
+	a.emit("stream:failover", streamFailoverEvent{ID: id, Source: next.Source, Provider: next.Provider, Reason: reason})
+	return &next, true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+// fakeResolver has Frieren on AnimeFire only: resolving on AllAnime fails.
+type fakeResolver struct {
+	mu       sync.Mutex
+	resolved []string
+	listed   int
+}
+
+func (f *fakeResolver) SearchAnimeContext(ctx context.Context, query string, source *types.Source) ([]*types.Anime, error) {
+	if *source != types.SourceAnimeFire {
+		return nil, nil
+	}
+	return []*types.Anime{
+		{Name: "[AnimeFire] Sousou no Frieren 2nd Season", URL: "af-frieren-2"},
+		{Name: "[AnimeFire] Sousou no Frieren", URL: "af-frieren"},
+	}, nil
+}
+
+func (f *fakeResolver) GetAnimeEpisodesContext(ctx context.Context, animeURL string, source types.Source) ([]*types.Episode, error) {
+	f.mu.Lock()
+	f.listed++
+	f.mu.Unlock()
+	if animeURL != "af-frieren" {
+		return nil, errors.New("unknown anime")
+	}
+	return []*types.Episode{
+		{Number: "01", Num: 1, URL: "af-frieren/1"},
+		{Number: "02", Num: 2, URL: "af-frieren/2"},
+	}, nil
+}
+
+func (f *fakeResolver) ResolveStream(ctx context.Context, req *types.StreamRequest) (*types.StreamResult, error) {
+	f.mu.Lock()
+	f.resolved = append(f.resolved, req.Anime.Source+" "+req.Episode.URL)
+	f.mu.Unlock()
+	if req.Anime.Source != "AnimeFire" {
+		return nil, errors.New("all mirrors failed")
+	}
+	return &types.StreamResult{URL: "https://cdn.example/" + req.Episode.URL + ".mp4", Source: types.SourceAnimeFire, Provider: "lightspeed"}, nil
+}
+
+func TestResolveStreamFailsOverToOtherSource(t *testing.T) {
+	f := &fakeResolver{}
+	a := &AnimeService{metadata: newMemoryMetadataStore(), resolver: f, downloadsDir: t.TempDir()}
+
+	target := streamTarget{AnimeName: "Sousou no Frieren", AnimeURL: "aa-frieren", Source: "AllAnime", EpNumStr: "2", EpNum: 2, Quality: qualityBest}
+	res, err := a.resolveStream(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Source != "AnimeFire" || !res.FailedOver || res.URL != "https://cdn.example/af-frieren/2.mp4" {
+		t.Errorf("stream = %+v, want episode 2 from AnimeFire", res)
+	}
+
+	// The series is mapped now: the next episode goes to AnimeFire directly
+	f.resolved = nil
+	target.EpNumStr, target.EpNum = "3", 3
+	if _, err := a.resolveStream(context.Background(), target); err == nil {
+		t.Error("expected an error for an episode no source has")
+	}
+	target.EpNumStr, target.EpNum = "1", 1
+	res, err = a.resolveStream(context.Background(), target)
+	if err != nil || res.Source != "AnimeFire" {
+		t.Fatalf("mapped stream = %+v, %v", res, err)
+	}
+	if last := f.resolved[len(f.resolved)-1]; last != "AnimeFire af-frieren/1" {
+		t.Errorf("resolved %v", f.resolved)
+	}
+
+	// A dub is looked up separately
+	target.IsDub = true
+	if _, err := a.resolveStream(context.Background(), target); err == nil {
+		t.Error("expected an error: AnimeFire lists no dub")
+	}
+}
+
+func TestProxyFailsOverToMirror(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Referer") != "https://mirror.example/" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "video")
+	}))
+	defer upstream.Close()
+
+	// The test server is on loopback, which the default upstream client
+	// refuses
+	cacheDir := t.TempDir()
+	a := &AnimeService{
+		metadata:       newMemoryMetadataStore(),
+		proxyCache:     make(map[string]*StreamInfo),
+		cacheDir:       cacheDir,
+		segments:       newSegmentCache(cacheDir, 0),
+		downloadsDir:   t.TempDir(),
+		upstreamClient: upstream.Client(),
+	}
+	a.proxyCache["1"] = &StreamInfo{
+		URL:        upstream.URL + "/expired",
+		AnimeName:  "Frieren",
+		EpisodeNum: "1",
+		Source:     "AllAnime",
+		failover: &streamFailover{alternatives: []types.StreamCandidate{
+			{URL: upstream.URL + "/mirror", Provider: "mirror", Headers: map[string]string{"Referer": "https://mirror.example/"}},
+		}},
+	}
+
+	rec := httptest.NewRecorder()
+	a.proxyHandler(rec, httptest.NewRequest("GET", a.proxyURL("1", ""), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "video" {
+		t.Fatalf("proxy answered %d %q", rec.Code, rec.Body.String())
+	}
+	if info := a.proxyCache["1"]; info.Provider != "mirror" || !info.FailedOver {
+		t.Errorf("stream not switched: %+v", info)
+	}
+
+	// No mirror left and no other source has the show: the refusal is
+	// passed on
+	a.resolver = &fakeResolver{}
+	a.proxyCache["1"].URL = upstream.URL + "/expired"
+	a.proxyCache["1"].failover.target = streamTarget{AnimeName: "Dungeon Meshi", AnimeURL: "aa-meshi", Source: "AllAnime", EpNumStr: "1", EpNum: 1}
+	rec = httptest.NewRecorder()
+	a.proxyHandler(rec, httptest.NewRequest("GET", a.proxyURL("1", ""), nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("proxy answered %d with nothing left to try", rec.Code)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Kinds of resources a playlist can reference.
+const (
+	hlsRefSegment   = "segment"
+	hlsRefVariant   = "variant"
+	hlsRefMap       = "map"
+	hlsRefKey       = "key"
+	hlsRefRendition = "rendition"
+	hlsRefOther     = "other"
+)
+
+// hlsURITags lists every tag that carries a URI="..." attribute and the kind
+// of resource it points at.
+var hlsURITags = map[string]string{
+	"#EXT-X-KEY":                hlsRefKey,
+	"#EXT-X-SESSION-KEY":        hlsRefKey,
+	"#EXT-X-MAP":                hlsRefMap,
+	"#EXT-X-MEDIA":              hlsRefRendition,
+	"#EXT-X-I-FRAME-STREAM-INF": hlsRefVariant,
+	"#EXT-X-SESSION-DATA":       hlsRefOther,
+	"#EXT-X-PART":               hlsRefSegment,
+	"#EXT-X-PRELOAD-HINT":       hlsRefSegment,
+	"#EXT-X-RENDITION-REPORT":   hlsRefOther,
+}
+
+type hlsAttribute struct {
+	Name   string
+	Value  string
+	Quoted bool
+}
+
+// parseAttributes splits an HLS attribute list (KEY=VALUE,KEY="VALUE") in
+// order. Quoted values may contain commas and are stored unquoted.
+func parseAttributes(s string) []hlsAttribute {
+	var attrs []hlsAttribute
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			break
+		}
+		attr := hlsAttribute{Name: strings.ToUpper(strings.TrimSpace(s[:eq]))}
+		s = s[eq+1:]
+
+		if strings.HasPrefix(s, "\"") {
+			attr.Quoted = true
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				attr.Value, s = s[1:], ""
+			} else {
+				attr.Value, s = s[1:end+1], s[end+2:]
+			}
+			if comma := strings.IndexByte(s, ','); comma != -1 {
+				s = s[comma+1:]
+			} else {
+				s = ""
+			}
+		} else if comma := strings.IndexByte(s, ','); comma != -1 {
+			attr.Value, s = strings.TrimSpace(s[:comma]), s[comma+1:]
+		} else {
+			attr.Value, s = strings.TrimSpace(s), ""
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+func formatAttributes(attrs []hlsAttribute) string {
+	parts := make([]string, len(attrs))
+	for i, attr := range attrs {
+		if attr.Quoted {
+			parts[i] = attr.Name + "=\"" + attr.Value + "\""
+		} else {
+			parts[i] = attr.Name + "=" + attr.Value
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseAttributeList is parseAttributes as a map, for lookups.
+func parseAttributeList(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range parseAttributes(s) {
+		attrs[attr.Name] = attr.Value
+	}
+	return attrs
+}
+
+// hlsLine is one line of a playlist. Tag lines keep the tag name and the text
+// after the colon; URI lines keep the URI and the kind of resource.
+type hlsLine struct {
+	Tag   string
+	Value string
+	URI   string
+	Kind  string
+	raw   string
+}
+
+// hlsPlaylist is a line-level model of a master or media playlist. It keeps
+// every line so that rewriting URIs reproduces everything else untouched.
+type hlsPlaylist struct {
+	Lines []hlsLine
+}
+
+// hlsReference is a URI found in a playlist, resolved against its base URL.
+type hlsReference struct {
+	URL  string
+	Kind string
+}
+
+func parsePlaylist(content string) *hlsPlaylist {
+	p := &hlsPlaylist{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lastTag := ""
+
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+
+		switch {
+		case line == "":
+			p.Lines = append(p.Lines, hlsLine{raw: raw})
+		case strings.HasPrefix(line, "#"):
+			tag, value, _ := strings.Cut(line, ":")
+			if strings.HasPrefix(tag, "#EXT") {
+				lastTag = tag
+			}
+			p.Lines = append(p.Lines, hlsLine{Tag: tag, Value: value, raw: raw})
+		default:
+			kind := hlsRefSegment
+			if lastTag == "#EXT-X-STREAM-INF" {
+				kind = hlsRefVariant
+			}
+			p.Lines = append(p.Lines, hlsLine{URI: line, Kind: kind, raw: raw})
+			lastTag = ""
+		}
+	}
+	return p
+}
+
+func (p *hlsPlaylist) IsMaster() bool {
+	for _, l := range p.Lines {
+		if l.Tag == "#EXT-X-STREAM-INF" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHLSURI resolves ref against base. Only http(s) URIs are returned,
+// so data: and skd:// style key URIs are left alone.
+func resolveHLSURI(base *url.URL, ref string) (string, bool) {
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	abs := base.ResolveReference(refURL)
+	if abs.Scheme != "http" && abs.Scheme != "https" {
+		return "", false
+	}
+	return abs.String(), true
+}
+
+// References returns every URI in the playlist, including those inside tag
+// attributes, resolved against baseURL and in playlist order.
+func (p *hlsPlaylist) References(baseURL string) []hlsReference {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil
+	}
+
+	var refs []hlsReference
+	for _, l := range p.Lines {
+		if l.URI != "" {
+			if abs, ok := resolveHLSURI(base, l.URI); ok {
+				refs = append(refs, hlsReference{URL: abs, Kind: l.Kind})
+			}
+			continue
+		}
+		kind, ok := hlsURITags[l.Tag]
+		if !ok {
+			continue
+		}
+		for _, attr := range parseAttributes(l.Value) {
+			if attr.Name != "URI" {
+				continue
+			}
+			if abs, ok := resolveHLSURI(base, attr.Value); ok {
+				refs = append(refs, hlsReference{URL: abs, Kind: kind})
+			}
+		}
+	}
+	return refs
+}
+
+// Rewrite returns the playlist with every URI replaced by fn(absoluteURL,
+// kind). URIs that cannot be resolved, or for which fn returns "", are kept.
+func (p *hlsPlaylist) Rewrite(baseURL string, fn func(absURL, kind string) string) string {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		base = &url.URL{}
+	}
+
+	replace := func(ref, kind string) string {
+		abs, ok := resolveHLSURI(base, ref)
+		if !ok {
+			return ref
+		}
+		if out := fn(abs, kind); out != "" {
+			return out
+		}
+		return ref
+	}
+
+	lines := make([]string, len(p.Lines))
+	for i, l := range p.Lines {
+		switch {
+		case l.URI != "":
+			lines[i] = replace(l.URI, l.Kind)
+		case hlsURITags[l.Tag] != "" && strings.Contains(l.Value, "URI="):
+			attrs := parseAttributes(l.Value)
+			for j := range attrs {
+				if attrs[j].Name == "URI" {
+					attrs[j].Value = replace(attrs[j].Value, hlsURITags[l.Tag])
+				}
+			}
+			lines[i] = l.Tag + ":" + formatAttributes(attrs)
+		default:
+			lines[i] = l.raw
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hlsKey is the EXT-X-KEY in effect for a media segment.
+type hlsKey struct {
+	Method string
+	URL    string
+	IV     []byte // nil when the IV is derived from the sequence number
+}
+
+// hlsByteRange is an EXT-X-BYTERANGE, or the BYTERANGE of an EXT-X-MAP, with
+// the implicit offset already filled in.
+type hlsByteRange struct {
+	Length int64
+	Offset int64
+}
+
+// hlsMap is the EXT-X-MAP init segment in effect for a media segment.
+type hlsMap struct {
+	URL       string
+	ByteRange *hlsByteRange
+}
+
+// hlsSegment is a media segment with everything that applies to it: its
+// duration, media sequence number, byte range, init segment and key.
+type hlsSegment struct {
+	URL           string
+	Duration      float64
+	Title         string
+	Sequence      int64
+	Discontinuity bool
+	ByteRange     *hlsByteRange
+	Map           *hlsMap
+	Key           *hlsKey
+}
+
+// IV returns the explicit IV of the segment's key, or the media sequence
+// number as a 128-bit big-endian integer as RFC 8216 prescribes.
+func (s *hlsSegment) IV() []byte {
+	if s.Key != nil && s.Key.IV != nil {
+		return s.Key.IV
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(s.Sequence))
+	return iv
+}
+
+// Segments returns the media segments of the playlist in order, resolved
+// against baseURL, with the key and sequence number that apply to each.
+func (p *hlsPlaylist) Segments(baseURL string) ([]hlsSegment, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []hlsSegment
+	var key *hlsKey
+	var initMap *hlsMap
+	var seq int64
+	var next hlsSegment
+	// End of the previous sub-range per URL, for byte ranges without offset
+	rangeEnd := make(map[string]int64)
+
+	for _, l := range p.Lines {
+		switch {
+		case l.Tag == "#EXT-X-MEDIA-SEQUENCE":
+			seq, _ = strconv.ParseInt(strings.TrimSpace(l.Value), 10, 64)
+		case l.Tag == "#EXT-X-KEY":
+			key, err = parseKey(base, l.Value)
+			if err != nil {
+				return nil, err
+			}
+		case l.Tag == "#EXT-X-MAP":
+			attrs := parseAttributeList(l.Value)
+			abs, ok := resolveHLSURI(base, attrs["URI"])
+			if !ok {
+				return nil, fmt.Errorf("unsupported map URI: %s", attrs["URI"])
+			}
+			initMap = &hlsMap{URL: abs}
+			if br := attrs["BYTERANGE"]; br != "" {
+				if initMap.ByteRange, err = parseByteRange(br, 0); err != nil {
+					return nil, err
+				}
+			}
+		case l.Tag == "#EXTINF":
+			duration, title, _ := strings.Cut(l.Value, ",")
+			next.Duration, _ = strconv.ParseFloat(strings.TrimSpace(duration), 64)
+			next.Title = title
+		case l.Tag == "#EXT-X-DISCONTINUITY":
+			next.Discontinuity = true
+		case l.Tag == "#EXT-X-BYTERANGE":
+			// The offset is filled in once the URI is known
+			if next.ByteRange, err = parseByteRange(l.Value, -1); err != nil {
+				return nil, err
+			}
+		case l.URI != "" && l.Kind == hlsRefSegment:
+			abs, ok := resolveHLSURI(base, l.URI)
+			if !ok {
+				return nil, fmt.Errorf("unsupported segment URI: %s", l.URI)
+			}
+			next.URL, next.Sequence, next.Key, next.Map = abs, seq, key, initMap
+			if br := next.ByteRange; br != nil {
+				if br.Offset < 0 {
+					br.Offset = rangeEnd[abs]
+				}
+				rangeEnd[abs] = br.Offset + br.Length
+			}
+			segments = append(segments, next)
+			next = hlsSegment{}
+			seq++
+		}
+	}
+	return segments, nil
+}
+
+// parseByteRange parses "<length>[@<offset>]". A missing offset is returned
+// as defaultOffset.
+func parseByteRange(s string, defaultOffset int64) (*hlsByteRange, error) {
+	length, offset, hasOffset := strings.Cut(strings.TrimSpace(s), "@")
+	br := &hlsByteRange{Offset: defaultOffset}
+	var err error
+	if br.Length, err = strconv.ParseInt(length, 10, 64); err != nil || br.Length < 0 {
+		return nil, fmt.Errorf("invalid byte range: %s", s)
+	}
+	if hasOffset {
+		if br.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil || br.Offset < 0 {
+			return nil, fmt.Errorf("invalid byte range: %s", s)
+		}
+	}
+	return br, nil
+}
+
+// Slice returns the part of a whole downloaded resource the range covers.
+func (br *hlsByteRange) Slice(data []byte) ([]byte, error) {
+	if br == nil {
+		return data, nil
+	}
+	if br.Offset+br.Length > int64(len(data)) {
+		return nil, fmt.Errorf("byte range %d@%d exceeds resource of %d bytes", br.Length, br.Offset, len(data))
+	}
+	return data[br.Offset : br.Offset+br.Length], nil
+}
+
+// TargetDuration returns the EXT-X-TARGETDURATION value, or 0 if missing.
+func (p *hlsPlaylist) TargetDuration() int {
+	for _, l := range p.Lines {
+		if l.Tag == "#EXT-X-TARGETDURATION" {
+			d, _ := strconv.Atoi(strings.TrimSpace(l.Value))
+			return d
+		}
+	}
+	return 0
+}
+
+// HasEndList reports whether the playlist is complete (EXT-X-ENDLIST).
+func (p *hlsPlaylist) HasEndList() bool {
+	for _, l := range p.Lines {
+		if l.Tag == "#EXT-X-ENDLIST" {
+			return true
+		}
+	}
+	return false
+}
+
+// finalize turns a media playlist into a complete VOD playlist: the target
+// duration is raised to cover the longest segment, as players reject
+// playlists where a rounded EXTINF exceeds it, and EXT-X-ENDLIST is added so
+// a snapshot of a live or event playlist is not reloaded.
+func (p *hlsPlaylist) finalize(segments []hlsSegment) {
+	target := 0
+	for _, seg := range segments {
+		if d := int(math.Round(seg.Duration)); d > target {
+			target = d
+		}
+	}
+
+	targetLine := hlsLine{
+		Tag:   "#EXT-X-TARGETDURATION",
+		Value: strconv.Itoa(target),
+		raw:   "#EXT-X-TARGETDURATION:" + strconv.Itoa(target),
+	}
+	if current := p.TargetDuration(); current == 0 {
+		// Insert right after #EXTM3U
+		insertAt := 0
+		if len(p.Lines) > 0 && p.Lines[0].Tag == "#EXTM3U" {
+			insertAt = 1
+		}
+		p.Lines = append(p.Lines[:insertAt], append([]hlsLine{targetLine}, p.Lines[insertAt:]...)...)
+	} else if current < target {
+		for i := range p.Lines {
+			if p.Lines[i].Tag == "#EXT-X-TARGETDURATION" {
+				p.Lines[i] = targetLine
+			}
+		}
+	}
+
+	if !p.HasEndList() {
+		p.Lines = append(p.Lines, hlsLine{Tag: "#EXT-X-ENDLIST", raw: "#EXT-X-ENDLIST"})
+	}
+}
+
+// parseKey reads an EXT-X-KEY attribute list. METHOD=NONE yields nil.
+func parseKey(base *url.URL, value string) (*hlsKey, error) {
+	attrs := parseAttributeList(value)
+	method := attrs["METHOD"]
+	if method == "" || method == "NONE" {
+		return nil, nil
+	}
+
+	key := &hlsKey{Method: method}
+	if abs, ok := resolveHLSURI(base, attrs["URI"]); ok {
+		key.URL = abs
+	}
+	if iv := attrs["IV"]; iv != "" {
+		raw, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+		if err != nil || len(raw) != aes.BlockSize {
+			return nil, fmt.Errorf("invalid key IV: %s", iv)
+		}
+		key.IV = raw
+	}
+	return key, nil
+}
+
+// decryptAES128 decrypts a segment encrypted with METHOD=AES-128, i.e.
+// AES-128-CBC over the whole segment with PKCS#7 padding.
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted segment is not a multiple of the block size")
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("invalid padding, wrong key or IV")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// hlsVariant is one #EXT-X-STREAM-INF entry of a master playlist.
+type hlsVariant struct {
+	URI       string
+	Bandwidth int64
+	Width     int
+	Height    int
+	Codecs    string
+}
+
+func (v *hlsVariant) Resolution() string {
+	if v.Width == 0 || v.Height == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", v.Width, v.Height)
+}
+
+func parseMasterPlaylist(content string) []hlsVariant {
+	var variants []hlsVariant
+	var current *hlsVariant
+
+	for _, l := range parsePlaylist(content).Lines {
+		if l.Tag == "#EXT-X-STREAM-INF" {
+			attrs := parseAttributeList(l.Value)
+			current = &hlsVariant{Codecs: attrs["CODECS"]}
+			current.Bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			if res := attrs["RESOLUTION"]; res != "" {
+				if w, h, ok := strings.Cut(strings.ToLower(res), "x"); ok {
+					current.Width, _ = strconv.Atoi(w)
+					current.Height, _ = strconv.Atoi(h)
+				}
+			}
+		} else if l.URI != "" && current != nil {
+			current.URI = l.URI
+			variants = append(variants, *current)
+			current = nil
+		}
+	}
+	return variants
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const byteRangePlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:5
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:5.005,Opening
+#EXT-X-BYTERANGE:1000@720
+media.mp4
+#EXTINF:4.171,
+#EXT-X-BYTERANGE:800
+media.mp4
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="ad-init.mp4"
+#EXTINF:6.4,
+ad.mp4
+`
+
+func TestPlaylistSegments(t *testing.T) {
+	segments, err := parsePlaylist(byteRangePlaylist).Segments("https://cdn.example/v/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(segments))
+	}
+
+	first, second, third := segments[0], segments[1], segments[2]
+	if first.Duration != 5.005 || first.Title != "Opening" {
+		t.Errorf("EXTINF not kept: %v %q", first.Duration, first.Title)
+	}
+	if first.Map == nil || first.Map.URL != "https://cdn.example/v/init.mp4" || *first.Map.ByteRange != (hlsByteRange{Length: 720}) {
+		t.Errorf("unexpected map %+v", first.Map)
+	}
+	if *first.ByteRange != (hlsByteRange{Length: 1000, Offset: 720}) {
+		t.Errorf("unexpected byte range %+v", first.ByteRange)
+	}
+	// No offset means it continues where the previous sub-range ended
+	if *second.ByteRange != (hlsByteRange{Length: 800, Offset: 1720}) {
+		t.Errorf("implicit offset not applied: %+v", second.ByteRange)
+	}
+	if first.Discontinuity || second.Discontinuity || !third.Discontinuity {
+		t.Errorf("discontinuity attached to the wrong segment")
+	}
+	if third.Map.URL != "https://cdn.example/v/ad-init.mp4" || third.ByteRange != nil {
+		t.Errorf("unexpected third segment %+v", third)
+	}
+}
+
+func TestLocalPlaylist(t *testing.T) {
+	base := "https://cdn.example/v/index.m3u8"
+	local := localPlaylist(byteRangePlaylist, base)
+
+	for _, want := range []string{
+		"#EXTINF:5.005,Opening",
+		"#EXTINF:4.171,",
+		"#EXT-X-BYTERANGE:1000@720",
+		"#EXT-X-BYTERANGE:800",
+		"#EXT-X-DISCONTINUITY",
+		`#EXT-X-MAP:URI="` + segmentFilename("https://cdn.example/v/init.mp4") + `",BYTERANGE="720@0"`,
+		segmentFilename("https://cdn.example/v/media.mp4"),
+		// 6.4 rounds to 6, above the original target of 5
+		"#EXT-X-TARGETDURATION:6",
+		"#EXT-X-ENDLIST",
+	} {
+		if !strings.Contains(local, want) {
+			t.Errorf("local playlist is missing %q:\n%s", want, local)
+		}
+	}
+	if strings.Contains(local, "cdn.example") || strings.Contains(local, "TARGETDURATION:5") {
+		t.Errorf("local playlist not fully rewritten:\n%s", local)
+	}
+
+	// The local playlist parses back to the same segments
+	segments, err := parsePlaylist(local).Segments("http://local/")
+	if err != nil || len(segments) != 3 || segments[1].ByteRange.Offset != 1720 {
+		t.Errorf("local playlist does not round-trip: %v %+v", err, segments)
+	}
+}
+
+func TestByteRangeSlice(t *testing.T) {
+	data := []byte("0123456789")
+	got, err := (&hlsByteRange{Length: 3, Offset: 4}).Slice(data)
+	if err != nil || string(got) != "456" {
+		t.Errorf("Slice = %q, %v", got, err)
+	}
+	if _, err := (&hlsByteRange{Length: 8, Offset: 4}).Slice(data); err == nil {
+		t.Errorf("expected an out of bounds range to fail")
+	}
+	var whole *hlsByteRange
+	if got, _ := whole.Slice(data); string(got) != string(data) {
+		t.Errorf("nil range should return the whole resource")
+	}
+}
+
+func TestPlaylistSegmentKeys(t *testing.T) {
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-MEDIA-SEQUENCE:41",
+		"a.ts",
+		`#EXT-X-KEY:METHOD=AES-128,URI="k.bin"`,
+		"b.ts",
+		`#EXT-X-KEY:METHOD=AES-128,URI="k.bin",IV=0X0000000000000000000000000000ABCD`,
+		"c.ts",
+		"#EXT-X-KEY:METHOD=NONE",
+		"d.ts",
+	}, "\n")
+
+	segments, err := parsePlaylist(content).Segments("https://cdn.example/v/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 4 {
+		t.Fatalf("expected 4 segments, got %d", len(segments))
+	}
+
+	if segments[0].Key != nil || segments[3].Key != nil {
+		t.Errorf("unencrypted segments should have no key")
+	}
+	if segments[1].Key.URL != "https://cdn.example/v/k.bin" {
+		t.Errorf("unexpected key URL %q", segments[1].Key.URL)
+	}
+	if got := hex.EncodeToString(segments[1].IV()); got != "0000000000000000000000000000002a" {
+		t.Errorf("sequence IV for segment 42 = %s", got)
+	}
+	if got := hex.EncodeToString(segments[2].IV()); got != "0000000000000000000000000000abcd" {
+		t.Errorf("explicit IV = %s", got)
+	}
+
+	if _, err := parsePlaylist("#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0x1234\nx.ts").Segments("https://cdn.example/"); err == nil {
+		t.Errorf("expected a short IV to be rejected")
+	}
+}
+
+func TestPlaylistRewrite(t *testing.T) {
+	const playlist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English, CC",LANGUAGE="en",URI="subs/en.m3u8",AUTOSELECT=YES
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example/k1?token=a,b",IV=0x0123456789abcdef0123456789abcdef
+#EXT-X-MAP:URI="/init/init.mp4",BYTERANGE="720@0"
+#EXTINF:4,
+seg0.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+https://other.example/seg1.m4s`
+
+	got := parsePlaylist(playlist).Rewrite("https://cdn.example/v/index.m3u8", func(absURL, kind string) string {
+		return "proxy/" + kind + "/" + absURL
+	})
+	want := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English, CC",LANGUAGE="en",URI="proxy/rendition/https://cdn.example/v/subs/en.m3u8",AUTOSELECT=YES
+#EXT-X-KEY:METHOD=AES-128,URI="proxy/key/https://keys.example/k1?token=a,b",IV=0x0123456789abcdef0123456789abcdef
+#EXT-X-MAP:URI="proxy/map/https://cdn.example/init/init.mp4",BYTERANGE="720@0"
+#EXTINF:4,
+proxy/segment/https://cdn.example/v/seg0.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+proxy/segment/https://other.example/seg1.m4s`
+	if got != want {
+		t.Errorf("rewritten playlist:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Served through the proxy, every one of them is signed and allowed
+	a := &AnimeService{proxyKey: []byte("session key")}
+	rec := httptest.NewRecorder()
+	a.servePlaylist(rec, parsePlaylist(playlist), "https://cdn.example/v/index.m3u8", "1")
+	for _, target := range []string{
+		"https://cdn.example/v/subs/en.m3u8",
+		"https://keys.example/k1?token=a,b",
+		"https://cdn.example/init/init.mp4",
+		"https://other.example/seg1.m4s",
+	} {
+		if !strings.Contains(rec.Body.String(), a.proxyURL("1", target)) {
+			t.Errorf("%s not proxied in:\n%s", target, rec.Body.String())
+		}
+		if !a.upstreamAllowed("1", target) {
+			t.Errorf("%s not allowed", target)
+		}
+	}
+	if a.upstreamAllowed("1", "https://unlisted.example/seg.ts") {
+		t.Error("a host the playlist never named is allowed")
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	errMetadataNotFound    = errors.New("no matching anime found")
+	errMetadataUnsupported = errors.New("not supported by this provider")
+	errRateLimited         = errors.New("rate limited")
+)
+
+// metadataTimeout bounds a single provider request so a hanging provider
+// does not hold up the fallback.
+const metadataTimeout = 15 * time.Second
+
+// MetadataProvider is a source of anime and episode metadata.
+type MetadataProvider interface {
+	Name() string
+	// FindAnime looks an anime up by MAL ID when known, otherwise by title.
+	FindAnime(ctx context.Context, title string, malID int) (*AnimeDetails, error)
+	// Episodes returns a page of the episode list of an anime, from 1.
+	Episodes(ctx context.Context, malID, page int) (*EpisodeMetadataPage, error)
+	// Episode returns the metadata of a single episode.
+	Episode(ctx context.Context, malID, epNum int) (*EpisodeMetadata, error)
+}
+
+func defaultMetadataProviders() metadataProviders {
+	return metadataProviders{newJikanProvider(), newAniListProvider()}
+}
+
+// metadataProviders queries providers in order and falls back to the next
+// one when a provider fails, is rate limited or does not know the anime.
+// Anime lookups are merged across every provider that answers, as Jikan and
+// AniList each carry fields the other lacks.
+type metadataProviders []MetadataProvider
+
+func (ps metadataProviders) FindAnime(ctx context.Context, title string, malID int) (*AnimeDetails, error) {
+	var merged *AnimeDetails
+	var errs []error
+	for _, p := range ps {
+		d, err := callProvider(ctx, func(ctx context.Context) (*AnimeDetails, error) {
+			return p.FindAnime(ctx, title, malID)
+		})
+		if err != nil {
+			logProviderError(p, title, err)
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		if merged == nil {
+			merged = d
+		} else {
+			merged.merge(d)
+		}
+		// Later providers look the anime up by ID instead of guessing from the title
+		if malID == 0 {
+			malID = merged.MalID
+		}
+	}
+	if merged == nil {
+		return nil, errors.Join(errs...)
+	}
+	return merged, nil
+}
+
+func (ps metadataProviders) Episodes(ctx context.Context, malID, page int) (*EpisodeMetadataPage, error) {
+	var errs []error
+	for _, p := range ps {
+		eps, err := callProvider(ctx, func(ctx context.Context) (*EpisodeMetadataPage, error) {
+			return p.Episodes(ctx, malID, page)
+		})
+		if err == nil {
+			return eps, nil
+		}
+		logProviderError(p, fmt.Sprintf("MAL %d episodes page %d", malID, page), err)
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (ps metadataProviders) Episode(ctx context.Context, malID, epNum int) (*EpisodeMetadata, error) {
+	var errs []error
+	for _, p := range ps {
+		ep, err := callProvider(ctx, func(ctx context.Context) (*EpisodeMetadata, error) {
+			return p.Episode(ctx, malID, epNum)
+		})
+		if err == nil {
+			return ep, nil
+		}
+		logProviderError(p, fmt.Sprintf("MAL %d episode %d", malID, epNum), err)
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func callProvider[T any](ctx context.Context, fn func(context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+func logProviderError(p MetadataProvider, what string, err error) {
+	if errors.Is(err, errMetadataUnsupported) {
+		return
+	}
+	fmt.Printf("[Metadata] %s lookup for %s failed: %v\n", p.Name(), what, err)
+}
+
+// merge fills the fields of d that are still empty from other.
+func (d *AnimeDetails) merge(other *AnimeDetails) {
+	if d.MalID == 0 {
+		d.MalID = other.MalID
+	}
+	if d.AnilistID == 0 {
+		d.AnilistID = other.AnilistID
+	}
+	if d.Title == "" {
+		d.Title = other.Title
+	}
+	if d.Img == "" {
+		d.Img = other.Img
+	}
+	if d.Banner == "" {
+		d.Banner = other.Banner
+	}
+	if d.Desc == "" {
+		d.Desc = other.Desc
+	}
+	if len(d.Genres) == 0 {
+		d.Genres = other.Genres
+	}
+	if d.Score == 0 {
+		d.Score = other.Score
+	}
+	if d.Status == "" {
+		d.Status = other.Status
+	}
+	if d.Episodes == 0 {
+		d.Episodes = other.Episodes
+	}
+}
+
+// Normalized airing status shared by all providers
+const (
+	statusAiring    = "airing"
+	statusFinished  = "finished"
+	statusUpcoming  = "upcoming"
+	statusCancelled = "cancelled"
+	statusHiatus    = "hiatus"
+)
+
+// jikanProvider reads MyAnimeList data through the Jikan v4 API. Jikan
+// allows 3 requests per second and 60 per minute; the shared transport
+// holds requests to that.
+type jikanProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newJikanProvider() *jikanProvider {
+	return &jikanProvider{baseURL: "https://api.jikan.moe/v4", client: httpClient}
+}
+
+func (p *jikanProvider) Name() string { return "Jikan" }
+
+// get requests path and decodes the JSON response into out. The client's
+// transport spaces requests to Jikan out and retries a 429; one still
+// limited after that is errRateLimited, so the caller can fall back to
+// another provider.
+func (p *jikanProvider) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		return errRateLimited
+	case http.StatusNotFound:
+		return errMetadataNotFound
+	default:
+		return fmt.Errorf("jikan api error: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p *jikanProvider) FindAnime(ctx context.Context, title string, malID int) (*AnimeDetails, error) {
+	if malID > 0 {
+		var result struct {
+			Data JikanAnime `json:"data"`
+		}
+		if err := p.get(ctx, fmt.Sprintf("/anime/%d", malID), &result); err != nil {
+			return nil, err
+		}
+		return jikanDetails(result.Data), nil
+	}
+
+	var jikan JikanResponse
+	if err := p.get(ctx, "/anime?q="+url.QueryEscape(title)+"&limit=5", &jikan); err != nil {
+		return nil, err
+	}
+	if len(jikan.Data) == 0 {
+		return nil, errMetadataNotFound
+	}
+
+	bestIdx := 0
+	maxSimilarity := -1
+	for i, data := range jikan.Data {
+		sim := calculateSimilarity(title, data.Title)
+		if data.TitleEnglish != "" {
+			if engSim := calculateSimilarity(title, data.TitleEnglish); engSim > sim {
+				sim = engSim
+			}
+		}
+		if sim > maxSimilarity {
+			maxSimilarity = sim
+			bestIdx = i
+		}
+	}
+
+	best := jikan.Data[bestIdx]
+	fmt.Printf("Found Jikan Metadata for %s: MAL ID %d (Similarity: %d)\n", title, best.MALID, maxSimilarity)
+	return jikanDetails(best), nil
+}
+
+func jikanDetails(j JikanAnime) *AnimeDetails {
+	d := &AnimeDetails{
+		MalID:    j.MALID,
+		Title:    j.Title,
+		Img:      j.Images.Webp.LargeImageURL,
+		Desc:     j.Synopsis,
+		Score:    j.Score,
+		Episodes: j.Episodes,
+	}
+	for _, g := range j.Genres {
+		d.Genres = append(d.Genres, g.Name)
+	}
+	switch j.Status {
+	case "Currently Airing":
+		d.Status = statusAiring
+	case "Finished Airing":
+		d.Status = statusFinished
+	case "Not yet aired":
+		d.Status = statusUpcoming
+	}
+	return d
+}
+
+// Episodes reads a page of /anime/{id}/episodes. Jikan pages hold 100
+// episodes; requests share the provider's rate limit.
+func (p *jikanProvider) Episodes(ctx context.Context, malID, page int) (*EpisodeMetadataPage, error) {
+	var jikan JikanEpisodeResponse
+	if err := p.get(ctx, fmt.Sprintf("/anime/%d/episodes?page=%d", malID, page), &jikan); err != nil {
+		return nil, err
+	}
+
+	out := &EpisodeMetadataPage{Page: page, HasNext: jikan.Pagination.HasNextPage}
+	for _, d := range jikan.Data {
+		// Keep YYYY-MM-DD
+		aired := d.Aired
+		if len(aired) > 10 {
+			aired = aired[:10]
+		}
+
+		out.Episodes = append(out.Episodes, EpisodeMetadata{
+			Episode: d.EpisodeID,
+			Title:   d.Title,
+			Aired:   aired,
+			Filler:  d.Filler,
+			Recap:   d.Recap,
+		})
+	}
+	return out, nil
+}
+
+func (p *jikanProvider) Episode(ctx context.Context, malID, epNum int) (*EpisodeMetadata, error) {
+	var result struct {
+		Data struct {
+			Title    string `json:"title"`
+			Synopsis string `json:"synopsis"`
+			Aired    string `json:"aired"`
+			Filler   bool   `json:"filler"`
+			Recap    bool   `json:"recap"`
+		} `json:"data"`
+	}
+	if err := p.get(ctx, fmt.Sprintf("/anime/%d/episodes/%d", malID, epNum), &result); err != nil {
+		return nil, err
+	}
+
+	aired := result.Data.Aired
+	if len(aired) > 10 {
+		aired = aired[:10]
+	}
+	return &EpisodeMetadata{
+		Episode:  epNum,
+		Title:    result.Data.Title,
+		Synopsis: result.Data.Synopsis,
+		Aired:    aired,
+		Filler:   result.Data.Filler,
+		Recap:    result.Data.Recap,
+	}, nil
+}
+
+// aniListProvider reads AniList data through its GraphQL API. AniList has
+// no per-episode metadata, so it only answers anime lookups.
+type aniListProvider struct {
+	url    string
+	client *http.Client
+}
+
+func newAniListProvider() *aniListProvider {
+	return &aniListProvider{url: "https://graphql.anilist.co", client: httpClient}
+}
+
+func (p *aniListProvider) Name() string { return "AniList" }
+
+const aniListMediaQuery = `query ($idMal: Int, $search: String) {
+	Media(idMal: $idMal, search: $search, type: ANIME) {
+		id
+		idMal
+		title { romaji english }
+		description(asHtml: false)
+		genres
+		averageScore
+		status
+		episodes
+		coverImage { extraLarge large }
+		bannerImage
+	}
+}`
+
+type aniListMedia struct {
+	ID    int `json:"id"`
+	IDMal int `json:"idMal"`
+	Title struct {
+		Romaji  string `json:"romaji"`
+		English string `json:"english"`
+	} `json:"title"`
+	Description  string   `json:"description"`
+	Genres       []string `json:"genres"`
+	AverageScore int      `json:"averageScore"`
+	Status       string   `json:"status"`
+	Episodes     int      `json:"episodes"`
+	CoverImage   struct {
+		ExtraLarge string `json:"extraLarge"`
+		Large      string `json:"large"`
+	} `json:"coverImage"`
+	BannerImage string `json:"bannerImage"`
+}
+
+func (p *aniListProvider) FindAnime(ctx context.Context, title string, malID int) (*AnimeDetails, error) {
+	variables := map[string]interface{}{}
+	if malID > 0 {
+		variables["idMal"] = malID
+	} else {
+		variables["search"] = title
+	}
+	body, err := json.Marshal(map[string]interface{}{"query": aniListMediaQuery, "variables": variables})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		return nil, errRateLimited
+	case http.StatusNotFound:
+		// A query without a match answers 404 with a GraphQL error
+		return nil, errMetadataNotFound
+	default:
+		return nil, fmt.Errorf("anilist api error: %s", resp.Status)
+	}
+
+	var result struct {
+		Data struct {
+			Media *aniListMedia `json:"Media"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	m := result.Data.Media
+	if m == nil || m.ID == 0 {
+		return nil, errMetadataNotFound
+	}
+
+	d := &AnimeDetails{
+		MalID:     m.IDMal,
+		AnilistID: m.ID,
+		Title:     m.Title.English,
+		Img:       m.CoverImage.ExtraLarge,
+		Banner:    m.BannerImage,
+		Desc:      stripTags(m.Description),
+		Genres:    m.Genres,
+		Score:     float64(m.AverageScore) / 10,
+		Episodes:  m.Episodes,
+	}
+	if d.Title == "" {
+		d.Title = m.Title.Romaji
+	}
+	if d.Img == "" {
+		d.Img = m.CoverImage.Large
+	}
+	switch m.Status {
+	case "RELEASING":
+		d.Status = statusAiring
+	case "FINISHED":
+		d.Status = statusFinished
+	case "NOT_YET_RELEASED":
+		d.Status = statusUpcoming
+	case "CANCELLED":
+		d.Status = statusCancelled
+	case "HIATUS":
+		d.Status = statusHiatus
+	}
+	return d, nil
+}
+
+func (p *aniListProvider) Episodes(ctx context.Context, malID, page int) (*EpisodeMetadataPage, error) {
+	return nil, errMetadataUnsupported
+}
+
+func (p *aniListProvider) Episode(ctx context.Context, malID, epNum int) (*EpisodeMetadata, error) {
+	return nil, errMetadataUnsupported
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// stripTags removes the line breaks and emphasis AniList leaves in
+// descriptions even when asked for plain text.
+func stripTags(s string) string {
+	return strings.TrimSpace(tagPattern.ReplaceAllString(s, ""))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
+)
+
+// metadataFixture stands in for Jikan and AniList. Each API can be switched
+// to answer with an error status to exercise the fallback.
+type metadataFixture struct {
+	jikanStatus   int
+	aniListStatus int
+	jikanHits     int32
+	aniListHits   int32
+	aniListVars   map[string]interface{}
+}
+
+func newMetadataFixture(t *testing.T) (*metadataFixture, metadataProviders) {
+	t.Helper()
+	f := &metadataFixture{jikanStatus: http.StatusOK, aniListStatus: http.StatusOK}
+
+	jikan := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.jikanHits, 1)
+		if f.jikanStatus != http.StatusOK {
+			w.WriteHeader(f.jikanStatus)
+			return
+		}
+		switch r.URL.Path {
+		case "/anime":
+			w.Write([]byte(`{"data":[
+				{"mal_id":11111,"title":"Sousou no Frieren Recap","images":{"webp":{"large_image_url":"recap.webp"}}},
+				{"mal_id":52991,"title":"Sousou no Frieren","title_english":"Frieren: Beyond Journey's End",
+				 "synopsis":"An elf mage outlives her party.","score":9.3,"status":"Finished Airing","episodes":28,
+				 "genres":[{"name":"Adventure"},{"name":"Drama"}],
+				 "images":{"webp":{"large_image_url":"frieren.webp"}}}
+			]}`))
+		case "/anime/52991/episodes":
+			w.Write([]byte(`{"data":[{"mal_id":1,"title":"The Journey's End","aired":"2023-09-29T00:00:00+00:00"}]}`))
+		case "/anime/21/episodes":
+			// A long show: a full first page, then a short second one
+			if r.URL.Query().Get("page") == "2" {
+				w.Write([]byte(`{"pagination":{"has_next_page":false},"data":[{"mal_id":101,"title":"Episode of Luffy","filler":true}]}`))
+				return
+			}
+			eps := make([]string, 100)
+			for i := range eps {
+				eps[i] = fmt.Sprintf(`{"mal_id":%d,"title":"Episode %d"}`, i+1, i+1)
+			}
+			fmt.Fprintf(w, `{"pagination":{"has_next_page":true},"data":[%s]}`, strings.Join(eps, ","))
+		case "/anime/52991/episodes/2":
+			w.Write([]byte(`{"data":{"mal_id":2,"title":"It Didn't Have to Be Magic...","synopsis":"Frieren meets Fern."}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(jikan.Close)
+
+	aniList := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.aniListHits, 1)
+		var req struct {
+			Variables map[string]interface{} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.aniListVars = req.Variables
+		if f.aniListStatus != http.StatusOK {
+			w.WriteHeader(f.aniListStatus)
+			return
+		}
+		w.Write([]byte(`{"data":{"Media":{
+			"id":154587,"idMal":52991,
+			"title":{"romaji":"Sousou no Frieren","english":"Frieren: Beyond Journey's End"},
+			"description":"The adventure is over<br><br>but life goes on.",
+			"genres":["Adventure","Drama","Fantasy"],"averageScore":91,"status":"FINISHED","episodes":28,
+			"coverImage":{"extraLarge":"anilist-cover.jpg"},
+			"bannerImage":"anilist-banner.jpg"
+		}}}`))
+	}))
+	t.Cleanup(aniList.Close)
+
+	// Jikan retries a 429 once, right away
+	jikanTransport := transport.New(jikan.Client().Transport, transport.Config{MaxRetries: 1, RetryBurst: 10})
+	return f, metadataProviders{
+		&jikanProvider{baseURL: jikan.URL, client: &http.Client{Transport: jikanTransport}},
+		&aniListProvider{url: aniList.URL, client: aniList.Client()},
+	}
+}
+
+func TestMetadataProvidersMerge(t *testing.T) {
+	f, providers := newMetadataFixture(t)
+	a := &AnimeService{metadata: newMemoryMetadataStore(), providers: providers}
+
+	d := a.animeDetails(context.Background(), "Sousou no Frieren")
+	if d == nil {
+		t.Fatal("no details")
+	}
+	// Jikan answers first, AniList fills in what Jikan lacks
+	if d.MalID != 52991 || d.Img != "frieren.webp" || d.Desc != "An elf mage outlives her party." {
+		t.Errorf("Jikan fields not kept: %+v", d)
+	}
+	if d.AnilistID != 154587 || d.Banner != "anilist-banner.jpg" {
+		t.Errorf("AniList fields not merged: %+v", d)
+	}
+	if d.Score != 9.3 || d.Status != statusFinished || len(d.Genres) != 2 {
+		t.Errorf("unexpected score, status or genres: %+v", d)
+	}
+	// AniList is asked by the MAL ID Jikan found, not by title
+	if id, ok := f.aniListVars["idMal"].(float64); !ok || int(id) != 52991 {
+		t.Errorf("AniList variables = %v, want idMal 52991", f.aniListVars)
+	}
+
+	anime := Anime{Name: "Sousou no Frieren"}
+	anime.applyDetails(d)
+	if anime.AnilistID != 154587 || anime.BannerImage == "" || anime.ImageURL != "frieren.webp" {
+		t.Errorf("search result not populated: %+v", anime)
+	}
+
+	// Fresh details come from the store
+	a.animeDetails(context.Background(), "Sousou no Frieren")
+	if f.jikanHits != 1 || f.aniListHits != 1 {
+		t.Errorf("cached lookup hit the APIs: jikan %d, anilist %d", f.jikanHits, f.aniListHits)
+	}
+}
+
+func TestMetadataProvidersFallback(t *testing.T) {
+	f, providers := newMetadataFixture(t)
+	f.jikanStatus = http.StatusTooManyRequests
+	a := &AnimeService{metadata: newMemoryMetadataStore(), providers: providers}
+
+	d := a.animeDetails(context.Background(), "Sousou no Frieren")
+	if d == nil {
+		t.Fatal("AniList fallback returned nothing")
+	}
+	if d.MalID != 52991 || d.AnilistID != 154587 {
+		t.Errorf("ids = %d/%d, want 52991/154587", d.MalID, d.AnilistID)
+	}
+	if d.Img != "anilist-cover.jpg" || d.Desc != "The adventure is overbut life goes on." {
+		t.Errorf("AniList fields: %+v", d)
+	}
+	if d.Status != statusFinished || d.Score != 9.1 {
+		t.Errorf("status %q score %v", d.Status, d.Score)
+	}
+	// The 429 is retried once before falling back
+	if f.jikanHits != 2 {
+		t.Errorf("jikan hit %d times, want 2", f.jikanHits)
+	}
+	if search, _ := f.aniListVars["search"].(string); search != "Sousou no Frieren" {
+		t.Errorf("AniList variables = %v, want a title search", f.aniListVars)
+	}
+
+	// Both down: no details and an error naming both providers
+	f.aniListStatus = http.StatusInternalServerError
+	_, err := providers.FindAnime(context.Background(), "Sousou no Frieren", 0)
+	if err == nil || !errors.Is(err, errRateLimited) || !strings.Contains(err.Error(), "AniList") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestEpisodeMetadataProviders(t *testing.T) {
+	f, providers := newMetadataFixture(t)
+	a := &AnimeService{metadata: newMemoryMetadataStore(), providers: providers}
+
+	meta, err := a.fetchFullMetadata(52991)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Episodes) != 1 || meta.Episodes[0].Aired != "2023-09-29" {
+		t.Errorf("episodes = %+v", meta.Episodes)
+	}
+
+	ep, err := a.GetEpisodeMetadata(52991, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Synopsis != "Frieren meets Fern." {
+		t.Errorf("episode 2 = %+v", ep)
+	}
+
+	// Jikan down: episode 2 is in the store now, episode 3 never was and
+	// AniList has no episode data
+	f.jikanStatus = http.StatusServiceUnavailable
+	if ep, err := a.GetEpisodeMetadata(52991, 2); err != nil || ep.Title == "" {
+		t.Errorf("cached episode: %+v, %v", ep, err)
+	}
+	if _, err := a.GetEpisodeMetadata(52991, 3); err == nil {
+		t.Error("expected an error for an episode no provider has")
+	}
+}
+
+func TestEpisodeMetadataPages(t *testing.T) {
+	f, providers := newMetadataFixture(t)
+	a := &AnimeService{metadata: newMemoryMetadataStore(), providers: providers}
+
+	meta, err := a.fetchFullMetadata(21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Episodes) != 101 || meta.Episodes[100].Episode != 101 || !meta.Episodes[100].Filler {
+		t.Fatalf("got %d episodes, want both pages", len(meta.Episodes))
+	}
+
+	// Pages are stored as they arrive
+	hits := f.jikanHits
+	page, err := a.GetEpisodeMetadataPage(21, 2)
+	if err != nil || page.HasNext || len(page.Episodes) != 1 {
+		t.Errorf("page 2 = %+v, %v", page, err)
+	}
+	if page, err := a.GetEpisodeMetadataPage(21, 1); err != nil || !page.HasNext {
+		t.Errorf("page 1 = %+v, %v, want another page after it", page, err)
+	}
+	if f.jikanHits != hits {
+		t.Errorf("jikan hit %d more times, want pages from the store", f.jikanHits-hits)
+	}
+	if eps, err := a.loadedEpisodeMetadata(context.Background(), 21); err != nil || len(eps) != 101 {
+		t.Errorf("loaded %d episodes, %v", len(eps), err)
+	}
+
+	if _, err := a.GetEpisodeMetadataPage(21, 0); err == nil {
+		t.Error("expected an error for page 0")
+	}
+}
+
+func TestGetEpisodesWithMetadata(t *testing.T) {
+	f, providers := newMetadataFixture(t)
+	resolver := &fakeResolver{}
+	a := &AnimeService{metadata: newMemoryMetadataStore(), providers: providers, resolver: resolver}
+
+	eps, err := a.GetEpisodesWithMetadata("Sousou no Frieren", "af-frieren", 52991, "AnimeFire", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eps) != 2 {
+		t.Fatalf("episodes = %+v", eps)
+	}
+	if eps[0].Num != 1 || eps[0].Title != "The Journey's End" || eps[0].Aired != "2023-09-29" {
+		t.Errorf("episode 1 = %+v, want the Jikan title and air date", eps[0])
+	}
+	if eps[1].Title != "" {
+		t.Errorf("episode 2 = %+v, Jikan does not list it", eps[1])
+	}
+
+	// Both lists come from the store the second time
+	if _, err := a.GetEpisodesWithMetadata("Sousou no Frieren", "af-frieren", 52991, "AnimeFire", false); err != nil {
+		t.Fatal(err)
+	}
+	if resolver.listed != 1 || f.jikanHits != 1 {
+		t.Errorf("listed %d times, jikan hit %d times, want 1 each", resolver.listed, f.jikanHits)
+	}
+
+	// Without a MAL ID the list comes back as the source has it
+	eps, err = a.GetEpisodesWithMetadata("Sousou no Frieren", "af-frieren", 0, "AnimeFire", false)
+	if err != nil || eps[0].Title != "" {
+		t.Errorf("episodes without metadata = %+v, %v", eps, err)
+	}
+}
+
+func TestMergeEpisodeMetadata(t *testing.T) {
+	eps := []Episode{
+		{Number: "12", Num: episodeNum("12", 12)},
+		{Number: "12.5", Num: episodeNum("12.5", 13)},
+		{Number: "OVA", Num: episodeNum("OVA", 14)},
+	}
+	if eps[1].Num != 12.5 || eps[2].Num != 14 {
+		t.Fatalf("nums = %v, %v", eps[1].Num, eps[2].Num)
+	}
+	mergeEpisodeMetadata(eps, []EpisodeMetadata{
+		{Episode: 12, Title: "Recap", Recap: true},
+		{Episode: 14, Title: "Beach Episode", Filler: true},
+	})
+	if !eps[0].IsRecap || eps[0].Title != "Recap" {
+		t.Errorf("episode 12 = %+v", eps[0])
+	}
+	if eps[1].Title != "" || eps[1].IsRecap {
+		t.Errorf("special 12.5 got episode 12's metadata: %+v", eps[1])
+	}
+	if !eps[2].IsFiller {
+		t.Errorf("episode 14 = %+v", eps[2])
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	mp4TrackVideo = "vide"
+	mp4TrackAudio = "soun"
+
+	// trun sample flags
+	mp4SampleSync    = 0x02000000 // depends on no other sample
+	mp4SampleNonSync = 0x01010000 // depends on others, not a sync sample
+)
+
+// mp4Sample is one access unit (video) or frame (audio) in track timescale.
+type mp4Sample struct {
+	DTS      int64
+	CTO      int32 // PTS - DTS
+	Duration uint32
+	Sync     bool
+	Data     []byte
+}
+
+// mp4Track is a track of the fragmented MP4 written by the remuxer.
+type mp4Track struct {
+	ID        uint32
+	Kind      string
+	Timescale uint32
+	// Duration is the length of the track in Timescale, known once every
+	// sample is written
+	Duration int64
+
+	// Video
+	Width  int
+	Height int
+	SPS    []byte
+	PPS    []byte
+
+	// Audio
+	SampleRate  int
+	Channels    int
+	AudioConfig []byte
+}
+
+func (t *mp4Track) ready() bool {
+	if t.Kind == mp4TrackVideo {
+		return t.SPS != nil && t.PPS != nil
+	}
+	return t.AudioConfig != nil
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := u32(uint32(version)<<24 | flags)
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+// mp4Matrix is the identity transformation matrix of mvhd and tkhd.
+var mp4Matrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// mp4MovieTimescale is the timescale of mvhd, tkhd and mehd durations
+const mp4MovieTimescale = 1000
+
+// movieDuration is the track's duration in mp4MovieTimescale
+func (t *mp4Track) movieDuration() uint32 {
+	if t.Timescale == 0 {
+		return 0
+	}
+	return uint32(t.Duration * mp4MovieTimescale / int64(t.Timescale))
+}
+
+// mp4InitSegment returns ftyp and moov for the given tracks, with the
+// durations of the tracks as set. Its size does not depend on them, so the
+// init segment written before the samples can be overwritten once they are
+// known.
+func mp4InitSegment(tracks []*mp4Track) []byte {
+	ftyp := mp4Box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso5iso6avc1mp41"))
+
+	var duration uint32
+	for _, t := range tracks {
+		duration = max(duration, t.movieDuration())
+	}
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation, modification time
+		u32(mp4MovieTimescale), u32(duration),
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		mp4Matrix, make([]byte, 24),
+		u32(uint32(len(tracks)+1)), // next_track_ID
+	)
+
+	moov := [][]byte{mvhd}
+	trex := [][]byte{mp4FullBox("mehd", 0, 0, u32(duration))}
+	for _, t := range tracks {
+		moov = append(moov, mp4Trak(t))
+		trex = append(trex, mp4FullBox("trex", 0, 0, u32(t.ID), u32(1), u32(0), u32(0), u32(0)))
+	}
+	moov = append(moov, mp4Box("mvex", trex...))
+
+	return append(ftyp, mp4Box("moov", moov...)...)
+}
+
+func mp4Trak(t *mp4Track) []byte {
+	volume, width, height := uint16(0), uint32(0), uint32(0)
+	handler, name := "vide", "VideoHandler"
+	mediaHeader := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	if t.Kind == mp4TrackAudio {
+		volume = 0x0100
+		handler, name = "soun", "SoundHandler"
+		mediaHeader = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	} else {
+		width, height = uint32(t.Width)<<16, uint32(t.Height)<<16
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 0x03, // enabled, in movie
+		u32(0), u32(0), u32(t.ID), u32(0), u32(t.movieDuration()), // times, track_ID, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), // reserved, layer, group, volume, reserved
+		mp4Matrix, u32(width), u32(height),
+	)
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.Timescale), u32(uint32(t.Duration)), u16(0x55C4), u16(0)) // language "und"
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), mp4SampleEntry(t)),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)),
+	)
+
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+}
+
+func mp4SampleEntry(t *mp4Track) []byte {
+	if t.Kind == mp4TrackAudio {
+		return mp4Box("mp4a",
+			make([]byte, 6), u16(1), // reserved, data_reference_index
+			make([]byte, 8), u16(uint16(t.Channels)), u16(16), // reserved, channels, sample size
+			u32(0), u32(uint32(t.SampleRate)<<16),
+			mp4ESDS(t.AudioConfig),
+		)
+	}
+
+	avcC := mp4Box("avcC",
+		[]byte{1, t.SPS[1], t.SPS[2], t.SPS[3], 0xFF, 0xE1}, // version, profile, compat, level, 4 byte lengths, 1 SPS
+		u16(uint16(len(t.SPS))), t.SPS,
+		[]byte{1}, u16(uint16(len(t.PPS))), t.PPS,
+	)
+	return mp4Box("avc1",
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		make([]byte, 16), u16(uint16(t.Width)), u16(uint16(t.Height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1), // 72 dpi, reserved, frame count
+		make([]byte, 32), u16(0x0018), u16(0xFFFF), // compressor name, depth, pre_defined
+		avcC,
+	)
+}
+
+// mp4ESDS wraps an AAC AudioSpecificConfig in an ES descriptor.
+func mp4ESDS(config []byte) []byte {
+	descriptor := func(tag byte, payload ...[]byte) []byte {
+		size := 0
+		for _, p := range payload {
+			size += len(p)
+		}
+		out := []byte{tag, byte(size)}
+		for _, p := range payload {
+			out = append(out, p...)
+		}
+		return out
+	}
+
+	decoderConfig := descriptor(0x04,
+		[]byte{0x40, 0x15, 0, 0, 0}, // MPEG-4 audio, audio stream, buffer size
+		u32(0), u32(0),              // max and average bitrate
+		descriptor(0x05, config),
+	)
+	es := descriptor(0x03, u16(0), []byte{0}, decoderConfig, descriptor(0x06, []byte{0x02}))
+	return mp4FullBox("esds", 0, 0, es)
+}
+
+// mp4Fragment is the samples of one track in a fragment.
+type mp4Fragment struct {
+	Track   *mp4Track
+	Samples []mp4Sample
+}
+
+// writeMP4Fragment writes a moof and mdat holding the given samples.
+func writeMP4Fragment(w io.Writer, seq uint32, frags []mp4Fragment) error {
+	build := func(offsets []int32) []byte {
+		trafs := [][]byte{mp4FullBox("mfhd", 0, 0, u32(seq))}
+		for i, f := range frags {
+			video := f.Track.Kind == mp4TrackVideo
+			flags := uint32(0x000001 | 0x000100 | 0x000200) // data offset, duration, size
+			if video {
+				flags |= 0x000400 | 0x000800 // sample flags, composition offset
+			}
+
+			entries := [][]byte{u32(uint32(len(f.Samples))), u32(uint32(offsets[i]))}
+			for _, s := range f.Samples {
+				entries = append(entries, u32(s.Duration), u32(uint32(len(s.Data))))
+				if video {
+					sampleFlags := uint32(mp4SampleNonSync)
+					if s.Sync {
+						sampleFlags = mp4SampleSync
+					}
+					entries = append(entries, u32(sampleFlags), u32(uint32(s.CTO)))
+				}
+			}
+
+			trafs = append(trafs, mp4Box("traf",
+				mp4FullBox("tfhd", 0, 0x020000, u32(f.Track.ID)), // default-base-is-moof
+				mp4FullBox("tfdt", 1, 0, u64(uint64(f.Samples[0].DTS))),
+				mp4FullBox("trun", 1, flags, entries...),
+			))
+		}
+		return mp4Box("moof", trafs...)
+	}
+
+	// The moof size does not depend on the offsets, so build it once to
+	// learn where the mdat payload starts
+	offsets := make([]int32, len(frags))
+	moofSize := len(build(offsets))
+	dataSize := 0
+	for i, f := range frags {
+		offsets[i] = int32(moofSize + 8 + dataSize)
+		for _, s := range f.Samples {
+			dataSize += len(s.Data)
+		}
+	}
+
+	if _, err := w.Write(build(offsets)); err != nil {
+		return err
+	}
+	if _, err := w.Write(u32(uint32(8 + dataSize))); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("mdat")); err != nil {
+		return err
+	}
+	for _, f := range frags {
+		for _, s := range f.Samples {
+			if _, err := w.Write(s.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
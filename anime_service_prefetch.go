@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The proxy runs ahead of the player: each segment requested has the next
+// few of its playlist fetched into the cache, so a seek or a network blip
+// finds them there. One stream is prefetched at a time; opening another, or
+// the player going quiet, cancels it.
+
+const (
+	defaultPrefetchSegments = 3
+	maxPrefetchSegments     = 20
+	prefetchConcurrency     = 2
+	prefetchIdle            = 30 * time.Second
+	// A prefetch taking more than this share of the segment's duration
+	// leaves little bandwidth to spare, so the window shrinks
+	prefetchSlowRatio = 0.5
+	prefetchPause     = 30 * time.Second
+)
+
+// prefetchItem is a segment of a media playlist
+type prefetchItem struct {
+	url      string
+	duration float64
+}
+
+type playlistPosition struct {
+	playlist string
+	index    int
+}
+
+// prefetcher holds the prefetch session of the stream being played. A nil
+// prefetcher prefetches nothing.
+type prefetcher struct {
+	mu      sync.Mutex
+	sem     chan struct{}
+	session *prefetchSession
+}
+
+// prefetchSession is the prefetching of one stream
+type prefetchSession struct {
+	id     string
+	ctx    context.Context
+	cancel context.CancelFunc
+	idle   *time.Timer
+	// playlists are the segments of each media playlist, by URL, and
+	// positions where each segment is in them
+	playlists map[string][]prefetchItem
+	positions map[string]playlistPosition
+	queued    map[string]bool
+	// window is how many segments to run ahead, at most the setting. It
+	// halves on a slow fetch and grows back by one on a fast one; at zero
+	// prefetching pauses until resume. It is -1 until the first segment.
+	window int
+	resume time.Time
+}
+
+func newPrefetcher() *prefetcher {
+	return &prefetcher{sem: make(chan struct{}, prefetchConcurrency)}
+}
+
+// sessionFor returns the session of stream id, ending the session of any
+// other stream. The session is kept alive for prefetchIdle. p.mu must be held.
+func (p *prefetcher) sessionFor(id string) *prefetchSession {
+	if s := p.session; s != nil && s.id == id {
+		s.idle.Reset(prefetchIdle)
+		return s
+	}
+	p.endLocked()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &prefetchSession{
+		id:        id,
+		ctx:       ctx,
+		cancel:    cancel,
+		playlists: make(map[string][]prefetchItem),
+		positions: make(map[string]playlistPosition),
+		queued:    make(map[string]bool),
+		window:    -1,
+	}
+	s.idle = time.AfterFunc(prefetchIdle, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.session == s {
+			p.endLocked()
+		}
+	})
+	p.session = s
+	return s
+}
+
+// endLocked cancels the current session; p.mu must be held
+func (p *prefetcher) endLocked() {
+	if s := p.session; s != nil {
+		s.idle.Stop()
+		s.cancel()
+		p.session = nil
+	}
+}
+
+// stop cancels any prefetching
+func (p *prefetcher) stop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endLocked()
+}
+
+// notePlaylist records the segments of a media playlist served for stream id
+func (a *AnimeService) notePlaylist(id, playlistURL string, pl *hlsPlaylist) {
+	if a.prefetch == nil || pl.IsMaster() {
+		return
+	}
+	segments, err := pl.Segments(playlistURL)
+	if err != nil {
+		return
+	}
+	items := make([]prefetchItem, 0, len(segments))
+	for _, seg := range segments {
+		// Sub-ranges are requested with a Range header and never cached
+		if seg.ByteRange != nil || !cacheableSegment(seg.URL) {
+			continue
+		}
+		items = append(items, prefetchItem{url: seg.URL, duration: seg.Duration})
+	}
+
+	p := a.prefetch
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.sessionFor(id)
+	// Live playlists are served again as they move on
+	for _, old := range s.playlists[playlistURL] {
+		delete(s.positions, old.url)
+	}
+	s.playlists[playlistURL] = items
+	for i, item := range items {
+		s.positions[item.url] = playlistPosition{playlist: playlistURL, index: i}
+	}
+}
+
+// prefetchAfter queues the segments following segURL that are not cached
+// yet, up to the prefetch window
+func (a *AnimeService) prefetchAfter(id, segURL string, info *StreamInfo) {
+	p := a.prefetch
+	if p == nil {
+		return
+	}
+	limit := min(a.GetSettings().PrefetchSegments, maxPrefetchSegments)
+	if limit <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.sessionFor(id)
+	if s.window < 0 || s.window > limit {
+		s.window = limit
+	}
+	if s.window == 0 {
+		if time.Now().Before(s.resume) {
+			return
+		}
+		s.window = 1
+	}
+
+	pos, ok := s.positions[segURL]
+	items := s.playlists[pos.playlist]
+	if !ok || pos.index >= len(items) {
+		return
+	}
+	epDir := a.getEpisodeDir(info.AnimeName, info.EpisodeNum)
+	for _, item := range items[pos.index+1 : min(pos.index+1+s.window, len(items))] {
+		name := segmentFilename(item.url)
+		if s.queued[item.url] || a.segments.has(name) {
+			continue
+		}
+		if info.AnimeName != "" {
+			if _, err := os.Stat(filepath.Join(epDir, name)); err == nil {
+				continue
+			}
+		}
+		s.queued[item.url] = true
+		go a.prefetchSegment(s, item, info)
+	}
+}
+
+// prefetchSegment fetches a segment into the cache, unless the player or
+// another prefetch is fetching it already
+func (a *AnimeService) prefetchSegment(s *prefetchSession, item prefetchItem, info *StreamInfo) {
+	p := a.prefetch
+	defer func() {
+		p.mu.Lock()
+		delete(s.queued, item.url)
+		p.mu.Unlock()
+	}()
+
+	select {
+	case p.sem <- struct{}{}:
+		defer func() { <-p.sem }()
+	case <-s.ctx.Done():
+		return
+	}
+
+	name := segmentFilename(item.url)
+	if _, leader := a.segments.flight(name); !leader {
+		return
+	}
+	defer a.segments.endFlight(name)
+	if a.segments.has(name) {
+		return
+	}
+
+	start := time.Now()
+	err := a.fetchIntoCache(s.ctx, item.url, name, info)
+	if s.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		fmt.Printf("[Prefetch] %s: %v\n", name, err)
+	}
+	slow := err != nil || item.duration > 0 && time.Since(start).Seconds() > item.duration*prefetchSlowRatio
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.adjust(slow)
+}
+
+// adjust shrinks the window after a slow fetch and grows it after a fast
+// one; p.mu must be held
+func (s *prefetchSession) adjust(slow bool) {
+	if !slow {
+		s.window++
+		return
+	}
+	s.window /= 2
+	if s.window == 0 {
+		s.resume = time.Now().Add(prefetchPause)
+	}
+}
+
+// fetchIntoCache requests a segment with the stream's headers and caches it
+// if the whole of it arrives
+func (a *AnimeService) fetchIntoCache(ctx context.Context, target, name string, info *StreamInfo) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range info.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := a.upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	length, ok := completeLength(resp)
+	if !ok {
+		return fmt.Errorf("upstream answered %d", resp.StatusCode)
+	}
+	return a.segments.store(io.Discard, resp, name, length, info)
+}
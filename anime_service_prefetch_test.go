@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyPrefetchesAheadOfPlayhead(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/index.m3u8":
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n")
+			for i := 0; i < 6; i++ {
+				fmt.Fprintf(w, "#EXTINF:4,\nseg%d.ts\n", i)
+			}
+			io.WriteString(w, "#EXT-X-ENDLIST\n")
+		case r.URL.Path == "/other.m3u8":
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nfast.ts\n#EXTINF:4,\nslow.ts\n#EXT-X-ENDLIST\n")
+		case r.URL.Path == "/slow.ts":
+			<-r.Context().Done()
+			close(cancelled)
+		default:
+			io.WriteString(w, "segment "+r.URL.Path)
+		}
+	}))
+	defer upstream.Close()
+	fetched := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+
+	cacheDir := t.TempDir()
+	a := &AnimeService{
+		metadata: newMemoryMetadataStore(),
+		proxyCache: map[string]*StreamInfo{
+			"1": {URL: upstream.URL + "/index.m3u8", IsHLS: true},
+			"2": {URL: upstream.URL + "/other.m3u8", IsHLS: true},
+		},
+		proxyKey:       []byte("session key"),
+		cacheDir:       cacheDir,
+		segments:       newSegmentCache(cacheDir, 0),
+		prefetch:       newPrefetcher(),
+		downloadsDir:   t.TempDir(),
+		upstreamClient: upstream.Client(),
+		settings:       AppSettings{PrefetchSegments: 2},
+	}
+	defer a.prefetch.stop()
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.proxyHandler(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+	// The proxied segment URLs of a stream's playlist, in order
+	open := func(id string) []string {
+		t.Helper()
+		rec := get(a.proxyURL(id, ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("playlist %s answered %d", id, rec.Code)
+		}
+		var segments []string
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "/proxy?") {
+				segments = append(segments, line)
+			}
+		}
+		return segments
+	}
+	cached := func(path string) bool {
+		return a.segments.has(segmentFilename(upstream.URL + path))
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !cond(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Playing a segment fetches the next two into the cache
+	segments := open("1")
+	if len(segments) != 6 {
+		t.Fatalf("got %d segments", len(segments))
+	}
+	if rec := get(segments[0]); rec.Code != http.StatusOK {
+		t.Fatalf("segment answered %d", rec.Code)
+	}
+	waitFor("seg1 and seg2", func() bool { return cached("/seg1.ts") && cached("/seg2.ts") })
+	if n := fetched("/seg3.ts"); n != 0 {
+		t.Errorf("seg3 fetched %d times, beyond the window", n)
+	}
+
+	// The player then finds them there
+	if rec := get(segments[1]); rec.Body.String() != "segment /seg1.ts" {
+		t.Errorf("seg1 body %q", rec.Body.String())
+	}
+	if n := fetched("/seg1.ts"); n != 1 {
+		t.Errorf("seg1 fetched %d times", n)
+	}
+	if stats := a.segments.stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("hits %d, misses %d", stats.Hits, stats.Misses)
+	}
+
+	// Opening another stream cancels prefetching for this one
+	other := open("2")
+	get(other[0])
+	waitFor("slow.ts to be requested", func() bool { return fetched("/slow.ts") == 1 })
+	open("1")
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("prefetch of the previous stream not cancelled")
+	}
+}
+
+func TestPrefetchWindowBacksOff(t *testing.T) {
+	s := &prefetchSession{window: 4}
+	s.adjust(true)
+	s.adjust(true)
+	if s.window != 1 {
+		t.Errorf("window %d after two slow fetches, want 1", s.window)
+	}
+	s.adjust(true)
+	if s.window != 0 || !s.resume.After(time.Now()) {
+		t.Errorf("window %d, resume %v: prefetching not paused", s.window, s.resume)
+	}
+	s.adjust(false)
+	if s.window != 1 {
+		t.Errorf("window %d after a fast fetch, want 1", s.window)
+	}
+}
@@ -1,31 +1,140 @@
 package main
 
 import (
-	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/hex"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
 )
 
-func (a *AnimeService) startProxyServer() {
-	http.HandleFunc("/proxy", a.proxyHandler)
+// The proxy listens on loopback only and serves URLs the app signed. It
+// fetches upstream only from hosts the stream or its playlists named, and
+// never from local addresses, so it cannot be used as a relay into the LAN.
+
+// startProxyServer starts the proxy on its preferred port, or on any free
+// port when that one is taken. Proxy URLs use the port it got.
+func (a *AnimeService) startProxyServer() error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(a.proxyHost, a.proxyPort))
+	if err != nil {
+		fmt.Printf("Proxy port %s unavailable (%v), using a free port\n", a.proxyPort, err)
+		ln, err = net.Listen("tcp", net.JoinHostPort(a.proxyHost, "0"))
+		if err != nil {
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy", a.proxyHandler)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	a.proxyMutex.Lock()
+	a.proxyServer = srv
+	a.proxyBase = "http://" + ln.Addr().String()
+	a.proxyMutex.Unlock()
+
+	fmt.Printf("Starting stream proxy on %s\n", ln.Addr())
 	go func() {
-		fmt.Printf("Starting stream proxy on :%s\n", a.proxyPort)
-		if err := http.ListenAndServe(":"+a.proxyPort, nil); err != nil {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			fmt.Printf("Proxy server error: %v\n", err)
 		}
 	}()
+	return nil
+}
+
+// newProxyKey makes the key proxy URLs are signed with, new every session
+func newProxyKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("proxy key: %v", err))
+	}
+	return key
+}
+
+// newUpstreamClient is the client the proxy fetches with. It shares the rate
+// limits of the other clients but refuses to connect to loopback, private
+// and link-local addresses.
+func newUpstreamClient() *http.Client {
+	base := &http.Transport{
+		DialContext:           transport.PublicDialer(30 * time.Second).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{Timeout: 120 * time.Second, Transport: transport.Default.Wrap(base)}
+}
+
+// proxySignature signs the stream id and upstream URL of a proxy URL. An
+// empty target is the stream itself.
+func (a *AnimeService) proxySignature(id, target string) string {
+	mac := hmac.New(sha256.New, a.proxyKey)
+	mac.Write([]byte(id))
+	mac.Write([]byte{0})
+	mac.Write([]byte(target))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (a *AnimeService) validProxySignature(id, target, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(a.proxySignature(id, target)))
+}
+
+// upstreamHost is the host an upstream URL is allowed by, empty for
+// anything but http and https
+func upstreamHost(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// allowUpstream lets stream id fetch from the hosts of urls
+func (a *AnimeService) allowUpstream(id string, urls ...string) {
+	a.proxyMutex.Lock()
+	defer a.proxyMutex.Unlock()
+	if a.proxyHosts == nil {
+		a.proxyHosts = make(map[string]map[string]bool)
+	}
+	hosts := a.proxyHosts[id]
+	if hosts == nil {
+		hosts = make(map[string]bool)
+		a.proxyHosts[id] = hosts
+	}
+	for _, u := range urls {
+		if h := upstreamHost(u); h != "" {
+			hosts[h] = true
+		}
+	}
+}
+
+func (a *AnimeService) upstreamAllowed(id, target string) bool {
+	h := upstreamHost(target)
+	a.proxyMutex.RLock()
+	defer a.proxyMutex.RUnlock()
+	return h != "" && a.proxyHosts[id][h]
 }
 
 func (a *AnimeService) proxyHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
+	query := r.URL.Query()
+	id := query.Get("id")
+	targetURL := query.Get("url")
+	if !a.validProxySignature(id, targetURL, query.Get("sig")) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
 
 	a.proxyMutex.RLock()
 	streamInfo, exists := a.proxyCache[id]
@@ -36,7 +145,16 @@ func (a *AnimeService) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	targetURL := r.URL.Query().Get("url")
+	// Requests without a URL are for the stream itself, not a segment.
+	// Opening a stream pins its segments in the cache.
+	isRoot := targetURL == ""
+	if isRoot {
+		a.segments.pin(cacheStreamKey(streamInfo.AnimeName, streamInfo.EpisodeNum))
+	}
+	if !isRoot && !a.upstreamAllowed(id, targetURL) {
+		http.Error(w, "Upstream host not allowed", http.StatusForbidden)
+		return
+	}
 
 	if targetURL == "" {
 		epDir := a.getEpisodeDir(streamInfo.AnimeName, streamInfo.EpisodeNum)
@@ -54,7 +172,7 @@ func (a *AnimeService) proxyHandler(w http.ResponseWriter, r *http.Request) {
 			a.LogProxyEvent(fmt.Sprintf("Serving LOCAL playlist (remuxed) for %s - Ep %s", streamInfo.AnimeName, streamInfo.EpisodeNum))
 			data, err := os.ReadFile(localPlaylist)
 			if err == nil {
-				a.rewriteM3U8(w, r, string(data), streamInfo.URL, id)
+				a.servePlaylist(w, vodPlaylist(string(data), streamInfo.URL), streamInfo.URL, id)
 				return
 			}
 		}
@@ -65,67 +183,74 @@ func (a *AnimeService) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ext := getUrlExtension(targetURL)
-	isVideoSegment := ext == ".ts" || ext == ".m4s" || ext == ".mp4" || ext == ".m3u8" || ext == ".aspx" || ext == ".avi"
-
-	if isVideoSegment {
-		hash := sha256.Sum256([]byte(targetURL))
-		filename := hex.EncodeToString(hash[:]) + ext
-		// Only force index.m3u8 if the request is for the root playlist
-		if ext == ".m3u8" && (targetURL == streamInfo.URL || !strings.Contains(targetURL, hex.EncodeToString(hash[:]))) {
-			filename = "index.m3u8"
-		}
 
-		if streamInfo.AnimeName != "" && streamInfo.EpisodeNum != "" {
-			epDir := a.getEpisodeDir(streamInfo.AnimeName, streamInfo.EpisodeNum)
-			persistentPath := filepath.Join(epDir, filename)
-			if _, err := os.Stat(persistentPath); err == nil {
-				if ext == ".m3u8" {
-					data, err := os.ReadFile(persistentPath)
-					if err == nil {
-						fmt.Printf("[Proxy] Serving LOCAL playlist from persistent storage: %s\n", filename)
-						a.LogProxyEvent(fmt.Sprintf("Serving LOCAL playlist from persistent storage: %s", filename))
-						a.rewriteM3U8(w, r, string(data), targetURL, id)
-						return
-					}
+	filename := segmentFilename(targetURL)
+	// Only force index.m3u8 if the request is for the root playlist, so
+	// variant and rendition playlists of a master stay apart
+	if ext == ".m3u8" && targetURL == streamInfo.URL {
+		filename = "index.m3u8"
+	}
+
+	// Downloaded episodes keep segments, init maps and keys in their directory
+	if streamInfo.AnimeName != "" && streamInfo.EpisodeNum != "" {
+		epDir := a.getEpisodeDir(streamInfo.AnimeName, streamInfo.EpisodeNum)
+		persistentPath := filepath.Join(epDir, filename)
+		if _, err := os.Stat(persistentPath); err == nil {
+			if ext == ".m3u8" {
+				data, err := os.ReadFile(persistentPath)
+				if err == nil {
+					fmt.Printf("[Proxy] Serving LOCAL playlist from persistent storage: %s\n", filename)
+					a.LogProxyEvent(fmt.Sprintf("Serving LOCAL playlist from persistent storage: %s", filename))
+					a.servePlaylist(w, vodPlaylist(string(data), targetURL), targetURL, id)
+					return
 				}
-				fmt.Printf("[Proxy] Serving PERSISTENT local file: %s (Path: %s)\n", filename, persistentPath)
-				a.LogProxyEvent(fmt.Sprintf("Serving PERSISTENT local file: %s", filename))
-				http.ServeFile(w, r, persistentPath)
-				return
 			}
+			fmt.Printf("[Proxy] Serving PERSISTENT local file: %s (Path: %s)\n", filename, persistentPath)
+			a.LogProxyEvent(fmt.Sprintf("Serving PERSISTENT local file: %s", filename))
+			http.ServeFile(w, r, persistentPath)
+			return
 		}
+	}
 
-		cachePath := filepath.Join(a.cacheDir, filename)
-		if _, err := os.Stat(cachePath); err == nil {
-			fmt.Printf("[Proxy] Serving CACHED segment: %s\n", filename)
-			a.LogProxyEvent(fmt.Sprintf("Serving CACHED segment: %s", filename))
-			http.ServeFile(w, r, cachePath)
+	if cacheableSegment(targetURL) {
+		name := segmentFilename(targetURL)
+		a.prefetchAfter(id, targetURL, streamInfo)
+		if a.serveCachedSegment(w, r, name) {
+			a.segments.count(streamInfo.AnimeName, true)
 			return
 		}
-
-		fmt.Printf("[Proxy] Local file NOT FOUND: %s (Target: %s)\n", filename, targetURL)
+		// Another request fetching the same segment caches it for this one
+		if done, leader := a.segments.flight(name); leader {
+			defer a.segments.endFlight(name)
+		} else {
+			select {
+			case <-done:
+			case <-r.Context().Done():
+				return
+			}
+			if a.serveCachedSegment(w, r, name) {
+				a.segments.count(streamInfo.AnimeName, true)
+				return
+			}
+		}
+		a.segments.count(streamInfo.AnimeName, false)
 	}
 
 	a.LogProxyEvent(fmt.Sprintf("Proxying stream: %s", targetURL))
-	req, err := http.NewRequest("GET", targetURL, nil)
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-
-	// Forward stored headers
-	if streamInfo.Headers != nil {
-		for k, v := range streamInfo.Headers {
-			req.Header.Set(k, v)
+	resp, err := a.fetchUpstream(r, targetURL, streamInfo.Headers)
+
+	// The CDN refusing the stream itself: switch to another mirror or
+	// source and retry
+	for isRoot && err == nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound) {
+		next, ok := a.failoverStream(r.Context(), id, targetURL)
+		if !ok {
+			break
 		}
+		resp.Body.Close()
+		streamInfo, targetURL = next, next.URL
+		a.LogProxyEvent(fmt.Sprintf("Proxying stream: %s", targetURL))
+		resp, err = a.fetchUpstream(r, targetURL, streamInfo.Headers)
 	}
-
-	// Range header is required for seeking support in HLS players
-	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
-		req.Header.Set("Range", rangeHeader)
-	}
-
-	resp, err := httpClient.Do(req)
 	if err != nil {
 		http.Error(w, "Failed to fetch upstream", http.StatusBadGateway)
 		return
@@ -160,23 +285,10 @@ func (a *AnimeService) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if isVideoSegment {
-		hash := sha256.Sum256([]byte(targetURL))
-		filename := hex.EncodeToString(hash[:]) + ext
-		cachePath := filepath.Join(a.cacheDir, filename)
-
-		out, err := os.Create(cachePath)
-		if err != nil {
-			fmt.Printf("Failed to create cache file: %v\n", err)
-			io.Copy(w, resp.Body)
-			return
-		}
-
-		mw := io.MultiWriter(w, out)
-		_, err = io.Copy(mw, resp.Body)
-		out.Close()
-		if err != nil {
-			os.Remove(cachePath)
+	// Partial and failed responses are passed through, never cached
+	if length, ok := completeLength(resp); cacheableSegment(targetURL) && ok {
+		if err := a.segments.store(w, resp, segmentFilename(targetURL), length, streamInfo); err != nil {
+			fmt.Printf("[Proxy] Segment not cached: %v\n", err)
 		}
 		return
 	}
@@ -185,36 +297,56 @@ func (a *AnimeService) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, resp.Body)
 }
 
-func (a *AnimeService) rewriteM3U8(w http.ResponseWriter, r *http.Request, content string, targetURL string, id string) {
-	baseURL, err := url.Parse(targetURL)
+// fetchUpstream requests target with the stream's stored headers
+func (a *AnimeService) fetchUpstream(r *http.Request, target string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), "GET", target, nil)
 	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	// Range header is required for seeking support in HLS players
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	return a.upstreamClient.Do(req)
+}
+
+// proxyURL is the signed proxy URL of absURL for stream id; an empty absURL
+// is the stream itself
+func (a *AnimeService) proxyURL(id, absURL string) string {
+	q := url.Values{"id": {id}}
+	if absURL != "" {
+		q.Set("url", absURL)
+	}
+	q.Set("sig", a.proxySignature(id, absURL))
+
+	a.proxyMutex.RLock()
+	base := a.proxyBase
+	a.proxyMutex.RUnlock()
+	return base + "/proxy?" + q.Encode()
+}
+
+func (a *AnimeService) rewriteM3U8(w http.ResponseWriter, r *http.Request, content string, targetURL string, id string) {
+	if _, err := url.Parse(targetURL); err != nil {
 		fmt.Printf("Failed to parse base URL: %v\n", err)
 		w.Write([]byte(content))
 		return
 	}
 
-	var lines []string
-	scanner := bufio.NewScanner(strings.NewReader(content))
-	for scanner.Scan() {
-		line := scanner.Text()
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
-			lines = append(lines, line)
-			continue
-		}
-
-		refURL, err := url.Parse(trimmed)
-		if err != nil {
-			lines = append(lines, line)
-			continue
-		}
-		absURL := baseURL.ResolveReference(refURL).String()
+	a.servePlaylist(w, parsePlaylist(content), targetURL, id)
+}
 
-		newLine := fmt.Sprintf("http://localhost:%s/proxy?id=%s&url=%s", a.proxyPort, id, url.QueryEscape(absURL))
-		lines = append(lines, newLine)
-	}
+func (a *AnimeService) servePlaylist(w http.ResponseWriter, p *hlsPlaylist, targetURL string, id string) {
+	a.notePlaylist(id, targetURL, p)
 
-	newContent := strings.Join(lines, "\n")
+	// Every URI goes through the proxy, including the ones inside
+	// EXT-X-KEY/MAP/MEDIA attributes, so upstream sees the stored headers
+	newContent := p.Rewrite(targetURL, func(absURL, kind string) string {
+		a.allowUpstream(id, absURL)
+		return a.proxyURL(id, absURL)
+	})
 	w.Header().Set("Content-Length", strconv.Itoa(len(newContent)))
 	w.Write([]byte(newContent))
 }
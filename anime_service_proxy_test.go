@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+func TestProxyServesOnlySignedAllowedURLs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts\n#EXT-X-ENDLIST\n")
+		case "/seg0.ts":
+			io.WriteString(w, "segment")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	cacheDir := t.TempDir()
+	a := &AnimeService{
+		metadata:       newMemoryMetadataStore(),
+		proxyCache:     map[string]*StreamInfo{"1": {URL: upstream.URL + "/index.m3u8", IsHLS: true}},
+		proxyBase:      "http://127.0.0.1:34116",
+		proxyKey:       []byte("session key"),
+		cacheDir:       cacheDir,
+		segments:       newSegmentCache(cacheDir, 0),
+		downloadsDir:   t.TempDir(),
+		upstreamClient: upstream.Client(),
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.proxyHandler(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	// Unsigned and re-signed with another key
+	if rec := get("/proxy?id=1&url=" + upstream.URL + "/seg0.ts"); rec.Code != http.StatusForbidden {
+		t.Errorf("unsigned URL answered %d", rec.Code)
+	}
+	other := &AnimeService{proxyBase: "http://127.0.0.1:34116", proxyKey: []byte("other key")}
+	if rec := get(other.proxyURL("1", "")); rec.Code != http.StatusForbidden {
+		t.Errorf("URL signed with another key answered %d", rec.Code)
+	}
+
+	// A signed URL to a host no playlist named
+	if rec := get(a.proxyURL("1", "http://192.168.1.1/admin")); rec.Code != http.StatusForbidden {
+		t.Errorf("URL to an unlisted host answered %d", rec.Code)
+	}
+
+	// The playlist's segments come back signed and allowed
+	rec := get(a.proxyURL("1", ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("playlist answered %d", rec.Code)
+	}
+	var segment string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "http://127.0.0.1:34116/proxy?") {
+			segment = line
+		}
+	}
+	if segment == "" {
+		t.Fatalf("no proxied segment in %q", rec.Body.String())
+	}
+	if rec := get(segment); rec.Code != http.StatusOK || rec.Body.String() != "segment" {
+		t.Errorf("segment answered %d %q", rec.Code, rec.Body.String())
+	}
+
+	// The default upstream client does not connect to local addresses
+	a.upstreamClient = newUpstreamClient()
+	if rec := get(a.proxyURL("1", "")); rec.Code != http.StatusBadGateway {
+		t.Errorf("loopback upstream answered %d", rec.Code)
+	}
+}
+
+func TestProxyServerPortFallbackAndShutdown(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, port, _ := net.SplitHostPort(taken.Addr().String())
+
+	a := &AnimeService{
+		metadata:    newMemoryMetadataStore(),
+		proxyCache:  make(map[string]*StreamInfo),
+		proxyHost:   "127.0.0.1",
+		proxyPort:   port,
+		proxyKey:    []byte("session key"),
+		cancelFuncs: make(map[string]context.CancelCauseFunc),
+	}
+	if err := a.startProxyServer(); err != nil {
+		t.Fatal(err)
+	}
+	if a.proxyBase == "" || a.proxyBase == "http://127.0.0.1:"+port {
+		t.Fatalf("proxy base %q, want another port than the taken %s", a.proxyBase, port)
+	}
+	target := a.proxyURL("unknown", "")
+	if !strings.HasPrefix(target, a.proxyBase+"/proxy?") {
+		t.Errorf("proxy URL %s not on %s", target, a.proxyBase)
+	}
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown stream answered %d", resp.StatusCode)
+	}
+
+	// Shutdown stops running downloads with a cause that keeps them queued,
+	// and closes the proxy
+	ctx, cancel := context.WithCancelCause(context.Background())
+	a.cancelFuncs["Frieren:1"] = cancel
+	a.shutdown(context.Background())
+	if !errors.Is(context.Cause(ctx), errShuttingDown) {
+		t.Errorf("download cause = %v", context.Cause(ctx))
+	}
+	if _, err := http.Get(target); err == nil {
+		t.Error("proxy still serving after shutdown")
+	}
+	if err := a.downloadEpisode(DownloadJob{AnimeName: "Frieren", EpNumStr: "2"}); !errors.Is(err, errShuttingDown) {
+		t.Errorf("download started after shutdown: %v", err)
+	}
+}
+
+func TestProxyCachesOnlyCompleteSegments(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/seg0.ts":
+			if hits.Add(1) > 1 {
+				<-release
+			}
+			w.Header().Set("Content-Type", "video/mp2t")
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+		default:
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	cacheDir := t.TempDir()
+	a := &AnimeService{
+		metadata:       newMemoryMetadataStore(),
+		proxyCache:     map[string]*StreamInfo{"1": {URL: upstream.URL + "/index.m3u8", IsHLS: true}},
+		proxyKey:       []byte("session key"),
+		cacheDir:       cacheDir,
+		segments:       newSegmentCache(cacheDir, 0),
+		downloadsDir:   t.TempDir(),
+		upstreamClient: upstream.Client(),
+	}
+	a.allowUpstream("1", upstream.URL)
+	segment, broken := upstream.URL+"/seg0.ts", upstream.URL+"/seg1.ts"
+	get := func(target, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", a.proxyURL("1", target), nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		a.proxyHandler(rec, req)
+		return rec
+	}
+	cached := func() []string {
+		entries, _ := os.ReadDir(a.cacheDir)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	// Neither a partial nor a failed response is stored
+	if rec := get(segment, "bytes=2-4"); rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Fatalf("range answered %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(broken, ""); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("broken segment answered %d", rec.Code)
+	}
+	if names := cached(); len(names) != 0 {
+		t.Fatalf("cached %v", names)
+	}
+
+	// Concurrent requests share one upstream fetch
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies[i] = get(segment, "").Body.String()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, body := range bodies {
+		if body != "0123456789" {
+			t.Errorf("segment body %q", body)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("%d upstream fetches for the segment, want 1 after the range", n-1)
+	}
+
+	// The cached segment keeps its type and answers ranges itself
+	name := segmentFilename(segment)
+	if names := cached(); len(names) != 2 || names[0] != name || names[1] != name+".meta" {
+		t.Errorf("cache holds %v, want the segment and its sidecar", names)
+	}
+	rec := get(segment, "bytes=2-4")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" || rec.Header().Get("Content-Type") != "video/mp2t" {
+		t.Errorf("cached range answered %d %q %s", rec.Code, rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("cached segment fetched upstream again")
+	}
+
+	// A segment whose length does not match its sidecar is not served
+	os.WriteFile(filepath.Join(a.cacheDir, name), []byte("01234"), 0644)
+	if _, _, ok := a.segments.lookup(name); ok {
+		t.Error("truncated segment served from the cache")
+	}
+}
+
+// masterResolver resolves every episode to a master playlist
+type masterResolver struct {
+	fakeResolver
+	url string
+}
+
+func (m *masterResolver) ResolveStream(ctx context.Context, req *types.StreamRequest) (*types.StreamResult, error) {
+	return &types.StreamResult{URL: m.url, Source: types.SourceAnimeFire}, nil
+}
+
+func TestProxyAdaptiveStreaming(t *testing.T) {
+	const master = "#EXTM3U\n" +
+		"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"English\",DEFAULT=YES,URI=\"audio/en.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,AUDIO=\"aud\"\n" +
+		"1080/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,AUDIO=\"aud\"\n" +
+		"720/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=854x480,AUDIO=\"aud\"\n" +
+		"480/index.m3u8\n"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/master.m3u8":
+			io.WriteString(w, master)
+		case strings.HasSuffix(r.URL.Path, ".m3u8"):
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\nseg0.ts\n#EXT-X-ENDLIST\n")
+		default:
+			io.WriteString(w, "segment")
+		}
+	}))
+	defer upstream.Close()
+
+	stream := func(adaptive bool) (*StreamInfo, string) {
+		t.Helper()
+		a := newTestService(t, "")
+		a.resolver = &masterResolver{url: upstream.URL + "/master.m3u8"}
+		a.proxyKey = []byte("session key")
+		a.upstreamClient = upstream.Client()
+		a.settings.AdaptiveStreaming = adaptive
+
+		info, err := a.GetStreamUrlWithQuality("Frieren", "af-frieren", "AnimeFire", "1", "af-frieren/1", 1, false, "720p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		a.proxyHandler(rec, httptest.NewRequest("GET", info.URL, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("playlist answered %d", rec.Code)
+		}
+		// Every URI the playlist names must be reachable through the proxy
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			uri := line
+			if i := strings.Index(line, `URI="`); i >= 0 {
+				uri = strings.SplitN(line[i+len(`URI="`):], `"`, 2)[0]
+			} else if strings.HasPrefix(line, "#") || line == "" {
+				continue
+			}
+			proxied := httptest.NewRecorder()
+			a.proxyHandler(proxied, httptest.NewRequest("GET", uri, nil))
+			if proxied.Code != http.StatusOK {
+				t.Errorf("%s answered %d", uri, proxied.Code)
+			}
+		}
+		return info, rec.Body.String()
+	}
+
+	// The master playlist goes to the player as it is, its URIs signed
+	info, body := stream(true)
+	if info.Quality != "auto" || info.Resolution != "" {
+		t.Errorf("adaptive stream quality %q, resolution %q", info.Quality, info.Resolution)
+	}
+	want := strings.Split(strings.TrimSuffix(master, "\n"), "\n")
+	got := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("master playlist has %d lines, want %d:\n%s", len(got), len(want), body)
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if j := strings.Index(w, `URI="`); j >= 0 {
+			end := strings.Index(w[j+len(`URI="`):], `"`) + j + len(`URI="`)
+			if !strings.HasPrefix(g, w[:j]+`URI="/proxy?`) || !strings.HasSuffix(g, w[end:]) {
+				t.Errorf("line %d = %q, want %q with the URI proxied", i, g, w)
+			}
+		} else if w != "" && !strings.HasPrefix(w, "#") {
+			if !strings.HasPrefix(g, "/proxy?") {
+				t.Errorf("line %d = %q, want %s proxied", i, g, w)
+			}
+		} else if g != w {
+			t.Errorf("line %d = %q, want %q", i, g, w)
+		}
+	}
+
+	// Without it the variant for the quality is picked and served alone
+	info, body = stream(false)
+	if info.Quality != "720p" || info.Resolution != "1280x720" || info.Bandwidth != 2500000 {
+		t.Errorf("stream quality %q, resolution %q, bandwidth %d", info.Quality, info.Resolution, info.Bandwidth)
+	}
+	if strings.Contains(body, "#EXT-X-STREAM-INF") || !strings.Contains(body, "#EXTINF") {
+		t.Errorf("expected the 720p media playlist, got:\n%s", body)
+	}
+}
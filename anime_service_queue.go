@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	queueStatusQueued  = "queued"
+	queueStatusActive  = "downloading"
+	queueStatusPaused  = "paused"
+	queueStatusFailed  = "failed"
+	queueOrderFIFO     = "fifo"
+	queueOrderPriority = "priority"
+
+	defaultMaxConcurrentDownloads = 2
+)
+
+// DownloadJob is a single episode waiting in (or running from) the download
+// queue. It carries everything DownloadEpisode needs so the job can be
+// restarted after the app is closed.
+type DownloadJob struct {
+	Key         string    `json:"key"`
+	AnimeName   string    `json:"animeName"`
+	AnimeURL    string    `json:"animeUrl"`
+	AnimeSource string    `json:"animeSource"`
+	EpNumStr    string    `json:"epNumStr"`
+	EpURL       string    `json:"epUrl"`
+	EpNum       float64   `json:"epNum"`
+	IsDub       bool      `json:"isDub"`
+	Quality     string    `json:"quality,omitempty"`
+	Priority    int       `json:"priority"`
+	Status      string    `json:"status"`
+	Progress    int       `json:"progress"`
+	Error       string    `json:"error,omitempty"`
+	AddedAt     time.Time `json:"addedAt"`
+}
+
+type QueueSettings struct {
+	MaxConcurrent int    `json:"maxConcurrent"`
+	Ordering      string `json:"ordering"`
+}
+
+type downloadQueue struct {
+	mu       sync.Mutex
+	path     string
+	jobs     []*DownloadJob
+	settings QueueSettings
+}
+
+type queueState struct {
+	Settings QueueSettings  `json:"settings"`
+	Jobs     []*DownloadJob `json:"jobs"`
+}
+
+func newDownloadQueue(path string) *downloadQueue {
+	return &downloadQueue{
+		path: path,
+		settings: QueueSettings{
+			MaxConcurrent: defaultMaxConcurrentDownloads,
+			Ordering:      queueOrderFIFO,
+		},
+	}
+}
+
+func (q *downloadQueue) find(key string) (int, *DownloadJob) {
+	for i, job := range q.jobs {
+		if job.Key == key {
+			return i, job
+		}
+	}
+	return -1, nil
+}
+
+// next returns the job that should start next, or nil if none is waiting or
+// the concurrency limit is reached. Must be called with q.mu held.
+func (q *downloadQueue) next() *DownloadJob {
+	active := 0
+	for _, job := range q.jobs {
+		if job.Status == queueStatusActive {
+			active++
+		}
+	}
+	if active >= q.settings.MaxConcurrent {
+		return nil
+	}
+
+	var best *DownloadJob
+	for _, job := range q.jobs {
+		if job.Status != queueStatusQueued {
+			continue
+		}
+		if q.settings.Ordering != queueOrderPriority {
+			return job
+		}
+		if best == nil || job.Priority > best.Priority {
+			best = job
+		}
+	}
+	return best
+}
+
+// requeue moves a paused or failed job back to the queued state.
+func (q *downloadQueue) requeue(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, job := q.find(key)
+	if job == nil || job.Status == queueStatusActive {
+		return false
+	}
+	requeueLocked(job)
+	return true
+}
+
+// requeueLocked queues a job again. Must be called with q.mu held.
+func requeueLocked(job *DownloadJob) {
+	job.Status = queueStatusQueued
+	job.Error = ""
+}
+
+func (a *AnimeService) loadQueue() {
+	a.queue.mu.Lock()
+	defer a.queue.mu.Unlock()
+
+	data, err := os.ReadFile(a.queue.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error reading download queue: %v\n", err)
+		}
+		return
+	}
+
+	var state queueState
+	if err := json.Unmarshal(data, &state); err != nil {
+		fmt.Printf("Error unmarshaling download queue (resetting): %v\n", err)
+		return
+	}
+
+	if state.Settings.MaxConcurrent > 0 {
+		a.queue.settings.MaxConcurrent = state.Settings.MaxConcurrent
+	}
+	if state.Settings.Ordering != "" {
+		a.queue.settings.Ordering = state.Settings.Ordering
+	}
+
+	resumed := 0
+	for _, job := range state.Jobs {
+		switch job.Status {
+		case queueStatusActive:
+			// Interrupted by shutdown, pick it up again
+			job.Status = queueStatusQueued
+			resumed++
+		case queueStatusQueued:
+			resumed++
+		case queueStatusPaused:
+			paused := *job
+			a.cancelMutex.Lock()
+			a.pausedDownloads[job.Key] = &paused
+			a.cancelMutex.Unlock()
+		}
+		a.queue.jobs = append(a.queue.jobs, job)
+	}
+	fmt.Printf("Loaded %d download jobs from queue (%d to resume)\n", len(a.queue.jobs), resumed)
+}
+
+func (a *AnimeService) saveQueue() {
+	a.queue.mu.Lock()
+	err := a.queue.writeLocked()
+	a.queue.mu.Unlock()
+
+	if err != nil {
+		fmt.Printf("Error saving download queue: %v\n", err)
+	}
+
+	a.emit("download-queue", a.GetQueue())
+}
+
+// writeLocked persists the queue through a temp file so a crash never leaves
+// a truncated queue behind. Must be called with q.mu held.
+func (q *downloadQueue) writeLocked() error {
+	data, err := json.MarshalIndent(queueState{
+		Settings: q.settings,
+		Jobs:     q.jobs,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := q.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, q.path)
+}
+
+// processQueue starts queued jobs until the concurrency limit is reached.
+func (a *AnimeService) processQueue() {
+	if a.closing.Load() {
+		return
+	}
+	for {
+		a.queue.mu.Lock()
+		job := a.queue.next()
+		if job == nil {
+			a.queue.mu.Unlock()
+			return
+		}
+		job.Status = queueStatusActive
+		job.Error = ""
+		jobCopy := *job
+		a.queue.mu.Unlock()
+
+		a.saveQueue()
+		go a.runQueuedJob(jobCopy)
+	}
+}
+
+func (a *AnimeService) runQueuedJob(job DownloadJob) {
+	err := a.downloadEpisode(job)
+
+	a.cancelMutex.RLock()
+	paused, isPaused := a.pausedDownloads[job.Key]
+	a.cancelMutex.RUnlock()
+
+	a.queue.mu.Lock()
+	idx, current := a.queue.find(job.Key)
+	switch {
+	case current == nil:
+		// Removed through CancelQueued while running
+	case errors.Is(err, errShuttingDown):
+		// Stays active so the next start resumes it
+	case isPaused:
+		current.Status = queueStatusPaused
+		current.Progress = paused.Progress
+	case err != nil:
+		current.Status = queueStatusFailed
+		current.Error = err.Error()
+	default:
+		a.queue.jobs = append(a.queue.jobs[:idx], a.queue.jobs[idx+1:]...)
+	}
+	a.queue.mu.Unlock()
+
+	a.saveQueue()
+	a.processQueue()
+}
+
+// EnqueueDownloads adds episodes to the download queue. A failed episode is
+// queued again; one that is queued, running or paused is left untouched.
+// Returns the jobs that were added or queued again.
+func (a *AnimeService) EnqueueDownloads(jobs []DownloadJob) ([]DownloadJob, error) {
+	var added []DownloadJob
+
+	a.queue.mu.Lock()
+	for _, j := range jobs {
+		if j.AnimeName == "" || j.EpNumStr == "" {
+			a.queue.mu.Unlock()
+			return nil, fmt.Errorf("download job is missing anime name or episode")
+		}
+		if err := validateQuality(j.Quality); err != nil {
+			a.queue.mu.Unlock()
+			return nil, err
+		}
+		job := j
+		job.Key = job.AnimeName + ":" + job.EpNumStr
+		if _, existing := a.queue.find(job.Key); existing != nil {
+			if existing.Status == queueStatusFailed {
+				requeueLocked(existing)
+				added = append(added, *existing)
+			}
+			continue
+		}
+		job.Status = queueStatusQueued
+		job.Progress = 0
+		job.Error = ""
+		job.AddedAt = time.Now()
+		a.queue.jobs = append(a.queue.jobs, &job)
+		added = append(added, job)
+	}
+	a.queue.mu.Unlock()
+
+	fmt.Printf("[Queue] Enqueued %d downloads\n", len(added))
+	a.saveQueue()
+	a.processQueue()
+	return added, nil
+}
+
+// GetQueue returns the queued, active, paused and failed jobs in queue order.
+func (a *AnimeService) GetQueue() []DownloadJob {
+	a.queue.mu.Lock()
+	defer a.queue.mu.Unlock()
+
+	out := make([]DownloadJob, len(a.queue.jobs))
+	for i, job := range a.queue.jobs {
+		out[i] = *job
+		if job.Status == queueStatusActive {
+			if p, ok := a.progressMap.Load(job.Key); ok {
+				out[i].Progress = p.(int)
+			}
+		}
+	}
+	return out
+}
+
+// ReorderQueue moves the given keys to the front of the queue in the given
+// order. Jobs that are not listed keep their relative order behind them.
+func (a *AnimeService) ReorderQueue(keys []string) error {
+	a.queue.mu.Lock()
+	reordered := make([]*DownloadJob, 0, len(a.queue.jobs))
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		_, job := a.queue.find(key)
+		if job == nil {
+			a.queue.mu.Unlock()
+			return fmt.Errorf("no queued download for %s", key)
+		}
+		if !seen[key] {
+			reordered = append(reordered, job)
+			seen[key] = true
+		}
+	}
+	for _, job := range a.queue.jobs {
+		if !seen[job.Key] {
+			reordered = append(reordered, job)
+		}
+	}
+	a.queue.jobs = reordered
+	a.queue.mu.Unlock()
+
+	a.saveQueue()
+	return nil
+}
+
+func (a *AnimeService) SetDownloadPriority(key string, priority int) error {
+	a.queue.mu.Lock()
+	_, job := a.queue.find(key)
+	if job == nil {
+		a.queue.mu.Unlock()
+		return fmt.Errorf("no queued download for %s", key)
+	}
+	job.Priority = priority
+	a.queue.mu.Unlock()
+
+	a.saveQueue()
+	return nil
+}
+
+// CancelQueued removes a job from the queue, stopping it first if it is
+// running. Files that were already downloaded are kept.
+func (a *AnimeService) CancelQueued(key string) error {
+	a.queue.mu.Lock()
+	idx, job := a.queue.find(key)
+	if job == nil {
+		a.queue.mu.Unlock()
+		return fmt.Errorf("no queued download for %s", key)
+	}
+	a.queue.jobs = append(a.queue.jobs[:idx], a.queue.jobs[idx+1:]...)
+	animeName, epNumStr, progress := job.AnimeName, job.EpNumStr, job.Progress
+	a.queue.mu.Unlock()
+
+	a.cancelMutex.Lock()
+	cancel, running := a.cancelFuncs[key]
+	if running {
+		cancel(errDownloadCancelled)
+	}
+	delete(a.pausedDownloads, key)
+	a.cancelMutex.Unlock()
+
+	// A running download reports its own cancellation; one that never
+	// started or is paused does not run again to do so
+	if !running {
+		a.emitDownloadProgress(key, animeName, epNumStr, progress, downloadStateCancelled)
+	}
+
+	fmt.Printf("[Queue] Cancelled %s\n", key)
+	a.saveQueue()
+	a.processQueue()
+	return nil
+}
+
+func (a *AnimeService) GetQueueSettings() QueueSettings {
+	a.queue.mu.Lock()
+	defer a.queue.mu.Unlock()
+	return a.queue.settings
+}
+
+func (a *AnimeService) SetQueueSettings(settings QueueSettings) error {
+	if settings.MaxConcurrent < 1 {
+		return fmt.Errorf("max concurrent downloads must be at least 1")
+	}
+	if settings.Ordering != queueOrderFIFO && settings.Ordering != queueOrderPriority {
+		return fmt.Errorf("unknown queue ordering: %s", settings.Ordering)
+	}
+
+	a.queue.mu.Lock()
+	a.queue.settings = settings
+	a.queue.mu.Unlock()
+
+	a.saveQueue()
+	a.processQueue()
+	return nil
+}
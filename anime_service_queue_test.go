@@ -0,0 +1,189 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestQueueNextFollowsOrderingAndLimit(t *testing.T) {
+	a := newTestService(t, "")
+	a.queue.jobs = []*DownloadJob{
+		{Key: "Frieren:1", Status: queueStatusActive},
+		{Key: "Frieren:2", Status: queueStatusQueued},
+		{Key: "Frieren:3", Status: queueStatusPaused, Priority: 9},
+		{Key: "Frieren:4", Status: queueStatusQueued, Priority: 5},
+		{Key: "Frieren:5", Status: queueStatusQueued, Priority: 5},
+	}
+
+	tests := []struct {
+		ordering      string
+		maxConcurrent int
+		want          string
+	}{
+		{queueOrderFIFO, 2, "Frieren:2"},
+		// The first of the highest priority, never a paused job
+		{queueOrderPriority, 2, "Frieren:4"},
+		// The active job takes the only slot
+		{queueOrderFIFO, 1, ""},
+		{queueOrderPriority, 1, ""},
+	}
+	for _, tt := range tests {
+		a.queue.settings = QueueSettings{MaxConcurrent: tt.maxConcurrent, Ordering: tt.ordering}
+		got := ""
+		if job := a.queue.next(); job != nil {
+			got = job.Key
+		}
+		if got != tt.want {
+			t.Errorf("%s with %d slots: next %q, want %q", tt.ordering, tt.maxConcurrent, got, tt.want)
+		}
+	}
+}
+
+func TestQueueReloadsInterruptedAndPausedJobs(t *testing.T) {
+	a := newTestService(t, "")
+	a.queue.settings = QueueSettings{MaxConcurrent: 3, Ordering: queueOrderPriority}
+	a.queue.jobs = []*DownloadJob{
+		{Key: "Frieren:1", AnimeName: "Frieren", EpNumStr: "1", Status: queueStatusActive, Progress: 30},
+		{Key: "Frieren:2", AnimeName: "Frieren", EpNumStr: "2", Status: queueStatusPaused, Progress: 60, Quality: "720p"},
+		{Key: "Frieren:3", AnimeName: "Frieren", EpNumStr: "3", Status: queueStatusFailed, Error: "all mirrors failed"},
+	}
+	a.saveQueue()
+
+	b := newTestService(t, "")
+	b.queue.path = a.queue.path
+	b.loadQueue()
+
+	if s := b.GetQueueSettings(); s != a.queue.settings {
+		t.Errorf("settings %+v, want %+v", s, a.queue.settings)
+	}
+	queue := b.GetQueue()
+	if len(queue) != 3 {
+		t.Fatalf("reloaded %d jobs, want 3", len(queue))
+	}
+	// Interrupted by the shutdown, so it runs again
+	if queue[0].Status != queueStatusQueued {
+		t.Errorf("active job reloaded as %s, want queued", queue[0].Status)
+	}
+	if queue[1].Status != queueStatusPaused || queue[2].Status != queueStatusFailed {
+		t.Errorf("reloaded statuses %s and %s", queue[1].Status, queue[2].Status)
+	}
+	paused := b.pausedDownloads["Frieren:2"]
+	if paused == nil || paused.Progress != 60 || paused.Quality != "720p" {
+		t.Errorf("paused download %+v, want it restored at 60%%", paused)
+	}
+	if len(b.pausedDownloads) != 1 {
+		t.Errorf("%d paused downloads, want 1", len(b.pausedDownloads))
+	}
+}
+
+func TestEnqueueRequeuesFailedJobs(t *testing.T) {
+	a := newTestService(t, "")
+	// Nothing runs, so the jobs stay where the queue puts them
+	a.queue.settings.MaxConcurrent = 0
+	a.queue.jobs = []*DownloadJob{
+		{Key: "Frieren:1", AnimeName: "Frieren", EpNumStr: "1", Status: queueStatusFailed, Error: "all mirrors failed"},
+		{Key: "Frieren:2", AnimeName: "Frieren", EpNumStr: "2", Status: queueStatusPaused},
+	}
+
+	added, err := a.EnqueueDownloads([]DownloadJob{
+		{AnimeName: "Frieren", EpNumStr: "1"},
+		{AnimeName: "Frieren", EpNumStr: "2"},
+		{AnimeName: "Frieren", EpNumStr: "3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || added[0].Key != "Frieren:1" || added[1].Key != "Frieren:3" {
+		t.Fatalf("added %+v, want the failed job and the new one", added)
+	}
+	queue := a.GetQueue()
+	if queue[0].Status != queueStatusQueued || queue[0].Error != "" {
+		t.Errorf("failed job %+v, want it queued again", queue[0])
+	}
+	if queue[1].Status != queueStatusPaused {
+		t.Errorf("paused job %s, want it left paused", queue[1].Status)
+	}
+
+	if _, err := a.EnqueueDownloads([]DownloadJob{{AnimeName: "Frieren", EpNumStr: "4", Quality: "sharpest"}}); err == nil {
+		t.Error("invalid quality accepted")
+	}
+}
+
+func TestReorderQueue(t *testing.T) {
+	a := newTestService(t, "")
+	a.queue.jobs = []*DownloadJob{
+		{Key: "Frieren:1", Status: queueStatusQueued},
+		{Key: "Frieren:2", Status: queueStatusQueued},
+		{Key: "Frieren:3", Status: queueStatusQueued},
+	}
+	order := func() string {
+		var keys string
+		for _, job := range a.GetQueue() {
+			keys += job.Key + " "
+		}
+		return keys
+	}
+
+	if err := a.ReorderQueue([]string{"Frieren:3", "Frieren:9"}); err == nil {
+		t.Error("unknown key accepted")
+	}
+	if got := order(); got != "Frieren:1 Frieren:2 Frieren:3 " {
+		t.Errorf("failed reorder changed the queue to %s", got)
+	}
+
+	if err := a.ReorderQueue([]string{"Frieren:3", "Frieren:2", "Frieren:3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := order(); got != "Frieren:3 Frieren:2 Frieren:1 " {
+		t.Errorf("queue reordered to %s", got)
+	}
+}
+
+func TestCancelQueuedReportsJobThatNeverRan(t *testing.T) {
+	a := newTestService(t, "")
+	a.queue.settings.MaxConcurrent = 0
+	a.queue.jobs = []*DownloadJob{
+		{Key: "Frieren:1", AnimeName: "Frieren", EpNumStr: "1", Status: queueStatusQueued},
+	}
+	// Progress events reach the batches, which is where they can be seen
+	a.activeBatches["b"] = &batchTracker{
+		batch:    DownloadBatch{ID: "b", Keys: []string{"Frieren:1", "Frieren:2"}},
+		progress: make(map[string]int),
+		states:   map[string]string{"Frieren:1": queueStatusQueued, "Frieren:2": queueStatusQueued},
+	}
+
+	if err := a.CancelQueued("Frieren:1"); err != nil {
+		t.Fatal(err)
+	}
+	if state := a.activeBatches["b"].states["Frieren:1"]; state != downloadStateCancelled {
+		t.Errorf("state %q after cancelling, want cancelled", state)
+	}
+	if len(a.GetQueue()) != 0 {
+		t.Error("cancelled job still queued")
+	}
+	if err := a.CancelQueued("Frieren:1"); err == nil {
+		t.Error("cancelling a job no longer queued succeeded")
+	}
+}
+
+func TestSetQueueSettings(t *testing.T) {
+	a := newTestService(t, "")
+	for _, s := range []QueueSettings{
+		{MaxConcurrent: 0, Ordering: queueOrderFIFO},
+		{MaxConcurrent: 2, Ordering: "random"},
+	} {
+		if err := a.SetQueueSettings(s); err == nil {
+			t.Errorf("settings %+v accepted", s)
+		}
+	}
+	want := QueueSettings{MaxConcurrent: 4, Ordering: queueOrderPriority}
+	if err := a.SetQueueSettings(want); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestService(t, "")
+	b.queue.path = a.queue.path
+	b.loadQueue()
+	if got := b.GetQueueSettings(); got != want {
+		t.Errorf("reloaded settings %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	defaultVideoFrameDuration = 3000 // 30fps in the 90kHz clock
+	aacFrameSamples           = 1024
+
+	// Timestamp jumps larger than this between segments are treated as a
+	// discontinuity even when the playlist does not mark one
+	maxSegmentGap = 10 * tsClockRate
+)
+
+// remuxEpisode writes mp4Path from the downloaded segments with the built-in
+// remuxer. FFmpeg is only used as a fallback, when it is installed and the
+// stream is not something the remuxer handles; ffmpegInput holds its input
+// arguments.
+func remuxEpisode(ctx context.Context, epDir string, segments []hlsSegment, mp4Path string, ffmpegInput ...string) error {
+	err := remuxSegments(ctx, epDir, segments, mp4Path)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	fmt.Printf("[Remux] Built-in remuxer failed for %s: %v\n", epDir, err)
+
+	if _, lookErr := exec.LookPath("ffmpeg"); lookErr != nil || len(ffmpegInput) == 0 {
+		return err
+	}
+	fmt.Printf("[Remux] Falling back to FFmpeg for %s\n", epDir)
+	args := append(append([]string{}, ffmpegInput...), "-c", "copy", "-y", mp4Path)
+	if ffErr := exec.CommandContext(ctx, "ffmpeg", args...).Run(); ffErr != nil {
+		return fmt.Errorf("%v; ffmpeg: %w", err, ffErr)
+	}
+	return nil
+}
+
+// remuxSegments joins the downloaded segments of an episode into mp4Path.
+// MPEG-TS segments with H.264 and AAC are remuxed into a fragmented MP4 with
+// one fragment per segment. Fragmented MP4 streams (EXT-X-MAP) already are
+// one, so their segments are written behind the init segment as they are.
+func remuxSegments(ctx context.Context, epDir string, segments []hlsSegment, mp4Path string) error {
+	if len(segments) == 0 {
+		return errors.New("no segments to remux")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(mp4Path), "episode-*.mp4.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriterSize(tmp, 1<<20)
+	reader := &segmentReader{epDir: epDir, keys: make(map[string][]byte)}
+	var header []byte
+	if segments[0].Map != nil {
+		err = joinFMP4(ctx, reader, segments, w)
+	} else {
+		header, err = remuxTS(ctx, reader, segments, w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && header != nil {
+		// The init segment now carries the duration of the episode
+		_, err = tmp.WriteAt(header, 0)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), mp4Path)
+}
+
+// segmentReader reads downloaded segments from an episode directory, cutting
+// out byte ranges and decrypting AES-128 segments with the local key copies.
+type segmentReader struct {
+	epDir    string
+	keys     map[string][]byte
+	lastPath string
+	lastData []byte
+}
+
+func (r *segmentReader) file(rawURL string) ([]byte, error) {
+	path := filepath.Join(r.epDir, segmentFilename(rawURL))
+	// Byte-range playlists point many segments at the same file
+	if path != r.lastPath {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		r.lastPath, r.lastData = path, data
+	}
+	return r.lastData, nil
+}
+
+func (r *segmentReader) read(seg hlsSegment) ([]byte, error) {
+	data, err := r.file(seg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = seg.ByteRange.Slice(data); err != nil {
+		return nil, err
+	}
+	if seg.Key == nil {
+		return data, nil
+	}
+
+	key, ok := r.keys[seg.Key.URL]
+	if !ok {
+		if key, err = os.ReadFile(filepath.Join(r.epDir, segmentFilename(seg.Key.URL))); err != nil {
+			return nil, fmt.Errorf("reading key: %w", err)
+		}
+		r.keys[seg.Key.URL] = key
+	}
+	return decryptAES128(data, key, seg.IV())
+}
+
+func (r *segmentReader) initSegment(m *hlsMap) ([]byte, error) {
+	data, err := r.file(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	return m.ByteRange.Slice(data)
+}
+
+func joinFMP4(ctx context.Context, r *segmentReader, segments []hlsSegment, w io.Writer) error {
+	initMap := segments[0].Map
+	init, err := r.initSegment(initMap)
+	if err != nil {
+		return err
+	}
+	// Copy before the reader moves on to the next file
+	if _, err := w.Write(append([]byte{}, init...)); err != nil {
+		return err
+	}
+
+	for _, seg := range segments {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if seg.Map == nil || seg.Map.URL != initMap.URL || (seg.Map.ByteRange != nil) != (initMap.ByteRange != nil) ||
+			(seg.Map.ByteRange != nil && *seg.Map.ByteRange != *initMap.ByteRange) {
+			return errors.New("streams that switch init segments are not supported")
+		}
+		data, err := r.read(seg)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackState is a track with the samples not written yet. The last sample
+// of a track is always held back until the next one arrives, because its
+// duration is only known from the next sample's timestamp.
+type trackState struct {
+	track        *mp4Track
+	pending      []mp4Sample
+	lastDuration uint32
+	// start and end are the decode times of the first sample written and
+	// of the end of the last one
+	written    bool
+	start, end int64
+}
+
+// tsRemuxer turns demuxed MPEG-TS segments into MP4 fragments. Timestamps
+// are rebased to start at zero and stitched across discontinuities.
+type tsRemuxer struct {
+	w      io.Writer
+	demux  *tsDemuxer
+	video  *trackState
+	audio  *trackState
+	header bool
+	tracks []*mp4Track
+	seq    uint32
+
+	started bool
+	offset  int64 // added to every 90kHz timestamp of the current segment
+	end     int64 // 90kHz decode end of the last sample added
+}
+
+// remuxTS writes the segments to w as a fragmented MP4. The init segment at
+// the start of w is written before the durations are known; the one returned
+// carries them and has the same size, to be written over it.
+func remuxTS(ctx context.Context, reader *segmentReader, segments []hlsSegment, w io.Writer) ([]byte, error) {
+	r := &tsRemuxer{w: w, demux: newTSDemuxer()}
+
+	for i, seg := range segments {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		data, err := reader.read(seg)
+		if err != nil {
+			return nil, err
+		}
+		packets, err := r.demux.Demux(data)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", i, err)
+		}
+		if err := r.addSegment(seg, packets); err != nil {
+			return nil, fmt.Errorf("segment %d: %w", i, err)
+		}
+		if err := r.writeFragment(false); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.writeFragment(true); err != nil {
+		return nil, err
+	}
+
+	for _, s := range []*trackState{r.video, r.audio} {
+		if s != nil && s.written {
+			s.track.Duration = s.end - s.start
+		}
+	}
+	return mp4InitSegment(r.tracks), nil
+}
+
+func (r *tsRemuxer) addSegment(seg hlsSegment, packets []pesPacket) error {
+	// Tracks are fixed once the init segment is written
+	for _, streamType := range r.demux.streams {
+		switch {
+		case r.header:
+		case streamType == tsStreamH264 && r.video == nil:
+			r.video = &trackState{track: &mp4Track{Kind: mp4TrackVideo, Timescale: tsClockRate}}
+		case streamType == tsStreamAAC && r.audio == nil:
+			r.audio = &trackState{track: &mp4Track{Kind: mp4TrackAudio}}
+		}
+	}
+	if r.video == nil && r.audio == nil {
+		return errors.New("no H.264 or AAC stream found")
+	}
+
+	first, found := int64(0), false
+	for _, pes := range packets {
+		if pes.DTS >= 0 && (!found || pes.DTS < first) {
+			first, found = pes.DTS, true
+		}
+	}
+	if found {
+		switch {
+		case !r.started:
+			r.offset, r.started = -first, true
+		case seg.Discontinuity || abs64(first+r.offset-r.end) > maxSegmentGap:
+			r.offset = r.end - first
+		}
+	}
+
+	for _, pes := range packets {
+		switch {
+		case pes.StreamType == tsStreamH264 && r.video != nil:
+			if err := r.addVideo(pes); err != nil {
+				return err
+			}
+		case pes.StreamType == tsStreamAAC && r.audio != nil:
+			r.addAudio(pes)
+		}
+	}
+	return nil
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (r *tsRemuxer) addVideo(pes pesPacket) error {
+	t := r.video.track
+	var data []byte
+	sync := false
+	for _, nal := range splitAnnexB(pes.Data) {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1F {
+		case h264NALSPS:
+			if t.SPS == nil {
+				sps, err := parseSPS(nal)
+				if err != nil {
+					return err
+				}
+				t.SPS, t.Width, t.Height = append([]byte{}, nal...), sps.Width, sps.Height
+			}
+		case h264NALPPS:
+			if t.PPS == nil {
+				t.PPS = append([]byte{}, nal...)
+			}
+		case h264NALAUD:
+			continue
+		case h264NALIDR:
+			sync = true
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nal)))
+		data = append(data, nal...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	var dts, pts int64
+	if pes.DTS >= 0 {
+		dts, pts = pes.DTS+r.offset, pes.PTS+r.offset
+	} else if n := len(r.video.pending); n > 0 {
+		// No timestamp, continue from the previous frame
+		dts = r.video.pending[n-1].DTS + int64(r.frameDuration(r.video))
+		pts = dts
+	} else {
+		return nil
+	}
+
+	r.video.pending = append(r.video.pending, mp4Sample{DTS: dts, CTO: int32(pts - dts), Sync: sync, Data: data})
+	// Decode time, so the next segment continues the DTS timeline
+	if end := dts + int64(r.frameDuration(r.video)); end > r.end {
+		r.end = end
+	}
+	return nil
+}
+
+func (r *tsRemuxer) addAudio(pes pesPacket) {
+	t := r.audio.track
+	// A broken frame ends the packet, the frames before it are still fine
+	frames, _ := parseADTS(pes.Data)
+	if len(frames) == 0 {
+		return
+	}
+	if t.AudioConfig == nil {
+		f := frames[0]
+		t.SampleRate, t.Channels, t.Timescale = f.SampleRate, f.Channels, uint32(f.SampleRate)
+		t.AudioConfig = f.AudioSpecificConfig()
+	}
+
+	var base int64
+	if pes.PTS >= 0 {
+		base = (pes.PTS + r.offset) * int64(t.SampleRate) / tsClockRate
+	} else if n := len(r.audio.pending); n > 0 {
+		base = r.audio.pending[n-1].DTS + aacFrameSamples
+	} else {
+		return
+	}
+
+	for i, f := range frames {
+		r.audio.pending = append(r.audio.pending, mp4Sample{
+			DTS:  base + int64(i*aacFrameSamples),
+			Sync: true,
+			Data: f.Data,
+		})
+	}
+	end := (base + int64(len(frames)*aacFrameSamples)) * tsClockRate / int64(t.SampleRate)
+	if end > r.end {
+		r.end = end
+	}
+}
+
+// frameDuration is the duration used for a sample whose successor is not
+// known yet.
+func (r *tsRemuxer) frameDuration(s *trackState) uint32 {
+	if s.lastDuration > 0 {
+		return s.lastDuration
+	}
+	if s.track.Kind == mp4TrackAudio {
+		return aacFrameSamples
+	}
+	return defaultVideoFrameDuration
+}
+
+// writeFragment writes every pending sample whose duration is known. The
+// first call that has the codec configuration of all tracks writes the init
+// segment. With final set, the held back samples are written as well.
+func (r *tsRemuxer) writeFragment(final bool) error {
+	var states []*trackState
+	for _, s := range []*trackState{r.video, r.audio} {
+		if s != nil {
+			states = append(states, s)
+		}
+	}
+
+	if !r.header {
+		ready := true
+		for _, s := range states {
+			ready = ready && s.track.ready()
+		}
+		if !ready && !final {
+			return nil
+		}
+
+		// Tracks that never carried a decodable config are left out
+		var tracks []*mp4Track
+		var kept []*trackState
+		for _, s := range states {
+			if s.track.ready() {
+				s.track.ID = uint32(len(tracks) + 1)
+				tracks = append(tracks, s.track)
+				kept = append(kept, s)
+			}
+		}
+		if len(tracks) == 0 {
+			return errors.New("no decodable H.264 or AAC stream found")
+		}
+		if _, err := r.w.Write(mp4InitSegment(tracks)); err != nil {
+			return err
+		}
+		r.header = true
+		r.tracks = tracks
+		states = kept
+		if r.video != nil && !r.video.track.ready() {
+			r.video = nil
+		}
+		if r.audio != nil && !r.audio.track.ready() {
+			r.audio = nil
+		}
+	}
+
+	var frags []mp4Fragment
+	for _, s := range states {
+		n := len(s.pending)
+		if !final {
+			n--
+		}
+		if n <= 0 {
+			continue
+		}
+		samples := s.pending[:n]
+		for i := range samples {
+			if i+1 < len(s.pending) {
+				if d := s.pending[i+1].DTS - samples[i].DTS; d > 0 {
+					s.lastDuration = uint32(d)
+				}
+			}
+			samples[i].Duration = r.frameDuration(s)
+		}
+		if !s.written {
+			s.written, s.start = true, samples[0].DTS
+		}
+		last := samples[len(samples)-1]
+		s.end = last.DTS + int64(last.Duration)
+		frags = append(frags, mp4Fragment{Track: s.track, Samples: samples})
+	}
+	if len(frags) == 0 {
+		return nil
+	}
+
+	r.seq++
+	if err := writeMP4Fragment(r.w, r.seq, frags); err != nil {
+		return err
+	}
+	for _, s := range states {
+		if final {
+			s.pending = nil
+		} else if n := len(s.pending); n > 0 {
+			s.pending = []mp4Sample{s.pending[n-1]}
+		}
+	}
+	return nil
+}
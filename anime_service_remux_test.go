@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	fixtureVideoPID = 0x100
+	fixtureAudioPID = 0x101
+	fixturePMTPID   = 0x1000
+
+	fixtureFrameTicks = 3600 // 25fps
+	fixtureCTO        = 3600
+)
+
+// bitWriter is the inverse of bitReader, used to build SPS fixtures.
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bit(b uint) {
+	if w.n%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	w.data[len(w.data)-1] |= byte(b&1) << (7 - uint(w.n%8))
+	w.n++
+}
+
+func (w *bitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(v >> uint(i))
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := 0
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// addEmulationPrevention inserts 0x03 after two zero bytes where needed.
+func addEmulationPrevention(data []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// fixtureSPS is a High profile SPS for 1920x1088 cropped to 1080.
+func fixtureSPS() []byte {
+	w := &bitWriter{}
+	w.ue(0)   // seq_parameter_set_id
+	w.ue(1)   // chroma_format_idc
+	w.ue(0)   // bit_depth_luma_minus8
+	w.ue(0)   // bit_depth_chroma_minus8
+	w.bit(0)  // qpprime_y_zero_transform_bypass_flag
+	w.bit(0)  // seq_scaling_matrix_present_flag
+	w.ue(0)   // log2_max_frame_num_minus4
+	w.ue(0)   // pic_order_cnt_type
+	w.ue(2)   // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(4)   // max_num_ref_frames
+	w.bit(0)  // gaps_in_frame_num_value_allowed_flag
+	w.ue(119) // pic_width_in_mbs_minus1
+	w.ue(67)  // pic_height_in_map_units_minus1
+	w.bit(1)  // frame_mbs_only_flag
+	w.bit(1)  // direct_8x8_inference_flag
+	w.bit(1)  // frame_cropping_flag
+	w.ue(0)   // left
+	w.ue(0)   // right
+	w.ue(0)   // top
+	w.ue(4)   // bottom
+	w.bit(0)  // vui_parameters_present_flag
+	w.bit(1)  // rbsp_stop_one_bit
+	header := []byte{0x67, 100, 0, 40}
+	return append(header, addEmulationPrevention(w.data)...)
+}
+
+var fixturePPS = []byte{0x68, 0xEE, 0x3C, 0x80}
+
+// adtsFixtureFrame is an AAC LC, 44.1kHz stereo frame.
+func adtsFixtureFrame(payload []byte) []byte {
+	frameLen := 7 + len(payload)
+	header := []byte{
+		0xFF, 0xF1, // sync, MPEG-4, no CRC
+		1<<6 | 4<<2 | 0, // LC, 44100, channel config high bit
+		2<<6 | byte(frameLen>>11&0x03),
+		byte(frameLen >> 3),
+		byte(frameLen&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+	return append(header, payload...)
+}
+
+// tsWriter builds an MPEG-TS stream in memory.
+type tsWriter struct {
+	buf bytes.Buffer
+	cc  map[uint16]byte
+}
+
+func (w *tsWriter) packets(pid uint16, payload []byte) {
+	if w.cc == nil {
+		w.cc = make(map[uint16]byte)
+	}
+	first := true
+	for len(payload) > 0 {
+		pkt := make([]byte, 0, tsPacketSize)
+		b1 := byte(pid >> 8)
+		if first {
+			b1 |= 0x40
+		}
+		n := len(payload)
+		if n >= tsPacketSize-4 {
+			n = tsPacketSize - 4
+			pkt = append(pkt, tsSyncByte, b1, byte(pid), 0x10|w.cc[pid])
+		} else {
+			// Stuff the adaptation field so the packet stays 188 bytes
+			afLen := tsPacketSize - 5 - n
+			pkt = append(pkt, tsSyncByte, b1, byte(pid), 0x30|w.cc[pid], byte(afLen))
+			if afLen > 0 {
+				pkt = append(pkt, 0x00)
+				pkt = append(pkt, bytes.Repeat([]byte{0xFF}, afLen-1)...)
+			}
+		}
+		pkt = append(pkt, payload[:n]...)
+		w.buf.Write(pkt)
+		w.cc[pid] = (w.cc[pid] + 1) & 0x0F
+		payload = payload[n:]
+		first = false
+	}
+}
+
+func (w *tsWriter) psi(pid uint16, tableID byte, body []byte) {
+	sectionLen := len(body) + 4 // CRC, which the demuxer does not check
+	section := []byte{0, tableID, 0xB0 | byte(sectionLen>>8), byte(sectionLen)}
+	section = append(section, body...)
+	section = append(section, 0, 0, 0, 0)
+	w.packets(pid, section)
+}
+
+func (w *tsWriter) tables() {
+	w.psi(0, 0x00, []byte{0, 1, 0xC1, 0, 0, 0, 1, 0xE0 | fixturePMTPID>>8, fixturePMTPID & 0xFF})
+	w.psi(fixturePMTPID, 0x02, []byte{
+		0, 1, 0xC1, 0, 0,
+		0xE0 | fixtureVideoPID>>8, fixtureVideoPID & 0xFF, 0xF0, 0,
+		tsStreamH264, 0xE0 | fixtureVideoPID>>8, fixtureVideoPID & 0xFF, 0xF0, 0,
+		0x06, 0xE1, 0x02, 0xF0, 0, // private data stream, ignored
+		tsStreamAAC, 0xE0 | fixtureAudioPID>>8, fixtureAudioPID & 0xFF, 0xF0, 0,
+	})
+}
+
+func pesTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>30&0x07)<<1 | 1,
+		byte(ts >> 22),
+		byte(ts>>15&0x7F)<<1 | 1,
+		byte(ts >> 7),
+		byte(ts&0x7F)<<1 | 1,
+	}
+}
+
+func (w *tsWriter) pes(pid uint16, streamID byte, pts, dts int64, payload []byte) {
+	var header []byte
+	if dts != pts {
+		header = append([]byte{0x80, 0xC0, 10}, pesTimestamp(3, pts)...)
+		header = append(header, pesTimestamp(1, dts)...)
+	} else {
+		header = append([]byte{0x80, 0x80, 5}, pesTimestamp(2, pts)...)
+	}
+	length := 0
+	if streamID != 0xE0 {
+		length = len(header) + len(payload)
+	}
+	pes := []byte{0, 0, 1, streamID, byte(length >> 8), byte(length)}
+	pes = append(pes, header...)
+	w.packets(pid, append(pes, payload...))
+}
+
+// tsFixture is a segment of frames video frames starting at a keyframe with
+// an AAC PES of two frames after each of them.
+func tsFixture(startDTS int64, frames int) []byte {
+	w := &tsWriter{}
+	w.tables()
+	for i := 0; i < frames; i++ {
+		dts := startDTS + int64(i*fixtureFrameTicks)
+		var au []byte
+		au = append(au, 0, 0, 0, 1, 0x09, 0xF0) // AUD
+		if i == 0 {
+			au = append(append(au, 0, 0, 0, 1), fixtureSPS()...)
+			au = append(append(au, 0, 0, 0, 1), fixturePPS...)
+			au = append(au, 0, 0, 1, 0x65)
+		} else {
+			au = append(au, 0, 0, 1, 0x41)
+		}
+		// A slice big enough to span several TS packets
+		au = append(au, bytes.Repeat([]byte{byte(i + 1)}, 500)...)
+		w.pes(fixtureVideoPID, 0xE0, dts+fixtureCTO, dts, au)
+
+		audio := append(adtsFixtureFrame(bytes.Repeat([]byte{0xA0 | byte(i)}, 40)),
+			adtsFixtureFrame(bytes.Repeat([]byte{0xB0 | byte(i)}, 40))...)
+		w.pes(fixtureAudioPID, 0xC0, dts, dts, audio)
+	}
+	return w.buf.Bytes()
+}
+
+// mp4Boxes splits data into boxes, returning type and payload pairs.
+func mp4Boxes(t *testing.T, data []byte) (types []string, payloads [][]byte) {
+	t.Helper()
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated box header")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("bad box size %d for %q", size, data[4:8])
+		}
+		types = append(types, string(data[4:8]))
+		payloads = append(payloads, data[8:size])
+		data = data[size:]
+	}
+	return types, payloads
+}
+
+// mp4Child returns the payload of the n-th child of the given type.
+func mp4Child(t *testing.T, data []byte, typ string, n int) []byte {
+	t.Helper()
+	types, payloads := mp4Boxes(t, data)
+	for i, bt := range types {
+		if bt == typ {
+			if n == 0 {
+				return payloads[i]
+			}
+			n--
+		}
+	}
+	t.Fatalf("box %q not found in %v", typ, types)
+	return nil
+}
+
+type testTrun struct {
+	trackID    uint32
+	baseTime   uint64
+	dataOffset int
+	durations  []uint32
+	sizes      []uint32
+	ctos       []int32
+}
+
+func parseTraf(t *testing.T, traf []byte) testTrun {
+	t.Helper()
+	var out testTrun
+	out.trackID = binary.BigEndian.Uint32(mp4Child(t, traf, "tfhd", 0)[4:])
+	out.baseTime = binary.BigEndian.Uint64(mp4Child(t, traf, "tfdt", 0)[4:])
+
+	trun := mp4Child(t, traf, "trun", 0)
+	flags := binary.BigEndian.Uint32(trun) & 0xFFFFFF
+	count := int(binary.BigEndian.Uint32(trun[4:]))
+	pos := 8
+	if flags&0x01 != 0 {
+		out.dataOffset = int(int32(binary.BigEndian.Uint32(trun[pos:])))
+		pos += 4
+	}
+	for i := 0; i < count; i++ {
+		if flags&0x100 != 0 {
+			out.durations = append(out.durations, binary.BigEndian.Uint32(trun[pos:]))
+			pos += 4
+		}
+		if flags&0x200 != 0 {
+			out.sizes = append(out.sizes, binary.BigEndian.Uint32(trun[pos:]))
+			pos += 4
+		}
+		if flags&0x400 != 0 {
+			pos += 4
+		}
+		if flags&0x800 != 0 {
+			out.ctos = append(out.ctos, int32(binary.BigEndian.Uint32(trun[pos:])))
+			pos += 4
+		}
+	}
+	return out
+}
+
+func writeSegments(t *testing.T, dir string, segments map[string][]byte) {
+	t.Helper()
+	for rawURL, data := range segments {
+		if err := os.WriteFile(filepath.Join(dir, segmentFilename(rawURL)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseSPS(t *testing.T) {
+	sps, err := parseSPS(fixtureSPS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Width != 1920 || sps.Height != 1080 || sps.Profile != 100 || sps.Level != 40 {
+		t.Errorf("unexpected SPS %+v", sps)
+	}
+}
+
+func TestRemuxTS(t *testing.T) {
+	dir := t.TempDir()
+	const frames = 5
+	// The second segment restarts its clock after a discontinuity
+	writeSegments(t, dir, map[string][]byte{
+		"https://cdn.example/a.ts": tsFixture(900000, frames),
+		"https://cdn.example/b.ts": tsFixture(10000, frames),
+	})
+	segments := []hlsSegment{
+		{URL: "https://cdn.example/a.ts"},
+		{URL: "https://cdn.example/b.ts", Discontinuity: true},
+	}
+
+	mp4Path := filepath.Join(dir, "episode.mp4")
+	if err := remuxSegments(context.Background(), dir, segments, mp4Path); err != nil {
+		t.Fatalf("remux failed: %v", err)
+	}
+	out, err := os.ReadFile(mp4Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types, payloads := mp4Boxes(t, out)
+	if len(types) < 4 || types[0] != "ftyp" || types[1] != "moov" {
+		t.Fatalf("unexpected top level boxes %v", types)
+	}
+
+	moov := payloads[1]
+	videoTrak := mp4Child(t, moov, "trak", 0)
+	tkhd := mp4Child(t, videoTrak, "tkhd", 0)
+	if w, h := binary.BigEndian.Uint32(tkhd[76:])>>16, binary.BigEndian.Uint32(tkhd[80:])>>16; w != 1920 || h != 1080 {
+		t.Errorf("video track is %dx%d", w, h)
+	}
+	stsd := mp4Child(t, mp4Child(t, mp4Child(t, mp4Child(t, videoTrak, "mdia", 0), "minf", 0), "stbl", 0), "stsd", 0)
+	if !bytes.Contains(stsd, fixtureSPS()) || !bytes.Contains(stsd, fixturePPS) {
+		t.Errorf("avcC does not carry the parameter sets")
+	}
+
+	audioTrak := mp4Child(t, moov, "trak", 1)
+	astsd := mp4Child(t, mp4Child(t, mp4Child(t, mp4Child(t, audioTrak, "mdia", 0), "minf", 0), "stbl", 0), "stsd", 0)
+	mp4a := mp4Child(t, astsd[8:], "mp4a", 0) // after version, flags and entry count
+	if ch, rate := binary.BigEndian.Uint16(mp4a[16:]), binary.BigEndian.Uint32(mp4a[24:])>>16; ch != 2 || rate != 44100 {
+		t.Errorf("audio track is %d channels at %d Hz", ch, rate)
+	}
+	if !bytes.Contains(mp4a, []byte{0x05, 0x02, 0x12, 0x10}) {
+		t.Errorf("esds does not carry the AAC LC 44.1kHz stereo config")
+	}
+
+	// Every sample ends up in a fragment and the timeline has no gaps
+	next := map[uint32]uint64{}
+	samples := map[uint32]int{}
+	for i, typ := range types {
+		if typ != "moof" {
+			continue
+		}
+		if types[i+1] != "mdat" {
+			t.Fatalf("moof not followed by mdat")
+		}
+		mdatSize := 0
+		for n := 0; ; n++ {
+			trafTypes, _ := mp4Boxes(t, payloads[i])
+			if n+1 >= len(trafTypes) {
+				break
+			}
+			run := parseTraf(t, mp4Child(t, payloads[i], "traf", n))
+			// data_offset is relative to the start of the moof box
+			moofStart := cap(out) - cap(payloads[i]) - 8
+			if run.trackID == 1 {
+				sample := out[moofStart+run.dataOffset:]
+				if nalLen := binary.BigEndian.Uint32(sample); nalLen+4 > run.sizes[0] || sample[4]&0x1F != h264NALSPS && sample[4]&0x1F != 1 {
+					t.Errorf("video data offset does not point at a sample")
+				}
+			}
+			if want, ok := next[run.trackID]; ok && run.baseTime != want {
+				t.Errorf("track %d fragment starts at %d, previous ended at %d", run.trackID, run.baseTime, want)
+			}
+			if run.trackID == 1 && len(next) == 0 && run.baseTime != 0 {
+				t.Errorf("video does not start at zero: %d", run.baseTime)
+			}
+			end := run.baseTime
+			for j, d := range run.durations {
+				end += uint64(d)
+				mdatSize += int(run.sizes[j])
+			}
+			for _, cto := range run.ctos {
+				if cto != fixtureCTO {
+					t.Errorf("composition offset %d, want %d", cto, fixtureCTO)
+				}
+			}
+			next[run.trackID] = end
+			samples[run.trackID] += len(run.durations)
+		}
+		if mdatSize != len(payloads[i+1]) {
+			t.Errorf("trun sizes add up to %d, mdat holds %d", mdatSize, len(payloads[i+1]))
+		}
+	}
+
+	if samples[1] != 2*frames || samples[2] != 4*frames {
+		t.Errorf("wrote %d video and %d audio samples", samples[1], samples[2])
+	}
+	// Stitching may leave a gap up to an audio frame to keep A/V in sync
+	if want := uint64(2 * frames * fixtureFrameTicks); next[1] < want || next[1] > want+fixtureFrameTicks {
+		t.Errorf("video timeline ends at %d, want about %d", next[1], want)
+	}
+
+	// The header carries the duration, so players need not walk the fragments
+	videoMs := uint32(next[1] * 1000 / tsClockRate)
+	if mdhd := mp4Child(t, mp4Child(t, videoTrak, "mdia", 0), "mdhd", 0); binary.BigEndian.Uint32(mdhd[16:]) != uint32(next[1]) {
+		t.Errorf("video mdhd duration %d, want %d", binary.BigEndian.Uint32(mdhd[16:]), next[1])
+	}
+	if d := binary.BigEndian.Uint32(tkhd[20:]); d != videoMs {
+		t.Errorf("video tkhd duration %d ms, want %d", d, videoMs)
+	}
+	mvhd := mp4Child(t, moov, "mvhd", 0)
+	movieMs := binary.BigEndian.Uint32(mvhd[16:])
+	if movieMs < videoMs || movieMs > videoMs+100 {
+		t.Errorf("mvhd duration %d ms, want about %d", movieMs, videoMs)
+	}
+	if mehd := mp4Child(t, mp4Child(t, moov, "mvex", 0), "mehd", 0); binary.BigEndian.Uint32(mehd[4:]) != movieMs {
+		t.Errorf("mehd duration %d ms, mvhd says %d", binary.BigEndian.Uint32(mehd[4:]), movieMs)
+	}
+}
+
+func TestRemuxEncryptedTS(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0x42}, 16)
+	clear := tsFixture(0, 3)
+
+	seg := hlsSegment{
+		URL:      "https://cdn.example/enc.ts",
+		Sequence: 3,
+		Key:      &hlsKey{Method: "AES-128", URL: "https://cdn.example/k.key"},
+	}
+	writeSegments(t, dir, map[string][]byte{
+		seg.URL:                    encryptAES128(t, clear, key, seg.IV()),
+		seg.Key.URL:                key,
+		"https://cdn.example/c.ts": clear,
+	})
+
+	encPath, clearPath := filepath.Join(dir, "enc.mp4"), filepath.Join(dir, "clear.mp4")
+	if err := remuxSegments(context.Background(), dir, []hlsSegment{seg}, encPath); err != nil {
+		t.Fatalf("remux of encrypted segment failed: %v", err)
+	}
+	if err := remuxSegments(context.Background(), dir, []hlsSegment{{URL: "https://cdn.example/c.ts"}}, clearPath); err != nil {
+		t.Fatal(err)
+	}
+	enc, _ := os.ReadFile(encPath)
+	plain, _ := os.ReadFile(clearPath)
+	if !bytes.Equal(enc, plain) {
+		t.Errorf("encrypted and clear segments remux differently")
+	}
+}
+
+func TestRemuxFMP4(t *testing.T) {
+	dir := t.TempDir()
+	media := []byte("init-moov|frag-one|frag-two")
+	writeSegments(t, dir, map[string][]byte{"https://cdn.example/media.mp4": media})
+
+	initMap := &hlsMap{URL: "https://cdn.example/media.mp4", ByteRange: &hlsByteRange{Length: 10}}
+	segments := []hlsSegment{
+		{URL: initMap.URL, Map: initMap, ByteRange: &hlsByteRange{Length: 9, Offset: 10}},
+		{URL: initMap.URL, Map: initMap, ByteRange: &hlsByteRange{Length: 8, Offset: 19}},
+	}
+
+	mp4Path := filepath.Join(dir, "episode.mp4")
+	if err := remuxSegments(context.Background(), dir, segments, mp4Path); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := os.ReadFile(mp4Path)
+	if string(out) != string(media) {
+		t.Errorf("joined fMP4 = %q", out)
+	}
+}
+
+func TestRemuxRejectsUnknownStreams(t *testing.T) {
+	dir := t.TempDir()
+	writeSegments(t, dir, map[string][]byte{"https://cdn.example/x.ts": bytes.Repeat([]byte{0x47, 0x1F, 0xFF, 0x10}, 47*4)})
+
+	mp4Path := filepath.Join(dir, "episode.mp4")
+	if err := remuxSegments(context.Background(), dir, []hlsSegment{{URL: "https://cdn.example/x.ts"}}, mp4Path); err == nil {
+		t.Fatal("expected a stream without H.264 or AAC to fail")
+	}
+	if _, err := os.Stat(mp4Path); !os.IsNotExist(err) {
+		t.Errorf("failed remux left an output file behind")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.part")); len(matches) != 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Kinds of request the UI starts. Only one request of each kind runs at a
+// time: starting a new one cancels the previous, e.g. when the user types a
+// new search or opens another anime before the episodes arrived.
+const (
+	requestSearch   = "search"
+	requestEpisodes = "episodes"
+	requestStream   = "stream"
+)
+
+const (
+	// episodesTimeout bounds an episode list request, dub lookup included
+	episodesTimeout = 30 * time.Second
+	// streamTimeout bounds resolving an episode's stream URL
+	streamTimeout = 45 * time.Second
+)
+
+type activeRequest struct {
+	id     uint64
+	cancel context.CancelFunc
+}
+
+// beginRequest starts a request of the given kind and cancels the one still
+// running, if any. A zero timeout means no deadline. The returned function
+// must be called once the request is done.
+func (a *AnimeService) beginRequest(kind string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a.baseContext())
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		parentCancel := cancel
+		cancel = func() {
+			cancelTimeout()
+			parentCancel()
+		}
+	}
+
+	a.requestsMutex.Lock()
+	if a.requests == nil {
+		a.requests = make(map[string]activeRequest)
+	}
+	if prev, ok := a.requests[kind]; ok {
+		fmt.Printf("[Request] Cancelling previous %s request\n", kind)
+		prev.cancel()
+	}
+	a.requestSeq++
+	id := a.requestSeq
+	a.requests[kind] = activeRequest{id: id, cancel: cancel}
+	a.requestsMutex.Unlock()
+
+	return ctx, func() {
+		cancel()
+		a.requestsMutex.Lock()
+		if cur, ok := a.requests[kind]; ok && cur.id == id {
+			delete(a.requests, kind)
+		}
+		a.requestsMutex.Unlock()
+	}
+}
+
+// CancelRequest cancels the running request of a kind: "search", "episodes"
+// or "stream". It does nothing if none is running.
+func (a *AnimeService) CancelRequest(kind string) {
+	a.requestsMutex.Lock()
+	defer a.requestsMutex.Unlock()
+	if cur, ok := a.requests[kind]; ok {
+		fmt.Printf("[Request] Cancelled %s request\n", kind)
+		cur.cancel()
+		delete(a.requests, kind)
+	}
+}
+
+// baseContext is the parent of every request context. It is the Wails
+// context once started up.
+func (a *AnimeService) baseContext() context.Context {
+	if a.ctx != nil {
+		return a.ctx
+	}
+	return context.Background()
+}
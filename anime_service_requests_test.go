@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBeginRequestCancelsPrevious(t *testing.T) {
+	a := &AnimeService{}
+
+	first, doneFirst := a.beginRequest(requestEpisodes, 0)
+	other, doneOther := a.beginRequest(requestStream, time.Minute)
+	defer doneOther()
+	second, doneSecond := a.beginRequest(requestEpisodes, 0)
+
+	if first.Err() != context.Canceled {
+		t.Errorf("first request not cancelled: %v", first.Err())
+	}
+	if other.Err() != nil || second.Err() != nil {
+		t.Errorf("unrelated request cancelled: %v, %v", other.Err(), second.Err())
+	}
+	if _, ok := other.Deadline(); !ok {
+		t.Error("stream request has no deadline")
+	}
+
+	// The superseded request finishing must not drop the current one
+	doneFirst()
+	a.CancelRequest(requestEpisodes)
+	if second.Err() != context.Canceled {
+		t.Errorf("CancelRequest did not cancel the current request: %v", second.Err())
+	}
+	doneSecond()
+	a.CancelRequest(requestEpisodes)
+}
+
+func TestSearchCancelledByNewSearch(t *testing.T) {
+	gate := make(chan struct{})
+	a := &AnimeService{
+		metadata: newMemoryMetadataStore(),
+		searcher: &fakeSearcher{results: frierenResults(), gate: gate},
+	}
+
+	done := make(chan []SearchSourceStatus)
+	ctx, finish := a.beginRequest(requestSearch, 0)
+	go func() {
+		done <- a.runSearch(ctx, "frieren", func(SearchSourceStatus, []Anime) {}, func(Anime) {}, finish)
+	}()
+
+	// The second source is held back until the first search is superseded
+	_, doneNext := a.beginRequest(requestSearch, 0)
+	defer doneNext()
+	select {
+	case statuses := <-done:
+		if len(statuses) != 1 {
+			t.Errorf("statuses = %+v, want only the source that answered", statuses)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("superseded search kept running")
+	}
+}
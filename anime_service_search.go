@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+const (
+	// searchSourceTimeout is how long each source may take to answer
+	searchSourceTimeout = 15 * time.Second
+	// searchMetadataLimit is how many results per source get metadata
+	searchMetadataLimit = 10
+	// searchMetadataWait is how long Search waits for metadata before
+	// returning results without it. Lookups still finish in the background
+	// and land in the metadata store.
+	searchMetadataWait = 5 * time.Second
+)
+
+// sourceSearcher fans a search out to all anime sources, see
+// goanime.Client.SearchAllSourcesContext.
+type sourceSearcher interface {
+	SearchAllSourcesContext(ctx context.Context, query string, timeout time.Duration) <-chan *types.SourceResult
+}
+
+// SearchSourceStatus is how the search on one source ended: ok, timeout,
+// error or challenge.
+type SearchSourceStatus struct {
+	Source     string `json:"source"`
+	Status     string `json:"status"`
+	Count      int    `json:"count"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// SearchResponse holds the results of every source that answered, and the
+// status of each source.
+type SearchResponse struct {
+	Results []Anime              `json:"results"`
+	Sources []SearchSourceStatus `json:"sources"`
+}
+
+// searchSourceEvent is emitted as "search:source" when a source finishes.
+// Results are all results so far, merged across sources.
+type searchSourceEvent struct {
+	SearchID string             `json:"searchId"`
+	Status   SearchSourceStatus `json:"status"`
+	Results  []Anime            `json:"results"`
+}
+
+// searchDetailsEvent is emitted as "search:details" when metadata arrives
+// for a result already sent. Removed lists the keys of results merged into
+// Anime because the metadata showed they are the same anime.
+type searchDetailsEvent struct {
+	SearchID string   `json:"searchId"`
+	Anime    Anime    `json:"anime"`
+	Removed  []string `json:"removed,omitempty"`
+}
+
+// searchDoneEvent is emitted as "search:done" once every source reported.
+type searchDoneEvent struct {
+	SearchID string               `json:"searchId"`
+	Sources  []SearchSourceStatus `json:"sources"`
+}
+
+func (a *AnimeService) Search(query string) ([]Anime, error) {
+	resp, err := a.SearchWithStatus(query)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+// SearchWithStatus searches all sources in parallel and returns the results
+// of those that answered along with the status of each. Results for the
+// same anime on several sources are merged into one. It fails only when no
+// source answered. Starting another search cancels this one.
+func (a *AnimeService) SearchWithStatus(query string) (*SearchResponse, error) {
+	ctx, done := a.beginRequest(requestSearch, 0)
+	return a.searchWithStatus(ctx, query, done)
+}
+
+// searchWithStatus implements SearchWithStatus. Metadata lookups may outlive
+// the call; onDetailsDone, if set, is called once they finished.
+func (a *AnimeService) searchWithStatus(ctx context.Context, query string, onDetailsDone func()) (*SearchResponse, error) {
+	fmt.Printf("Searching for: %s\n", query)
+
+	clusters := newResultClusters(a.GetSettings().PreferredSource)
+
+	detailsDone := make(chan struct{})
+	statuses := a.runSearch(ctx, query,
+		func(_ SearchSourceStatus, found []Anime) {
+			clusters.add(found)
+		},
+		func(anime Anime) {
+			clusters.update(anime)
+		},
+		func() {
+			close(detailsDone)
+			if onDetailsDone != nil {
+				onDetailsDone()
+			}
+		},
+	)
+
+	// Metadata that arrives after the wait only goes to the store
+	select {
+	case <-detailsDone:
+	case <-time.After(searchMetadataWait):
+		fmt.Printf("[Search] Metadata for %q still loading, returning results without it\n", query)
+	}
+
+	out := clusters.list(query)
+	if len(out) == 0 && !anySourceAnswered(statuses) {
+		return nil, fmt.Errorf("search failed on every source: %s", summarizeStatuses(statuses))
+	}
+	return &SearchResponse{Results: out, Sources: statuses}, nil
+}
+
+// StartSearch runs a search in the background and returns its ID. Results
+// are streamed as events tagged with that ID: "search:source" as each source
+// finishes, "search:details" as metadata arrives for a result and
+// "search:done" at the end. The caller may pick the ID so it can match
+// events that arrive before the call returns; an empty ID generates one.
+// Starting a new search cancels the previous one, metadata lookups included.
+func (a *AnimeService) StartSearch(query, searchID string) string {
+	if searchID == "" {
+		searchID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	ctx, done := a.beginRequest(requestSearch, 0)
+	clusters := newResultClusters(a.GetSettings().PreferredSource)
+
+	go func() {
+		fmt.Printf("Searching for: %s (stream %s)\n", query, searchID)
+		statuses := a.runSearch(ctx, query,
+			func(status SearchSourceStatus, found []Anime) {
+				clusters.add(found)
+				a.emit("search:source", searchSourceEvent{SearchID: searchID, Status: status, Results: clusters.list(query)})
+			},
+			func(anime Anime) {
+				if ctx.Err() != nil {
+					return
+				}
+				if merged, removed, ok := clusters.update(anime); ok {
+					a.emit("search:details", searchDetailsEvent{SearchID: searchID, Anime: merged, Removed: removed})
+				}
+			},
+			done,
+		)
+		a.emit("search:done", searchDoneEvent{SearchID: searchID, Sources: statuses})
+	}()
+
+	return searchID
+}
+
+// runSearch fans query out to every source. onSource is called as each
+// source finishes, with its results sorted by similarity and any fresh
+// metadata from the store applied. Metadata for the top results is then
+// looked up and each update passed to onDetails. runSearch returns once all
+// sources reported, usually before the lookups finish; onDetailsDone, if
+// set, is called once they have. Cancelling ctx stops the lookups.
+func (a *AnimeService) runSearch(ctx context.Context, query string, onSource func(SearchSourceStatus, []Anime), onDetails func(Anime), onDetailsDone func()) []SearchSourceStatus {
+	var statuses []SearchSourceStatus
+	var wg sync.WaitGroup
+
+	for res := range a.searcher.SearchAllSourcesContext(ctx, query, searchSourceTimeout) {
+		status := SearchSourceStatus{
+			Source:     res.Source.String(),
+			Status:     string(res.Status),
+			Count:      len(res.Anime),
+			DurationMs: res.Duration.Milliseconds(),
+		}
+		if res.Err != nil {
+			status.Error = res.Err.Error()
+		}
+		statuses = append(statuses, status)
+		fmt.Printf("[Search] %s: %s, %d results in %v\n", status.Source, status.Status, status.Count, res.Duration.Round(time.Millisecond))
+
+		found := mapAnimeList(res.Anime, status.Source)
+		sortBySimilarity(query, found)
+
+		var pending []Anime
+		for i := range found {
+			details, fresh := a.storedDetails(found[i].Name)
+			if details != nil {
+				found[i].applyDetails(details)
+			}
+			if !fresh && i < searchMetadataLimit {
+				pending = append(pending, found[i])
+			}
+		}
+		onSource(status, found)
+
+		for _, anime := range pending {
+			wg.Add(1)
+			go func(anime Anime) {
+				defer wg.Done()
+				if ctx.Err() != nil {
+					return
+				}
+				if details := a.animeDetails(ctx, anime.Name); details != nil {
+					anime.applyDetails(details)
+					onDetails(anime)
+				}
+			}(anime)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		if onDetailsDone != nil {
+			onDetailsDone()
+		}
+	}()
+	return statuses
+}
+
+func sortBySimilarity(query string, results []Anime) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return calculateSimilarity(query, results[i].Name) > calculateSimilarity(query, results[j].Name)
+	})
+}
+
+func anySourceAnswered(statuses []SearchSourceStatus) bool {
+	for _, s := range statuses {
+		if s.Status == string(types.SearchOK) {
+			return true
+		}
+	}
+	return false
+}
+
+func summarizeStatuses(statuses []SearchSourceStatus) string {
+	summary := ""
+	for i, s := range statuses {
+		if i > 0 {
+			summary += ", "
+		}
+		summary += s.Source + " " + s.Status
+	}
+	return summary
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+// fakeSearcher reports canned source results in order. With gate set, each
+// result after the first waits for a value on gate; cancelling the search
+// while it waits ends it early.
+type fakeSearcher struct {
+	results []*types.SourceResult
+	gate    chan struct{}
+}
+
+func (f *fakeSearcher) SearchAllSourcesContext(ctx context.Context, query string, timeout time.Duration) <-chan *types.SourceResult {
+	ch := make(chan *types.SourceResult)
+	go func() {
+		defer close(ch)
+		for i, r := range f.results {
+			if i > 0 && f.gate != nil {
+				select {
+				case <-f.gate:
+				case <-ctx.Done():
+					return
+				}
+			}
+			ch <- r
+		}
+	}()
+	return ch
+}
+
+func frierenResults() []*types.SourceResult {
+	return []*types.SourceResult{
+		{
+			Source: types.SourceAllAnime,
+			Status: types.SearchOK,
+			Anime: []*types.Anime{
+				{Name: "[AllAnime] Sousou no Frieren", URL: "allanime-1", Source: "AllAnime"},
+				{Name: "[AllAnime] Sousou no Frieren Mini Anime", URL: "allanime-2", Source: "AllAnime"},
+			},
+			Duration: 120 * time.Millisecond,
+		},
+		{
+			Source:   types.SourceAnimeFire,
+			Status:   types.SearchChallenge,
+			Err:      errors.New("animefire returned a challenge page"),
+			Duration: 300 * time.Millisecond,
+		},
+	}
+}
+
+func TestSearchWithStatus(t *testing.T) {
+	_, providers := newMetadataFixture(t)
+	a := &AnimeService{
+		metadata:  newMemoryMetadataStore(),
+		providers: providers,
+		searcher:  &fakeSearcher{results: frierenResults()},
+	}
+
+	resp, err := a.SearchWithStatus("Sousou no Frieren")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Sources) != 2 {
+		t.Fatalf("sources = %+v", resp.Sources)
+	}
+	if s := resp.Sources[0]; s.Source != "AllAnime" || s.Status != "ok" || s.Count != 2 || s.DurationMs != 120 {
+		t.Errorf("AllAnime status = %+v", s)
+	}
+	if s := resp.Sources[1]; s.Source != "AnimeFire" || s.Status != "challenge" || s.Error == "" {
+		t.Errorf("AnimeFire status = %+v", s)
+	}
+
+	if len(resp.Results) != 2 {
+		t.Fatalf("results = %+v", resp.Results)
+	}
+	best := resp.Results[0]
+	if best.URL != "allanime-1" {
+		t.Errorf("best match = %q, want the exact title first", best.Name)
+	}
+	if best.MalID != 52991 || best.AnilistID != 154587 || best.ImageURL == "" {
+		t.Errorf("metadata not applied: %+v", best)
+	}
+}
+
+func TestSearchWithStatusAllSourcesFailed(t *testing.T) {
+	a := &AnimeService{
+		metadata: newMemoryMetadataStore(),
+		searcher: &fakeSearcher{results: []*types.SourceResult{
+			{Source: types.SourceAllAnime, Status: types.SearchTimeout, Err: errors.New("timed out")},
+			{Source: types.SourceAnimeFire, Status: types.SearchError, Err: errors.New("403")},
+		}},
+	}
+	if _, err := a.SearchWithStatus("frieren"); err == nil {
+		t.Fatal("expected an error when no source answered")
+	}
+
+	// Sources that answer with nothing are an empty result, not a failure
+	a.searcher = &fakeSearcher{results: []*types.SourceResult{
+		{Source: types.SourceAllAnime, Status: types.SearchOK},
+	}}
+	resp, err := a.SearchWithStatus("frieren")
+	if err != nil || len(resp.Results) != 0 {
+		t.Errorf("empty search = %+v, %v", resp, err)
+	}
+}
+
+func TestRunSearchStreamsPerSource(t *testing.T) {
+	_, providers := newMetadataFixture(t)
+	gate := make(chan struct{})
+	a := &AnimeService{
+		metadata:  newMemoryMetadataStore(),
+		providers: providers,
+		searcher:  &fakeSearcher{results: frierenResults(), gate: gate},
+	}
+
+	sources := make(chan SearchSourceStatus, 2)
+	details := make(chan Anime, 4)
+	done := make(chan []SearchSourceStatus)
+	go func() {
+		done <- a.runSearch(context.Background(), "Sousou no Frieren",
+			func(status SearchSourceStatus, found []Anime) { sources <- status },
+			func(anime Anime) { details <- anime },
+			nil,
+		)
+	}()
+
+	// The first source is delivered while the second is still searching
+	select {
+	case s := <-sources:
+		if s.Source != "AllAnime" {
+			t.Errorf("first source = %s", s.Source)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first source not streamed before the second finished")
+	}
+	select {
+	case d := <-details:
+		if d.MalID == 0 {
+			t.Errorf("details event without metadata: %+v", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no metadata update streamed")
+	}
+
+	close(gate)
+	if statuses := <-done; len(statuses) != 2 {
+		t.Errorf("statuses = %+v", statuses)
+	}
+}
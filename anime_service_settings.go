@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/alvarorichard/Goanime/pkg/goanime/types"
+)
+
+// AppSettings holds user preferences that persist across restarts.
+type AppSettings struct {
+	// Quality is the default stream quality, see validateQuality
+	Quality string `json:"quality"`
+	// AdaptiveStreaming keeps master playlists intact so the player can
+	// switch variants itself instead of being pinned to one
+	AdaptiveStreaming bool `json:"adaptiveStreaming"`
+	// MetadataTTL overrides how long cached metadata stays fresh
+	MetadataTTL MetadataTTLSettings `json:"metadataTtl"`
+	// PreferredSource is opened by default when an anime is on several
+	// sources. Empty picks the one listing the most episodes.
+	PreferredSource string `json:"preferredSource,omitempty"`
+	// CacheBudgetMB bounds the segment cache, 0 for the default
+	CacheBudgetMB int `json:"cacheBudgetMb,omitempty"`
+	// PrefetchSegments is how many segments the proxy fetches ahead of the
+	// player, 0 to turn prefetching off
+	PrefetchSegments int `json:"prefetchSegments"`
+}
+
+func defaultSettings() AppSettings {
+	return AppSettings{
+		Quality:          qualityBest,
+		PrefetchSegments: defaultPrefetchSegments,
+	}
+}
+
+func (a *AnimeService) loadSettings() {
+	a.settingsMutex.Lock()
+	defer a.settingsMutex.Unlock()
+
+	data, err := os.ReadFile(a.settingsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error reading settings: %v\n", err)
+		}
+		return
+	}
+
+	settings := defaultSettings()
+	if err := json.Unmarshal(data, &settings); err != nil {
+		fmt.Printf("Error unmarshaling settings (using defaults): %v\n", err)
+		return
+	}
+	if err := validateQuality(settings.Quality); err != nil {
+		settings.Quality = qualityBest
+	}
+	a.settings = settings
+}
+
+func (a *AnimeService) saveSettings() {
+	a.settingsMutex.RLock()
+	data, err := json.MarshalIndent(a.settings, "", "  ")
+	a.settingsMutex.RUnlock()
+
+	if err != nil {
+		fmt.Printf("Error marshaling settings: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(a.settingsPath, data, 0644); err != nil {
+		fmt.Printf("Error saving settings: %v\n", err)
+	}
+}
+
+func (a *AnimeService) GetSettings() AppSettings {
+	a.settingsMutex.RLock()
+	defer a.settingsMutex.RUnlock()
+	return a.settings
+}
+
+func (a *AnimeService) GetQualityPreference() string {
+	return a.GetSettings().Quality
+}
+
+// SetQualityPreference sets the default quality used for streaming and
+// downloads when a call does not override it.
+func (a *AnimeService) SetQualityPreference(quality string) error {
+	if err := validateQuality(quality); err != nil {
+		return err
+	}
+	if quality == "" {
+		quality = qualityBest
+	}
+
+	a.settingsMutex.Lock()
+	a.settings.Quality = quality
+	a.settingsMutex.Unlock()
+
+	a.saveSettings()
+	return nil
+}
+
+func (a *AnimeService) SetAdaptiveStreaming(enabled bool) {
+	a.settingsMutex.Lock()
+	a.settings.AdaptiveStreaming = enabled
+	a.settingsMutex.Unlock()
+
+	a.saveSettings()
+}
+
+// SetMetadataTTL sets how long cached titles, anime details and episode
+// lists are used before they are fetched again.
+func (a *AnimeService) SetMetadataTTL(ttl MetadataTTLSettings) error {
+	if ttl.Titles < 0 || ttl.Anime < 0 || ttl.Episodes < 0 {
+		return fmt.Errorf("metadata TTL cannot be negative")
+	}
+
+	a.settingsMutex.Lock()
+	a.settings.MetadataTTL = ttl
+	a.settingsMutex.Unlock()
+
+	a.metadata.SetTTL(ttl)
+	a.saveSettings()
+	return nil
+}
+
+// SetPreferredSource sets the source opened by default for search results
+// found on several sources. An empty source picks automatically.
+func (a *AnimeService) SetPreferredSource(source string) error {
+	if source != "" {
+		parsed, err := types.ParseSource(source)
+		if err != nil {
+			return err
+		}
+		source = parsed.String()
+	}
+
+	a.settingsMutex.Lock()
+	a.settings.PreferredSource = source
+	a.settingsMutex.Unlock()
+
+	a.saveSettings()
+	return nil
+}
+
+// SetCacheBudget sets how many megabytes of segments the cache keeps, 0 for
+// the default. Lowering it evicts right away.
+func (a *AnimeService) SetCacheBudget(mb int) error {
+	if mb < 0 {
+		return fmt.Errorf("cache budget cannot be negative")
+	}
+
+	a.settingsMutex.Lock()
+	a.settings.CacheBudgetMB = mb
+	budget := a.settings.cacheBudget()
+	a.settingsMutex.Unlock()
+
+	a.segments.setBudget(budget)
+	a.saveSettings()
+	return nil
+}
+
+// SetPrefetchSegments sets how many segments the proxy fetches ahead of the
+// player, 0 to turn prefetching off.
+func (a *AnimeService) SetPrefetchSegments(n int) error {
+	if n < 0 || n > maxPrefetchSegments {
+		return fmt.Errorf("prefetch must be between 0 and %d segments", maxPrefetchSegments)
+	}
+
+	a.settingsMutex.Lock()
+	a.settings.PrefetchSegments = n
+	a.settingsMutex.Unlock()
+
+	if n == 0 {
+		a.prefetch.stop()
+	}
+	a.saveSettings()
+	return nil
+}
+
+// cacheBudget is the segment cache budget in bytes
+func (s AppSettings) cacheBudget() int64 {
+	if s.CacheBudgetMB > 0 {
+		return int64(s.CacheBudgetMB) << 20
+	}
+	return defaultCacheBudgetMB << 20
+}
+
+// effectiveQuality returns the per-call override if set, otherwise the
+// global preference.
+func (a *AnimeService) effectiveQuality(override string) string {
+	if override != "" {
+		return override
+	}
+	return a.GetQualityPreference()
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetimes of cached metadata. Title lookups rarely change, while
+// episode lists grow every week for airing shows.
+const (
+	defaultTitleTTL   = 30 * 24 * time.Hour
+	defaultAnimeTTL   = 7 * 24 * time.Hour
+	defaultEpisodeTTL = 24 * time.Hour
+	// defaultSourceTTL is how long a series stays mapped to the source it
+	// failed over to
+	defaultSourceTTL = 30 * 24 * time.Hour
+	// defaultEpisodeListTTL is how long a source's episode list is reused
+	// before it is listed again for new episodes
+	defaultEpisodeListTTL = time.Hour
+)
+
+// MetadataTTLSettings overrides the cache lifetimes, in hours. Zero keeps the
+// default.
+type MetadataTTLSettings struct {
+	Titles   int `json:"titles"`
+	Anime    int `json:"anime"`
+	Episodes int `json:"episodes"`
+}
+
+func ttlOrDefault(hours int, def time.Duration) time.Duration {
+	if hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return def
+}
+
+// titleEntry maps a cleaned title to its MyAnimeList ID, or its AniList ID
+// for anime MyAnimeList does not list.
+type titleEntry struct {
+	MalID     int `json:"malId"`
+	AnilistID int `json:"anilistId,omitempty"`
+}
+
+// metadataStore caches metadata in three tables: cleaned title to MAL ID,
+// merged anime details by MAL ID, and episode lists by MAL ID. Each table is an
+// append-only JSON lines file, so a lookup writes one line instead of
+// rewriting the whole cache. Two more tables keep the episode lists of the
+// sources and the source each series failed over to.
+type metadataStore struct {
+	titles       *storeTable[titleEntry]
+	anime        *storeTable[AnimeDetails]
+	episodes     *storeTable[[]EpisodeMetadata]
+	episodeLists *storeTable[[]Episode]
+	sources      *storeTable[sourceMapping]
+}
+
+func openMetadataStore(dir string) (*metadataStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &metadataStore{}
+	var err error
+	if s.titles, err = openStoreTable[titleEntry](filepath.Join(dir, "titles.jsonl"), defaultTitleTTL, 5000); err != nil {
+		return nil, err
+	}
+	if s.anime, err = openStoreTable[AnimeDetails](filepath.Join(dir, "anime.jsonl"), defaultAnimeTTL, 5000); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.episodes, err = openStoreTable[[]EpisodeMetadata](filepath.Join(dir, "episodes.jsonl"), defaultEpisodeTTL, 1000); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.episodeLists, err = openStoreTable[[]Episode](filepath.Join(dir, "episode_lists.jsonl"), defaultEpisodeListTTL, 500); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.sources, err = openStoreTable[sourceMapping](filepath.Join(dir, "sources.jsonl"), defaultSourceTTL, 1000); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// newMemoryMetadataStore returns a store that is not persisted, used when
+// the metadata directory cannot be opened.
+func newMemoryMetadataStore() *metadataStore {
+	return &metadataStore{
+		titles:       newStoreTable[titleEntry]("", defaultTitleTTL, 5000),
+		anime:        newStoreTable[AnimeDetails]("", defaultAnimeTTL, 5000),
+		episodes:     newStoreTable[[]EpisodeMetadata]("", defaultEpisodeTTL, 1000),
+		episodeLists: newStoreTable[[]Episode]("", defaultEpisodeListTTL, 500),
+		sources:      newStoreTable[sourceMapping]("", defaultSourceTTL, 1000),
+	}
+}
+
+// SetTTL applies user overrides of the cache lifetimes.
+func (s *metadataStore) SetTTL(ttl MetadataTTLSettings) {
+	s.titles.SetTTL(ttlOrDefault(ttl.Titles, defaultTitleTTL))
+	s.anime.SetTTL(ttlOrDefault(ttl.Anime, defaultAnimeTTL))
+	s.episodes.SetTTL(ttlOrDefault(ttl.Episodes, defaultEpisodeTTL))
+}
+
+func (s *metadataStore) Close() {
+	if s.titles != nil {
+		s.titles.Close()
+	}
+	if s.anime != nil {
+		s.anime.Close()
+	}
+	if s.episodes != nil {
+		s.episodes.Close()
+	}
+	if s.episodeLists != nil {
+		s.episodeLists.Close()
+	}
+	if s.sources != nil {
+		s.sources.Close()
+	}
+}
+
+func malKey(malID int) string {
+	return strconv.Itoa(malID)
+}
+
+// detailsKey is the anime table key: the MAL ID, or the AniList ID with a
+// prefix when there is none.
+func detailsKey(malID, anilistID int) string {
+	if malID == 0 && anilistID > 0 {
+		return "anilist:" + strconv.Itoa(anilistID)
+	}
+	return malKey(malID)
+}
+
+// migrateLegacyCache imports metadata_cache.json, the single JSON map used by
+// earlier versions, and renames it so the import runs once. That map mixed
+// cleaned titles with MAL IDs as keys; numeric keys only ever held episode
+// lists. Imported entries keep the file's modification time so they expire
+// as if they had been fetched then.
+func (s *metadataStore) migrateLegacyCache(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var legacy map[string]Metadata
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			fmt.Printf("Legacy metadata cache unreadable, skipping import: %v\n", err)
+		}
+	}
+
+	fetchedAt := info.ModTime()
+	imported := 0
+	for k, v := range legacy {
+		if v.MalID <= 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(k); err != nil {
+			s.titles.putAt(k, titleEntry{MalID: v.MalID}, fetchedAt)
+			if v.Img != "" || v.Desc != "" {
+				s.anime.putAt(malKey(v.MalID), AnimeDetails{MalID: v.MalID, Img: v.Img, Desc: v.Desc}, fetchedAt)
+			}
+		}
+		if len(v.Episodes) > 0 {
+			s.episodes.putAt(malKey(v.MalID), v.Episodes, fetchedAt)
+		}
+		imported++
+	}
+
+	fmt.Printf("Imported %d entries from legacy metadata cache\n", imported)
+	return os.Rename(path, path+".migrated")
+}
+
+// storeRecord is one line of a table file. A record with Deleted set removes
+// the key.
+type storeRecord[V any] struct {
+	Key       string `json:"k"`
+	Value     V      `json:"v,omitempty"`
+	FetchedAt int64  `json:"t,omitempty"`
+	Deleted   bool   `json:"d,omitempty"`
+}
+
+type storeEntry[V any] struct {
+	value     V
+	fetchedAt time.Time
+	usedAt    time.Time
+}
+
+// storeTable is a size-bounded key-value table backed by an append-only log.
+// Entries older than the TTL are still returned, marked stale, so callers can
+// fall back to them when a refresh fails. When the table is full the least
+// recently used entry is evicted. The log is compacted once it holds more
+// dead lines than live entries.
+type storeTable[V any] struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	entries    map[string]*storeEntry[V]
+	lines      int
+	ttl        time.Duration
+	maxEntries int
+}
+
+func newStoreTable[V any](path string, ttl time.Duration, maxEntries int) *storeTable[V] {
+	return &storeTable[V]{
+		path:       path,
+		entries:    make(map[string]*storeEntry[V]),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+	}
+}
+
+func openStoreTable[V any](path string, ttl time.Duration, maxEntries int) (*storeTable[V], error) {
+	t := newStoreTable[V](path, ttl, maxEntries)
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	if t.lines > 2*len(t.entries)+100 || len(t.entries) > maxEntries {
+		t.evict()
+		if err := t.compact(); err != nil {
+			fmt.Printf("Error compacting %s: %v\n", filepath.Base(path), err)
+		}
+	}
+	if t.file == nil {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		t.file = f
+	}
+	return t, nil
+}
+
+// load replays the log. A torn last line from a crash mid-write is skipped.
+func (t *storeTable[V]) load() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		t.lines++
+
+		var rec storeRecord[V]
+		if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Key == "" {
+			continue
+		}
+		if rec.Deleted {
+			delete(t.entries, rec.Key)
+			continue
+		}
+		fetchedAt := time.Unix(rec.FetchedAt, 0)
+		t.entries[rec.Key] = &storeEntry[V]{value: rec.Value, fetchedAt: fetchedAt, usedAt: fetchedAt}
+	}
+	return scanner.Err()
+}
+
+func (t *storeTable[V]) SetTTL(ttl time.Duration) {
+	t.mu.Lock()
+	t.ttl = ttl
+	t.mu.Unlock()
+}
+
+// Get returns the value for key and whether it is still within the TTL.
+func (t *storeTable[V]) Get(key string) (value V, fresh bool, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[key]
+	if !ok {
+		return value, false, false
+	}
+	e.usedAt = time.Now()
+	return e.value, time.Since(e.fetchedAt) < t.ttl, true
+}
+
+// Put stores value as fetched now.
+func (t *storeTable[V]) Put(key string, value V) {
+	t.putAt(key, value, time.Now())
+}
+
+func (t *storeTable[V]) putAt(key string, value V, fetchedAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.put(key, value, fetchedAt)
+}
+
+// put stores an entry and appends it to the log. Callers hold t.mu.
+func (t *storeTable[V]) put(key string, value V, fetchedAt time.Time) {
+	t.entries[key] = &storeEntry[V]{value: value, fetchedAt: fetchedAt, usedAt: time.Now()}
+	t.append(storeRecord[V]{Key: key, Value: value, FetchedAt: fetchedAt.Unix()})
+	t.evict()
+
+	if t.lines > 2*len(t.entries)+100 {
+		if err := t.compact(); err != nil {
+			fmt.Printf("Error compacting %s: %v\n", filepath.Base(t.path), err)
+		}
+	}
+}
+
+// Update applies fn to the current value of key, or to the zero value if
+// there is none. The entry keeps its fetch time, as a partial update does
+// not refresh the rest of the value; a new entry counts as fetched now.
+func (t *storeTable[V]) Update(key string, fn func(V) V) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var current V
+	fetchedAt := time.Now()
+	if e, ok := t.entries[key]; ok {
+		current, fetchedAt = e.value, e.fetchedAt
+	}
+	t.put(key, fn(current), fetchedAt)
+}
+
+func (t *storeTable[V]) Delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.entries[key]; !ok {
+		return
+	}
+	delete(t.entries, key)
+	t.append(storeRecord[V]{Key: key, Deleted: true})
+}
+
+func (t *storeTable[V]) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
+
+func (t *storeTable[V]) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// append writes one record to the log. Callers hold t.mu.
+func (t *storeTable[V]) append(rec storeRecord[V]) {
+	if t.file == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Printf("Error marshaling %s record: %v\n", filepath.Base(t.path), err)
+		return
+	}
+	if _, err := t.file.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Error writing %s: %v\n", filepath.Base(t.path), err)
+		return
+	}
+	t.lines++
+}
+
+// evict drops least recently used entries until the table fits. Callers
+// hold t.mu.
+func (t *storeTable[V]) evict() {
+	for len(t.entries) > t.maxEntries {
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range t.entries {
+			if oldestKey == "" || e.usedAt.Before(oldest) {
+				oldestKey, oldest = k, e.usedAt
+			}
+		}
+		delete(t.entries, oldestKey)
+		t.append(storeRecord[V]{Key: oldestKey, Deleted: true})
+	}
+}
+
+// compact rewrites the log with only the live entries. Callers hold t.mu.
+func (t *storeTable[V]) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for k, e := range t.entries {
+		if err := enc.Encode(storeRecord[V]{Key: k, Value: e.value, FetchedAt: e.fetchedAt.Unix()}); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+
+	// Windows cannot rename over an open file
+	reopen := t.file != nil
+	if reopen {
+		t.file.Close()
+		t.file = nil
+	}
+	renameErr := os.Rename(tmp.Name(), t.path)
+	if renameErr != nil {
+		os.Remove(tmp.Name())
+	}
+	if reopen {
+		f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		t.file = f
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	t.lines = len(t.entries)
+	return nil
+}
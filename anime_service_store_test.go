@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreTablePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anime.jsonl")
+	table, err := openStoreTable[AnimeDetails](path, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Put("1", AnimeDetails{Img: "a.webp", Desc: "first"})
+	table.Put("2", AnimeDetails{Img: "b.webp"})
+	table.Put("1", AnimeDetails{Img: "a.webp", Desc: "updated"})
+	table.Delete("2")
+	table.Close()
+
+	// A crash mid-write leaves a torn last line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"k":"3","v":{"img":`)
+	f.Close()
+
+	table, err = openStoreTable[AnimeDetails](path, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	v, fresh, ok := table.Get("1")
+	if !ok || !fresh || v.Desc != "updated" {
+		t.Errorf("Get(1) = %+v, fresh=%v, ok=%v", v, fresh, ok)
+	}
+	if _, _, ok := table.Get("2"); ok {
+		t.Error("deleted key survived reopening")
+	}
+	if table.Len() != 1 {
+		t.Errorf("Len = %d, want 1", table.Len())
+	}
+}
+
+func TestStoreTableTTL(t *testing.T) {
+	table, err := openStoreTable[titleEntry](filepath.Join(t.TempDir(), "titles.jsonl"), time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	table.putAt("old", titleEntry{MalID: 1}, time.Now().Add(-2*time.Hour))
+	table.Put("new", titleEntry{MalID: 2})
+
+	if v, fresh, ok := table.Get("old"); !ok || fresh || v.MalID != 1 {
+		t.Errorf("expired entry: %+v, fresh=%v, ok=%v; want stale value", v, fresh, ok)
+	}
+	if _, fresh, _ := table.Get("new"); !fresh {
+		t.Error("new entry reported stale")
+	}
+
+	// A partial update keeps the entry's age
+	table.Update("old", func(v titleEntry) titleEntry { v.MalID = 3; return v })
+	if v, fresh, _ := table.Get("old"); fresh || v.MalID != 3 {
+		t.Errorf("after Update: %+v, fresh=%v", v, fresh)
+	}
+
+	table.SetTTL(3 * time.Hour)
+	if _, fresh, _ := table.Get("old"); !fresh {
+		t.Error("longer TTL not applied")
+	}
+}
+
+func TestStoreTableEvictsAndCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "episodes.jsonl")
+	table, err := openStoreTable[titleEntry](path, time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Put("a", titleEntry{MalID: 1})
+	time.Sleep(time.Millisecond)
+	table.Put("b", titleEntry{MalID: 2})
+	time.Sleep(time.Millisecond)
+	table.Put("c", titleEntry{MalID: 3})
+	time.Sleep(time.Millisecond)
+	table.Get("a")
+	table.Put("d", titleEntry{MalID: 4})
+
+	if _, _, ok := table.Get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, _, ok := table.Get(k); !ok {
+			t.Errorf("%s evicted", k)
+		}
+	}
+
+	// Rewriting one key over and over must not grow the log forever
+	for i := 0; i < 500; i++ {
+		table.Put("a", titleEntry{MalID: i})
+	}
+	table.Close()
+	data, _ := os.ReadFile(path)
+	if lines := bytes.Count(data, []byte("\n")); lines > 2*3+100 {
+		t.Errorf("log has %d lines for 3 entries, compaction did not run", lines)
+	}
+
+	table, err = openStoreTable[titleEntry](path, time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if v, _, _ := table.Get("a"); v.MalID != 499 {
+		t.Errorf("after compaction a = %d, want 499", v.MalID)
+	}
+	if table.Len() != 3 {
+		t.Errorf("Len = %d, want 3", table.Len())
+	}
+}
+
+func TestMigrateLegacyCache(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "metadata_cache.json")
+	legacy := map[string]Metadata{
+		"frieren": {Img: "f.webp", Desc: "An elf mage", MalID: 52991},
+		"52991":   {MalID: 52991, Episodes: []EpisodeMetadata{{Episode: 1, Title: "The Journey's End"}}},
+		"unknown": {},
+	}
+	data, _ := json.Marshal(legacy)
+	if err := os.WriteFile(legacyPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	os.Chtimes(legacyPath, old, old)
+
+	store, err := openMetadataStore(filepath.Join(dir, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.migrateLegacyCache(legacyPath); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Error("legacy cache left in place, migration would run again")
+	}
+
+	store, err = openMetadataStore(filepath.Join(dir, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if title, _, ok := store.titles.Get("frieren"); !ok || title.MalID != 52991 {
+		t.Errorf("title = %+v, ok=%v", title, ok)
+	}
+	if _, _, ok := store.titles.Get("52991"); ok {
+		t.Error("MAL ID key imported as a title")
+	}
+	if _, _, ok := store.titles.Get("unknown"); ok {
+		t.Error("entry without a MAL ID imported")
+	}
+	details, fresh, ok := store.anime.Get("52991")
+	if !ok || details.Desc != "An elf mage" {
+		t.Errorf("details = %+v, ok=%v", details, ok)
+	}
+	if fresh {
+		t.Error("imported details should keep the legacy file's age")
+	}
+	eps, _, ok := store.episodes.Get("52991")
+	if !ok || len(eps) != 1 || eps[0].Title != "The Journey's End" {
+		t.Errorf("episodes = %+v, ok=%v", eps, ok)
+	}
+}
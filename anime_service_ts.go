@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	tsStreamH264 = 0x1B
+	tsStreamAAC  = 0x0F
+
+	// PTS/DTS are 33-bit counters of a 90kHz clock
+	tsClockRate = 90000
+	tsWrap      = int64(1) << 33
+)
+
+// pesPacket is a reassembled PES packet of one elementary stream.
+type pesPacket struct {
+	StreamType byte
+	PTS        int64
+	DTS        int64
+	Data       []byte
+}
+
+// tsDemuxer reassembles the H.264 and AAC elementary streams of the first
+// program in an MPEG-TS stream. It keeps its state across segments so the
+// PMT and timestamp unwrapping carry over.
+type tsDemuxer struct {
+	pmtPID  int
+	streams map[uint16]byte
+	pending map[uint16]*bytes.Buffer
+	lastTS  int64
+	haveTS  bool
+	packets []pesPacket
+}
+
+func newTSDemuxer() *tsDemuxer {
+	return &tsDemuxer{
+		pmtPID:  -1,
+		streams: make(map[uint16]byte),
+		pending: make(map[uint16]*bytes.Buffer),
+	}
+}
+
+// Demux parses one segment and returns its PES packets in stream order.
+// Packets still being assembled at the end of the segment are completed,
+// since every HLS segment starts with fresh PES packets.
+func (d *tsDemuxer) Demux(data []byte) ([]pesPacket, error) {
+	d.packets = nil
+
+	for pos := tsSync(data, 0); pos >= 0 && pos+tsPacketSize <= len(data); {
+		pkt := data[pos : pos+tsPacketSize]
+		if pkt[0] != tsSyncByte {
+			pos = tsSync(data, pos)
+			continue
+		}
+		if err := d.parsePacket(pkt); err != nil {
+			return nil, err
+		}
+		pos += tsPacketSize
+	}
+
+	for pid := range d.pending {
+		if err := d.flush(pid); err != nil {
+			return nil, err
+		}
+	}
+	return d.packets, nil
+}
+
+// tsSync finds the next packet boundary at or after pos, confirmed by a sync
+// byte one packet later where the data allows it.
+func tsSync(data []byte, pos int) int {
+	for ; pos < len(data); pos++ {
+		if data[pos] != tsSyncByte {
+			continue
+		}
+		if pos+tsPacketSize >= len(data) || data[pos+tsPacketSize] == tsSyncByte {
+			return pos
+		}
+	}
+	return -1
+}
+
+func (d *tsDemuxer) parsePacket(pkt []byte) error {
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	afc := (pkt[3] >> 4) & 0x03
+
+	payload := pkt[4:]
+	switch afc {
+	case 0, 2:
+		return nil
+	case 3:
+		afLen := int(payload[0])
+		if afLen+1 > len(payload) {
+			return nil
+		}
+		payload = payload[afLen+1:]
+	}
+
+	switch {
+	case pid == 0:
+		if pusi {
+			d.parsePAT(payload)
+		}
+	case int(pid) == d.pmtPID:
+		if pusi {
+			d.parsePMT(payload)
+		}
+	default:
+		if _, ok := d.streams[pid]; !ok {
+			return nil
+		}
+		if pusi {
+			if err := d.flush(pid); err != nil {
+				return err
+			}
+			d.pending[pid] = &bytes.Buffer{}
+		}
+		if buf, ok := d.pending[pid]; ok {
+			buf.Write(payload)
+		}
+	}
+	return nil
+}
+
+// psiSection returns the section body after the section_length field,
+// without the trailing CRC.
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	payload = payload[1:]
+	if pointer+3 > len(payload) {
+		return nil
+	}
+	payload = payload[pointer:]
+	sectionLen := int(payload[1]&0x0F)<<8 | int(payload[2])
+	if sectionLen < 4 || 3+sectionLen > len(payload) {
+		return nil
+	}
+	return payload[3 : 3+sectionLen-4]
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 5 {
+		return
+	}
+	for entries := section[5:]; len(entries) >= 4; entries = entries[4:] {
+		program := uint16(entries[0])<<8 | uint16(entries[1])
+		if program != 0 {
+			d.pmtPID = int(entries[2]&0x1F)<<8 | int(entries[3])
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 9 {
+		return
+	}
+	infoLen := int(section[7]&0x0F)<<8 | int(section[8])
+	if 9+infoLen > len(section) {
+		return
+	}
+
+	haveVideo, haveAudio := false, false
+	for entries := section[9+infoLen:]; len(entries) >= 5; {
+		streamType := entries[0]
+		pid := uint16(entries[1]&0x1F)<<8 | uint16(entries[2])
+		esInfoLen := int(entries[3]&0x0F)<<8 | int(entries[4])
+
+		// Only the first stream of each kind is kept
+		if streamType == tsStreamH264 && !haveVideo {
+			d.streams[pid] = streamType
+			haveVideo = true
+		} else if streamType == tsStreamAAC && !haveAudio {
+			d.streams[pid] = streamType
+			haveAudio = true
+		}
+
+		if 5+esInfoLen > len(entries) {
+			break
+		}
+		entries = entries[5+esInfoLen:]
+	}
+}
+
+func (d *tsDemuxer) flush(pid uint16) error {
+	buf, ok := d.pending[pid]
+	if !ok {
+		return nil
+	}
+	delete(d.pending, pid)
+
+	data := buf.Bytes()
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return fmt.Errorf("invalid PES packet on PID %d", pid)
+	}
+
+	flags := data[7] >> 6
+	hdrLen := int(data[8])
+	if 9+hdrLen > len(data) {
+		return fmt.Errorf("truncated PES header on PID %d", pid)
+	}
+
+	pes := pesPacket{StreamType: d.streams[pid], PTS: -1, DTS: -1, Data: data[9+hdrLen:]}
+	if flags&0x02 != 0 && hdrLen >= 5 {
+		pes.PTS = d.unwrap(parsePESTimestamp(data[9:]))
+		pes.DTS = pes.PTS
+	}
+	if flags == 0x03 && hdrLen >= 10 {
+		pes.DTS = d.unwrap(parsePESTimestamp(data[14:]))
+	}
+	d.packets = append(d.packets, pes)
+	return nil
+}
+
+func parsePESTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// unwrap turns a 33-bit timestamp into one that keeps counting past the
+// wrap point, relative to the previous timestamp seen.
+func (d *tsDemuxer) unwrap(ts int64) int64 {
+	if d.haveTS {
+		for ts-d.lastTS < -tsWrap/2 {
+			ts += tsWrap
+		}
+		for ts-d.lastTS > tsWrap/2 {
+			ts -= tsWrap
+		}
+	}
+	d.lastTS, d.haveTS = ts, true
+	return ts
+}
+
+// H.264 NAL unit types used by the remuxer.
+const (
+	h264NALIDR = 5
+	h264NALSPS = 7
+	h264NALPPS = 8
+	h264NALAUD = 9
+)
+
+// splitAnnexB splits an Annex B byte stream into NAL units without start
+// codes.
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nals = append(nals, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+	return nals
+}
+
+// h264SPS holds the fields of a sequence parameter set the MP4 needs.
+type h264SPS struct {
+	Profile       byte
+	Compatibility byte
+	Level         byte
+	Width         int
+	Height        int
+}
+
+// rbsp removes emulation prevention bytes (00 00 03) from a NAL unit.
+func rbsp(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.data)*8 {
+		r.err = errors.New("unexpected end of bitstream")
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint(b)
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = errors.New("invalid Exp-Golomb code")
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 1 {
+		return int(v/2 + 1)
+	}
+	return -int(v / 2)
+}
+
+func parseSPS(nal []byte) (*h264SPS, error) {
+	data := rbsp(nal)
+	if len(data) < 4 {
+		return nil, errors.New("SPS too short")
+	}
+	sps := &h264SPS{Profile: data[1], Compatibility: data[2], Level: data[3]}
+	r := &bitReader{data: data[4:]}
+
+	r.ue() // seq_parameter_set_id
+	chromaFormat := uint(1)
+	switch sps.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bit())
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	sps.Width = widthMbs * 16
+	sps.Height = (2 - frameMbsOnly) * heightMapUnits * 16
+	if r.bit() == 1 {
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, 2-frameMbsOnly
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+		sps.Width -= cropX * (left + right)
+		sps.Height -= cropY * (top + bottom)
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("parsing SPS: %w", r.err)
+	}
+	return sps, nil
+}
+
+// adtsFrame is one AAC frame of an ADTS stream with the header removed.
+type adtsFrame struct {
+	ObjectType int
+	SampleRate int
+	FreqIndex  int
+	Channels   int
+	Data       []byte
+}
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// parseADTS splits an ADTS stream into raw AAC frames.
+func parseADTS(data []byte) ([]adtsFrame, error) {
+	var frames []adtsFrame
+	for len(data) >= 7 {
+		if data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+			return frames, errors.New("lost ADTS sync")
+		}
+		hdrLen := 7
+		if data[1]&0x01 == 0 {
+			hdrLen = 9 // CRC present
+		}
+		frameLen := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if frameLen < hdrLen || frameLen > len(data) {
+			return frames, errors.New("truncated ADTS frame")
+		}
+
+		freqIndex := int(data[2]>>2) & 0x0F
+		if freqIndex >= len(adtsSampleRates) {
+			return frames, fmt.Errorf("invalid ADTS sample rate index %d", freqIndex)
+		}
+		frames = append(frames, adtsFrame{
+			ObjectType: int(data[2]>>6) + 1,
+			FreqIndex:  freqIndex,
+			SampleRate: adtsSampleRates[freqIndex],
+			Channels:   int(data[2]&0x01)<<2 | int(data[3]>>6),
+			Data:       data[hdrLen:frameLen],
+		})
+		data = data[frameLen:]
+	}
+	return frames, nil
+}
+
+// AudioSpecificConfig returns the two byte decoder config for the frame.
+func (f *adtsFrame) AudioSpecificConfig() []byte {
+	v := f.ObjectType<<11 | f.FreqIndex<<7 | f.Channels<<3
+	return []byte{byte(v >> 8), byte(v)}
+}
@@ -1,25 +1,37 @@
 package main
 
+type JikanAnime struct {
+	MALID  int `json:"mal_id"`
+	Images struct {
+		Webp struct {
+			LargeImageURL string `json:"large_image_url"`
+		} `json:"webp"`
+	} `json:"images"`
+	Title        string  `json:"title"`
+	TitleEnglish string  `json:"title_english"`
+	Synopsis     string  `json:"synopsis"`
+	Score        float64 `json:"score"`
+	Status       string  `json:"status"`
+	Episodes     int     `json:"episodes"`
+	Genres       []struct {
+		Name string `json:"name"`
+	} `json:"genres"`
+}
+
 type JikanResponse struct {
-	Data []struct {
-		MALID  int `json:"mal_id"`
-		Images struct {
-			Webp struct {
-				LargeImageURL string `json:"large_image_url"`
-			} `json:"webp"`
-		} `json:"images"`
-		Title        string `json:"title"`
-		TitleEnglish string `json:"title_english"`
-		Synopsis     string `json:"synopsis"`
-	} `json:"data"`
+	Data []JikanAnime `json:"data"`
 }
 
 type JikanEpisodeResponse struct {
+	Pagination struct {
+		HasNextPage bool `json:"has_next_page"`
+	} `json:"pagination"`
 	Data []struct {
 		EpisodeID int    `json:"mal_id"`
 		Title     string `json:"title"`
 		Aired     string `json:"aired"`
 		Filler    bool   `json:"filler"`
+		Recap     bool   `json:"recap"`
 	} `json:"data"`
 }
 
@@ -29,6 +41,29 @@ type EpisodeMetadata struct {
 	Synopsis string `json:"synopsis"`
 	Aired    string `json:"aired"`
 	Filler   bool   `json:"filler"`
+	Recap    bool   `json:"recap,omitempty"`
+}
+
+// AnimeDetails is anime metadata merged from the metadata providers. Score
+// is out of 10.
+type AnimeDetails struct {
+	MalID     int      `json:"malId,omitempty"`
+	AnilistID int      `json:"anilistId,omitempty"`
+	Title     string   `json:"title,omitempty"`
+	Img       string   `json:"img"`
+	Banner    string   `json:"banner,omitempty"`
+	Desc      string   `json:"desc"`
+	Genres    []string `json:"genres,omitempty"`
+	Score     float64  `json:"score,omitempty"`
+	Status    string   `json:"status,omitempty"`
+	Episodes  int      `json:"episodes,omitempty"`
+}
+
+// EpisodeMetadataPage is one page of an anime's episode metadata.
+type EpisodeMetadataPage struct {
+	Page     int               `json:"page"`
+	HasNext  bool              `json:"hasNext"`
+	Episodes []EpisodeMetadata `json:"episodes"`
 }
 
 type Metadata struct {
@@ -46,6 +81,31 @@ type Anime struct {
 	Source    string `json:"source"`
 	Synopsis  string `json:"synopsis"`
 	HasDub    bool   `json:"hasDub"`
+
+	Genres      []string `json:"genres,omitempty"`
+	Score       float64  `json:"score,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	BannerImage string   `json:"bannerImage,omitempty"`
+
+	// Key identifies a merged search result across updates
+	Key string `json:"key,omitempty"`
+	// Sources lists every source that has this anime. URL and Source above
+	// are the one picked by default.
+	Sources []AnimeSource `json:"sources,omitempty"`
+}
+
+// AnimeSource is one source's entry for an anime in search results.
+type AnimeSource struct {
+	Source string `json:"source"`
+	// URL is the source's entry for the anime. It is empty when the source
+	// only lists a dubbed entry.
+	URL string `json:"url,omitempty"`
+	// DubURL is set for sources that list the dub as a separate anime
+	DubURL      string `json:"dubUrl,omitempty"`
+	HasSub      bool   `json:"hasSub"`
+	HasDub      bool   `json:"hasDub"`
+	SubEpisodes int    `json:"subEpisodes,omitempty"`
+	DubEpisodes int    `json:"dubEpisodes,omitempty"`
 }
 
 type Episode struct {
@@ -67,4 +127,36 @@ type StreamInfo struct {
 	IsDownloaded bool              `json:"isDownloaded"`
 	AnimeName    string            `json:"animeName,omitempty"`
 	EpisodeNum   string            `json:"episodeNum,omitempty"`
+	Quality      string            `json:"quality,omitempty"`
+	Resolution   string            `json:"resolution,omitempty"`
+	Bandwidth    int64             `json:"bandwidth,omitempty"`
+	// Source and Provider are where the stream was resolved. FailedOver is
+	// set when that is not the source the anime was opened on.
+	Source     string `json:"source,omitempty"`
+	Provider   string `json:"provider,omitempty"`
+	FailedOver bool   `json:"failedOver,omitempty"`
+
+	failover *streamFailover
+}
+
+// CacheStats describes the segment cache. Hits and misses count segment
+// requests since the app started.
+type CacheStats struct {
+	Size     int64             `json:"size"`
+	Items    int               `json:"items"`
+	Budget   int64             `json:"budget"`
+	Hits     int64             `json:"hits"`
+	Misses   int64             `json:"misses"`
+	HitRatio float64           `json:"hitRatio"`
+	Anime    []AnimeCacheStats `json:"anime"`
+}
+
+// AnimeCacheStats is the share of the segment cache taken by one anime
+type AnimeCacheStats struct {
+	AnimeName string  `json:"animeName"`
+	Size      int64   `json:"size"`
+	Items     int     `json:"items"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRatio  float64 `json:"hitRatio"`
 }
@@ -1,43 +1,126 @@
 package main
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 )
 
-func selectHighestQualityVariant(content string) string {
-	scanner := bufio.NewScanner(strings.NewReader(content))
-	var bestVariant string
-	var maxBandwidth int64
-	var currentBandwidth int64
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
-			tags := line[len("#EXT-X-STREAM-INF:"):]
-			parts := strings.Split(tags, ",")
-			for _, p := range parts {
-				p = strings.TrimSpace(p)
-				if strings.HasPrefix(p, "BANDWIDTH=") {
-					bwStr := p[len("BANDWIDTH="):]
-					if idx := strings.Index(bwStr, ","); idx != -1 {
-						bwStr = bwStr[:idx]
-					}
-					currentBandwidth, _ = strconv.ParseInt(bwStr, 10, 64)
+const (
+	qualityBest         = "best"
+	qualityWorst        = "worst"
+	qualityMaxBandwidth = "max-bandwidth:"
+)
+
+// validateQuality checks a quality preference: "best", "worst", a target
+// height such as "720p", or "max-bandwidth:<bits per second>".
+func validateQuality(quality string) error {
+	switch {
+	case quality == "" || quality == qualityBest || quality == qualityWorst:
+		return nil
+	case strings.HasPrefix(quality, qualityMaxBandwidth):
+		if n, err := strconv.ParseInt(quality[len(qualityMaxBandwidth):], 10, 64); err != nil || n <= 0 {
+			return fmt.Errorf("invalid bandwidth limit: %s", quality)
+		}
+		return nil
+	case strings.HasSuffix(quality, "p"):
+		if n, err := strconv.Atoi(strings.TrimSuffix(quality, "p")); err != nil || n <= 0 {
+			return fmt.Errorf("invalid resolution: %s", quality)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown quality preference: %s", quality)
+}
+
+// selectVariant picks the variant matching the quality preference. Target
+// heights choose the best variant at or below that height, falling back to
+// the smallest one; bandwidth limits work the same way on BANDWIDTH.
+func selectVariant(variants []hlsVariant, quality string) *hlsVariant {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	better := func(a, b *hlsVariant) bool {
+		if a.Bandwidth != b.Bandwidth {
+			return a.Bandwidth > b.Bandwidth
+		}
+		return a.Height > b.Height
+	}
+
+	pick := func(fits func(v *hlsVariant) bool) *hlsVariant {
+		var best, lowest *hlsVariant
+		for i := range variants {
+			v := &variants[i]
+			if lowest == nil || better(lowest, v) {
+				lowest = v
+			}
+			if fits(v) && (best == nil || better(v, best)) {
+				best = v
+			}
+		}
+		if best == nil {
+			return lowest
+		}
+		return best
+	}
+
+	switch {
+	case quality == qualityWorst:
+		return pick(func(v *hlsVariant) bool { return false })
+	case strings.HasPrefix(quality, qualityMaxBandwidth):
+		limit, _ := strconv.ParseInt(quality[len(qualityMaxBandwidth):], 10, 64)
+		return pick(func(v *hlsVariant) bool { return v.Bandwidth <= limit })
+	case strings.HasSuffix(quality, "p"):
+		height, err := strconv.Atoi(strings.TrimSuffix(quality, "p"))
+		if err == nil {
+			hasResolution := false
+			for _, v := range variants {
+				if v.Height > 0 {
+					hasResolution = true
 					break
 				}
 			}
-		} else if line != "" && !strings.HasPrefix(line, "#") {
-			if currentBandwidth >= maxBandwidth {
-				maxBandwidth = currentBandwidth
-				bestVariant = line
+			if hasResolution {
+				return pick(func(v *hlsVariant) bool { return v.Height > 0 && v.Height <= height })
 			}
 		}
 	}
-	return bestVariant
+	return pick(func(v *hlsVariant) bool { return true })
+}
+
+// libraryQuality maps a quality preference to a value understood by
+// goanime.StreamOptions.Quality.
+func libraryQuality(quality string) string {
+	if quality == "" || strings.HasPrefix(quality, qualityMaxBandwidth) {
+		return qualityBest
+	}
+	return quality
+}
+
+// parseEpisodeNumber extracts the numeric part of an episode label such as
+// "12", "12.5" or "Episode 3". Returns 0 when no number is found.
+func parseEpisodeNumber(s string) float64 {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return n
+	}
+
+	start := strings.IndexAny(s, "0123456789")
+	if start == -1 {
+		return 0
+	}
+	end := start
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == '.') {
+		end++
+	}
+	n, _ := strconv.ParseFloat(strings.TrimSuffix(s[start:end], "."), 64)
+	return n
 }
 
 func sanitizeFilename(name string) string {
@@ -129,6 +212,13 @@ func (a *AnimeService) getEpisodeDir(animeName, epNumStr string) string {
 	return filepath.Join(a.downloadsDir, sanitizeFilename(animeName), sanitizeFilename(epNumStr))
 }
 
+// segmentFilename is the name a downloaded or cached resource is stored
+// under: the sha256 of its absolute URL plus the URL's extension.
+func segmentFilename(rawURL string) string {
+	hash := sha256.Sum256([]byte(rawURL))
+	return hex.EncodeToString(hash[:]) + getUrlExtension(rawURL)
+}
+
 func getUrlExtension(rawURL string) string {
 	base := rawURL
 	if idx := strings.IndexAny(base, "?#"); idx != -1 {
@@ -140,3 +230,28 @@ func getUrlExtension(rawURL string) string {
 	}
 	return filepath.Ext(u.Path)
 }
+
+// copyFile copies src to dst through a temp file, so dst is either complete
+// or missing.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := dst + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
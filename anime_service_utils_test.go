@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateQuality(t *testing.T) {
+	tests := []struct {
+		quality string
+		ok      bool
+	}{
+		{"", true},
+		{"best", true},
+		{"worst", true},
+		{"720p", true},
+		{"max-bandwidth:1500000", true},
+		{"720", false},
+		{"0p", false},
+		{"-480p", false},
+		{"hdp", false},
+		{"max-bandwidth:", false},
+		{"max-bandwidth:0", false},
+		{"max-bandwidth:fast", false},
+		{"ultra", false},
+	}
+	for _, tt := range tests {
+		if err := validateQuality(tt.quality); (err == nil) != tt.ok {
+			t.Errorf("validateQuality(%q) = %v, want ok %v", tt.quality, err, tt.ok)
+		}
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	ladder := []hlsVariant{
+		{URI: "1080.m3u8", Bandwidth: 5000000, Width: 1920, Height: 1080},
+		{URI: "360.m3u8", Bandwidth: 800000, Width: 640, Height: 360},
+		{URI: "576.m3u8", Bandwidth: 2000000, Width: 1024, Height: 576},
+	}
+	// Without RESOLUTION only the bandwidth tells them apart
+	bare := []hlsVariant{
+		{URI: "low.m3u8", Bandwidth: 1000000},
+		{URI: "high.m3u8", Bandwidth: 3000000},
+	}
+	mixed := []hlsVariant{
+		{URI: "1080.m3u8", Bandwidth: 5000000, Height: 1080},
+		{URI: "unknown.m3u8", Bandwidth: 9000000},
+		{URI: "480.m3u8", Bandwidth: 1500000, Height: 480},
+	}
+
+	tests := []struct {
+		name     string
+		variants []hlsVariant
+		quality  string
+		want     string
+	}{
+		{"no preference", ladder, "", "1080.m3u8"},
+		{"best", ladder, "best", "1080.m3u8"},
+		{"worst", ladder, "worst", "360.m3u8"},
+		{"exact height", ladder, "1080p", "1080.m3u8"},
+		{"next height down", ladder, "720p", "576.m3u8"},
+		{"below every height", ladder, "240p", "360.m3u8"},
+		{"bandwidth limit", ladder, "max-bandwidth:2500000", "576.m3u8"},
+		{"below every bandwidth", ladder, "max-bandwidth:100000", "360.m3u8"},
+		{"height without resolutions", bare, "720p", "high.m3u8"},
+		{"worst without resolutions", bare, "worst", "low.m3u8"},
+		{"bandwidth without resolutions", bare, "max-bandwidth:2000000", "low.m3u8"},
+		{"height skips unknown resolution", mixed, "720p", "480.m3u8"},
+	}
+	for _, tt := range tests {
+		v := selectVariant(tt.variants, tt.quality)
+		if v == nil || v.URI != tt.want {
+			t.Errorf("%s: selectVariant(%q) = %+v, want %s", tt.name, tt.quality, v, tt.want)
+		}
+	}
+
+	if v := selectVariant(nil, "best"); v != nil {
+		t.Errorf("selectVariant of no variants = %+v, want nil", v)
+	}
+}
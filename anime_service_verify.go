@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	downloadHealthy    = "healthy"
+	downloadDamaged    = "damaged"
+	downloadIncomplete = "incomplete"
+)
+
+// DownloadHealth is the result of verifying one downloaded episode. Damaged
+// episodes can be fixed with RepairDownload; incomplete ones never finished
+// downloading and belong to the download queue.
+type DownloadHealth struct {
+	AnimeName string   `json:"animeName"`
+	EpNumStr  string   `json:"epNumStr"`
+	Status    string   `json:"status"`
+	HasMP4    bool     `json:"hasMp4"`
+	Segments  int      `json:"segments"`
+	Missing   []string `json:"missing"`
+	Corrupt   []string `json:"corrupt"`
+	Problems  []string `json:"problems"`
+}
+
+// VerifyDownload checks a downloaded episode: episode.mp4 must have a
+// complete box structure with a moov atom, and without it every file in
+// manifest.json must be present with the recorded size and plausible content.
+func (a *AnimeService) VerifyDownload(animeName, epNumStr string) (*DownloadHealth, error) {
+	epDir := a.getEpisodeDir(animeName, epNumStr)
+	if _, err := os.Stat(epDir); err != nil {
+		return nil, fmt.Errorf("no download for %s episode %s", animeName, epNumStr)
+	}
+
+	health := &DownloadHealth{
+		AnimeName: animeName,
+		EpNumStr:  epNumStr,
+		Status:    downloadHealthy,
+		Missing:   []string{},
+		Corrupt:   []string{},
+		Problems:  []string{},
+	}
+	problem := func(format string, args ...interface{}) {
+		health.Problems = append(health.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, err := loadStreamMetadata(epDir); err != nil {
+		health.Status = downloadIncomplete
+		problem("stream metadata missing, the download never completed")
+		return health, nil
+	}
+
+	mp4Path := filepath.Join(epDir, "episode.mp4")
+	if _, err := os.Stat(mp4Path); err == nil {
+		health.HasMP4 = true
+		if err := probeMP4(mp4Path); err != nil {
+			health.Status = downloadDamaged
+			health.Corrupt = append(health.Corrupt, "episode.mp4")
+			problem("episode.mp4: %v", err)
+		}
+		// The segments are removed once the MP4 is written
+		return health, nil
+	}
+
+	manifest, err := readManifest(epDir)
+	if err != nil {
+		health.Status = downloadDamaged
+		problem("manifest.json unreadable: %v", err)
+		return health, nil
+	}
+	health.Segments = len(manifest)
+
+	for _, entry := range manifest {
+		if err := checkManifestEntry(epDir, entry); err != nil {
+			if os.IsNotExist(err) {
+				health.Missing = append(health.Missing, entry.File)
+				continue
+			}
+			health.Corrupt = append(health.Corrupt, entry.File)
+			problem("%s: %v", entry.File, err)
+		}
+	}
+	if len(health.Missing) > 0 {
+		problem("%d of %d files missing", len(health.Missing), len(manifest))
+	}
+	if len(health.Missing) > 0 || len(health.Corrupt) > 0 {
+		health.Status = downloadDamaged
+	}
+	return health, nil
+}
+
+// VerifyAllDownloads verifies every downloaded episode. Episodes that are
+// downloading right now are skipped.
+func (a *AnimeService) VerifyAllDownloads() ([]DownloadHealth, error) {
+	downloads, err := a.GetDownloads()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(downloads))
+	for name := range downloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	active := a.GetActiveDownloads()
+	results := []DownloadHealth{}
+	for _, dirName := range names {
+		for _, epNumStr := range downloads[dirName] {
+			// Directory names are sanitized; active keys use the real name
+			busy := false
+			for key := range active {
+				name, ep, _ := strings.Cut(key, ":")
+				if sanitizeFilename(name) == dirName && sanitizeFilename(ep) == epNumStr {
+					busy = true
+				}
+			}
+			if busy {
+				continue
+			}
+
+			health, err := a.VerifyDownload(dirName, epNumStr)
+			if err != nil {
+				continue
+			}
+			results = append(results, *health)
+		}
+	}
+	return results, nil
+}
+
+// RepairDownload fixes a damaged episode. If only the MP4 is missing and the
+// segments are intact it is remuxed locally. Otherwise corrupt files are
+// removed and the episode is queued again from the stored stream metadata,
+// which fetches only the files that are not on disk. The queued repair
+// reports through "download-progress" like any other download; the health
+// returned is the one found before it.
+func (a *AnimeService) RepairDownload(animeName, epNumStr string) (*DownloadHealth, error) {
+	health, err := a.VerifyDownload(animeName, epNumStr)
+	if err != nil {
+		return nil, err
+	}
+	switch health.Status {
+	case downloadHealthy:
+		if health.HasMP4 {
+			return health, nil
+		}
+	case downloadIncomplete:
+		return health, fmt.Errorf("%s episode %s never finished downloading, resume it instead", animeName, epNumStr)
+	}
+
+	key := animeName + ":" + epNumStr
+	a.cancelMutex.RLock()
+	_, busy := a.cancelFuncs[key]
+	a.cancelMutex.RUnlock()
+	a.queue.mu.Lock()
+	if _, job := a.queue.find(key); job != nil {
+		busy = true
+	}
+	a.queue.mu.Unlock()
+	if busy {
+		return health, fmt.Errorf("download in progress for %s", key)
+	}
+
+	epDir := a.getEpisodeDir(animeName, epNumStr)
+	fmt.Printf("[Repair] %s: %d missing, %d corrupt\n", key, len(health.Missing), len(health.Corrupt))
+
+	if health.Status == downloadHealthy {
+		// Segments are fine, only the remux is missing
+		if err := a.remuxDownloaded(epDir); err == nil {
+			return a.VerifyDownload(animeName, epNumStr)
+		}
+	}
+
+	for _, f := range health.Corrupt {
+		os.Remove(filepath.Join(epDir, f))
+	}
+
+	added, err := a.EnqueueDownloads([]DownloadJob{{AnimeName: animeName, EpNumStr: epNumStr, EpNum: parseEpisodeNumber(epNumStr)}})
+	if err != nil {
+		return health, fmt.Errorf("repair failed: %w", err)
+	}
+	if len(added) == 0 {
+		return health, fmt.Errorf("download in progress for %s", key)
+	}
+	return health, nil
+}
+
+// remuxDownloaded turns the stored segments of a completed download into
+// episode.mp4 and removes them.
+func (a *AnimeService) remuxDownloaded(epDir string) error {
+	meta, err := loadStreamMetadata(epDir)
+	if err != nil {
+		return err
+	}
+	manifest, err := readManifest(epDir)
+	if err != nil {
+		return err
+	}
+	rawContent, err := os.ReadFile(filepath.Join(epDir, "index.m3u8"))
+	if err != nil {
+		return err
+	}
+	segments, err := parsePlaylist(string(rawContent)).Segments(meta.URL)
+	if err != nil {
+		return err
+	}
+
+	localM3U8Path := filepath.Join(epDir, "local_index.m3u8")
+	if err := os.WriteFile(localM3U8Path, []byte(localPlaylist(string(rawContent), meta.URL)), 0644); err != nil {
+		return err
+	}
+
+	mp4Path := filepath.Join(epDir, "episode.mp4")
+	if err := remuxEpisode(context.Background(), epDir, segments, mp4Path, "-allowed_extensions", "ALL", "-i", localM3U8Path); err != nil {
+		return err
+	}
+	a.CleanupHLSFiles(epDir, manifestFiles(manifest))
+	return nil
+}
+
+// checkManifestEntry checks a downloaded file against its manifest entry:
+// size, and content that matches what the file should be. Error pages served
+// with a 200 status are the usual culprit.
+func checkManifestEntry(epDir string, entry manifestEntry) error {
+	path := filepath.Join(epDir, entry.File)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("empty file")
+	}
+	if entry.Size > 0 && info.Size() != entry.Size {
+		return fmt.Errorf("size %d, expected %d", info.Size(), entry.Size)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+
+	switch {
+	case entry.Kind == hlsRefKey:
+		if info.Size() != 16 {
+			return fmt.Errorf("AES-128 key is %d bytes", info.Size())
+		}
+		return nil
+	case entry.Encrypted:
+		// Ciphertext can start with any byte, so only its length tells
+		if info.Size()%16 != 0 {
+			return fmt.Errorf("encrypted segment is not a multiple of the AES block size")
+		}
+		return nil
+	case looksLikeErrorPage(head):
+		return fmt.Errorf("contains a text or HTML response instead of media")
+	}
+
+	switch strings.ToLower(filepath.Ext(entry.File)) {
+	case ".ts":
+		if head[0] != tsSyncByte {
+			return fmt.Errorf("not an MPEG-TS segment")
+		}
+	case ".mp4", ".m4s", ".m4v", ".m4a":
+		if len(head) < 8 || !isBoxType(head[4:8]) {
+			return fmt.Errorf("not an MP4 fragment")
+		}
+	}
+	return nil
+}
+
+func looksLikeErrorPage(head []byte) bool {
+	trimmed := bytes.TrimSpace(head)
+	if len(trimmed) == 0 {
+		return true
+	}
+	return trimmed[0] == '<' || trimmed[0] == '{'
+}
+
+func isBoxType(typ []byte) bool {
+	for _, c := range typ {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// probeMP4 walks the top-level boxes of an MP4 file. It fails when a box
+// runs past the end of the file, which is what an interrupted write leaves
+// behind, or when there is no moov or no media data.
+func probeMP4(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	var pos int64
+	hasMoov, hasMdat := false, false
+	header := make([]byte, 16)
+	for pos < fileSize {
+		if fileSize-pos < 8 {
+			return fmt.Errorf("trailing %d bytes at offset %d", fileSize-pos, pos)
+		}
+		if _, err := f.ReadAt(header[:8], pos); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		typ := string(header[4:8])
+		switch size {
+		case 0:
+			size = fileSize - pos
+		case 1:
+			if _, err := f.ReadAt(header[8:16], pos+8); err != nil {
+				return fmt.Errorf("truncated %q box header", typ)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 || !isBoxType(header[4:8]) {
+			return fmt.Errorf("invalid box at offset %d", pos)
+		}
+		if pos+size > fileSize {
+			return fmt.Errorf("%q box is truncated (%d of %d bytes)", typ, fileSize-pos, size)
+		}
+
+		switch typ {
+		case "moov":
+			hasMoov = true
+		case "mdat":
+			hasMdat = true
+		}
+		pos += size
+	}
+
+	if !hasMoov {
+		return fmt.Errorf("no moov atom")
+	}
+	if !hasMdat {
+		return fmt.Errorf("no media data")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyAndRepairDownload(t *testing.T) {
+	f, srv := newEncryptedFixture(t, false)
+	a := newTestService(t, srv.URL+"/media/index.m3u8")
+
+	if err := a.downloadEpisode(DownloadJob{AnimeName: "Fixture", EpNumStr: "1", EpNum: 1}); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+
+	health, err := a.VerifyDownload("Fixture", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != downloadHealthy {
+		t.Fatalf("fresh download reported %s: %v", health.Status, health.Problems)
+	}
+	if health.Segments == 0 {
+		t.Fatal("manifest lists no files")
+	}
+
+	// An error page saved in place of a segment, and a segment lost entirely
+	epDir := a.getEpisodeDir("Fixture", "1")
+	corrupt := segmentFilename(srv.URL + "/media/seg1.ts")
+	missing := segmentFilename(srv.URL + "/media/seg3.ts")
+	if err := os.WriteFile(filepath.Join(epDir, corrupt), []byte("<html>502 Bad Gateway</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(epDir, missing)); err != nil {
+		t.Fatal(err)
+	}
+
+	health, err = a.VerifyDownload("Fixture", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != downloadDamaged {
+		t.Fatalf("expected damaged, got %s", health.Status)
+	}
+	if len(health.Corrupt) != 1 || health.Corrupt[0] != corrupt {
+		t.Errorf("corrupt = %v, want [%s]", health.Corrupt, corrupt)
+	}
+	if len(health.Missing) != 1 || health.Missing[0] != missing {
+		t.Errorf("missing = %v, want [%s]", health.Missing, missing)
+	}
+
+	before := map[string]int{}
+	for _, p := range []string{"/media/seg0.ts", "/media/seg1.ts", "/media/seg2.ts", "/media/seg3.ts", "/media/keys/k1.key"} {
+		before[p] = f.Hits(p)
+	}
+
+	if _, err := a.RepairDownload("Fixture", "1"); err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+	// The repair runs from the queue
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		queue := a.GetQueue()
+		if len(queue) == 0 {
+			break
+		}
+		if queue[0].Status == queueStatusFailed {
+			t.Fatalf("repair failed: %s", queue[0].Error)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("repair still %s", queue[0].Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	health, err = a.VerifyDownload("Fixture", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != downloadHealthy {
+		t.Fatalf("repaired download reported %s: %v", health.Status, health.Problems)
+	}
+
+	for p, n := range before {
+		want := n
+		if p == "/media/seg1.ts" || p == "/media/seg3.ts" {
+			want++
+		}
+		if got := f.Hits(p); got != want {
+			t.Errorf("%s fetched %d times during repair, want %d", p, got-n, want-n)
+		}
+	}
+}
+
+func TestProbeMP4(t *testing.T) {
+	dir := t.TempDir()
+	moov := mp4Box("moov", mp4FullBox("mvhd", 0, 0, make([]byte, 96)))
+	mdat := mp4Box("mdat", make([]byte, 64))
+	file := append(append(mp4Box("ftyp", []byte("isom"), u32(0)), moov...), mdat...)
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"complete", file, true},
+		{"truncated", file[:len(file)-10], false},
+		{"no moov", append(mp4Box("ftyp", []byte("isom"), u32(0)), mdat...), false},
+		{"html", []byte("<html>not found</html>"), false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".mp4")
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := probeMP4(path)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: probeMP4 = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckEncryptedSegmentStartingLikeText(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 32)
+	data[0] = '<'
+	if err := os.WriteFile(filepath.Join(dir, "seg.ts"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := manifestEntry{File: "seg.ts", Kind: hlsRefSegment, Size: 32, Encrypted: true}
+	if err := checkManifestEntry(dir, entry); err != nil {
+		t.Errorf("encrypted segment reported: %v", err)
+	}
+	entry.Encrypted = false
+	if err := checkManifestEntry(dir, entry); err == nil {
+		t.Error("plain segment starting with '<' not reported")
+	}
+
+	// A truncated encrypted segment is still caught
+	if err := os.WriteFile(filepath.Join(dir, "seg.ts"), data[:20], 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry = manifestEntry{File: "seg.ts", Kind: hlsRefSegment, Encrypted: true}
+	if err := checkManifestEntry(dir, entry); err == nil {
+		t.Error("truncated encrypted segment not reported")
+	}
+}
@@ -14,11 +14,10 @@ import { animeService } from './services/animeService';
 import {
     GetEpisodes,
     GetStreamUrl,
-    Search,
-    GetEpisodeMetadata
+    Search
 } from '../wailsjs/go/main/AnimeService';
 import { userLibraryService, DownloadedItem } from './services/userLibraryService';
-import { Anime, Episode, StreamResponse } from './types/anime';
+import { Anime, AnimeSource, Episode, StreamResponse, SearchSourceStatus, SearchSourceEvent, SearchDetailsEvent, SearchDoneEvent, StreamFailoverEvent } from './types/anime';
 import { EventsOn, EventsOff } from '../wailsjs/runtime/runtime';
 
 type ViewMode = 'grid' | 'details' | 'player';
@@ -55,6 +54,10 @@ const App: React.FC = () => {
     const [historyIndex, setHistoryIndex] = useState(-1);
     const isNavigatingHistory = React.useRef(false);
 
+    // Streamed search
+    const activeSearch = React.useRef<string | null>(null);
+    const [searchSources, setSearchSources] = useState<SearchSourceStatus[]>([]);
+
     const refreshDownloads = () => {
         setFullDownloads(userLibraryService.getDownloadsMetadata());
     };
@@ -191,6 +194,47 @@ const App: React.FC = () => {
         });
     }, [activeTab, viewMode, selectedAnime?.malId, selectedEpisode?.number, streamUrl?.url, animes, episodes, isDub]);
 
+    // Search results stream in per source, metadata follows per result
+    React.useEffect(() => {
+        const offSource = EventsOn('search:source', (e: SearchSourceEvent) => {
+            if (e.searchId !== activeSearch.current) return;
+            setSearchSources(prev => [...prev, e.status]);
+            // Results are everything so far, merged across sources
+            if (e.results && e.results.length > 0) {
+                setAnimes(e.results);
+                setIsLoading(false);
+            }
+        });
+        const offDetails = EventsOn('search:details', (e: SearchDetailsEvent) => {
+            if (e.searchId !== activeSearch.current) return;
+            const removed = e.removed || [];
+            setAnimes(prev => prev
+                .filter(a => !a.key || !removed.includes(a.key))
+                .map(a => a.key === e.anime.key ? e.anime : a));
+        });
+        const offDone = EventsOn('search:done', (e: SearchDoneEvent) => {
+            if (e.searchId !== activeSearch.current) return;
+            setIsLoading(false);
+            if (e.sources.length > 0 && e.sources.every(s => s.status !== 'ok')) {
+                setError('Failed to fetch anime. Please try again.');
+            }
+        });
+        return () => {
+            offSource();
+            offDetails();
+            offDone();
+        };
+    }, []);
+
+    // The proxy switched the playing stream to another mirror or source
+    React.useEffect(() => {
+        return EventsOn('stream:failover', (e: StreamFailoverEvent) => {
+            setStreamUrl(prev => prev && prev.url.includes(`id=${e.id}`)
+                ? { ...prev, source: e.source || prev.source, provider: e.provider, failedOver: true }
+                : prev);
+        });
+    }, []);
+
     const handleSearch = async (query: string) => {
         setIsLoading(true);
         setError(null);
@@ -198,13 +242,16 @@ const App: React.FC = () => {
         setSelectedAnime(null);
         setSelectedEpisode(null);
         setStreamUrl(null);
+        setAnimes([]);
+        setSearchSources([]);
+
+        const searchId = `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+        activeSearch.current = searchId;
         try {
-            const results = await animeService.search(query);
-            setAnimes(results);
+            await animeService.startSearch(query, searchId);
         } catch (err) {
             console.error('Search error:', err);
             setError('Failed to fetch anime. Please try again.');
-        } finally {
             setIsLoading(false);
         }
     };
@@ -234,33 +281,8 @@ const App: React.FC = () => {
             const eps = await animeService.getEpisodes(anime, useDub);
             setEpisodes(eps);
             setViewMode('details');
-
-            // Trigger background metadata fetch for all episodes
-            if (anime.malId && anime.malId > 0) {
-                // Fetch first 20 or all if less
-                const toFetch = eps.slice(0, 50);
-                toFetch.forEach(async (ep) => {
-                    if (!ep.synopsis) {
-                        try {
-                            // @ts-ignore
-                            const meta = await GetEpisodeMetadata(anime.malId, parseInt(ep.number));
-                            if (meta) {
-                                setEpisodes(prev => prev.map(e =>
-                                    e.number === ep.number ? {
-                                        ...e,
-                                        synopsis: meta.synopsis || e.synopsis,
-                                        title: meta.title && meta.title !== ep.number ? meta.title : e.title,
-                                        aired: meta.aired || e.aired
-                                    } : e
-                                ));
-                            }
-                        } catch (e) {
-                            // Silently fail for background fetch
-                        }
-                    }
-                });
-            }
         } catch (err) {
+            if (animeService.isCancelled(err)) return;
             console.error('Episodes error:', err);
             setError('Failed to fetch episodes.');
         } finally {
@@ -274,10 +296,48 @@ const App: React.FC = () => {
         await handleAnimeSelect(selectedAnime, dub);
     };
 
-    const handleEpisodeSelect = (episode: Episode) => {
+    const handleSelectSource = async (source: AnimeSource) => {
+        if (!selectedAnime || source.source === selectedAnime.source) return;
+        const dub = isDub && source.hasDub;
+        setIsDub(dub);
+        await handleAnimeSelect(animeService.withSource(selectedAnime, source), dub);
+    };
+
+    const handleEpisodeSelect = async (episode: Episode) => {
         setSelectedEpisode(episode);
+
+        // The episode list has no synopses; fetch the selected one's
+        const malId = selectedAnime?.malId;
+        if (!malId || episode.synopsis || episode.num !== Math.trunc(episode.num)) return;
+        try {
+            const meta = await animeService.getEpisodeMetadata(malId, episode.num);
+            if (meta?.synopsis) {
+                const withSynopsis = { ...episode, synopsis: meta.synopsis };
+                setEpisodes(prev => prev.map(e => e.number === episode.number ? withSynopsis : e));
+                setSelectedEpisode(prev => prev?.number === episode.number ? withSynopsis : prev);
+            }
+        } catch (e) {
+            // The details pane shows no synopsis
+        }
     };
 
+    // Metadata pages past the first, loaded as the list scrolls to them;
+    // keyed by MAL ID and page
+    const loadedPages = React.useRef<Set<string>>(new Set());
+    const malId = selectedAnime?.malId;
+    const handlePageVisible = React.useCallback(async (page: number) => {
+        const key = `${malId}:${page}`;
+        if (!malId || loadedPages.current.has(key)) return;
+        loadedPages.current.add(key);
+        try {
+            const meta = await animeService.getEpisodeMetadataPage(malId, page);
+            setEpisodes(prev => animeService.mergeEpisodeMetadata(prev, meta));
+        } catch (e) {
+            // Try again next time the page comes into view
+            loadedPages.current.delete(key);
+        }
+    }, [malId]);
+
     const handleEpisodePlay = async (episode: Episode, animeContext?: Anime) => {
         const anime = animeContext || selectedAnime;
         if (!anime) return;
@@ -293,6 +353,7 @@ const App: React.FC = () => {
             const stream = await animeService.getStreamUrl(anime, episode, isDub);
             setStreamUrl(stream);
         } catch (err) {
+            if (animeService.isCancelled(err)) return;
             setError('Failed to load stream url');
             console.error(err);
         }
@@ -402,9 +463,11 @@ const App: React.FC = () => {
 
     const handleBack = () => {
         if (viewMode === 'player') {
+            animeService.cancelRequest('stream');
             setViewMode('details');
             setStreamUrl(null);
         } else {
+            animeService.cancelRequest('episodes');
             setViewMode('grid');
             setSelectedAnime(null);
             setSelectedEpisode(null);
@@ -518,6 +581,12 @@ const App: React.FC = () => {
                             </div>
                         )}
 
+                        {activeTab === 'library' && viewMode === 'grid' && searchSources.some(s => s.status !== 'ok') && (
+                            <div className="px-4 py-1 text-[11px] text-gray-500 bg-white border-b border-[#D0D0D0]">
+                                {searchSources.filter(s => s.status !== 'ok').map(s => `${s.source}: ${s.status}`).join(' · ')}
+                            </div>
+                        )}
+
                         {!isLoading && activeTab === 'library' && animes.length > 0 && viewMode === 'grid' && (
                             <div className="h-full bg-white">
                                 <AnimeGrid animes={animes} onSelect={handleAnimeSelect} />
@@ -566,6 +635,7 @@ const App: React.FC = () => {
                                     isDownloaded={isDownloaded}
                                     downloadingEpisodes={downloadingEpisodes}
                                     currentAnime={selectedAnime}
+                                    onPageVisible={handlePageVisible}
                                 />
                             </div>
                         )}
@@ -591,6 +661,7 @@ const App: React.FC = () => {
                         selectedEpisode={selectedEpisode}
                         isDub={isDub}
                         onToggleDub={handleToggleDub}
+                        onSelectSource={handleSelectSource}
                     />
                 )}
             </div>
@@ -604,6 +675,13 @@ const App: React.FC = () => {
                                 ? `${episodes.length} items`
                                 : 'Playing'}
                     </span>
+                    {viewMode === 'player' && streamUrl?.source && (
+                        <span title={streamUrl.provider}>
+                            {streamUrl.failedOver && selectedAnime && streamUrl.source !== selectedAnime.source
+                                ? `From ${streamUrl.source} (${selectedAnime.source} failed)`
+                                : `From ${streamUrl.source}`}
+                        </span>
+                    )}
                 </div>
             </footer>
         </div>
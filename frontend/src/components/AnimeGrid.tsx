@@ -12,7 +12,7 @@ const AnimeGrid: React.FC<AnimeGridProps> = ({ animes, onSelect }) => {
         <div className="grid grid-cols-2 sm:grid-cols-4 md:grid-cols-5 lg:grid-cols-6 gap-2 p-2">
             {animes.map((anime) => (
                 <div
-                    key={anime.url}
+                    key={anime.key || anime.url}
                     className="group flex flex-col items-center p-2 rounded-sm cursor-pointer hover:bg-[#E5F3FF] border border-transparent hover:border-[#99D1FF] transition-colors"
                     onClick={() => onSelect(anime)}
                     title={anime.name}
@@ -33,7 +33,11 @@ const AnimeGrid: React.FC<AnimeGridProps> = ({ animes, onSelect }) => {
                         <h3 className="text-[#333333] text-xs font-normal truncate w-full">
                             {anime.name}
                         </h3>
-                        {/* Optional subtitle (year, etc.) could go here */}
+                        {anime.sources && anime.sources.length > 1 && (
+                            <p className="text-[10px] text-gray-500 truncate w-full">
+                                {anime.sources.map(s => s.source).join(' · ')}
+                            </p>
+                        )}
                     </div>
                 </div>
             ))}
@@ -1,5 +1,5 @@
 import React from 'react';
-import { Anime, Episode } from '../../../types/anime';
+import { Anime, AnimeSource, Episode } from '../../../types/anime';
 import { Info, FileText, Play } from 'lucide-react';
 
 interface DetailsPaneProps {
@@ -7,9 +7,18 @@ interface DetailsPaneProps {
     selectedEpisode: Episode | null;
     isDub: boolean;
     onToggleDub: (dub: boolean) => void;
+    onSelectSource: (source: AnimeSource) => void;
 }
 
-const DetailsPane: React.FC<DetailsPaneProps> = ({ anime, selectedEpisode, isDub, onToggleDub }) => {
+// Episode counts a source lists, e.g. "28 sub · 12 dub"
+const sourceSummary = (s: AnimeSource): string => {
+    const parts: string[] = [];
+    if (s.hasSub) parts.push(s.subEpisodes ? `${s.subEpisodes} sub` : 'sub');
+    if (s.hasDub) parts.push(s.dubEpisodes ? `${s.dubEpisodes} dub` : 'dub');
+    return parts.join(' · ');
+};
+
+const DetailsPane: React.FC<DetailsPaneProps> = ({ anime, selectedEpisode, isDub, onToggleDub, onSelectSource }) => {
     if (!anime) {
         return (
             <div className="w-80 h-full bg-[#F5F5F5] border-l border-[#D0D0D0] flex flex-col items-center justify-center p-8 text-center text-gray-400">
@@ -34,6 +43,16 @@ const DetailsPane: React.FC<DetailsPaneProps> = ({ anime, selectedEpisode, isDub
                 </h2>
 
                 <div className="flex flex-wrap gap-2 mb-4">
+                    {anime.score ? (
+                        <span className="px-2 py-0.5 bg-yellow-100 text-yellow-700 rounded text-[10px] font-bold">
+                            ★ {anime.score.toFixed(1)}
+                        </span>
+                    ) : null}
+                    {anime.status && (
+                        <span className="px-2 py-0.5 bg-gray-200 text-gray-600 rounded text-[10px] font-bold uppercase">
+                            {anime.status}
+                        </span>
+                    )}
                     {anime.source && (
                         <span className="px-2 py-0.5 bg-blue-100 text-blue-700 rounded text-[10px] font-bold uppercase">
                             {anime.source}
@@ -56,6 +75,22 @@ const DetailsPane: React.FC<DetailsPaneProps> = ({ anime, selectedEpisode, isDub
                         </div>
                     )}
                 </div>
+
+                {anime.sources && anime.sources.length > 1 && (
+                    <div className="space-y-1">
+                        <span className="text-[10px] font-bold uppercase text-gray-500">Sources</span>
+                        {anime.sources.map(s => (
+                            <button
+                                key={s.source}
+                                className={`w-full flex justify-between px-2 py-1 rounded-sm text-[11px] border transition-colors ${s.source === anime.source ? 'bg-white border-blue-300 text-blue-700' : 'border-transparent text-gray-600 hover:bg-gray-200'}`}
+                                onClick={() => onSelectSource(s)}
+                            >
+                                <span className="font-bold">{s.source}</span>
+                                <span>{sourceSummary(s)}</span>
+                            </button>
+                        ))}
+                    </div>
+                )}
             </div>
 
             <div className="flex-1 overflow-y-auto p-4 space-y-4 custom-scrollbar">
@@ -86,6 +121,9 @@ const DetailsPane: React.FC<DetailsPaneProps> = ({ anime, selectedEpisode, isDub
                         <p className="text-[11px] text-gray-600 leading-relaxed">
                             {anime.synopsis || 'No description available.'}
                         </p>
+                        {anime.genres && anime.genres.length > 0 && (
+                            <p className="text-[10px] text-gray-500">{anime.genres.join(' · ')}</p>
+                        )}
                     </div>
                 )}
             </div>
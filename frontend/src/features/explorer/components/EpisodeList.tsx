@@ -1,4 +1,4 @@
-import React from 'react';
+import React, { useEffect, useRef, useState } from 'react';
 import { Episode } from '../../../types/anime';
 import { Play, Star, Download, Trash2, Loader2 } from 'lucide-react';
 
@@ -14,8 +14,20 @@ interface EpisodeListProps {
     isDownloaded: (episode: Episode) => boolean;
     downloadingEpisodes: Record<string, number>;
     currentAnime?: any;
+    // Called when the first episode of a metadata page past the first,
+    // e.g. episode 101 for page 2, scrolls into view
+    onPageVisible?: (page: number) => void;
 }
 
+const EPISODES_PER_PAGE = 100;
+
+// metadataPage is the metadata page an episode starts, 0 for page 1 and
+// episodes that start none
+const metadataPage = (ep: Episode): number => {
+    const n = Math.trunc(ep.num);
+    return n > EPISODES_PER_PAGE && n === ep.num && n % EPISODES_PER_PAGE === 1 ? Math.ceil(n / EPISODES_PER_PAGE) : 0;
+};
+
 const EpisodeList: React.FC<EpisodeListProps> = ({
     episodes,
     selectedEpisode,
@@ -27,23 +39,53 @@ const EpisodeList: React.FC<EpisodeListProps> = ({
     onDelete,
     isDownloaded,
     downloadingEpisodes,
-    currentAnime
+    currentAnime,
+    onPageVisible
 }) => {
+    const [hideFillers, setHideFillers] = useState(false);
+    const hasFillers = episodes.some(ep => ep.isFiller || ep.isRecap);
+    const visible = hideFillers ? episodes.filter(ep => !ep.isFiller && !ep.isRecap) : episodes;
+
+    // Rows starting a metadata page are watched; App loads each page once
+    const listBody = useRef<HTMLDivElement>(null);
+    useEffect(() => {
+        if (!onPageVisible || !listBody.current) return;
+        const observer = new IntersectionObserver(entries => {
+            for (const entry of entries) {
+                if (entry.isIntersecting) {
+                    onPageVisible(Number((entry.target as HTMLElement).dataset.page));
+                    observer.unobserve(entry.target);
+                }
+            }
+        });
+        listBody.current.querySelectorAll('[data-page]').forEach(el => observer.observe(el));
+        return () => observer.disconnect();
+    }, [onPageVisible, visible]);
+
     return (
         <div className="flex flex-col w-full text-sm select-none">
             {/* Table Header */}
             <div className="flex border-b border-[#E5E5E5] bg-white sticky top-0 z-10">
                 <div className="w-12 px-3 py-1.5 text-left text-gray-500 font-normal border-r border-[#E5E5E5]">Eps</div>
-                <div className="flex-1 px-3 py-1.5 text-left text-gray-500 font-normal border-r border-[#E5E5E5]">Title</div>
+                <div className="flex-1 px-3 py-1.5 text-left text-gray-500 font-normal border-r border-[#E5E5E5] flex items-center justify-between">
+                    Title
+                    {hasFillers && (
+                        <label className="flex items-center gap-1 text-[11px] cursor-pointer">
+                            <input type="checkbox" checked={hideFillers} onChange={e => setHideFillers(e.target.checked)} />
+                            Hide fillers
+                        </label>
+                    )}
+                </div>
                 <div className="w-32 px-3 py-1.5 text-left text-gray-500 font-normal border-r border-[#E5E5E5]">Aired</div>
                 <div className="w-24 px-3 py-1.5 text-center text-gray-500 font-normal">Action</div>
             </div>
 
             {/* List Body */}
-            <div className="bg-white min-h-full">
-                {episodes.map((ep) => (
+            <div ref={listBody} className="bg-white min-h-full">
+                {visible.map((ep) => (
                     <div
                         key={ep.number}
+                        data-page={metadataPage(ep) || undefined}
                         className={`flex border-b border-transparent cursor-default group ${selectedEpisode?.number === ep.number
                             ? 'bg-[#CCE8FF] outline-[#99D1FF] outline-1'
                             : 'hover:bg-[#E5F3FF]'
@@ -59,6 +101,11 @@ const EpisodeList: React.FC<EpisodeListProps> = ({
                                 <Play size={10} fill="currentColor" />
                             </span>
                             {ep.title || `Episode ${ep.number}`}
+                            {(ep.isFiller || ep.isRecap) && (
+                                <span className="px-1 text-[9px] font-bold bg-gray-100 text-gray-500 rounded border border-gray-200">
+                                    {ep.isRecap ? 'RECAP' : 'FILLER'}
+                                </span>
+                            )}
 
                             {ep.hasDub && (
                                 <button
@@ -3,7 +3,6 @@ import Hls from 'hls.js';
 import { Play, Pause, Square, Volume2, VolumeX, Maximize, Minimize, Monitor, SkipBack, SkipForward, Settings, Check } from 'lucide-react';
 import { StreamResponse } from '../../../types/anime';
 import { WindowFullscreen, WindowUnfullscreen, EventsOn } from '../../../../wailsjs/runtime/runtime';
-import { ClearCache } from '../../../../wailsjs/go/main/AnimeService';
 import ProgressBar from './ProgressBar';
 
 interface VideoPlayerProps {
@@ -64,13 +63,6 @@ const VideoPlayer: React.FC<VideoPlayerProps> = ({ stream, onClose, onNext, onPr
         }
     };
 
-    // Cleanup cache on unmount
-    useEffect(() => {
-        return () => {
-            ClearCache();
-        };
-    }, []);
-
     useEffect(() => {
         if (!videoRef.current) return;
 
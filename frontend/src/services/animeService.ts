@@ -1,38 +1,116 @@
 import { Search, GetEpisodes, GetStreamUrl } from '../../wailsjs/go/main/AnimeService';
-import { Anime, Episode, StreamResponse } from '../types/anime';
+import { Anime, AnimeSource, Episode, EpisodeMetadataPage, StreamResponse, DownloadJob, DownloadHealth, MetadataTTLSettings, SearchResponse, CacheStats } from '../types/anime';
 
 export const animeService = {
     search: async (query: string): Promise<Anime[]> => {
         return await (window as any).go.main.AnimeService.Search(query);
     },
+    searchWithStatus: async (query: string): Promise<SearchResponse> => {
+        return await (window as any).go.main.AnimeService.SearchWithStatus(query);
+    },
+    // Results arrive as search:source, search:details and search:done events
+    startSearch: async (query: string, searchId: string): Promise<string> => {
+        return await (window as any).go.main.AnimeService.StartSearch(query, searchId);
+    },
+    // Cancels the running 'search', 'episodes' or 'stream' request
+    cancelRequest: async (kind: 'search' | 'episodes' | 'stream'): Promise<void> => {
+        return await (window as any).go.main.AnimeService.CancelRequest(kind);
+    },
+    // A request superseded by a newer one of its kind fails with this error
+    isCancelled: (err: unknown): boolean => {
+        return String(err).includes('context canceled');
+    },
     getEpisodes: async (anime: Anime, isDub: boolean = false): Promise<Episode[]> => {
-        return await (window as any).go.main.AnimeService.GetEpisodes(anime.name, anime.url, anime.malId || 0, anime.source, isDub);
+        // Sources listing the dub separately are opened on that entry
+        const entry = anime.sources?.find(s => s.source === anime.source);
+        const url = isDub && entry?.dubUrl ? entry.dubUrl : anime.url;
+        // Titles, air dates and filler/recap flags come merged in
+        return await (window as any).go.main.AnimeService.GetEpisodesWithMetadata(anime.name, url, anime.malId || 0, anime.source, isDub);
+    },
+    // The anime as opened on another of its sources
+    withSource: (anime: Anime, source: AnimeSource): Anime => {
+        return { ...anime, source: source.source, url: source.url || source.dubUrl || anime.url };
     },
-    getStreamUrl: async (anime: Anime, episode: Episode, isDub: boolean = false): Promise<StreamResponse> => {
-        return await (window as any).go.main.AnimeService.GetStreamUrl(
+    setPreferredSource: async (source: string): Promise<void> => {
+        return await (window as any).go.main.AnimeService.SetPreferredSource(source);
+    },
+    getStreamUrl: async (anime: Anime, episode: Episode, isDub: boolean = false, quality: string = ''): Promise<StreamResponse> => {
+        // An empty quality falls back to the global preference
+        return await (window as any).go.main.AnimeService.GetStreamUrlWithQuality(
             anime.name,
             anime.url,
             anime.source,
             episode.number,
             episode.url,
             episode.num,
-            isDub
+            isDub,
+            quality
         );
     },
+    getQualityPreference: async (): Promise<string> => {
+        return await (window as any).go.main.AnimeService.GetQualityPreference();
+    },
+    setQualityPreference: async (quality: string): Promise<void> => {
+        return await (window as any).go.main.AnimeService.SetQualityPreference(quality);
+    },
+    setAdaptiveStreaming: async (enabled: boolean): Promise<void> => {
+        return await (window as any).go.main.AnimeService.SetAdaptiveStreaming(enabled);
+    },
+    setMetadataTTL: async (ttl: MetadataTTLSettings): Promise<void> => {
+        // Hours per table, 0 keeps the default
+        return await (window as any).go.main.AnimeService.SetMetadataTTL(ttl);
+    },
+    // Megabytes of segments to keep, 0 for the default
+    setCacheBudget: async (mb: number): Promise<void> => {
+        return await (window as any).go.main.AnimeService.SetCacheBudget(mb);
+    },
+    // Segments the proxy fetches ahead of the player, 0 turns it off
+    setPrefetchSegments: async (n: number): Promise<void> => {
+        return await (window as any).go.main.AnimeService.SetPrefetchSegments(n);
+    },
+    getCacheStats: async (): Promise<CacheStats> => {
+        return await (window as any).go.main.AnimeService.GetCacheStats();
+    },
+    // Keeps the segments of the episode being played
+    clearCache: async (): Promise<void> => {
+        return await (window as any).go.main.AnimeService.ClearCache();
+    },
     getEpisodeMetadata: async (malId: number, epNum: number): Promise<any> => {
         return await (window as any).go.main.AnimeService.GetEpisodeMetadata(malId, epNum);
     },
+    // getEpisodes merges the first page only; page 2 is episodes 101 to 200
+    getEpisodeMetadataPage: async (malId: number, page: number): Promise<EpisodeMetadataPage> => {
+        return await (window as any).go.main.AnimeService.GetEpisodeMetadataPage(malId, page);
+    },
+    // Fills in an episode list from a page of metadata, by episode number
+    mergeEpisodeMetadata: (episodes: Episode[], page: EpisodeMetadataPage): Episode[] => {
+        const byNum = new Map(page.episodes.map(m => [m.episode, m]));
+        return episodes.map(ep => {
+            const m = byNum.get(ep.num);
+            if (!m) return ep;
+            return {
+                ...ep,
+                title: ep.title || m.title,
+                aired: ep.aired || m.aired,
+                isFiller: ep.isFiller || m.filler,
+                isRecap: ep.isRecap || !!m.recap
+            };
+        });
+    },
     downloadEpisode: async (anime: Anime, episode: Episode, isDub: boolean = false): Promise<void> => {
-        // Use full path to avoid ambiguity if needed, but 'main' often suffices
-        return await (window as any).go.main.AnimeService.DownloadEpisode(
-            anime.name,
-            anime.url,
-            anime.source,
-            episode.number,
-            episode.url,
-            episode.num,
+        // Goes through the download queue so the concurrency limit applies
+        await (window as any).go.main.AnimeService.EnqueueDownloads([{
+            animeName: anime.name,
+            animeUrl: anime.url,
+            animeSource: anime.source,
+            epNumStr: episode.number,
+            epUrl: episode.url,
+            epNum: episode.num,
             isDub
-        );
+        }]);
+    },
+    downloadRange: async (anime: Anime, startEp: number, endEp: number, isDub: boolean = false): Promise<any> => {
+        return await (window as any).go.main.AnimeService.DownloadRange(anime, startEp, endEp, isDub);
     },
     deleteDownload: async (animeName: string, epNumStr: string): Promise<void> => {
         return await (window as any).go.main.AnimeService.DeleteDownload(animeName, epNumStr);
@@ -46,18 +124,28 @@ export const animeService = {
     pauseDownload: async (animeName: string, epNumStr: string): Promise<void> => {
         return await (window as any).go.main.AnimeService.PauseDownload(animeName, epNumStr);
     },
-    resumeDownload: async (anime: any, episode: any): Promise<void> => {
-        // Reuse downloadEpisode for resume
-        return await (window as any).go.main.AnimeService.DownloadEpisode(
-            anime.name,
-            anime.url,
-            anime.source,
-            episode.number,
-            episode.url,
-            episode.num
-        );
+    resumeDownload: async (animeName: string, epNumStr: string): Promise<void> => {
+        return await (window as any).go.main.AnimeService.ResumeDownload(animeName, epNumStr);
+    },
+    getQueue: async (): Promise<DownloadJob[]> => {
+        return await (window as any).go.main.AnimeService.GetQueue();
+    },
+    reorderQueue: async (keys: string[]): Promise<void> => {
+        return await (window as any).go.main.AnimeService.ReorderQueue(keys);
+    },
+    cancelQueued: async (key: string): Promise<void> => {
+        return await (window as any).go.main.AnimeService.CancelQueued(key);
     },
     getActiveDownloads: async (): Promise<Record<string, number>> => {
         return await (window as any).go.main.AnimeService.GetActiveDownloads();
+    },
+    verifyDownload: async (animeName: string, epNumStr: string): Promise<DownloadHealth> => {
+        return await (window as any).go.main.AnimeService.VerifyDownload(animeName, epNumStr);
+    },
+    verifyAllDownloads: async (): Promise<DownloadHealth[]> => {
+        return await (window as any).go.main.AnimeService.VerifyAllDownloads();
+    },
+    repairDownload: async (animeName: string, epNumStr: string): Promise<DownloadHealth> => {
+        return await (window as any).go.main.AnimeService.RepairDownload(animeName, epNumStr);
     }
 };
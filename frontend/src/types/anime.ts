@@ -7,6 +7,23 @@ export interface Anime {
     source: string;
     synopsis?: string;
     hasDub?: boolean;
+    genres?: string[];
+    score?: number;
+    status?: 'airing' | 'finished' | 'upcoming' | 'cancelled' | 'hiatus';
+    bannerImage?: string;
+    // Search results merged across sources; url and source are the default pick
+    key?: string;
+    sources?: AnimeSource[];
+}
+
+export interface AnimeSource {
+    source: string;
+    url?: string;
+    dubUrl?: string;
+    hasSub: boolean;
+    hasDub: boolean;
+    subEpisodes?: number;
+    dubEpisodes?: number;
 }
 
 export interface Episode {
@@ -24,9 +41,124 @@ export interface Episode {
     dubUrl?: string;
 }
 
+export interface EpisodeMetadata {
+    episode: number;
+    title: string;
+    synopsis: string;
+    aired: string;
+    filler: boolean;
+    recap?: boolean;
+}
+
+// Episode metadata comes 100 episodes to a page
+export interface EpisodeMetadataPage {
+    page: number;
+    hasNext: boolean;
+    episodes: EpisodeMetadata[];
+}
+
 export interface StreamResponse {
     url: string;
     headers: Record<string, string>;
     isHls: boolean;
     isDownloaded: boolean;
+    quality?: string;
+    resolution?: string;
+    bandwidth?: number;
+    // Where the stream came from; failedOver when not the anime's own source
+    source?: string;
+    provider?: string;
+    failedOver?: boolean;
+}
+
+// Sent when the proxy switches a playing stream to another mirror or source
+export interface StreamFailoverEvent {
+    id: string;
+    source: string;
+    provider?: string;
+    reason: 'mirror' | 'source';
+}
+
+export interface DownloadJob {
+    key: string;
+    animeName: string;
+    animeUrl: string;
+    animeSource: string;
+    epNumStr: string;
+    epUrl: string;
+    epNum: number;
+    isDub: boolean;
+    priority: number;
+    status: 'queued' | 'downloading' | 'paused' | 'failed';
+    progress: number;
+    error?: string;
+    addedAt: string;
+}
+
+export interface DownloadHealth {
+    animeName: string;
+    epNumStr: string;
+    status: 'healthy' | 'damaged' | 'incomplete';
+    hasMp4: boolean;
+    segments: number;
+    missing: string[];
+    corrupt: string[];
+    problems: string[];
+}
+
+export interface MetadataTTLSettings {
+    titles: number;
+    anime: number;
+    episodes: number;
+}
+
+// Hits and misses count segment requests since the app started
+export interface AnimeCacheStats {
+    animeName: string;
+    size: number;
+    items: number;
+    hits: number;
+    misses: number;
+    hitRatio: number;
+}
+
+export interface CacheStats {
+    size: number;
+    items: number;
+    budget: number;
+    hits: number;
+    misses: number;
+    hitRatio: number;
+    anime: AnimeCacheStats[];
+}
+
+export interface SearchSourceStatus {
+    source: string;
+    status: 'ok' | 'timeout' | 'error' | 'challenge';
+    count: number;
+    error?: string;
+    durationMs: number;
+}
+
+export interface SearchResponse {
+    results: Anime[];
+    sources: SearchSourceStatus[];
+}
+
+export interface SearchSourceEvent {
+    searchId: string;
+    status: SearchSourceStatus;
+    results: Anime[] | null;
+}
+
+export interface SearchDetailsEvent {
+    searchId: string;
+    anime: Anime;
+    // Keys of results merged into anime
+    removed?: string[];
+}
+
+export interface SearchDoneEvent {
+    searchId: string;
+    sources: SearchSourceStatus[];
 }
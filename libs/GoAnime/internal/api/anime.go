@@ -14,12 +14,14 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/alvarorichard/Goanime/internal/models"
 	"github.com/alvarorichard/Goanime/internal/util"
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
 	"github.com/ktr0731/go-fuzzyfinder"
 	"github.com/pkg/errors"
 )
 
-// Common HTTP client instance
-var httpClient = &http.Client{}
+// Common HTTP client instance, rate limited per host with the rest of the
+// library
+var httpClient = &http.Client{Transport: transport.Default}
 
 func GetEpisodeData(animeID int, episodeNo int, anime *models.Anime) error {
 
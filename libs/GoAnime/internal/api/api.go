@@ -7,11 +7,13 @@ import (
 	"time"
 
 	"context"
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
 	"github.com/pkg/errors"
 )
 
 // IsDisallowedIP checks if the given IP address falls under a disallowed category.
-// It returns true if the IP address is multicast, unspecified, loopback, or private.
+// It returns true if the IP address is multicast, unspecified, loopback, link-local or private,
+// see transport.IsDisallowedIP.
 //
 // Parameters:
 // - hostIP: a string representing the IP address to check.
@@ -19,15 +21,7 @@ import (
 // Returns:
 // - bool: true if the IP address is disallowed, false otherwise.
 func IsDisallowedIP(hostIP string) bool {
-	// Parse the provided IP address string into a net.IP object.
-	ip := net.ParseIP(hostIP)
-
-	// Check if the IP address is in one of the disallowed categories:
-	// - IsMulticast: returns true if the IP is a multicast address.
-	// - IsUnspecified: returns true if the IP is unspecified (e.g., 0.0.0.0).
-	// - IsLoopback: returns true if the IP is a loopback address (e.g., 127.0.0.1).
-	// - IsPrivate: returns true if the IP is in a private range (e.g., 192.168.x.x).
-	return ip.IsMulticast() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate()
+	return transport.IsDisallowedIP(net.ParseIP(hostIP))
 }
 
 // checkDisallowedIP validates the IP address of a connection to ensure it is allowed.
@@ -16,6 +16,7 @@ import (
 	"github.com/alvarorichard/Goanime/internal/models"
 	"github.com/alvarorichard/Goanime/internal/player"
 	"github.com/alvarorichard/Goanime/internal/util"
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
 	"github.com/charmbracelet/bubbles/progress"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/lrstanley/go-ytdlp"
@@ -285,8 +286,8 @@ func (d *EpisodeDownloader) downloadEpisodeWithSharedProgress(videoURL, destPath
 
 	// Create HTTP client with longer timeout for video downloads
 	client := &http.Client{
-		Transport: api.SafeTransport(10 * time.Minute), // Much longer transport timeout
-		Timeout:   0,                                   // No overall timeout - let it download completely
+		Transport: transport.Default.Wrap(api.SafeTransport(10 * time.Minute)), // Much longer transport timeout
+		Timeout:   0,                                                           // No overall timeout - let it download completely
 	}
 
 	// Get the file
@@ -429,7 +430,7 @@ func (d *EpisodeDownloader) getContentLength(url string) (int64, error) {
 
 	// Simple HTTP HEAD request to get content length
 	httpClient := &http.Client{
-		Transport: api.SafeTransport(10 * time.Second),
+		Transport: transport.Default.Wrap(api.SafeTransport(10 * time.Second)),
 		Timeout:   10 * time.Second,
 	}
 
@@ -646,8 +647,8 @@ func (d *EpisodeDownloader) downloadEpisodeWithProgress(videoURL, destPath strin
 func (d *EpisodeDownloader) downloadHTTPWithProgress(videoURL, destPath string, progressModel *progressModel, program *tea.Program) error {
 	// Create HTTP client with longer timeout for video downloads
 	client := &http.Client{
-		Transport: api.SafeTransport(10 * time.Minute), // Much longer transport timeout
-		Timeout:   0,                                   // No overall timeout - let it download completely
+		Transport: transport.Default.Wrap(api.SafeTransport(10 * time.Minute)), // Much longer transport timeout
+		Timeout:   0,                                                           // No overall timeout - let it download completely
 	}
 
 	// Get the file
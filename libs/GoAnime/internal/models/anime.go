@@ -10,6 +10,10 @@ type Anime struct {
 	Details   AniListDetails
 	Source    string // Identifies the source (AllAnime, AnimeFire, etc.)
 	HasDub    bool   // Indicates if a dubbed version is available
+
+	// Episode counts as listed by the source, 0 when it does not say
+	SubEpisodes int
+	DubEpisodes int
 }
 
 // Episode represents a single episode of an anime series, containing details such as episode number,
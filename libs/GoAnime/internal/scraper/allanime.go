@@ -2,6 +2,7 @@
 package scraper
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/alvarorichard/Goanime/internal/models"
 	"github.com/alvarorichard/Goanime/internal/util"
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
 )
 
 const (
@@ -35,7 +37,8 @@ type AllAnimeClient struct {
 func NewAllAnimeClient() *AllAnimeClient {
 	return &AllAnimeClient{
 		client: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: transport.Default,
 		},
 		referer:   AllAnimeReferer,
 		apiBase:   AllAnimeAPI,
@@ -84,6 +87,11 @@ type EpisodesListResponse struct {
 
 // SearchAnime searches for anime using AllAnime API (based on Curd implementation)
 func (c *AllAnimeClient) SearchAnime(query string, options ...interface{}) ([]*models.Anime, error) {
+	return c.SearchAnimeContext(context.Background(), query, options...)
+}
+
+// SearchAnimeContext is SearchAnime with a context that cancels the request
+func (c *AllAnimeClient) SearchAnimeContext(ctx context.Context, query string, options ...interface{}) ([]*models.Anime, error) {
 	// Use the exact same GraphQL query as Curd
 	searchGql := `query($search: SearchInput, $limit: Int, $page: Int, $translationType: VaildTranslationTypeEnumType, $countryOrigin: VaildCountryOriginEnumType) {
 		shows(search: $search, limit: $limit, page: $page, translationType: $translationType, countryOrigin: $countryOrigin) {
@@ -119,7 +127,7 @@ func (c *AllAnimeClient) SearchAnime(query string, options ...interface{}) ([]*m
 	// Build the request URL exactly like Curd
 	reqURL := fmt.Sprintf("%s?variables=%s&query=%s", c.apiBase, url.QueryEscape(string(variablesJSON)), url.QueryEscape(searchGql))
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -177,10 +185,12 @@ func (c *AllAnimeClient) SearchAnime(query string, options ...interface{}) ([]*m
 
 		// Always add the anime as a single entry
 		anime := &models.Anime{
-			Name:   displayName,
-			URL:    edge.ID,
-			HasDub: dubCount > 0,
-			Source: "AllAnime",
+			Name:        displayName,
+			URL:         edge.ID,
+			HasDub:      dubCount > 0,
+			Source:      "AllAnime",
+			SubEpisodes: subCount,
+			DubEpisodes: dubCount,
 		}
 
 		// Optionally append episode count to Name for search visibility if desired,
@@ -200,6 +210,11 @@ func (c *AllAnimeClient) SearchAnime(query string, options ...interface{}) ([]*m
 
 // GetEpisodesList gets the list of available episodes for an anime (based on Curd implementation)
 func (c *AllAnimeClient) GetEpisodesList(animeID string, mode string) ([]string, error) {
+	return c.GetEpisodesListContext(context.Background(), animeID, mode)
+}
+
+// GetEpisodesListContext is GetEpisodesList with a context that cancels the request
+func (c *AllAnimeClient) GetEpisodesListContext(ctx context.Context, animeID string, mode string) ([]string, error) {
 	if mode == "" {
 		mode = "sub"
 	}
@@ -213,7 +228,7 @@ func (c *AllAnimeClient) GetEpisodesList(animeID string, mode string) ([]string,
 		url.QueryEscape(variables),
 		url.QueryEscape(episodesListGql))
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -277,11 +292,16 @@ func extractEpisodes(availableEpisodesDetail map[string]interface{}, mode string
 
 // GetAnimeEpisodes converts AllAnime episode list to models.Episode format
 func (c *AllAnimeClient) GetAnimeEpisodes(animeURL string) ([]models.Episode, error) {
+	return c.GetAnimeEpisodesContext(context.Background(), animeURL)
+}
+
+// GetAnimeEpisodesContext is GetAnimeEpisodes with a context that cancels the request
+func (c *AllAnimeClient) GetAnimeEpisodesContext(ctx context.Context, animeURL string) ([]models.Episode, error) {
 	// Extract anime ID from URL (animeURL should be the anime ID for AllAnime)
 	animeID := animeURL
 
 	// Get episode list using existing function
-	episodeStrings, err := c.GetEpisodesList(animeID, "sub")
+	episodeStrings, err := c.GetEpisodesListContext(ctx, animeID, "sub")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get episodes list: %w", err)
 	}
@@ -430,20 +450,58 @@ var LinkPriorities = []string{
 }
 
 // GetEpisodeURL gets the streaming URL for a specific episode using priority-based selection
+//
+// Deprecated: Use ResolveStream, which also returns headers, subtitles and
+// the other mirrors.
 func (c *AllAnimeClient) GetEpisodeURL(animeID string, episodeNo string, mode string, quality string) (string, map[string]string, error) {
+	return c.GetEpisodeURLContext(context.Background(), animeID, episodeNo, mode, quality)
+}
+
+// GetEpisodeURLContext is GetEpisodeURL with a context that cancels the
+// episode lookup and every source link request
+//
+// Deprecated: Use ResolveStream.
+func (c *AllAnimeClient) GetEpisodeURLContext(ctx context.Context, animeID string, episodeNo string, mode string, quality string) (string, map[string]string, error) {
+	res, err := c.ResolveStream(ctx, StreamRequest{AnimeURL: animeID, Episode: episodeNo, Mode: mode, Quality: quality})
+	if err != nil {
+		return "", nil, err
+	}
+	metadata := res.Metadata()
+	metadata["anime_id"] = animeID
+	metadata["episode"] = episodeNo
+	return res.URL, metadata, nil
+}
+
+// ResolveStream resolves an episode to a playable link using priority-based
+// selection across the episode's mirrors. A ":dub" suffix on AnimeURL selects
+// the dub unless Mode says otherwise.
+func (c *AllAnimeClient) ResolveStream(ctx context.Context, request StreamRequest) (*StreamResult, error) {
+	animeID := request.AnimeURL
+	mode := request.Mode
+	if strings.HasSuffix(animeID, ":dub") {
+		animeID = strings.TrimSuffix(animeID, ":dub")
+		if mode == "" {
+			mode = "dub"
+		}
+	}
 	if mode == "" {
 		mode = "sub"
 	}
+	quality := request.Quality
 	if quality == "" {
 		quality = "best"
 	}
+	episodeNo := request.Episode
+	if episodeNo == "" {
+		episodeNo = "1"
+	}
 
 	episodeEmbedGQL := `query ($showId: String!, $translationType: VaildTranslationTypeEnumType!, $episodeString: String!) { episode( showId: $showId translationType: $translationType episodeString: $episodeString ) { episodeString sourceUrls }}`
 	variables := fmt.Sprintf(`{"showId":"%s","translationType":"%s","episodeString":"%s"}`, animeID, mode, episodeNo)
 
-	req, err := http.NewRequest("GET", c.apiBase+"/api", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", c.apiBase+"/api", nil)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	q := req.URL.Query()
@@ -456,132 +514,229 @@ func (c *AllAnimeClient) GetEpisodeURL(animeID string, episodeNo string, mode st
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	// Parse the response to extract source URLs
-	sourceURLs := c.extractSourceURLs(string(body))
-	if len(sourceURLs) == 0 {
-		return "", nil, fmt.Errorf("no source URLs found for episode %s", episodeNo)
+	sources := c.extractSources(string(body))
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source URLs found for episode %s", episodeNo)
 	}
 
 	// Process URLs concurrently like Curd does
-	return c.processSourceURLsConcurrent(sourceURLs, quality, animeID, episodeNo)
+	res, err := c.processSourceURLsConcurrent(ctx, sources, quality)
+	if err != nil {
+		return nil, err
+	}
+	res.Mode = mode
+	return res, nil
 }
 
-// processSourceURLsConcurrent processes source URLs with concurrent requests and priority-based selection
-func (c *AllAnimeClient) processSourceURLsConcurrent(sourceURLs []string, quality string, animeID string, episodeNo string) (string, map[string]string, error) {
-	type result struct {
-		index     int
-		links     map[string]string
-		err       error
-		sourceURL string
-	}
+// episodeSource is one mirror offering an episode
+type episodeSource struct {
+	Name string
+	URL  string
+}
+
+// sourceLinks holds the video links found on one mirror
+type sourceLinks struct {
+	source episodeSource
+	// links maps quality to URL, see prioritizeLinks
+	links map[string]string
+	// headers holds the headers a link needs, by URL
+	headers   map[string]map[string]string
+	subtitles []SubtitleTrack
+}
 
-	results := make(chan result, len(sourceURLs))
-	highPriorityLink := make(chan string, 1)
+// alternativesGrace is how long the other mirrors may still answer once a
+// priority link is chosen
+const alternativesGrace = 1500 * time.Millisecond
 
-	// Rate limiter like in Curd
-	rateLimiter := time.NewTicker(50 * time.Millisecond)
-	defer rateLimiter.Stop()
+// processSourceURLsConcurrent processes source URLs with concurrent requests and priority-based selection.
+// The other mirrors get alternativesGrace to answer once a priority link is
+// chosen; the requests still running after that are cancelled.
+func (c *AllAnimeClient) processSourceURLsConcurrent(ctx context.Context, sources []episodeSource, quality string) (*StreamResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// Launch goroutines for concurrent processing
-	for i, sourceURL := range sourceURLs {
-		go func(idx int, url string) {
-			<-rateLimiter.C // Rate limit the requests
+	type result struct {
+		links *sourceLinks
+		err   error
+	}
 
-			links, err := c.getLinks(url)
+	results := make(chan result, len(sources))
+	highPriorityLinks := make(chan *sourceLinks, 1)
+
+	// Launch goroutines for concurrent processing; the shared transport
+	// spaces out the requests per host
+	for _, source := range sources {
+		go func(source episodeSource) {
+			links, err := c.getLinks(ctx, source)
 			if err != nil {
-				results <- result{index: idx, err: err, sourceURL: url}
+				results <- result{err: err}
 				return
 			}
 
 			// Check for high priority links first
-			for _, link := range links {
-				for _, domain := range LinkPriorities[:3] { // Check top 3 priority domains
-					if strings.Contains(link, domain) {
-						// Found high priority link, send it immediately
-						select {
-						case highPriorityLink <- link:
-						default:
-							// Channel already has a high priority link
-						}
-						break
-					}
+			if c.hasHighPriorityLink(links.links) {
+				select {
+				case highPriorityLinks <- links:
+				default:
+					// Channel already has a high priority link
 				}
 			}
 
-			results <- result{index: idx, links: links, sourceURL: url}
-		}(i, sourceURL)
+			results <- result{links: links}
+		}(source)
+	}
+
+	var candidates []*StreamResult
+	pending := len(sources)
+	collect := func(res result) *StreamResult {
+		pending--
+		if res.err != nil {
+			return nil
+		}
+		candidate := c.streamFromLinks(res.links, quality)
+		if candidate != nil {
+			candidates = append(candidates, candidate)
+		}
+		return candidate
+	}
+	// finish gives the mirrors still running a short grace period, so the
+	// chosen link comes with others to fail over to
+	finish := func(chosen *StreamResult) (*StreamResult, error) {
+		grace := time.NewTimer(alternativesGrace)
+		defer grace.Stop()
+		for pending > 0 {
+			select {
+			case res := <-results:
+				collect(res)
+			case <-grace.C:
+				return withAlternatives(chosen, candidates), nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return withAlternatives(chosen, candidates), nil
 	}
 
 	// First, try to get a high priority link quickly
 	select {
-	case link := <-highPriorityLink:
-		// Found high priority link, return it immediately
-		metadata := map[string]string{
-			"quality":  quality,
-			"anime_id": animeID,
-			"episode":  episodeNo,
-			"priority": "high",
-		}
-		return link, metadata, nil
+	case links := <-highPriorityLinks:
+		// Found high priority link, use it without waiting for the rest
+		if res := c.streamFromLinks(links, quality); res != nil {
+			return finish(res)
+		}
 	case <-time.After(2 * time.Second): // Wait briefly for high priority link
 		// No high priority link found quickly, proceed with normal collection
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
 	// Collect results with timeout
 	timeout := time.After(10 * time.Second)
-	successCount := 0
-	var bestURL string
-	var bestMetadata map[string]string
+	var best *StreamResult
 
-	for successCount < len(sourceURLs) {
+	for pending > 0 {
 		select {
 		case res := <-results:
-			if res.err != nil {
+			candidate := collect(res)
+			if candidate == nil {
 				continue
 			}
-
-			// Select quality from the links
-			selectedURL, metadata := c.selectQuality(res.links, quality)
-			if selectedURL != "" {
-				// Check if this is a prioritized link
-				priority := c.getPriorityScore(selectedURL)
-				if priority > 0 || bestURL == "" {
-					bestURL = selectedURL
-					bestMetadata = metadata
-					bestMetadata["source_url"] = res.sourceURL
-					bestMetadata["anime_id"] = animeID
-					bestMetadata["episode"] = episodeNo
-
-					if priority > 0 {
-						// Found a priority link, return immediately
-						return bestURL, bestMetadata, nil
-					}
-				}
+			if candidate.Priority {
+				// Found a priority link, use it
+				return finish(candidate)
+			}
+			if best == nil {
+				best = candidate
 			}
-			successCount++
 
 		case <-timeout:
-			if bestURL != "" {
-				return bestURL, bestMetadata, nil
+			if best != nil {
+				return withAlternatives(best, candidates), nil
+			}
+			return nil, fmt.Errorf("timeout waiting for results")
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if best != nil {
+		return withAlternatives(best, candidates), nil
+	}
+
+	return nil, fmt.Errorf("no suitable quality found from any source")
+}
+
+// hasHighPriorityLink reports whether any link is on one of the top 3 priority domains
+func (c *AllAnimeClient) hasHighPriorityLink(links map[string]string) bool {
+	for _, link := range links {
+		for _, domain := range LinkPriorities[:3] {
+			if strings.Contains(link, domain) {
+				return true
 			}
-			return "", nil, fmt.Errorf("timeout waiting for results")
 		}
 	}
+	return false
+}
+
+// streamFromLinks picks the link matching quality from one mirror, or nil if
+// it has none
+func (c *AllAnimeClient) streamFromLinks(links *sourceLinks, quality string) *StreamResult {
+	selectedURL, metadata := c.selectQuality(links.links, quality)
+	if selectedURL == "" {
+		return nil
+	}
 
-	if bestURL != "" {
-		return bestURL, bestMetadata, nil
+	headers := make(map[string]string)
+	for k, v := range links.headers[selectedURL] {
+		headers[k] = v
 	}
 
-	return "", nil, fmt.Errorf("no suitable quality found from any source")
+	res := &StreamResult{
+		URL:       selectedURL,
+		Source:    AllAnimeType,
+		Quality:   quality,
+		Provider:  links.source.Name,
+		Type:      streamType(selectedURL),
+		Headers:   headers,
+		Subtitles: links.subtitles,
+		ExpiresAt: expiryHint(selectedURL),
+		SourceURL: links.source.URL,
+		Priority:  c.getPriorityScore(selectedURL) > 0,
+	}
+	if metadata["type"] == "m3u8" {
+		res.Type = "m3u8"
+	}
+	if q := metadata["quality"]; !strings.EqualFold(q, "hls") && q != "unknown" {
+		res.Resolution = q
+	}
+	return res
+}
+
+// withAlternatives records every candidate other than chosen on it
+func withAlternatives(chosen *StreamResult, candidates []*StreamResult) *StreamResult {
+	for _, cand := range candidates {
+		if cand == chosen || cand.URL == chosen.URL {
+			continue
+		}
+		chosen.Alternatives = append(chosen.Alternatives, StreamCandidate{
+			URL:        cand.URL,
+			Resolution: cand.Resolution,
+			Provider:   cand.Provider,
+			Headers:    cand.Headers,
+		})
+	}
+	return chosen
 }
 
 // getPriorityScore returns the priority score of a URL based on domain
@@ -594,40 +749,40 @@ func (c *AllAnimeClient) getPriorityScore(url string) int {
 	return 0
 }
 
-// extractSourceURLs extracts source URLs from the API response
-func (c *AllAnimeClient) extractSourceURLs(response string) []string {
+// extractSources extracts the mirrors and their source URLs from the API response
+func (c *AllAnimeClient) extractSources(response string) []episodeSource {
 	// Parse the response as JSON to extract sourceUrls properly
 	var episodeResp EpisodeResponse
 	if err := json.Unmarshal([]byte(response), &episodeResp); err == nil {
-		var urls []string
+		var sources []episodeSource
 		for _, sourceUrl := range episodeResp.Data.Episode.SourceUrls {
 			if strings.HasPrefix(sourceUrl.SourceUrl, "--") {
 				// This is an encoded URL that needs decoding
 				encoded := strings.TrimPrefix(sourceUrl.SourceUrl, "--")
 				decoded := c.decodeSourceURL(encoded)
-				urls = append(urls, decoded)
+				sources = append(sources, episodeSource{Name: sourceUrl.SourceName, URL: decoded})
 			} else {
 				// Direct URL
-				urls = append(urls, sourceUrl.SourceUrl)
+				sources = append(sources, episodeSource{Name: sourceUrl.SourceName, URL: sourceUrl.SourceUrl})
 			}
 		}
-		return urls
+		return sources
 	}
 
 	// Fallback to regex-based extraction if JSON parsing fails
 	re := regexp.MustCompile(`"sourceUrl":"--([^"]*)".*?"sourceName":"([^"]*)"`)
 	matches := re.FindAllStringSubmatch(response, -1)
 
-	var urls []string
+	var sources []episodeSource
 	for _, match := range matches {
-		if len(match) >= 2 {
+		if len(match) >= 3 {
 			// Decode the URL using the complex decoding logic from ani-cli
 			decodedURL := c.decodeSourceURL(match[1])
-			urls = append(urls, decodedURL)
+			sources = append(sources, episodeSource{Name: match[2], URL: decodedURL})
 		}
 	}
 
-	return urls
+	return sources
 }
 
 // decodeSourceURL decodes the encoded source URL using the exact logic from Curd
@@ -675,8 +830,8 @@ func (c *AllAnimeClient) decodeSourceURL(encoded string) string {
 }
 
 // getLinks extracts video links from the source URL with proper headers
-func (c *AllAnimeClient) getLinks(sourceURL string) (map[string]string, error) {
-	req, err := http.NewRequest("GET", sourceURL, nil)
+func (c *AllAnimeClient) getLinks(ctx context.Context, source episodeSource) (*sourceLinks, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", source.URL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -697,9 +852,52 @@ func (c *AllAnimeClient) getLinks(sourceURL string) (map[string]string, error) {
 	}
 
 	links := c.extractVideoLinks(string(body))
+	headers, subtitles := c.extractLinkExtras(string(body))
 
 	// Apply priority-based link selection
-	return c.prioritizeLinks(links), nil
+	return &sourceLinks{
+		source:    source,
+		links:     c.prioritizeLinks(links),
+		headers:   headers,
+		subtitles: subtitles,
+	}, nil
+}
+
+// extractLinkExtras extracts the headers each link needs and the subtitle
+// tracks from a mirror's JSON response
+func (c *AllAnimeClient) extractLinkExtras(response string) (map[string]map[string]string, []SubtitleTrack) {
+	var data struct {
+		Links []struct {
+			Link      string            `json:"link"`
+			Headers   map[string]string `json:"headers"`
+			Subtitles []struct {
+				Lang  string `json:"lang"`
+				Src   string `json:"src"`
+				Label string `json:"label"`
+			} `json:"subtitles"`
+		} `json:"links"`
+	}
+	if err := json.Unmarshal([]byte(response), &data); err != nil {
+		return nil, nil
+	}
+
+	headers := make(map[string]map[string]string)
+	var subtitles []SubtitleTrack
+	seen := make(map[string]bool)
+	for _, l := range data.Links {
+		link := strings.ReplaceAll(l.Link, "\\", "")
+		if len(l.Headers) > 0 {
+			headers[link] = l.Headers
+		}
+		for _, sub := range l.Subtitles {
+			if sub.Src == "" || seen[sub.Src] {
+				continue
+			}
+			seen[sub.Src] = true
+			subtitles = append(subtitles, SubtitleTrack{URL: sub.Src, Language: sub.Lang, Label: sub.Label})
+		}
+	}
+	return headers, subtitles
 }
 
 // prioritizeLinks applies priority-based sorting to video links
@@ -872,11 +1070,19 @@ func (c *AllAnimeClient) selectQuality(links map[string]string, requestedQuality
 	return "", metadata
 }
 
-// GetStreamURL implements the UnifiedScraper interface
+// GetStreamURL implements the UnifiedScraper interface. episodeURL is the
+// anime ID, options are the episode number, quality and mode.
+//
+// Deprecated: Use ResolveStream.
 func (c *AllAnimeClient) GetStreamURL(episodeURL string, options ...interface{}) (string, map[string]string, error) {
-	// For AllAnime, episodeURL contains episode ID, we need anime ID and episode number
-	// This is a simplified implementation - in practice you'd need to parse more context
-	return "", map[string]string{}, fmt.Errorf("GetStreamURL not fully implemented for AllAnime - use GetEpisodeURL instead")
+	return c.GetStreamURLContext(context.Background(), episodeURL, options...)
+}
+
+// GetStreamURLContext implements the UnifiedScraper interface
+//
+// Deprecated: Use ResolveStream.
+func (c *AllAnimeClient) GetStreamURLContext(ctx context.Context, episodeURL string, options ...interface{}) (string, map[string]string, error) {
+	return resolveStreamLegacy(ctx, c, episodeURL, options)
 }
 
 // GetType implements the UnifiedScraper interface
@@ -0,0 +1,177 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessSourceURLsCancelsLosers(t *testing.T) {
+	t.Parallel()
+
+	// The winner answers once the slow request is in flight
+	started := make(chan struct{})
+	winner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+		}
+		_, _ = fmt.Fprint(w, `{"links":[{"link":"https://cdn.sharepoint.com/ep1.mp4","resolutionStr":"1080p"}]}`)
+	}))
+	defer winner.Close()
+
+	stopped := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			stopped <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	client := NewAllAnimeClient()
+	sources := []episodeSource{{Name: "S-mp4", URL: winner.URL}, {Name: "Luf-mp4", URL: slow.URL}}
+	res, err := client.processSourceURLsConcurrent(context.Background(), sources, "best")
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.sharepoint.com/ep1.mp4", res.URL)
+	assert.True(t, res.Priority)
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request to the losing source kept running after a link was chosen")
+	}
+}
+
+func TestGetEpisodeURLContextCancelled(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := NewAllAnimeClient()
+	client.apiBase = server.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := client.GetEpisodeURLContext(ctx, "show", "1", "sub", "best")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "request outlived its deadline")
+}
+
+func TestResolveStreamReturnsTypedResult(t *testing.T) {
+	t.Parallel()
+
+	mirrorA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"links":[
+			{"link":"https://video.example/ep1-720.mp4?expires=2000000000","resolutionStr":"720p",
+			 "headers":{"Referer":"https://mirror-a.example/"},
+			 "subtitles":[{"lang":"en","label":"English","src":"https://subs.example/en.vtt"}]}
+		]}`)
+	}))
+	defer mirrorA.Close()
+	mirrorB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = fmt.Fprint(w, `{"links":[{"link":"https://video.example/master.m3u8","hls":true,"resolutionStr":"Hls"}]}`)
+	}))
+	defer mirrorB.Close()
+
+	var mode string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode = r.URL.Query().Get("variables")
+		_, _ = fmt.Fprintf(w, `{"data":{"episode":{"episodeString":"1","sourceUrls":[
+			{"sourceName":"Default","sourceUrl":%q},
+			{"sourceName":"Luf-mp4","sourceUrl":%q}
+		]}}}`, mirrorA.URL, mirrorB.URL)
+	}))
+	defer api.Close()
+
+	client := NewAllAnimeClient()
+	client.apiBase = api.URL
+
+	res, err := client.ResolveStream(context.Background(), StreamRequest{AnimeURL: "show:dub", Episode: "1", Quality: "best"})
+	require.NoError(t, err)
+	assert.Contains(t, mode, `"translationType":"dub"`)
+	assert.Equal(t, "dub", res.Mode)
+
+	// Both mirrors answered; the first one wins and the other is kept
+	assert.Equal(t, "https://video.example/ep1-720.mp4?expires=2000000000", res.URL)
+	assert.Equal(t, "Default", res.Provider)
+	assert.Equal(t, "720p", res.Resolution)
+	assert.Equal(t, "mp4", res.Type)
+	assert.Equal(t, "https://mirror-a.example/", res.Headers["Referer"])
+	require.Len(t, res.Subtitles, 1)
+	assert.Equal(t, "en", res.Subtitles[0].Language)
+	assert.Equal(t, int64(2000000000), res.ExpiresAt.Unix())
+	require.Len(t, res.Alternatives, 1)
+	assert.Equal(t, "Luf-mp4", res.Alternatives[0].Provider)
+
+	// The deprecated signature still works
+	link, meta, err := client.GetEpisodeURL("show", "1", "sub", "best")
+	require.NoError(t, err)
+	assert.Equal(t, res.URL, link)
+	assert.Equal(t, "720p", meta["quality"])
+	assert.Equal(t, "show", meta["anime_id"])
+}
+
+func TestResolveStreamKeepsAlternativesOfPriorityLink(t *testing.T) {
+	t.Parallel()
+
+	priority := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"links":[{"link":"https://cdn.sharepoint.com/ep1.mp4","resolutionStr":"1080p"}]}`)
+	}))
+	defer priority.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = fmt.Fprint(w, `{"links":[{"link":"https://video.example/master.m3u8","hls":true,"resolutionStr":"Hls"}]}`)
+	}))
+	defer mirror.Close()
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer stalled.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"data":{"episode":{"episodeString":"1","sourceUrls":[
+			{"sourceName":"S-mp4","sourceUrl":%q},
+			{"sourceName":"Luf-mp4","sourceUrl":%q},
+			{"sourceName":"Yt-mp4","sourceUrl":%q}
+		]}}}`, priority.URL, mirror.URL, stalled.URL)
+	}))
+	defer api.Close()
+
+	client := NewAllAnimeClient()
+	client.apiBase = api.URL
+
+	start := time.Now()
+	res, err := client.ResolveStream(context.Background(), StreamRequest{AnimeURL: "show", Episode: "1", Quality: "best"})
+	require.NoError(t, err)
+
+	// The priority link wins at once, the mirror answering within the grace
+	// period is kept and the stalled one is not waited for
+	assert.Equal(t, "https://cdn.sharepoint.com/ep1.mp4", res.URL)
+	assert.True(t, res.Priority)
+	require.Len(t, res.Alternatives, 1)
+	assert.Equal(t, "Luf-mp4", res.Alternatives[0].Provider)
+	assert.Equal(t, "https://video.example/master.m3u8", res.Alternatives[0].URL)
+	assert.Less(t, time.Since(start), alternativesGrace+time.Second)
+}
@@ -2,6 +2,7 @@
 package scraper
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -11,13 +12,16 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/alvarorichard/Goanime/internal/models"
 	"github.com/alvarorichard/Goanime/internal/util"
+	"github.com/alvarorichard/Goanime/pkg/goanime/transport"
 )
 
 const (
 	AnimefireBase = "https://animefire.plus"
 )
 
-// AnimefireClient handles interactions with Animefire.plus
+// AnimefireClient handles interactions with Animefire.plus. Failed
+// requests are retried by the shared transport; the client itself only
+// retries pages it cannot use, like challenge pages.
 type AnimefireClient struct {
 	client     *http.Client
 	baseURL    string
@@ -30,7 +34,8 @@ type AnimefireClient struct {
 func NewAnimefireClient() *AnimefireClient {
 	return &AnimefireClient{
 		client: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: transport.Default,
 		},
 		baseURL:    AnimefireBase,
 		userAgent:  UserAgent,
@@ -41,6 +46,12 @@ func NewAnimefireClient() *AnimefireClient {
 
 // SearchAnime searches for anime on Animefire.plus using the original logic
 func (c *AnimefireClient) SearchAnime(query string) ([]*models.Anime, error) {
+	return c.SearchAnimeContext(context.Background(), query)
+}
+
+// SearchAnimeContext is SearchAnime with a context that cancels the request
+// and the waits between retries
+func (c *AnimefireClient) SearchAnimeContext(ctx context.Context, query string) ([]*models.Anime, error) {
 	// AnimeFire expects spaces as hyphens in the URL
 	normalizedQuery := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(query)), " ", "-")
 	searchURL := fmt.Sprintf("%s/pesquisar/%s", c.baseURL, normalizedQuery)
@@ -51,7 +62,7 @@ func (c *AnimefireClient) SearchAnime(query string) ([]*models.Anime, error) {
 	attempts := c.maxRetries + 1
 
 	for attempt := 0; attempt < attempts; attempt++ {
-		req, err := http.NewRequest("GET", searchURL, nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", searchURL, nil)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
@@ -60,39 +71,29 @@ func (c *AnimefireClient) SearchAnime(query string) ([]*models.Anime, error) {
 
 		resp, err := c.client.Do(req)
 		if err != nil {
-			lastErr = fmt.Errorf("failed to make request: %w", err)
-			if c.shouldRetry(attempt) {
-				c.sleep()
-				continue
-			}
-			return nil, lastErr
+			return nil, fmt.Errorf("failed to make request: %w", err)
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			lastErr = c.handleStatusError(resp)
 			_ = resp.Body.Close()
-			if c.shouldRetry(attempt) {
-				c.sleep()
-				continue
-			}
-			return nil, lastErr
+			return nil, c.handleStatusError(resp)
 		}
 
 		doc, err := goquery.NewDocumentFromReader(resp.Body)
 		_ = resp.Body.Close()
 		if err != nil {
 			lastErr = fmt.Errorf("failed to parse HTML: %w", err)
-			if c.shouldRetry(attempt) {
-				c.sleep()
+			if c.shouldRetry(ctx, attempt) {
+				c.sleep(ctx)
 				continue
 			}
 			return nil, lastErr
 		}
 
 		if c.isChallengePage(doc) {
-			lastErr = errors.New("animefire returned a challenge page (try VPN or wait)")
-			if c.shouldRetry(attempt) {
-				c.sleep()
+			lastErr = fmt.Errorf("animefire returned a %w (try VPN or wait)", ErrChallenge)
+			if c.shouldRetry(ctx, attempt) {
+				c.sleep(ctx)
 				continue
 			}
 			return nil, lastErr
@@ -129,15 +130,20 @@ func (c *AnimefireClient) handleStatusError(resp *http.Response) error {
 	return fmt.Errorf("server returned: %s", resp.Status)
 }
 
-func (c *AnimefireClient) shouldRetry(attempt int) bool {
-	return attempt < c.maxRetries
+func (c *AnimefireClient) shouldRetry(ctx context.Context, attempt int) bool {
+	return attempt < c.maxRetries && ctx.Err() == nil
 }
 
-func (c *AnimefireClient) sleep() {
+func (c *AnimefireClient) sleep(ctx context.Context) {
 	if c.retryDelay <= 0 {
 		return
 	}
-	time.Sleep(c.retryDelay)
+	timer := time.NewTimer(c.retryDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
 }
 
 func (c *AnimefireClient) isChallengePage(doc *goquery.Document) bool {
@@ -89,4 +89,5 @@ func TestAnimefireSearchDetectsChallengePage(t *testing.T) {
 	_, err := client.SearchAnime("naruto")
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "challenge")
+	assert.ErrorIs(t, err, ErrChallenge)
 }
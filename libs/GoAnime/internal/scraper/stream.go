@@ -0,0 +1,161 @@
+package scraper
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamRequest describes the episode to resolve and how
+type StreamRequest struct {
+	// AnimeURL identifies the anime: the show ID for AllAnime, optionally
+	// with a ":dub" suffix
+	AnimeURL string
+	// EpisodeURL is the episode page, used by AnimeFire
+	EpisodeURL string
+	// Episode is the episode number as the source lists it
+	Episode string
+	// Quality is "best", "worst" or a resolution like "720p"
+	Quality string
+	// Mode is "sub" or "dub". Empty uses the AnimeURL suffix, then "sub".
+	Mode string
+}
+
+// SubtitleTrack is an external subtitle file offered with a stream
+type SubtitleTrack struct {
+	URL      string
+	Language string
+	Label    string
+}
+
+// StreamCandidate is a playable link from a mirror that was not chosen
+type StreamCandidate struct {
+	URL        string
+	Resolution string
+	Provider   string
+	Headers    map[string]string
+}
+
+// StreamResult is a resolved stream and what is needed to play it
+type StreamResult struct {
+	URL string
+	// Source is the scraper that resolved the stream
+	Source ScraperType
+	// Quality and Mode are what was asked for
+	Quality string
+	Mode    string
+	// Resolution is the resolution actually picked, e.g. "1080p". It is
+	// empty for adaptive HLS streams.
+	Resolution string
+	// Provider is the mirror the link came from
+	Provider string
+	// Type is "mp4" or "m3u8"
+	Type string
+	// Headers must be sent when fetching URL
+	Headers   map[string]string
+	Subtitles []SubtitleTrack
+	// ExpiresAt is when the link stops working, when the source tells;
+	// zero otherwise
+	ExpiresAt time.Time
+	// Alternatives are links from other mirrors, to try if URL fails
+	Alternatives []StreamCandidate
+	// SourceURL is the mirror endpoint the link was resolved from
+	SourceURL string
+	// Priority is set when the link is on a preferred host
+	Priority bool
+}
+
+// Metadata flattens the result into the map the deprecated GetStreamURL
+// variants return
+func (r *StreamResult) Metadata() map[string]string {
+	metadata := make(map[string]string)
+	if r == nil {
+		return metadata
+	}
+	if r.Source == AnimefireType {
+		metadata["source"] = "animefire"
+	}
+	if r.Resolution != "" {
+		metadata["quality"] = r.Resolution
+	} else if r.Type == "m3u8" {
+		metadata["quality"] = "hls"
+	}
+	if r.Type == "m3u8" {
+		metadata["type"] = "m3u8"
+	}
+	if r.Priority {
+		metadata["priority"] = "high"
+	}
+	if r.SourceURL != "" {
+		metadata["source_url"] = r.SourceURL
+	}
+	if r.Provider != "" {
+		metadata["provider"] = r.Provider
+	}
+	return metadata
+}
+
+// streamRequestFromOptions maps the positional options of the deprecated
+// GetStreamURL (episode number, quality, mode) onto a StreamRequest
+func streamRequestFromOptions(episodeURL string, options []interface{}) StreamRequest {
+	req := StreamRequest{AnimeURL: episodeURL, EpisodeURL: episodeURL, Episode: "1", Quality: "best"}
+	fields := []*string{&req.Episode, &req.Quality, &req.Mode}
+	for i, opt := range options {
+		if i >= len(fields) {
+			break
+		}
+		if s, ok := opt.(string); ok {
+			*fields[i] = s
+		}
+	}
+	return req
+}
+
+// resolveStreamLegacy adapts ResolveStream to the deprecated GetStreamURL
+// signature
+func resolveStreamLegacy(ctx context.Context, s UnifiedScraper, episodeURL string, options []interface{}) (string, map[string]string, error) {
+	req := streamRequestFromOptions(episodeURL, options)
+	res, err := s.ResolveStream(ctx, req)
+	if err != nil {
+		return "", nil, err
+	}
+	metadata := res.Metadata()
+	if res.Source == AllAnimeType {
+		metadata["anime_id"] = strings.TrimSuffix(req.AnimeURL, ":dub")
+		metadata["episode"] = req.Episode
+	}
+	return res.URL, metadata, nil
+}
+
+// streamType guesses the container from a link
+func streamType(link string) string {
+	if strings.Contains(strings.ToLower(link), ".m3u8") {
+		return "m3u8"
+	}
+	return "mp4"
+}
+
+// expiryHint reads the expiry CDNs commonly put in signed links, as a unix
+// timestamp in an "expires", "expire", "exp" or "e" query parameter
+func expiryHint(link string) time.Time {
+	u, err := url.Parse(link)
+	if err != nil {
+		return time.Time{}
+	}
+	q := u.Query()
+	for _, key := range []string{"expires", "Expires", "expire", "exp", "e"} {
+		v := q.Get(key)
+		if v == "" {
+			continue
+		}
+		ts, err := strconv.ParseInt(v, 10, 64)
+		// Only plausible timestamps, between 2001 and 2286
+		if err != nil || ts < 1e9 || ts > 1e10 {
+			continue
+		}
+		return time.Unix(ts, 0)
+	}
+	return time.Time{}
+}
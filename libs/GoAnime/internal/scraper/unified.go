@@ -2,8 +2,13 @@
 package scraper
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alvarorichard/Goanime/internal/models"
 	"github.com/alvarorichard/Goanime/internal/util"
@@ -17,12 +22,50 @@ const (
 	AnimefireType
 )
 
-// UnifiedScraper provides a common interface for all scrapers
+// ErrChallenge is returned when a source answers with an anti-bot challenge
+// page instead of results
+var ErrChallenge = errors.New("challenge page")
+
+// DefaultSourceTimeout is how long a single source may take to answer a search
+const DefaultSourceTimeout = 15 * time.Second
+
+// SearchStatus describes how the search on one source ended
+type SearchStatus string
+
+const (
+	SearchOK        SearchStatus = "ok"
+	SearchTimeout   SearchStatus = "timeout"
+	SearchError     SearchStatus = "error"
+	SearchChallenge SearchStatus = "challenge"
+)
+
+// SourceResult is the outcome of a search on one source
+type SourceResult struct {
+	Source   ScraperType
+	Results  []*models.Anime
+	Status   SearchStatus
+	Err      error
+	Duration time.Duration
+}
+
+// UnifiedScraper provides a common interface for all scrapers.
+// The Context variants and ResolveStream stop their requests when ctx is
+// cancelled or its deadline passes; the others run with context.Background().
 type UnifiedScraper interface {
 	SearchAnime(query string, options ...interface{}) ([]*models.Anime, error)
 	GetAnimeEpisodes(animeURL string) ([]models.Episode, error)
-	GetStreamURL(episodeURL string, options ...interface{}) (string, map[string]string, error)
+	SearchAnimeContext(ctx context.Context, query string, options ...interface{}) ([]*models.Anime, error)
+	GetAnimeEpisodesContext(ctx context.Context, animeURL string) ([]models.Episode, error)
+	ResolveStream(ctx context.Context, req StreamRequest) (*StreamResult, error)
 	GetType() ScraperType
+
+	// GetStreamURL takes the episode number, quality and mode as positional
+	// options.
+	//
+	// Deprecated: Use ResolveStream.
+	GetStreamURL(episodeURL string, options ...interface{}) (string, map[string]string, error)
+	// Deprecated: Use ResolveStream.
+	GetStreamURLContext(ctx context.Context, episodeURL string, options ...interface{}) (string, map[string]string, error)
 }
 
 // ScraperManager manages multiple scrapers
@@ -45,29 +88,24 @@ func NewScraperManager() *ScraperManager {
 
 // SearchAnime searches across all available scrapers with enhanced Portuguese messaging
 func (sm *ScraperManager) SearchAnime(query string, scraperType *ScraperType) ([]*models.Anime, error) {
-	var allResults []*models.Anime
+	return sm.SearchAnimeContext(context.Background(), query, scraperType)
+}
 
+// SearchAnimeContext is SearchAnime with a context that cancels the search on
+// every source
+func (sm *ScraperManager) SearchAnimeContext(ctx context.Context, query string, scraperType *ScraperType) ([]*models.Anime, error) {
 	if scraperType != nil {
 		// Search using specific scraper
 		if scraper, exists := sm.scrapers[*scraperType]; exists {
 			util.Debug("Searching specific scraper", "scraper", sm.getScraperDisplayName(*scraperType))
 
-			results, err := scraper.SearchAnime(query)
+			results, err := scraper.SearchAnimeContext(ctx, query)
 			if err != nil {
 				return nil, fmt.Errorf("busca falhou em %s: %w", sm.getScraperDisplayName(*scraperType), err)
 			}
 
 			// Add source tags even for specific searches
-			for _, anime := range results {
-				sourceName := sm.getScraperDisplayName(*scraperType)
-				sourceTag := sm.getSourceTag(*scraperType)
-
-				if !strings.Contains(anime.Name, fmt.Sprintf("[%s]", sourceName)) && !strings.Contains(anime.Name, sourceTag) {
-					anime.Name = fmt.Sprintf("%s %s", sourceTag, anime.Name)
-				}
-				// Add metadata to identify the source
-				anime.Source = sourceName
-			}
+			sm.tagResults(*scraperType, results)
 
 			if len(results) > 0 {
 				util.Debug("Search completed", "scraper", sm.getScraperDisplayName(*scraperType), "results", len(results))
@@ -78,35 +116,18 @@ func (sm *ScraperManager) SearchAnime(query string, scraperType *ScraperType) ([
 		return nil, fmt.Errorf("tipo de scraper %v não encontrado", *scraperType)
 	}
 
-	// Search across all scrapers simultaneously
-	util.Debug("Starting simultaneous search", "query", query)
-
-	for scraperType, scraper := range sm.scrapers {
-		util.Debug("Searching in source", "source", sm.getScraperDisplayName(scraperType))
-
-		results, err := scraper.SearchAnime(query)
-		if err != nil {
-			// Log error but continue with other scrapers
-			util.Debug("Search error", "source", sm.getScraperDisplayName(scraperType), "error", err)
-			continue
-		}
-
-		util.Debug("Search results", "source", sm.getScraperDisplayName(scraperType), "count", len(results))
-
-		// Add source information to results with enhanced formatting
-		for _, anime := range results {
-			sourceName := sm.getScraperDisplayName(scraperType)
-			sourceTag := sm.getSourceTag(scraperType)
-
-			if !strings.Contains(anime.Name, sourceTag) {
-				anime.Name = fmt.Sprintf("%s %s", sourceTag, anime.Name)
-			}
-
-			// Add metadata to identify the source
-			anime.Source = sourceName
-		}
+	// Collect every source, then order by source so results are stable
+	var sourceResults []SourceResult
+	for res := range sm.SearchAllSourcesContext(ctx, query, DefaultSourceTimeout) {
+		sourceResults = append(sourceResults, res)
+	}
+	sort.Slice(sourceResults, func(i, j int) bool {
+		return sourceResults[i].Source < sourceResults[j].Source
+	})
 
-		allResults = append(allResults, results...)
+	var allResults []*models.Anime
+	for _, res := range sourceResults {
+		allResults = append(allResults, res.Results...)
 	}
 
 	if len(allResults) == 0 {
@@ -135,6 +156,97 @@ func (sm *ScraperManager) SearchAnime(query string, scraperType *ScraperType) ([
 	return allResults, nil
 }
 
+// SearchAllSources searches every scraper simultaneously and sends each
+// source's result on the returned channel as soon as that source finishes.
+// A source that does not answer within timeout is reported as SearchTimeout
+// and its request is cancelled. The channel is closed once every source has
+// reported.
+func (sm *ScraperManager) SearchAllSources(query string, timeout time.Duration) <-chan SourceResult {
+	return sm.SearchAllSourcesContext(context.Background(), query, timeout)
+}
+
+// SearchAllSourcesContext is SearchAllSources with a context. Cancelling ctx
+// stops every source still searching; they report SearchError with the
+// context's error.
+func (sm *ScraperManager) SearchAllSourcesContext(ctx context.Context, query string, timeout time.Duration) <-chan SourceResult {
+	out := make(chan SourceResult, len(sm.scrapers))
+	util.Debug("Starting simultaneous search", "query", query)
+
+	var wg sync.WaitGroup
+	for scraperType, scraper := range sm.scrapers {
+		wg.Add(1)
+		go func(scraperType ScraperType, scraper UnifiedScraper) {
+			defer wg.Done()
+			out <- sm.searchSource(ctx, query, scraperType, scraper, timeout)
+		}(scraperType, scraper)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func (sm *ScraperManager) searchSource(ctx context.Context, query string, scraperType ScraperType, scraper UnifiedScraper, timeout time.Duration) SourceResult {
+	start := time.Now()
+	sourceName := sm.getScraperDisplayName(scraperType)
+	util.Debug("Searching in source", "source", sourceName)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Buffered so a scraper that ignores ctx can still finish and exit
+	done := make(chan SourceResult, 1)
+	go func() {
+		results, err := scraper.SearchAnimeContext(ctx, query)
+		done <- SourceResult{Source: scraperType, Results: results, Err: err}
+	}()
+
+	var res SourceResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		res = SourceResult{Source: scraperType, Err: ctx.Err()}
+	}
+	res.Duration = time.Since(start)
+
+	switch {
+	case errors.Is(res.Err, context.DeadlineExceeded):
+		res.Status = SearchTimeout
+		res.Err = fmt.Errorf("%s did not answer within %v: %w", sourceName, timeout, res.Err)
+	case errors.Is(res.Err, ErrChallenge):
+		res.Status = SearchChallenge
+	case res.Err != nil:
+		res.Status = SearchError
+	default:
+		res.Status = SearchOK
+		sm.tagResults(scraperType, res.Results)
+	}
+
+	if res.Err != nil {
+		// Log error but continue with other scrapers
+		util.Debug("Search error", "source", sourceName, "status", res.Status, "error", res.Err)
+		res.Results = nil
+	} else {
+		util.Debug("Search results", "source", sourceName, "count", len(res.Results))
+	}
+	return res
+}
+
+// tagResults adds the source tag to result names and records the source
+func (sm *ScraperManager) tagResults(scraperType ScraperType, results []*models.Anime) {
+	sourceName := sm.getScraperDisplayName(scraperType)
+	sourceTag := sm.getSourceTag(scraperType)
+	for _, anime := range results {
+		if !strings.Contains(anime.Name, fmt.Sprintf("[%s]", sourceName)) && !strings.Contains(anime.Name, sourceTag) {
+			anime.Name = fmt.Sprintf("%s %s", sourceTag, anime.Name)
+		}
+		// Add metadata to identify the source
+		anime.Source = sourceName
+	}
+}
+
 // GetScraper returns a specific scraper by type
 func (sm *ScraperManager) GetScraper(scraperType ScraperType) (UnifiedScraper, error) {
 	if scraper, exists := sm.scrapers[scraperType]; exists {
@@ -173,11 +285,19 @@ type AllAnimeAdapter struct {
 }
 
 func (a *AllAnimeAdapter) SearchAnime(query string, options ...interface{}) ([]*models.Anime, error) {
+	return a.SearchAnimeContext(context.Background(), query, options...)
+}
+
+func (a *AllAnimeAdapter) SearchAnimeContext(ctx context.Context, query string, options ...interface{}) ([]*models.Anime, error) {
 	// mode is now hardcoded in the new implementation
-	return a.client.SearchAnime(query)
+	return a.client.SearchAnimeContext(ctx, query)
 }
 
 func (a *AllAnimeAdapter) GetAnimeEpisodes(animeURL string) ([]models.Episode, error) {
+	return a.GetAnimeEpisodesContext(context.Background(), animeURL)
+}
+
+func (a *AllAnimeAdapter) GetAnimeEpisodesContext(ctx context.Context, animeURL string) ([]models.Episode, error) {
 	// For AllAnime, animeURL is actually the anime ID, possibly with :dub suffix
 	animeID := animeURL
 	mode := "sub"
@@ -186,7 +306,7 @@ func (a *AllAnimeAdapter) GetAnimeEpisodes(animeURL string) ([]models.Episode, e
 		mode = "dub"
 	}
 
-	episodes, err := a.client.GetEpisodesList(animeID, mode)
+	episodes, err := a.client.GetEpisodesListContext(ctx, animeID, mode)
 	if err != nil {
 		return nil, err
 	}
@@ -206,38 +326,20 @@ func (a *AllAnimeAdapter) GetAnimeEpisodes(animeURL string) ([]models.Episode, e
 	return episodeModels, nil
 }
 
+// Deprecated: Use ResolveStream.
 func (a *AllAnimeAdapter) GetStreamURL(episodeURL string, options ...interface{}) (string, map[string]string, error) {
-	// For AllAnime, episodeURL contains the anime ID, possibly with :dub suffix
-	animeID := episodeURL
-	modePreference := "sub"
-	if strings.HasSuffix(animeID, ":dub") {
-		animeID = strings.TrimSuffix(animeID, ":dub")
-		modePreference = "dub"
-	}
-
-	// Parse options to get episode number
-	episodeNo := "1"
-	if len(options) > 0 {
-		if ep, ok := options[0].(string); ok {
-			episodeNo = ep
-		}
-	}
-
-	quality := "best"
-	if len(options) > 1 {
-		if q, ok := options[1].(string); ok {
-			quality = q
-		}
-	}
+	return a.GetStreamURLContext(context.Background(), episodeURL, options...)
+}
 
-	mode := modePreference
-	if len(options) > 2 {
-		if m, ok := options[2].(string); ok {
-			mode = m
-		}
-	}
+// Deprecated: Use ResolveStream.
+func (a *AllAnimeAdapter) GetStreamURLContext(ctx context.Context, episodeURL string, options ...interface{}) (string, map[string]string, error) {
+	return resolveStreamLegacy(ctx, a, episodeURL, options)
+}
 
-	return a.client.GetEpisodeURL(animeID, episodeNo, mode, quality)
+// ResolveStream resolves an episode of the anime in req.AnimeURL, the show
+// ID possibly with a ":dub" suffix.
+func (a *AllAnimeAdapter) ResolveStream(ctx context.Context, req StreamRequest) (*StreamResult, error) {
+	return a.client.ResolveStream(ctx, req)
 }
 
 func (a *AllAnimeAdapter) GetType() ScraperType {
@@ -250,20 +352,59 @@ type AnimefireAdapter struct {
 }
 
 func (a *AnimefireAdapter) SearchAnime(query string, options ...interface{}) ([]*models.Anime, error) {
-	return a.client.SearchAnime(query)
+	return a.SearchAnimeContext(context.Background(), query, options...)
+}
+
+func (a *AnimefireAdapter) SearchAnimeContext(ctx context.Context, query string, options ...interface{}) ([]*models.Anime, error) {
+	return a.client.SearchAnimeContext(ctx, query)
 }
 
 func (a *AnimefireAdapter) GetAnimeEpisodes(animeURL string) ([]models.Episode, error) {
+	return a.GetAnimeEpisodesContext(context.Background(), animeURL)
+}
+
+func (a *AnimefireAdapter) GetAnimeEpisodesContext(ctx context.Context, animeURL string) ([]models.Episode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return a.client.GetAnimeEpisodes(animeURL)
 }
 
+// Deprecated: Use ResolveStream.
 func (a *AnimefireAdapter) GetStreamURL(episodeURL string, options ...interface{}) (string, map[string]string, error) {
-	url, err := a.client.GetEpisodeStreamURL(episodeURL)
-	metadata := make(map[string]string)
-	metadata["source"] = "animefire"
+	return a.GetStreamURLContext(context.Background(), episodeURL, options...)
+}
+
+// Deprecated: Use ResolveStream.
+func (a *AnimefireAdapter) GetStreamURLContext(ctx context.Context, episodeURL string, options ...interface{}) (string, map[string]string, error) {
+	url, metadata, err := resolveStreamLegacy(ctx, a, episodeURL, options)
+	if metadata == nil {
+		metadata = map[string]string{"source": "animefire"}
+	}
 	return url, metadata, err
 }
 
+// ResolveStream resolves the episode page in req.EpisodeURL
+func (a *AnimefireAdapter) ResolveStream(ctx context.Context, req StreamRequest) (*StreamResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	url, err := a.client.GetEpisodeStreamURL(req.EpisodeURL)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamResult{
+		URL:       url,
+		Source:    AnimefireType,
+		Quality:   req.Quality,
+		Mode:      req.Mode,
+		Provider:  "animefire",
+		Type:      streamType(url),
+		Headers:   map[string]string{},
+		ExpiresAt: expiryHint(url),
+	}, nil
+}
+
 func (a *AnimefireAdapter) GetType() ScraperType {
 	return AnimefireType
 }
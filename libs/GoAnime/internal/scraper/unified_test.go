@@ -0,0 +1,180 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alvarorichard/Goanime/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeScraper answers searches after a delay with fixed results or an error.
+// A search whose context ends first is reported on cancelled, if set.
+type fakeScraper struct {
+	scraperType ScraperType
+	delay       time.Duration
+	results     []string
+	err         error
+	cancelled   chan ScraperType
+}
+
+func (f *fakeScraper) SearchAnime(query string, options ...interface{}) ([]*models.Anime, error) {
+	return f.SearchAnimeContext(context.Background(), query, options...)
+}
+
+func (f *fakeScraper) SearchAnimeContext(ctx context.Context, query string, options ...interface{}) ([]*models.Anime, error) {
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		if f.cancelled != nil {
+			f.cancelled <- f.scraperType
+		}
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	var out []*models.Anime
+	for _, name := range f.results {
+		out = append(out, &models.Anime{Name: name, URL: "/" + name})
+	}
+	return out, nil
+}
+
+func (f *fakeScraper) GetAnimeEpisodes(animeURL string) ([]models.Episode, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeScraper) GetStreamURL(episodeURL string, options ...interface{}) (string, map[string]string, error) {
+	return "", nil, errors.New("not implemented")
+}
+
+func (f *fakeScraper) GetAnimeEpisodesContext(ctx context.Context, animeURL string) ([]models.Episode, error) {
+	return f.GetAnimeEpisodes(animeURL)
+}
+
+func (f *fakeScraper) GetStreamURLContext(ctx context.Context, episodeURL string, options ...interface{}) (string, map[string]string, error) {
+	return f.GetStreamURL(episodeURL, options...)
+}
+
+func (f *fakeScraper) ResolveStream(ctx context.Context, req StreamRequest) (*StreamResult, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeScraper) GetType() ScraperType {
+	return f.scraperType
+}
+
+func newFakeManager(scrapers ...*fakeScraper) *ScraperManager {
+	sm := &ScraperManager{scrapers: make(map[ScraperType]UnifiedScraper)}
+	for _, s := range scrapers {
+		sm.scrapers[s.scraperType] = s
+	}
+	return sm
+}
+
+func TestSearchAllSourcesRunsInParallel(t *testing.T) {
+	t.Parallel()
+
+	sm := newFakeManager(
+		&fakeScraper{scraperType: AllAnimeType, delay: 10 * time.Millisecond, results: []string{"Naruto"}},
+		&fakeScraper{scraperType: AnimefireType, delay: 300 * time.Millisecond, results: []string{"Naruto Shippuden"}},
+	)
+
+	start := time.Now()
+	ch := sm.SearchAllSources("naruto", time.Second)
+
+	// The fast source is reported before the slow one finishes
+	first := <-ch
+	assert.Equal(t, AllAnimeType, first.Source)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+	assert.Equal(t, SearchOK, first.Status)
+	require.Len(t, first.Results, 1)
+	assert.Equal(t, "[AllAnime] Naruto", first.Results[0].Name)
+	assert.Equal(t, "AllAnime", first.Results[0].Source)
+
+	second := <-ch
+	assert.Equal(t, AnimefireType, second.Source)
+	assert.Equal(t, SearchOK, second.Status)
+
+	_, open := <-ch
+	assert.False(t, open, "channel should close after every source reported")
+}
+
+func TestSearchAllSourcesStatuses(t *testing.T) {
+	t.Parallel()
+
+	sm := newFakeManager(
+		&fakeScraper{scraperType: AllAnimeType, delay: time.Second, results: []string{"Late"}},
+		&fakeScraper{scraperType: AnimefireType, err: fmt.Errorf("animefire returned a %w", ErrChallenge)},
+	)
+
+	start := time.Now()
+	statuses := map[ScraperType]SourceResult{}
+	for res := range sm.SearchAllSources("naruto", 50*time.Millisecond) {
+		statuses[res.Source] = res
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "timeout not applied")
+
+	assert.Equal(t, SearchTimeout, statuses[AllAnimeType].Status)
+	assert.Empty(t, statuses[AllAnimeType].Results)
+	assert.Error(t, statuses[AllAnimeType].Err)
+
+	assert.Equal(t, SearchChallenge, statuses[AnimefireType].Status)
+	assert.ErrorIs(t, statuses[AnimefireType].Err, ErrChallenge)
+}
+
+func TestSearchAllSourcesCancelsSlowSources(t *testing.T) {
+	t.Parallel()
+
+	cancelled := make(chan ScraperType, 4)
+	sm := newFakeManager(
+		&fakeScraper{scraperType: AllAnimeType, delay: 5 * time.Second, results: []string{"Late"}, cancelled: cancelled},
+		&fakeScraper{scraperType: AnimefireType, delay: 5 * time.Second, results: []string{"Later"}, cancelled: cancelled},
+	)
+
+	// The per-source timeout cancels the request instead of abandoning it
+	res := <-sm.SearchAllSources("naruto", 50*time.Millisecond)
+	assert.Equal(t, SearchTimeout, res.Status)
+	assert.ErrorIs(t, res.Err, context.DeadlineExceeded)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("timed out search was not cancelled")
+	}
+
+	// Cancelling the caller's context stops every source
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := sm.SearchAllSourcesContext(ctx, "naruto", time.Minute)
+	cancel()
+
+	start := time.Now()
+	for res := range ch {
+		assert.Equal(t, SearchError, res.Status)
+		assert.ErrorIs(t, res.Err, context.Canceled)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSearchAnimeReturnsPartialResults(t *testing.T) {
+	t.Parallel()
+
+	sm := newFakeManager(
+		&fakeScraper{scraperType: AllAnimeType, err: errors.New("connection refused")},
+		&fakeScraper{scraperType: AnimefireType, results: []string{"Naruto"}},
+	)
+
+	results, err := sm.SearchAnime("naruto", nil)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "[AnimeFire] Naruto", results[0].Name)
+	assert.Equal(t, "AnimeFire.plus", results[0].Source)
+
+	sm = newFakeManager(&fakeScraper{scraperType: AllAnimeType, err: errors.New("down")})
+	_, err = sm.SearchAnime("naruto", nil)
+	assert.Error(t, err)
+}
@@ -3,11 +3,21 @@
 package goanime
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/alvarorichard/Goanime/internal/scraper"
 	"github.com/alvarorichard/Goanime/pkg/goanime/types"
 )
 
-// Client is the main client for interacting with anime sources
+// Client is the main client for interacting with anime sources.
+//
+// Every method has a Context variant that stops its requests when the
+// context is cancelled or its deadline passes. The variants without a
+// context use context.Background() and are bounded only by the per-request
+// HTTP timeout.
 type Client struct {
 	manager *scraper.ScraperManager
 }
@@ -23,13 +33,18 @@ func NewClient() *Client {
 // If source is nil, searches all available sources.
 // Returns a list of anime results or an error.
 func (c *Client) SearchAnime(query string, source *types.Source) ([]*types.Anime, error) {
+	return c.SearchAnimeContext(context.Background(), query, source)
+}
+
+// SearchAnimeContext is SearchAnime with a context for cancellation and deadlines.
+func (c *Client) SearchAnimeContext(ctx context.Context, query string, source *types.Source) ([]*types.Anime, error) {
 	var scraperType *scraper.ScraperType
 	if source != nil {
 		st := source.ToScraperType()
 		scraperType = &st
 	}
 
-	results, err := c.manager.SearchAnime(query, scraperType)
+	results, err := c.manager.SearchAnimeContext(ctx, query, scraperType)
 	if err != nil {
 		return nil, err
 	}
@@ -38,15 +53,47 @@ func (c *Client) SearchAnime(query string, source *types.Source) ([]*types.Anime
 	return types.FromInternalAnimeList(results), nil
 }
 
+// SearchAllSources searches every source in parallel and streams the
+// outcome of each source on the returned channel as soon as it finishes, so
+// a slow or blocked source does not hold up the others. Each source gets
+// timeout to answer; zero uses the default of 15 seconds. The channel is
+// closed after the last source has reported.
+func (c *Client) SearchAllSources(query string, timeout time.Duration) <-chan *types.SourceResult {
+	return c.SearchAllSourcesContext(context.Background(), query, timeout)
+}
+
+// SearchAllSourcesContext is SearchAllSources with a context. Cancelling it
+// stops the sources still searching, which then report SearchError.
+func (c *Client) SearchAllSourcesContext(ctx context.Context, query string, timeout time.Duration) <-chan *types.SourceResult {
+	if timeout <= 0 {
+		timeout = scraper.DefaultSourceTimeout
+	}
+
+	internal := c.manager.SearchAllSourcesContext(ctx, query, timeout)
+	out := make(chan *types.SourceResult, cap(internal))
+	go func() {
+		defer close(out)
+		for res := range internal {
+			out <- types.FromInternalSourceResult(res)
+		}
+	}()
+	return out
+}
+
 // GetAnimeEpisodes retrieves all episodes for a specific anime.
 // The animeURL should be obtained from a SearchAnime result.
 func (c *Client) GetAnimeEpisodes(animeURL string, source types.Source) ([]*types.Episode, error) {
+	return c.GetAnimeEpisodesContext(context.Background(), animeURL, source)
+}
+
+// GetAnimeEpisodesContext is GetAnimeEpisodes with a context for cancellation and deadlines.
+func (c *Client) GetAnimeEpisodesContext(ctx context.Context, animeURL string, source types.Source) ([]*types.Episode, error) {
 	scr, err := c.manager.GetScraper(source.ToScraperType())
 	if err != nil {
 		return nil, err
 	}
 
-	episodes, err := scr.GetAnimeEpisodes(animeURL)
+	episodes, err := scr.GetAnimeEpisodesContext(ctx, animeURL)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +110,8 @@ func (c *Client) GetAnimeEpisodes(animeURL string, source types.Source) ([]*type
 
 // GetStreamURL retrieves the streaming URL and headers for a specific episode.
 // The episodeURL should be obtained from GetAnimeEpisodes.
-// Deprecated: Use GetEpisodeStreamURL instead for better control over quality and mode.
+//
+// Deprecated: Use ResolveStream instead for better control over quality and mode.
 func (c *Client) GetStreamURL(episodeURL string, source types.Source, options ...interface{}) (string, map[string]string, error) {
 	scr, err := c.manager.GetScraper(source.ToScraperType())
 	if err != nil {
@@ -89,8 +137,46 @@ func DefaultStreamOptions() StreamOptions {
 	}
 }
 
-// GetEpisodeStreamURL retrieves the streaming URL for a specific episode with full control.
-// This is the recommended method to get playback URLs.
+// ResolveStream resolves an episode to a playable stream. This is the
+// recommended method to get playback URLs: besides the URL, the result
+// carries the headers to send, the resolution and mirror picked, subtitle
+// tracks, an expiry hint and links from other mirrors to fall back on.
+// Cancelling ctx stops every request still running.
+func (c *Client) ResolveStream(ctx context.Context, req *types.StreamRequest) (*types.StreamResult, error) {
+	res, err := c.resolveStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return types.FromInternalStreamResult(res), nil
+}
+
+func (c *Client) resolveStream(ctx context.Context, req *types.StreamRequest) (*scraper.StreamResult, error) {
+	if req == nil || req.Anime == nil || req.Episode == nil {
+		return nil, fmt.Errorf("stream request needs an anime and an episode")
+	}
+
+	source, err := types.ParseSource(req.Anime.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	scr, err := c.manager.GetScraper(source.ToScraperType())
+	if err != nil {
+		return nil, err
+	}
+
+	// AllAnime resolves by anime ID and episode number, AnimeFire by the
+	// episode page
+	return scr.ResolveStream(ctx, scraper.StreamRequest{
+		AnimeURL:   req.Anime.URL,
+		EpisodeURL: req.Episode.URL,
+		Episode:    req.Episode.Number,
+		Quality:    req.Quality,
+		Mode:       req.Mode,
+	})
+}
+
+// GetEpisodeStreamURL retrieves the streaming URL for a specific episode.
 //
 // Parameters:
 //   - anime: The anime object from SearchAnime
@@ -101,17 +187,18 @@ func DefaultStreamOptions() StreamOptions {
 //   - streamURL: Direct URL for video playback
 //   - metadata: Additional info like quality, source, etc.
 //   - error: Any error that occurred
+//
+// Deprecated: Use ResolveStream, which returns the headers the stream needs
+// and more.
 func (c *Client) GetEpisodeStreamURL(anime *types.Anime, episode *types.Episode, options *StreamOptions) (string, map[string]string, error) {
-	source, err := types.ParseSource(anime.Source)
-	if err != nil {
-		return "", nil, err
-	}
-
-	scr, err := c.manager.GetScraper(source.ToScraperType())
-	if err != nil {
-		return "", nil, err
-	}
+	return c.GetEpisodeStreamURLContext(context.Background(), anime, episode, options)
+}
 
+// GetEpisodeStreamURLContext is GetEpisodeStreamURL with a context for
+// cancellation and deadlines.
+//
+// Deprecated: Use ResolveStream.
+func (c *Client) GetEpisodeStreamURLContext(ctx context.Context, anime *types.Anime, episode *types.Episode, options *StreamOptions) (string, map[string]string, error) {
 	// Set default options if not provided
 	opts := DefaultStreamOptions()
 	if options != nil {
@@ -123,13 +210,17 @@ func (c *Client) GetEpisodeStreamURL(anime *types.Anime, episode *types.Episode,
 		}
 	}
 
-	// For AllAnime, we need to pass: animeID (URL), episodeNumber, quality, mode
-	if source == types.SourceAllAnime {
-		return scr.GetStreamURL(anime.URL, episode.Number, opts.Quality, opts.Mode)
+	res, err := c.resolveStream(ctx, &types.StreamRequest{Anime: anime, Episode: episode, Quality: opts.Quality, Mode: opts.Mode})
+	if err != nil {
+		return "", nil, err
 	}
 
-	// For AnimeFire, the episode URL is the direct episode page
-	return scr.GetStreamURL(episode.URL)
+	metadata := res.Metadata()
+	if res.Source == scraper.AllAnimeType {
+		metadata["anime_id"] = strings.TrimSuffix(anime.URL, ":dub")
+		metadata["episode"] = episode.Number
+	}
+	return res.URL, metadata, nil
 }
 
 // GetAvailableSources returns a list of all available scraper sources.
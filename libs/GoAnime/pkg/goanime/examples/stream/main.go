@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -49,24 +50,31 @@ func main() {
 	episode := episodes[0]
 	fmt.Printf("\nGetting stream URL for Episode %s...\n", episode.Number)
 
-	// Use GetEpisodeStreamURL with options for best quality and subtitled
-	streamURL, metadata, err := client.GetEpisodeStreamURL(anime, episode, &goanime.StreamOptions{
+	// Use ResolveStream for best quality and subtitled
+	stream, err := client.ResolveStream(context.Background(), &types.StreamRequest{
+		Anime:   anime,
+		Episode: episode,
 		Quality: "best",
 		Mode:    "sub",
 	})
 	if err != nil {
 		log.Fatalf("Error getting stream URL: %v", err)
 	}
+	streamURL := stream.URL
 
 	fmt.Println("\n=== Stream Information ===")
 	fmt.Printf("Episode: %s\n", episode.Number)
 	fmt.Printf("Stream URL: %s\n", streamURL)
+	fmt.Printf("Resolution: %s, type: %s, mirror: %s\n", stream.Resolution, stream.Type, stream.Provider)
 
-	if len(metadata) > 0 {
-		fmt.Println("\nMetadata:")
-		for key, value := range metadata {
-			fmt.Printf("  %s: %s\n", key, value)
-		}
+	for key, value := range stream.Headers {
+		fmt.Printf("  Header %s: %s\n", key, value)
+	}
+	for _, sub := range stream.Subtitles {
+		fmt.Printf("  Subtitles (%s): %s\n", sub.Language, sub.URL)
+	}
+	if len(stream.Alternatives) > 0 {
+		fmt.Printf("%d other mirrors available\n", len(stream.Alternatives))
 	}
 
 	fmt.Println("\nYou can use this URL with video players like mpv, vlc, or ffmpeg")
@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrDisallowedIP is returned when dialing an address IsDisallowedIP refuses
+var ErrDisallowedIP = errors.New("ip address is not allowed")
+
+// IsDisallowedIP tells whether ip is a local destination that a request
+// built from remote input must not reach: loopback, private, link-local,
+// multicast or unspecified.
+func IsDisallowedIP(ip net.IP) bool {
+	return ip.IsMulticast() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// PublicDialer returns a dialer that refuses disallowed addresses. The check
+// runs on the resolved address right before connecting, so a hostname
+// cannot resolve its way around it.
+func PublicDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if IsDisallowedIP(net.ParseIP(host)) {
+				return ErrDisallowedIP
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,346 @@
+// Package transport provides the HTTP stack shared by every outbound request
+// of the library and the applications built on it: per-host rate limits and
+// retries with backoff on rate limiting and gateway errors.
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: Rate requests a second on average, in bursts of
+// up to Burst. A zero Rate is no limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Config configures a Transport
+type Config struct {
+	// Limits are per host. A host also covers its subdomains, so
+	// "allanime.day" applies to "api.allanime.day".
+	Limits map[string]Limit
+	// DefaultLimit applies to every other host
+	DefaultLimit Limit
+	// MaxRetries is how often a request is retried when answered 429, 502,
+	// 503 or 504, or when an idempotent request fails to get an answer
+	MaxRetries int
+	// BaseDelay is the wait before the first retry, doubled for each one
+	// after and jittered. A Retry-After header replaces it.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait. A Retry-After asking for longer is not waited
+	// out: the response is returned as is.
+	MaxDelay time.Duration
+	// RetryRatio is the retries each request earns its host, kept up to
+	// RetryBurst. With 0.2, once the burst is spent at most one request in
+	// five is retried, so a failing host is not hammered.
+	RetryRatio float64
+	RetryBurst float64
+}
+
+// DefaultConfig returns the limits of the APIs the library talks to: Jikan
+// allows 3 requests a second and 60 a minute, AniList 90 a minute.
+func DefaultConfig() Config {
+	return Config{
+		Limits: map[string]Limit{
+			"api.jikan.moe":      {Rate: 1, Burst: 3},
+			"graphql.anilist.co": {Rate: 1.5, Burst: 5},
+			"animefire.plus":     {Rate: 2, Burst: 4},
+			"allanime.day":       {Rate: 20, Burst: 5},
+		},
+		DefaultLimit: Limit{Rate: 20, Burst: 40},
+		MaxRetries:   2,
+		BaseDelay:    500 * time.Millisecond,
+		MaxDelay:     10 * time.Second,
+		RetryRatio:   0.2,
+		RetryBurst:   10,
+	}
+}
+
+// Transport is an http.RoundTripper that rate limits requests per host and
+// retries them. Transports made by Wrap share the limits of the one wrapped.
+type Transport struct {
+	base  http.RoundTripper
+	hosts *hostTable
+}
+
+// Default is the transport shared by the library. Use it, or a Wrap of it,
+// for every request so limits hold across packages.
+var Default = New(http.DefaultTransport, DefaultConfig())
+
+// New returns a Transport sending requests through base, nil for
+// http.DefaultTransport
+func New(base http.RoundTripper, cfg Config) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{base: base, hosts: &hostTable{cfg: cfg, hosts: make(map[string]*host)}}
+}
+
+// Wrap returns a Transport sending requests through base with the limits and
+// retry budgets of t
+func (t *Transport) Wrap(base http.RoundTripper) *Transport {
+	return &Transport{base: base, hosts: t.hosts}
+}
+
+// NewClient returns a client using the Default transport
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: Default, Timeout: timeout}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := &t.hosts.cfg
+	h := t.hosts.get(req.URL.Hostname())
+	h.earn(cfg.RetryRatio, cfg.RetryBurst)
+
+	ctx := req.Context()
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		if err := h.wait(ctx); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(attemptReq)
+
+		delay, ok := t.retryDelay(req, resp, err, attempt)
+		if !ok {
+			return resp, err
+		}
+		next, rewindErr := rewind(req)
+		if rewindErr != nil || !h.spend() {
+			return resp, err
+		}
+		if resp != nil {
+			if resp.Header.Get("Retry-After") != "" {
+				// The host asked every request to wait, not only this one
+				h.pause(time.Now().Add(delay))
+			}
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		attemptReq = next
+	}
+}
+
+// retryDelay tells whether an attempt should be retried and after how long
+func (t *Transport) retryDelay(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	cfg := &t.hosts.cfg
+	if attempt >= cfg.MaxRetries || req.Context().Err() != nil {
+		return 0, false
+	}
+	if err != nil {
+		if !idempotent(req.Method) || errors.Is(err, ErrDisallowedIP) {
+			return 0, false
+		}
+		return backoff(cfg, attempt), true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return 0, false
+	}
+
+	delay := backoff(cfg, attempt)
+	if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		if cfg.MaxDelay > 0 && d > cfg.MaxDelay {
+			return 0, false
+		}
+		delay = d
+	}
+	if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+		return 0, false
+	}
+	return delay, true
+}
+
+// backoff is an exponential backoff with full jitter
+func backoff(cfg *Config, attempt int) time.Duration {
+	d := cfg.BaseDelay << attempt
+	if cfg.MaxDelay > 0 && (d > cfg.MaxDelay || d <= 0) {
+		d = cfg.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d) + 1
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as a date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// rewind copies req for another attempt, with a fresh body
+func rewind(req *http.Request) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return next, nil
+	}
+	if req.GetBody == nil {
+		return nil, http.ErrBodyReadAfterClose
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	next.Body = body
+	return next, nil
+}
+
+// hostTable holds the state of every host a Transport has talked to
+type hostTable struct {
+	cfg   Config
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+func (t *hostTable) get(name string) *host {
+	name = strings.ToLower(name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.hosts[name]; ok {
+		return h
+	}
+	limit := t.cfg.limitFor(name)
+	h := &host{limit: limit, tokens: float64(limit.Burst), last: time.Now(), budget: t.cfg.RetryBurst}
+	t.hosts[name] = h
+	return h
+}
+
+// limitFor finds the limit of a host or of the closest parent domain
+func (c *Config) limitFor(name string) Limit {
+	for d := name; d != ""; {
+		if l, ok := c.Limits[d]; ok {
+			return l
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return c.DefaultLimit
+}
+
+// host is the token bucket and retry budget of one host
+type host struct {
+	mu     sync.Mutex
+	limit  Limit
+	tokens float64
+	last   time.Time
+	paused time.Time
+	budget float64
+}
+
+// wait takes a token, sleeping until it is due. The token is reserved under
+// the lock and the sleep happens after releasing it, so waiters queue in
+// order without blocking each other; a cancelled wait gives its token back.
+func (h *host) wait(ctx context.Context) error {
+	d := h.reserve(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		h.unreserve()
+		return ctx.Err()
+	}
+}
+
+func (h *host) reserve(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var wait time.Duration
+	if h.limit.Rate > 0 {
+		h.refill(now)
+		h.tokens--
+		if h.tokens < 0 {
+			wait = time.Duration(-h.tokens / h.limit.Rate * float64(time.Second))
+		}
+	}
+	if p := h.paused.Sub(now); p > wait {
+		wait = p
+	}
+	return wait
+}
+
+func (h *host) unreserve() {
+	if h.limit.Rate <= 0 {
+		return
+	}
+	h.mu.Lock()
+	h.tokens = min(h.tokens+1, float64(max(h.limit.Burst, 1)))
+	h.mu.Unlock()
+}
+
+func (h *host) refill(now time.Time) {
+	h.tokens = min(h.tokens+now.Sub(h.last).Seconds()*h.limit.Rate, float64(max(h.limit.Burst, 1)))
+	h.last = now
+}
+
+// pause holds every request to the host until the given time
+func (h *host) pause(until time.Time) {
+	h.mu.Lock()
+	if until.After(h.paused) {
+		h.paused = until
+	}
+	h.mu.Unlock()
+}
+
+// earn credits the retry budget for a request
+func (h *host) earn(ratio, burst float64) {
+	h.mu.Lock()
+	h.budget = min(h.budget+ratio, burst)
+	h.mu.Unlock()
+}
+
+// spend takes a retry from the budget, if there is one left
+func (h *host) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.budget < 1 {
+		return false
+	}
+	h.budget--
+	return true
+}
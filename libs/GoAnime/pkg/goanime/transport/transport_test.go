@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetriesHonourRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: New(nil, Config{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Second, RetryBurst: 1})}
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.EqualValues(t, 2, hits)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "Retry-After not waited out")
+}
+
+func TestRetryLimits(t *testing.T) {
+	t.Parallel()
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/later" {
+			w.Header().Set("Retry-After", "3600")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tr := New(nil, Config{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second, RetryRatio: 0.5, RetryBurst: 2})
+	client := &http.Client{Transport: tr}
+
+	// The burst allows two retries
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.EqualValues(t, 3, hits)
+
+	// The budget is spent: half a retry earned is not enough
+	atomic.StoreInt32(&hits, 0)
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, 1, hits)
+
+	// A Retry-After longer than MaxDelay is handed back, not waited out
+	tr = New(nil, Config{MaxRetries: 3, MaxDelay: time.Second, RetryBurst: 10})
+	atomic.StoreInt32(&hits, 0)
+	resp, err = (&http.Client{Transport: tr}).Get(server.URL + "/later")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.EqualValues(t, 1, hits)
+
+	// A POST body is replayed
+	var bodies []string
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer echo.Close()
+	resp, err = (&http.Client{Transport: tr}).Post(echo.URL, "text/plain", strings.NewReader("query"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"query", "query"}, bodies)
+}
+
+func TestLimiterQueuesWithoutBlocking(t *testing.T) {
+	t.Parallel()
+
+	tr := New(nil, Config{Limits: map[string]Limit{"example.com": {Rate: 10, Burst: 1}}})
+	h := tr.hosts.get("api.example.com")
+	assert.Equal(t, Limit{Rate: 10, Burst: 1}, h.limit, "subdomain does not get its parent's limit")
+	assert.Equal(t, Limit{}, tr.hosts.get("example.org").limit)
+
+	require.NoError(t, h.wait(context.Background()))
+
+	// A waiter whose context ends gives its token back
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, h.wait(ctx), context.DeadlineExceeded)
+
+	// The next waiter is due one interval after the first token, not after
+	// the cancelled one as well
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		_ = h.wait(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waiter never woke up")
+	}
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+
+	d, ok = parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
+
+func TestPublicDialerRefusesLocalAddresses(t *testing.T) {
+	t.Parallel()
+
+	for _, ip := range []string{"127.0.0.1", "10.0.0.8", "192.168.1.1", "169.254.169.254", "::1", "0.0.0.0"} {
+		assert.True(t, IsDisallowedIP(net.ParseIP(ip)), ip)
+	}
+	assert.False(t, IsDisallowedIP(net.ParseIP("104.16.0.1")))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{DialContext: PublicDialer(time.Second).DialContext}}
+	_, err := client.Get(server.URL)
+	assert.ErrorIs(t, err, ErrDisallowedIP)
+}
@@ -25,6 +25,10 @@ type Anime struct {
 	Details *AniListDetails
 	// HasDub indicates if a dubbed version is available
 	HasDub bool
+	// SubEpisodes and DubEpisodes are the episode counts the source lists
+	// in search results, 0 when it does not say
+	SubEpisodes int
+	DubEpisodes int
 }
 
 // Episode represents a single episode of an anime
@@ -109,6 +113,9 @@ func FromInternalAnime(internal *models.Anime) *Anime {
 		MalID:     internal.MalID,
 		Source:    internal.Source,
 		HasDub:    internal.HasDub,
+
+		SubEpisodes: internal.SubEpisodes,
+		DubEpisodes: internal.DubEpisodes,
 	}
 
 	// Convert episodes
@@ -0,0 +1,46 @@
+package types
+
+import (
+	"time"
+
+	"github.com/alvarorichard/Goanime/internal/scraper"
+)
+
+// SearchStatus describes how the search on one source ended
+type SearchStatus string
+
+const (
+	// SearchOK means the source answered, possibly with no results
+	SearchOK SearchStatus = "ok"
+	// SearchTimeout means the source did not answer in time
+	SearchTimeout SearchStatus = "timeout"
+	// SearchError means the request failed
+	SearchError SearchStatus = "error"
+	// SearchChallenge means the source answered with an anti-bot challenge page
+	SearchChallenge SearchStatus = "challenge"
+)
+
+// SourceResult is the outcome of a search on one source
+type SourceResult struct {
+	// Source is the source that was searched
+	Source Source
+	// Anime holds the results, empty unless Status is SearchOK
+	Anime []*Anime
+	// Status tells how the search ended
+	Status SearchStatus
+	// Err is the reason the search did not succeed
+	Err error
+	// Duration is how long the source took, or the timeout
+	Duration time.Duration
+}
+
+// FromInternalSourceResult converts an internal search result to the public type
+func FromInternalSourceResult(internal scraper.SourceResult) *SourceResult {
+	return &SourceResult{
+		Source:   FromScraperType(internal.Source),
+		Anime:    FromInternalAnimeList(internal.Results),
+		Status:   SearchStatus(internal.Status),
+		Err:      internal.Err,
+		Duration: internal.Duration,
+	}
+}
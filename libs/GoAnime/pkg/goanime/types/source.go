@@ -40,6 +40,16 @@ func (s Source) ToScraperType() scraper.ScraperType {
 	}
 }
 
+// FromScraperType converts the internal ScraperType to the public Source type
+func FromScraperType(st scraper.ScraperType) Source {
+	switch st {
+	case scraper.AnimefireType:
+		return SourceAnimeFire
+	default:
+		return SourceAllAnime
+	}
+}
+
 // ParseSource parses a string into a Source type
 func ParseSource(s string) (Source, error) {
 	switch s {
@@ -0,0 +1,94 @@
+package types
+
+import (
+	"time"
+
+	"github.com/alvarorichard/Goanime/internal/scraper"
+)
+
+// StreamRequest identifies an episode and how it should be played
+type StreamRequest struct {
+	// Anime is the anime from SearchAnime
+	Anime *Anime
+	// Episode is the episode from GetAnimeEpisodes
+	Episode *Episode
+	// Quality can be "best", "worst", "1080p", "720p", "480p", "360p".
+	// Empty means "best".
+	Quality string
+	// Mode can be "sub" or "dub". Empty picks the dub for an AllAnime
+	// anime whose URL ends in ":dub", the sub otherwise.
+	Mode string
+}
+
+// SubtitleTrack is an external subtitle file offered with a stream
+type SubtitleTrack struct {
+	URL string
+	// Language is the language code, e.g. "en"
+	Language string
+	Label    string
+}
+
+// StreamCandidate is a playable link from another mirror
+type StreamCandidate struct {
+	URL        string
+	Resolution string
+	Provider   string
+	Headers    map[string]string
+}
+
+// StreamResult is a resolved episode stream
+type StreamResult struct {
+	// URL is the link to play
+	URL string
+	// Source is the source that resolved the stream
+	Source Source
+	// Quality and Mode are what was requested
+	Quality string
+	Mode    string
+	// Resolution is the resolution picked, e.g. "1080p". Empty for
+	// adaptive HLS streams, whose master playlist lists the variants.
+	Resolution string
+	// Provider is the mirror the link came from
+	Provider string
+	// Type is "mp4" or "m3u8"
+	Type string
+	// Headers must be sent with every request for URL
+	Headers map[string]string
+	// Subtitles are external subtitle tracks, if the mirror has any
+	Subtitles []SubtitleTrack
+	// ExpiresAt is when the link stops working, if the source tells.
+	// Zero means unknown.
+	ExpiresAt time.Time
+	// Alternatives are links from other mirrors to try if URL fails
+	Alternatives []StreamCandidate
+}
+
+// FromInternalStreamResult converts an internal stream result to the public type
+func FromInternalStreamResult(internal *scraper.StreamResult) *StreamResult {
+	if internal == nil {
+		return nil
+	}
+	res := &StreamResult{
+		URL:        internal.URL,
+		Source:     FromScraperType(internal.Source),
+		Quality:    internal.Quality,
+		Mode:       internal.Mode,
+		Resolution: internal.Resolution,
+		Provider:   internal.Provider,
+		Type:       internal.Type,
+		Headers:    internal.Headers,
+		ExpiresAt:  internal.ExpiresAt,
+	}
+	for _, sub := range internal.Subtitles {
+		res.Subtitles = append(res.Subtitles, SubtitleTrack{URL: sub.URL, Language: sub.Language, Label: sub.Label})
+	}
+	for _, alt := range internal.Alternatives {
+		res.Alternatives = append(res.Alternatives, StreamCandidate{
+			URL:        alt.URL,
+			Resolution: alt.Resolution,
+			Provider:   alt.Provider,
+			Headers:    alt.Headers,
+		})
+	}
+	return res
+}
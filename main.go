@@ -31,6 +31,9 @@ func main() {
 			app.startup(ctx)
 			animeService.startup(ctx)
 		},
+		OnShutdown: func(ctx context.Context) {
+			animeService.shutdown(ctx)
+		},
 		Bind: []interface{}{
 			app,
 			animeService,